@@ -1,16 +1,37 @@
 package srtmp
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
 	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/hls"
+	"github.com/fabo871218/srtmp/httpflv"
+	"github.com/fabo871218/srtmp/httpopera"
 	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/media/h264"
 	"github.com/fabo871218/srtmp/protocol"
+	"github.com/fabo871218/srtmp/webhook"
 )
 
 //RtmpAPI api接口类
 type RtmpAPI struct {
-	setting *SettingEngine
-	logger  logger.Logger
+	setting  *SettingEngine
+	handler  *protocol.StreamHandler
+	mutex    sync.Mutex
+	servers  []*Server
+	services []httpService //hls、http-flv和http控制服务
+	notifier *webhook.Notifier
+	logger   logger.Logger
+}
+
+//httpService 通过api创建的http服务，随rtmp服务一起关闭
+type httpService interface {
+	Shutdown(ctx context.Context) error
+	Close() error
 }
 
 //NewAPI 创建一个api，设置相应的参数信息
@@ -31,25 +52,149 @@ func NewAPI(opts ...SettingFunc) *RtmpAPI {
 	}
 	api.logger = setting.loggerFactory.NewLogger(setting.logLevel)
 	api.setting = setting
+	api.handler = protocol.NewStreamHandler(api.logger)
+	auth := setting.authenticator
+	if setting.webhook != nil {
+		api.notifier = webhook.NewNotifier(*setting.webhook, api.logger)
+		auth = protocol.ChainAuthenticator(auth, api.notifier)
+		api.handler.AddObserver(api.notifier)
+	}
+	if auth != nil {
+		api.handler.SetAuthenticator(auth)
+	}
+	for _, o := range setting.observers {
+		api.handler.AddObserver(o)
+	}
+	if setting.recorder != nil {
+		api.handler.AddWriterFactory(&recorderFactory{cfg: *setting.recorder, logger: api.logger})
+	}
+	if len(setting.g711ToAAC) > 0 {
+		api.handler.AddTransformerFactory(newG711TranscoderFactory(setting.g711ToAAC))
+	}
+	for app, policy := range setting.cachePolicies {
+		api.handler.SetCachePolicy(app, policy)
+	}
+	if setting.slowPolicy != nil {
+		api.handler.SetSlowConsumerPolicy(*setting.slowPolicy)
+	}
+	if setting.vodDir != "" {
+		api.handler.SetVODResolver(protocol.NewDirResolver(setting.vodDir))
+	}
 	return api
 }
 
+//NewRtmpServer 创建一个rtmp服务，所有服务共享同一个StreamHandler
+func (api *RtmpAPI) NewRtmpServer() *Server {
+	server := NewRtmpServer(api.handler, api.logger)
+	api.mutex.Lock()
+	api.servers = append(api.servers, server)
+	api.mutex.Unlock()
+	return server
+}
+
 //ServeRtmp 创建一个rtmp服务，并监听响应的地址
 func (api *RtmpAPI) ServeRtmp(addr string) error {
-	server := &Server{
-		handler: protocol.NewStreamHandler(api.logger),
-		logger:  api.logger,
-	}
-	return server.Serve(addr)
+	return api.NewRtmpServer().Serve(addr)
 }
 
 //ServeRtmpTLS 创建一个rtmp服务，并监听响应的地址
 func (api *RtmpAPI) ServeRtmpTLS(addr, tlsKey, tlsCrt string) error {
-	server := &Server{
-		handler: protocol.NewStreamHandler(api.logger),
-		logger:  api.logger,
+	return api.NewRtmpServer().ServeTLS(addr, tlsCrt, tlsKey)
+}
+
+//Shutdown 优雅关闭通过api创建的所有rtmp服务，参考Server.Shutdown，流停止之后再关闭hls、
+//http-flv和http控制服务，最后在ctx的期限内发送完队列中的webhook通知
+func (api *RtmpAPI) Shutdown(ctx context.Context) error {
+	for _, server := range api.rtmpServers() {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	for _, service := range api.httpServices() {
+		if err := service.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if api.notifier != nil {
+		return api.notifier.Shutdown(ctx)
+	}
+	return nil
+}
+
+//Close 立即关闭通过api创建的所有rtmp和http服务，等待队列中的webhook通知发送完成后返回
+func (api *RtmpAPI) Close() error {
+	for _, server := range api.rtmpServers() {
+		server.Close()
+	}
+	for _, service := range api.httpServices() {
+		service.Close()
+	}
+	if api.notifier != nil {
+		api.notifier.Close()
+	}
+	return nil
+}
+
+func (api *RtmpAPI) rtmpServers() []*Server {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	servers := make([]*Server, len(api.servers))
+	copy(servers, api.servers)
+	return servers
+}
+
+func (api *RtmpAPI) addHTTPService(service httpService) {
+	api.mutex.Lock()
+	api.services = append(api.services, service)
+	api.mutex.Unlock()
+}
+
+func (api *RtmpAPI) httpServices() []httpService {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	services := make([]httpService, len(api.services))
+	copy(services, api.services)
+	return services
+}
+
+//ServeHLS 创建一个hls服务，并监听相应的地址，rtmp服务上发布的流可以通过
+// http://addr/app/name.m3u8 观看
+func (api *RtmpAPI) ServeHLS(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen failed, %v", err)
+	}
+	server := hls.NewServer(api.logger)
+	api.handler.AddWriterFactory(server)
+	api.addHTTPService(server)
+	api.logger.Infof("Start hls server, listen on:%s", addr)
+	return server.Serve(listener)
+}
+
+//ServeHTTPFlv 创建一个http-flv服务，并监听相应的地址，rtmp服务上发布的流可以通过
+// http://addr/app/name.flv 观看
+func (api *RtmpAPI) ServeHTTPFlv(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen failed, %v", err)
+	}
+	server := httpflv.NewServer(api.handler, api.logger)
+	api.addHTTPService(server)
+	api.logger.Infof("Start http-flv server, listen on:%s", addr)
+	return server.Serve(listener)
+}
+
+//ServeHTTPOpera 创建一个http控制服务，并监听相应的地址，提供/control/push、/control/pull
+// 和/stat/livestat接口，rtmpAddr为本地rtmp服务的监听地址
+func (api *RtmpAPI) ServeHTTPOpera(addr, rtmpAddr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen failed, %v", err)
 	}
-	return server.ServeTLS(addr, tlsKey, tlsCrt)
+	server := httpopera.NewServer(api.handler, rtmpAddr, api.logger)
+	api.addHTTPService(server)
+	api.logger.Infof("Start http opera server, listen on:%s", addr)
+	return server.Serve(listener)
 }
 
 //NewRtmpClient 创建一个rtmp客户端
@@ -59,6 +204,7 @@ func (api *RtmpAPI) NewRtmpClient() *RtmpClient {
 		videoFirst: true,
 		audioFirst: true,
 		demuxer:    flv.NewDemuxer(),
+		h264Order:  h264.NewFrameOrderer(),
 		logger:     api.logger,
 	}
 	return client
@@ -23,8 +23,11 @@ const (
 	SOUND_NELLYMOSER            = 6
 	SOUND_ALAW                  = 7
 	SOUND_MULAW                 = 8
+	SOUND_EX_HEADER             = 9 //Enhanced RTMP的音频扩展头，后面跟4字节FourCC
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
+	SOUND_OPUS                  = 13 //opus只能通过Enhanced RTMP的FourCC传输，这里的id只在程序内部使用
+	SOUND_MP3_8KHZ              = 14
 
 	//rtmp tag中只支持前面四种采样率，后面是为了程序处理方便自己添加
 	SOUND_RATE_5_5Khz = 0 //
@@ -56,9 +59,9 @@ const (
 
 const (
 	//视频tag的帧类型, 对于avc(h264)只用到了前面两个
-	FRAME_KEY   = 1 // keyframe （for avc, a seekable frame)
-	FRAME_INTER = 2 // inter frame (for avc, a non-seekable frame)
-	//3:disposable inter frame
+	FRAME_KEY        = 1 // keyframe （for avc, a seekable frame)
+	FRAME_INTER      = 2 // inter frame (for avc, a non-seekable frame)
+	FRAME_DISPOSABLE = 3 // disposable inter frame (h263 only)
 	//4:generated keyframe(reserved for server use only)
 	//5:vidoe info/command frame
 
@@ -75,8 +78,42 @@ const (
 	VideoVP6WithAlpha = 5
 	VideoScreenV2     = 6
 	VIDEO_H264        = 7
+	VIDEO_HEVC        = 12 //非标准的扩展，国内cdn普遍使用12作为h265的编码id
+	VIDEO_AV1         = 13 //av1和vp9只能通过Enhanced RTMP的FourCC传输，这里的id只在程序内部使用
+	VIDEO_VP9         = 14
 )
 
+//Enhanced RTMP 视频tag扩展头，第一个字节最高位为1时，低4位为包类型，后面4个字节为FourCC
+const (
+	ExPacketTypeSequenceStart        = 0 //HEVCDecoderConfigurationRecord等解码配置
+	ExPacketTypeCodedFrames          = 1 //带3字节CompositionTime的帧数据
+	ExPacketTypeSequenceEnd          = 2
+	ExPacketTypeCodedFramesX         = 3 //CompositionTime为0，省略该字段
+	ExPacketTypeMetadata             = 4 //AMF编码的视频元数据，比如colorInfo
+	ExPacketTypeMPEG2TSSequenceStart = 5 //av1使用的另一种解码配置
+	ExPacketTypeMultitrack           = 6
+	ExPacketTypeModEx                = 7 //v2，在真正的包类型之前携带扩展信息
+
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+	FourCCVP9  = "vp09"
+)
+
+//Enhanced RTMP 音频tag扩展头，第一个字节高4位为9时，低4位为包类型，后面4个字节为FourCC
+const (
+	AudioPacketTypeSequenceStart      = 0 //OpusHead等解码配置
+	AudioPacketTypeCodedFrames        = 1
+	AudioPacketTypeSequenceEnd        = 2
+	AudioPacketTypeMultichannelConfig = 4
+	AudioPacketTypeMultitrack         = 5
+	AudioPacketTypeModEx              = 7
+
+	FourCCOpus = "Opus"
+)
+
+//FourCCList 支持的Enhanced RTMP音视频编码，在connect命令中与对端协商
+var FourCCList = []string{FourCCAV1, FourCCVP9, FourCCHEVC, FourCCOpus}
+
 // Packet类型
 const (
 	PacketTypeUnknow   = 0
@@ -98,6 +135,62 @@ type Packet struct {
 	VHeader    VideoPacketHeader
 	AHeader    AudioPacketHeader
 	Data       []byte
+
+	buffer *packetBuffer //Data使用的pool内存，拷贝Packet时共享同一个引用计数
+}
+
+//IsHeader 是否是metadata或者sequence header，播放端解码需要，写对象不能丢弃
+func (p *Packet) IsHeader() bool {
+	switch p.PacketType {
+	case PacketTypeMetadata:
+		return true
+	case PacketTypeVideo:
+		return p.VHeader.IsSeqHeader()
+	case PacketTypeAudio:
+		return p.AHeader.IsSeqHeader()
+	}
+	return false
+}
+
+//PushHeader 把metadata或sequence header写入写对象的发送队列，队列满时丢弃最早的音视频数据包腾出位置，
+//队列中的header保留，只有队列中全部是header时才丢弃最早的header，
+//返回丢弃的个数，丢弃了视频帧的写对象需要等待下一个关键帧，只能在写入队列的协程中调用
+func PushHeader(queue chan *Packet, p *Packet) (dropped int) {
+	select {
+	case queue <- p:
+		return
+	default:
+	}
+
+	//取出队列中的数据包，发送协程同时在读取，取到的是还没有发送的部分
+	var pending []*Packet
+	for len(pending) < cap(queue) {
+		select {
+		case pkt := <-queue:
+			pending = append(pending, pkt)
+			continue
+		default:
+		}
+		break
+	}
+
+	for len(pending) >= cap(queue) {
+		index := 0
+		for i, pkt := range pending {
+			if !pkt.IsHeader() {
+				index = i
+				break
+			}
+		}
+		pending = append(pending[:index], pending[index+1:]...)
+		dropped++
+	}
+
+	//只有当前协程写入队列，取出之后的空间足够放回
+	for _, pkt := range append(pending, p) {
+		queue <- pkt
+	}
+	return
 }
 
 //AudioPacketHeader comment
@@ -106,15 +199,42 @@ type AudioPacketHeader struct {
 	SoundRate     uint8
 	SoundSize     uint8
 	SoundType     uint8
-	AACPacketType uint8
+	AACPacketType uint8 //Enhanced RTMP的包类型会转换成对应的AACPacketType
+	IsExHeader    bool  //是否是Enhanced RTMP的扩展头
+	ExPacketType  uint8 //Enhanced RTMP的包类型，IsExHeader为true时有效
+}
+
+//IsSeqHeader 是否是音频的sequence header
+func (h AudioPacketHeader) IsSeqHeader() bool {
+	switch h.SoundFormat {
+	case SOUND_AAC, SOUND_OPUS:
+		return h.AACPacketType == AAC_SEQHDR
+	}
+	return false
 }
 
 //VideoPacketHeader ...
 type VideoPacketHeader struct {
 	FrameType       uint8
-	AVCPacketType   uint8
+	AVCPacketType   uint8 //Enhanced RTMP的包类型会转换成对应的AVCPacketType
 	CodecID         uint8
-	CompositionTime int32
+	CompositionTime int32 //毫秒，pts = TimeStamp + CompositionTime
+	IsExHeader      bool  //是否是Enhanced RTMP的扩展头
+	ExPacketType    uint8 //Enhanced RTMP的包类型，IsExHeader为true时有效
+}
+
+//IsSeqHeader 是否是视频的sequence header
+func (h VideoPacketHeader) IsSeqHeader() bool {
+	switch h.CodecID {
+	case VIDEO_H264, VIDEO_HEVC, VIDEO_AV1, VIDEO_VP9:
+		return h.FrameType == FRAME_KEY && h.AVCPacketType == AVC_SEQHDR
+	}
+	return false
+}
+
+//IsMetadataFrame 是否是Enhanced RTMP的视频元数据帧，数据为AMF编码，不是视频帧
+func (h VideoPacketHeader) IsMetadataFrame() bool {
+	return h.IsExHeader && h.ExPacketType == ExPacketTypeMetadata
 }
 
 type Demuxer interface {
@@ -133,3 +253,9 @@ type CodecParser interface {
 	SampleRater
 	Parse(*Packet, io.Writer) error
 }
+
+//Transformer 流数据的处理阶段，位于发布端和播放端之间，可以转换、丢弃数据包，
+//或者把一个包拆分成多个包，返回的包按顺序缓存和转发
+type Transformer interface {
+	Transform(*Packet) ([]*Packet, error)
+}
@@ -0,0 +1,59 @@
+package av
+
+import (
+	"sync/atomic"
+)
+
+//BufferPool 数据包内存的来源，内存不再使用时通过Put归还
+type BufferPool interface {
+	Put(*[]byte)
+}
+
+//PacketRetainer 写对象实现这个接口时，表示Write之后还要使用的数据包会调用Retain，
+//用完之后调用Release；没有实现的写对象收到的数据包要先Detach，内存不再归还pool
+type PacketRetainer interface {
+	RetainsPackets()
+}
+
+//packetBuffer 数据包内存的引用计数，为0时归还pool
+type packetBuffer struct {
+	refs     int32
+	detached int32
+	pool     BufferPool
+	buf      *[]byte
+}
+
+//SetBuffer 设置Data使用的pool内存，引用计数为1，由调用者持有，
+//最后一个Release之后内存归还pool，Data不能再访问
+func (p *Packet) SetBuffer(pool BufferPool, buf *[]byte) {
+	p.buffer = nil
+	if pool != nil && buf != nil {
+		p.buffer = &packetBuffer{refs: 1, pool: pool, buf: buf}
+	}
+}
+
+//Retain 增加Data的引用，Data不是pool内存时不做处理
+func (p *Packet) Retain() {
+	if p.buffer != nil {
+		atomic.AddInt32(&p.buffer.refs, 1)
+	}
+}
+
+//Release 减少Data的引用，引用为0并且没有Detach时内存归还pool
+func (p *Packet) Release() {
+	b := p.buffer
+	if b == nil || atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
+	if atomic.LoadInt32(&b.detached) == 0 {
+		b.pool.Put(b.buf)
+	}
+}
+
+//Detach Data交给不调用Release的对象使用，内存不再归还pool，由gc回收，
+//调用者需要持有引用
+func (p *Packet) Detach() {
+	if p.buffer != nil {
+		atomic.StoreInt32(&p.buffer.detached, 1)
+	}
+}
@@ -0,0 +1,45 @@
+package av
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countPool struct {
+	puts int
+}
+
+func (pool *countPool) Put(*[]byte) {
+	pool.puts++
+}
+
+func TestPacketBuffer(t *testing.T) {
+	pool := &countPool{}
+	buf := make([]byte, 10)
+	p := &Packet{Data: buf}
+	p.SetBuffer(pool, &buf)
+	//拷贝的Packet共享引用计数
+	copied := *p
+	copied.Retain()
+	p.Release()
+	assert.Equal(t, 0, pool.puts)
+	copied.Release()
+	assert.Equal(t, 1, pool.puts)
+
+	//Detach之后不再归还
+	p = &Packet{Data: buf}
+	p.SetBuffer(pool, &buf)
+	p.Retain()
+	p.Detach()
+	p.Release()
+	p.Release()
+	assert.Equal(t, 1, pool.puts)
+
+	//没有pool内存时不做处理
+	p = &Packet{}
+	p.Retain()
+	p.Release()
+	p.Detach()
+	assert.Equal(t, 1, pool.puts)
+}
@@ -12,6 +12,9 @@ type RWBaser struct {
 	BaseTimestamp      uint32
 	LastVideoTimestamp uint32
 	LastAudioTimestamp uint32
+
+	unwrapStarted bool
+	lastUnwrapped uint64 //展开后的最大时间戳
 }
 
 func NewRWBaser(duration time.Duration) RWBaser {
@@ -41,11 +44,36 @@ func (rw *RWBaser) RecTimeStamp(timestamp, typeID uint32) {
 	}
 }
 
+//Unwrap 把32位的毫秒时间戳展开成64位，rtmp的时间戳大约49.7天回绕一次，
+//和最大时间戳相差不超过2^31时认为是同一个周期内的时间戳，音视频交错导致的小幅回退不会被当作回绕
+func (rw *RWBaser) Unwrap(timestamp uint32) uint64 {
+	if !rw.unwrapStarted {
+		rw.unwrapStarted = true
+		rw.lastUnwrapped = uint64(timestamp)
+		return rw.lastUnwrapped
+	}
+	diff := int64(int32(timestamp - uint32(rw.lastUnwrapped)))
+	if diff < 0 && uint64(-diff) > rw.lastUnwrapped {
+		//在第一个周期开始之前，不会出现这种情况，除非时间戳错乱
+		return 0
+	}
+	unwrapped := uint64(int64(rw.lastUnwrapped) + diff)
+	if unwrapped > rw.lastUnwrapped {
+		rw.lastUnwrapped = unwrapped
+	}
+	return unwrapped
+}
+
+//SetPreTime 在发送协程中调用，和流循环中的Alive并发，需要加锁
 func (rw *RWBaser) SetPreTime() {
+	rw.lock.Lock()
 	rw.PreTime = time.Now()
+	rw.lock.Unlock()
 }
 
 func (rw *RWBaser) Alive() bool {
+	rw.lock.Lock()
 	b := !(time.Now().Sub(rw.PreTime) >= rw.timeout)
+	rw.lock.Unlock()
 	return b
 }
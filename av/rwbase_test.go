@@ -0,0 +1,51 @@
+package av
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnwrap(t *testing.T) {
+	rw := NewRWBaser(time.Second)
+	assert.Equal(t, uint64(0xfffffc18), rw.Unwrap(0xfffffc18))
+	//音视频交错导致的小幅回退
+	assert.Equal(t, uint64(0xfffffc00), rw.Unwrap(0xfffffc00))
+	assert.Equal(t, uint64(0x100000028), rw.Unwrap(40))
+	//回绕之前的时间戳晚到
+	assert.Equal(t, uint64(0xfffffff0), rw.Unwrap(0xfffffff0))
+	assert.Equal(t, uint64(0x100000050), rw.Unwrap(80))
+
+	//模拟一年的推流，每分钟一帧
+	rw = NewRWBaser(time.Second)
+	var expected uint64
+	for i := 0; i < 365*24*60; i++ {
+		assert.Equal(t, expected, rw.Unwrap(uint32(expected)))
+		expected += 60 * 1000
+	}
+}
+
+func TestPushHeader(t *testing.T) {
+	header := &Packet{PacketType: PacketTypeMetadata}
+	queue := make(chan *Packet, 3)
+	assert.Equal(t, 0, PushHeader(queue, header))
+
+	//队列满时丢弃最早的音视频包，已有的header保留
+	audio1 := &Packet{PacketType: PacketTypeAudio}
+	audio2 := &Packet{PacketType: PacketTypeAudio}
+	queue <- audio1
+	queue <- audio2
+	seq := &Packet{PacketType: PacketTypeVideo, VHeader: VideoPacketHeader{FrameType: FRAME_KEY, CodecID: VIDEO_H264, AVCPacketType: AVC_SEQHDR}}
+	assert.Equal(t, 1, PushHeader(queue, seq))
+	assert.Equal(t, header, <-queue)
+	assert.Equal(t, audio2, <-queue)
+	assert.Equal(t, seq, <-queue)
+
+	//队列中全部是header时丢弃最早的header
+	queue <- header
+	queue <- seq
+	queue <- header
+	assert.Equal(t, 1, PushHeader(queue, seq))
+	assert.Equal(t, []*Packet{seq, header, seq}, []*Packet{<-queue, <-queue, <-queue})
+}
@@ -9,7 +9,11 @@ import (
 	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/container/flv"
 	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/media/av1"
 	"github.com/fabo871218/srtmp/media/h264"
+	"github.com/fabo871218/srtmp/media/h265"
+	"github.com/fabo871218/srtmp/media/opus"
+	"github.com/fabo871218/srtmp/media/vp9"
 	"github.com/fabo871218/srtmp/protocol/amf"
 	"github.com/fabo871218/srtmp/protocol/core"
 )
@@ -24,6 +28,8 @@ type RtmpClient struct {
 	videoFirst      bool //first packet to send
 	audioFirst      bool
 	demuxer         *flv.Demuxer
+	h264Order       *h264.FrameOrderer //调用方没有提供CompositionTime时，根据slice header推算
+	ctSupplied      bool               //调用方是否提供过非0的CompositionTime
 	logger          logger.Logger
 }
 
@@ -34,6 +40,7 @@ func NewRtmpClient(log logger.Logger) *RtmpClient {
 		videoFirst: true,
 		audioFirst: true,
 		demuxer:    flv.NewDemuxer(),
+		h264Order:  h264.NewFrameOrderer(),
 		logger:     log,
 	}
 }
@@ -62,6 +69,22 @@ func (c *RtmpClient) OpenPlay(URL string, onPacketReceive func(*av.Packet), onCl
 	return
 }
 
+//Seek 播放录制文件时跳转到timestamp(毫秒)的位置，服务端会从之前最近的关键帧开始发送
+func (c *RtmpClient) Seek(timestamp uint32) error {
+	if c.isPublish {
+		return fmt.Errorf("It is not play mode")
+	}
+	return c.conn.Seek(timestamp)
+}
+
+//Pause 播放录制文件时暂停或者恢复播放，timestamp为当前播放的位置(毫秒)
+func (c *RtmpClient) Pause(pause bool, timestamp uint32) error {
+	if c.isPublish {
+		return fmt.Errorf("It is not play mode")
+	}
+	return c.conn.Pause(pause, timestamp)
+}
+
 //Close 关闭连接，并回调onClosed
 func (c *RtmpClient) Close() error {
 	c.conn.Close()
@@ -71,7 +94,9 @@ func (c *RtmpClient) Close() error {
 	return nil
 }
 
-// SendPacket 发送数据包
+// SendPacket 发送数据包，TimeStamp为dts，视频的pts通过VHeader.CompositionTime(pts - dts)传入，
+// h264没有提供CompositionTime时根据slice header推算，推算假设帧率固定，sps中没有
+// max_num_reorder_frames时开头几帧的pts可能偏小，参考h264.FrameOrderer，有B帧的流最好自己传入
 func (c *RtmpClient) SendPacket(pkt *av.Packet) error {
 	if !c.isPublish {
 		return fmt.Errorf("It is not publish mode")
@@ -89,18 +114,47 @@ func (c *RtmpClient) SendPacket(pkt *av.Packet) error {
 	}
 }
 
+//SendTag 发送flv tag格式的数据包，Data为不包含tag头的tag数据，比如flv.FileReader读取的数据包，
+//数据会原样发送
+func (c *RtmpClient) SendTag(pkt *av.Packet) error {
+	if !c.isPublish {
+		return fmt.Errorf("It is not publish mode")
+	}
+	if err := c.sendPacketData(pkt.Data, pkt.TimeStamp, int(pkt.PacketType)); err != nil {
+		return fmt.Errorf("send packet failed, %v", err)
+	}
+	return nil
+}
+
 func (c *RtmpClient) sendAudioPacket(pkt *av.Packet) error {
 	var err error
-	if pkt.AHeader.SoundFormat == av.SOUND_AAC && c.audioFirst {
-		//如果音频是aac，需要先发送aac sequence header
-		sequencePkt := &av.Packet{
-			PacketType: av.PacketTypeAudio,
-			Data:       flv.NewAACSequenceHeader(pkt.AHeader),
-			TimeStamp:  pkt.TimeStamp,
-		}
-		if err = c.sendPacketData(sequencePkt.Data, sequencePkt.TimeStamp,
+	if pkt.AHeader.SoundFormat == av.SOUND_OPUS && opus.IsHead(pkt.Data) {
+		//调用者自己提供了OpusHead，作为sequence header发送
+		if err = c.sendPacketData(flv.NewOpusSequenceHeader(pkt.Data, pkt.TimeStamp), pkt.TimeStamp,
 			av.PacketTypeAudio); err != nil {
-			return fmt.Errorf("send aac sequence header failed. %v", err)
+			return fmt.Errorf("send opus sequence header failed. %v", err)
+		}
+		c.audioFirst = false
+		return nil
+	}
+	if c.audioFirst {
+		//如果音频是aac或opus，需要先发送sequence header
+		var seqHeader []byte
+		switch pkt.AHeader.SoundFormat {
+		case av.SOUND_AAC:
+			seqHeader = flv.NewAACSequenceHeader(pkt.AHeader)
+		case av.SOUND_OPUS:
+			channels := byte(2)
+			if pkt.AHeader.SoundType == av.SOUND_MONO {
+				channels = 1
+			}
+			seqHeader = flv.NewOpusSequenceHeader(opus.NewHead(channels, opus.SampleRate, opus.DefaultPreSkip),
+				pkt.TimeStamp)
+		}
+		if seqHeader != nil {
+			if err = c.sendPacketData(seqHeader, pkt.TimeStamp, av.PacketTypeAudio); err != nil {
+				return fmt.Errorf("send audio sequence header failed. %v", err)
+			}
 		}
 		c.audioFirst = false
 	}
@@ -117,36 +171,21 @@ func (c *RtmpClient) sendAudioPacket(pkt *av.Packet) error {
 
 func (c *RtmpClient) sendVideoPacket(pkt *av.Packet) error {
 	var err error
-	if pkt.VHeader.CodecID == av.VIDEO_H264 {
-		// 如果是h264，第一帧要发送sequence header
-		if c.videoFirst {
-			var sps, pps []byte
-			nalus := h264.ParseNalus(pkt.Data)
-			for _, nalu := range nalus {
-				if naluType := nalu[0] & 0x1F; naluType == 7 {
-					sps = nalu
-				} else if naluType == 8 {
-					pps = nalu
-				}
-			}
-
-			if sps == nil || pps == nil {
-				c.logger.Warn("sps and pps need for first packet.")
-				return nil
-			}
-			//send flv sequence header
-			sequencePkt := &av.Packet{
-				PacketType: av.PacketTypeVideo,
-				Data:       flv.NewAVCSequenceHeader(sps, pps, pkt.TimeStamp),
-				TimeStamp:  pkt.TimeStamp,
-			}
-
-			if err = c.sendPacketData(sequencePkt.Data, sequencePkt.TimeStamp,
-				av.PacketTypeVideo); err != nil {
-				return fmt.Errorf("send flv sequence header failed, %v", err)
-			}
-			c.videoFirst = false
+	if c.videoFirst && needVideoSequenceHeader(pkt.VHeader.CodecID) {
+		// 如果是h264，h265，av1或vp9，第一帧要发送sequence header
+		var seqHeader []byte
+		if seqHeader, err = c.videoSequenceHeader(pkt); err != nil {
+			return err
+		} else if seqHeader == nil {
+			return nil
+		}
+		if err = c.sendPacketData(seqHeader, pkt.TimeStamp, av.PacketTypeVideo); err != nil {
+			return fmt.Errorf("send flv sequence header failed, %v", err)
 		}
+		c.videoFirst = false
+	}
+	if pkt.VHeader.CodecID == av.VIDEO_H264 {
+		c.h264CompositionTime(pkt)
 	}
 	if pkt.Data, err = flv.PackVideoData(&pkt.VHeader, pkt.StreamID, pkt.Data,
 		pkt.TimeStamp); err != nil {
@@ -158,6 +197,99 @@ func (c *RtmpClient) sendVideoPacket(pkt *av.Packet) error {
 	return nil
 }
 
+//h264CompositionTime 调用方一直没有提供CompositionTime时，根据帧的显示顺序计算，
+//有B帧的流pts和dts不同，不设置的话播放端会乱序
+func (c *RtmpClient) h264CompositionTime(pkt *av.Packet) {
+	if pkt.VHeader.CompositionTime != 0 {
+		c.ctSupplied = true
+	}
+	if c.ctSupplied {
+		return
+	}
+	ct, err := c.h264Order.CompositionTime(pkt.Data, pkt.TimeStamp)
+	if err != nil {
+		c.logger.Debugf("calc composition time failed, %v", err)
+		return
+	}
+	pkt.VHeader.CompositionTime = ct
+}
+
+func needVideoSequenceHeader(codecID uint8) bool {
+	switch codecID {
+	case av.VIDEO_H264, av.VIDEO_HEVC, av.VIDEO_AV1, av.VIDEO_VP9:
+		return true
+	}
+	return false
+}
+
+//videoSequenceHeader 从第一帧中获取参数集，生成sequence header，参数集不完整时返回nil
+func (c *RtmpClient) videoSequenceHeader(pkt *av.Packet) ([]byte, error) {
+	switch pkt.VHeader.CodecID {
+	case av.VIDEO_AV1:
+		//av1的第一帧需要带有sequence header OBU
+		record, err := av1.CodecConfigurationRecord(pkt.Data)
+		if err != nil {
+			c.logger.Warnf("sequence header obu need for first packet, %v", err)
+			return nil, nil
+		}
+		return flv.NewExSequenceHeader(av.VIDEO_AV1, record, pkt.TimeStamp)
+	case av.VIDEO_VP9:
+		//vp9的vpcC从第一个关键帧中生成
+		record, err := vp9.VPCodecConfigurationRecord(pkt.Data)
+		if err != nil {
+			c.logger.Warnf("key frame need for first packet, %v", err)
+			return nil, nil
+		}
+		return flv.NewExSequenceHeader(av.VIDEO_VP9, record, pkt.TimeStamp)
+	}
+
+	var vps, sps, pps []byte
+	nalus := h264.ParseNalus(pkt.Data)
+	for _, nalu := range nalus {
+		if pkt.VHeader.CodecID == av.VIDEO_H264 {
+			if naluType := nalu[0] & 0x1F; naluType == 7 {
+				sps = nalu
+			} else if naluType == 8 {
+				pps = nalu
+			}
+			continue
+		}
+		switch h265.NaluType(nalu) {
+		case h265.NaluTypeVPS:
+			vps = nalu
+		case h265.NaluTypeSPS:
+			sps = nalu
+		case h265.NaluTypePPS:
+			pps = nalu
+		}
+	}
+
+	if pkt.VHeader.CodecID == av.VIDEO_H264 {
+		if sps == nil || pps == nil {
+			c.logger.Warn("sps and pps need for first packet.")
+			return nil, nil
+		}
+		return flv.NewAVCSequenceHeader(sps, pps, pkt.TimeStamp), nil
+	}
+	if vps == nil || sps == nil || pps == nil {
+		c.logger.Warn("vps, sps and pps need for first packet.")
+		return nil, nil
+	}
+	if !pkt.VHeader.IsExHeader {
+		seqHeader, err := flv.NewHEVCSequenceHeader(vps, sps, pps, pkt.TimeStamp)
+		if err != nil {
+			return nil, fmt.Errorf("create hevc sequence header failed, %v", err)
+		}
+		return seqHeader, nil
+	}
+	//使用Enhanced RTMP的hvc1发送
+	record, err := h265.HEVCDecoderConfigurationRecord(vps, sps, pps)
+	if err != nil {
+		return nil, fmt.Errorf("create hevc sequence header failed, %v", err)
+	}
+	return flv.NewExSequenceHeader(av.VIDEO_HEVC, record, pkt.TimeStamp)
+}
+
 func (c *RtmpClient) sendMetaPacket(pkt *av.Packet) error {
 	return fmt.Errorf("Mata data unsupport")
 }
@@ -225,6 +357,11 @@ func (c *RtmpClient) handleVideoAudio(cs *core.ChunkStream) error {
 	case av.PacketTypeAudio: //处理音频数据
 		c.onPacketReceive(&pkt)
 	case av.PacketTypeVideo: //处理视频数据
+		if pkt.VHeader.IsMetadataFrame() {
+			//Enhanced RTMP的视频元数据，AMF编码，直接返回
+			c.onPacketReceive(&pkt)
+			return nil
+		}
 		switch pkt.VHeader.CodecID {
 		case av.VIDEO_H264:
 			// 如果是h264的sequence header，需要解析出sps和pps
@@ -245,6 +382,25 @@ func (c *RtmpClient) handleVideoAudio(cs *core.ChunkStream) error {
 				}
 				return nil
 			}
+		case av.VIDEO_HEVC:
+			// 如果是h265的sequence header，按顺序返回第一个vps，sps和pps
+			if pkt.VHeader.IsSeqHeader() {
+				vpss, spss, ppss, err := flv.ParseHEVCSequenceHeader(pkt.Data)
+				if err != nil {
+					return fmt.Errorf("Parse hevc sequence header failed, %v", err)
+				}
+				for _, nalus := range [][][]byte{vpss, spss, ppss} {
+					if len(nalus) > 0 {
+						pkt.Data = nalus[0]
+						c.onPacketReceive(&pkt)
+					}
+				}
+				return nil
+			}
+		case av.VIDEO_AV1, av.VIDEO_VP9:
+			//av1和vp9的数据不是nalu格式，整帧返回
+			c.onPacketReceive(&pkt)
+			return nil
 		default:
 		}
 
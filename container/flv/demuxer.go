@@ -1,10 +1,12 @@
 package flv
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 
 	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/media/h265"
 )
 
 //ErrAvcEndSEQ ...
@@ -32,6 +34,8 @@ func (d *Demuxer) DemuxH(p *av.Packet) (err error) {
 			SoundSize:     tag.mediat.soundSize,
 			SoundType:     tag.mediat.soundType,
 			AACPacketType: tag.mediat.aacPacketType,
+			IsExHeader:    tag.mediat.isExHeader,
+			ExPacketType:  tag.mediat.exPacketType,
 		}
 	case av.PacketTypeVideo:
 		if _, err = tag.ParseVideoHeader(p.Data); err != nil {
@@ -42,6 +46,8 @@ func (d *Demuxer) DemuxH(p *av.Packet) (err error) {
 			AVCPacketType:   tag.mediat.avcPacketType,
 			CodecID:         tag.mediat.codecID,
 			CompositionTime: tag.mediat.compositionTime,
+			IsExHeader:      tag.mediat.isExHeader,
+			ExPacketType:    tag.mediat.exPacketType,
 		}
 	default:
 		//todo IsMetadata如何处理
@@ -67,6 +73,8 @@ func (d *Demuxer) Demux(p *av.Packet) (err error) {
 			SoundSize:     tag.mediat.soundSize,
 			SoundType:     tag.mediat.soundType,
 			AACPacketType: tag.mediat.aacPacketType,
+			IsExHeader:    tag.mediat.isExHeader,
+			ExPacketType:  tag.mediat.exPacketType,
 		}
 	case av.PacketTypeVideo:
 		if n, err = tag.ParseVideoHeader(p.Data); err != nil {
@@ -77,6 +85,8 @@ func (d *Demuxer) Demux(p *av.Packet) (err error) {
 			AVCPacketType:   tag.mediat.avcPacketType,
 			CodecID:         tag.mediat.codecID,
 			CompositionTime: tag.mediat.compositionTime,
+			IsExHeader:      tag.mediat.isExHeader,
+			ExPacketType:    tag.mediat.exPacketType,
 		}
 	default:
 		return fmt.Errorf("Unsupport type:%d", p.PacketType)
@@ -87,3 +97,52 @@ func (d *Demuxer) Demux(p *av.Packet) (err error) {
 	p.Data = p.Data[n:]
 	return
 }
+
+//IsDisposable 视频帧是否可以丢弃而不影响其他帧的解码，h264为nal_ref_idc为0的帧，
+//h265为sub-layer non-reference的帧，nalu长度按4字节解析，其他编码或者解析失败时返回false
+func IsDisposable(p *av.Packet) bool {
+	if p.PacketType != av.PacketTypeVideo || p.VHeader.FrameType == av.FRAME_KEY ||
+		p.VHeader.AVCPacketType != av.AVC_NALU || p.VHeader.IsMetadataFrame() {
+		return false
+	}
+	if p.VHeader.FrameType == av.FRAME_DISPOSABLE {
+		return true
+	}
+	codecID := p.VHeader.CodecID
+	if codecID != av.VIDEO_H264 && codecID != av.VIDEO_HEVC {
+		return false
+	}
+	var tag Tag
+	n, err := tag.ParseVideoHeader(p.Data)
+	if err != nil {
+		return false
+	}
+
+	data := p.Data[n:]
+	hasSlice := false
+	for len(data) > 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size == 0 || size > len(data) {
+			return false
+		}
+		nalu := data[:size]
+		data = data[size:]
+		if codecID == av.VIDEO_H264 {
+			//1-5为slice，nal_ref_idc不为0时会被参考
+			if t := nalu[0] & 0x1f; t >= 1 && t <= 5 {
+				if nalu[0]&0x60 != 0 {
+					return false
+				}
+				hasSlice = true
+			}
+		} else if t := h265.NaluType(nalu); t < 32 {
+			//0-14中的偶数为sub-layer non-reference，其他vcl类型会被参考
+			if t > 14 || t%2 == 1 {
+				return false
+			}
+			hasSlice = true
+		}
+	}
+	return hasSlice
+}
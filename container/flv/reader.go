@@ -0,0 +1,273 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/protocol/amf"
+)
+
+var (
+	//ErrInvalidHeader flv文件头错误
+	ErrInvalidHeader = errors.New("invalid flv header")
+	//ErrNotSeekable 底层的io.Reader没有实现io.Seeker
+	ErrNotSeekable = errors.New("reader is not seekable")
+)
+
+//关键帧在文件中的位置，用于seek
+type keyFrame struct {
+	timestamp uint32
+	offset    int64
+}
+
+//FileReader 读取flv文件，把每个tag解析成av.Packet
+//Packet.Data为tag数据，不包含tag头，和rtmp推流收到的数据格式一致
+type FileReader struct {
+	r        io.Reader
+	hasAudio bool
+	hasVideo bool
+	metaData amf.Object
+	demuxer  *Demuxer
+	header   [TagHeaderLen]byte
+
+	dataStart int64 //第一个tag在文件中的偏移
+	offset    int64 //下一个tag在文件中的偏移
+	index     []keyFrame
+	indexed   bool
+}
+
+//NewFileReader 创建一个flv读对象，会先读取并检查flv文件头
+func NewFileReader(r io.Reader) (*FileReader, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("read flv header failed, %v", err)
+	}
+	if header[0] != 'F' || header[1] != 'L' || header[2] != 'V' {
+		return nil, ErrInvalidHeader
+	}
+	dataOffset := binary.BigEndian.Uint32(header[5:])
+	if dataOffset < uint32(len(header)) {
+		return nil, ErrInvalidHeader
+	}
+	//跳过文件头的剩余部分以及PreviousTagSize0
+	if _, err := io.CopyN(ioutil.Discard, r, int64(dataOffset)-int64(len(header))+4); err != nil {
+		return nil, fmt.Errorf("read flv header failed, %v", err)
+	}
+	return &FileReader{
+		r:         r,
+		hasAudio:  header[4]&0x04 != 0,
+		hasVideo:  header[4]&0x01 != 0,
+		demuxer:   NewDemuxer(),
+		dataStart: int64(dataOffset) + 4,
+		offset:    int64(dataOffset) + 4,
+	}, nil
+}
+
+//OpenFile 打开一个flv文件，使用完需要调用Close
+func OpenFile(path string) (*FileReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open failed, %v", err)
+	}
+	reader, err := NewFileReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+//HasAudio 文件头中是否标记了有音频
+func (fr *FileReader) HasAudio() bool {
+	return fr.hasAudio
+}
+
+//HasVideo 文件头中是否标记了有视频
+func (fr *FileReader) HasVideo() bool {
+	return fr.hasVideo
+}
+
+//MetaData 返回已经读到的onMetaData，还没有读到时返回nil
+func (fr *FileReader) MetaData() amf.Object {
+	return fr.metaData
+}
+
+//Read 读取下一个音频、视频或者metadata数据包，其他类型的tag会被跳过
+//读到文件结尾时返回io.EOF，tag不完整时返回io.ErrUnexpectedEOF
+func (fr *FileReader) Read(p *av.Packet) error {
+	for {
+		typeID, filtered, dataSize, timestamp, err := fr.readTagHeader()
+		if err != nil {
+			return err
+		}
+		streamID := uint32(fr.header[8])<<16 | uint32(fr.header[9])<<8 | uint32(fr.header[10])
+
+		data := make([]byte, dataSize+4)
+		if _, err := io.ReadFull(fr.r, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		fr.offset += TagHeaderLen + int64(dataSize) + 4
+		data = data[:dataSize]
+		if filtered || dataSize == 0 {
+			continue
+		}
+
+		*p = av.Packet{
+			TimeStamp: timestamp,
+			StreamID:  streamID,
+			Data:      data,
+		}
+		switch typeID {
+		case av.TAG_AUDIO:
+			p.PacketType = av.PacketTypeAudio
+		case av.TAG_VIDEO:
+			p.PacketType = av.PacketTypeVideo
+		case av.TAG_SCRIPTDATAAMF0:
+			p.PacketType = av.PacketTypeMetadata
+			if obj, err := decodeMetaData(data); err == nil && fr.metaData == nil {
+				fr.metaData = obj
+			}
+			return nil
+		default:
+			continue
+		}
+		if err := fr.demuxer.DemuxH(p); err != nil {
+			return fmt.Errorf("demux tag failed, %v", err)
+		}
+		return nil
+	}
+}
+
+//读取tag头，返回tag类型，是否加密，数据长度以及时间戳
+func (fr *FileReader) readTagHeader() (typeID uint8, filtered bool, dataSize, timestamp uint32, err error) {
+	if _, err = io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return
+	}
+	//高3位是保留位和加密标志
+	typeID = fr.header[0] & 0x1f
+	filtered = fr.header[0]&0x20 != 0
+	dataSize = uint32(fr.header[1])<<16 | uint32(fr.header[2])<<8 | uint32(fr.header[3])
+	timestamp = uint32(fr.header[4])<<16 | uint32(fr.header[5])<<8 | uint32(fr.header[6]) |
+		uint32(fr.header[7])<<24
+	return
+}
+
+//Seek 跳转到timestamp(毫秒)之前最近的关键帧，没有视频时跳转到之前最近的音频帧，
+//返回实际跳转到的时间戳，需要底层的io.Reader实现io.Seeker
+func (fr *FileReader) Seek(timestamp uint32) (uint32, error) {
+	seeker, ok := fr.r.(io.Seeker)
+	if !ok {
+		return 0, ErrNotSeekable
+	}
+	if !fr.indexed {
+		if err := fr.buildIndex(seeker); err != nil {
+			return 0, err
+		}
+	}
+
+	target := keyFrame{offset: fr.dataStart}
+	for i, kf := range fr.index {
+		if i > 0 && kf.timestamp > timestamp {
+			break
+		}
+		target = kf
+	}
+	if _, err := seeker.Seek(target.offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek failed, %v", err)
+	}
+	fr.offset = target.offset
+	return target.timestamp, nil
+}
+
+//扫描整个文件，记录视频关键帧的位置，纯音频文件记录每个音频帧的位置
+func (fr *FileReader) buildIndex(seeker io.Seeker) error {
+	if _, err := seeker.Seek(fr.dataStart, io.SeekStart); err != nil {
+		return fmt.Errorf("seek failed, %v", err)
+	}
+	var videos, audios []keyFrame
+	offset := fr.dataStart
+	var buf [5]byte
+	for {
+		typeID, filtered, dataSize, timestamp, err := fr.readTagHeader()
+		if err != nil {
+			//文件结尾可能有不完整的tag，忽略
+			break
+		}
+		skip := int64(dataSize) + 4
+		if !filtered && dataSize >= 2 && (typeID == av.TAG_VIDEO || typeID == av.TAG_AUDIO) {
+			n := len(buf)
+			if int(dataSize) < n {
+				n = int(dataSize)
+			}
+			if _, err := io.ReadFull(fr.r, buf[:n]); err != nil {
+				break
+			}
+			skip -= int64(n)
+			kf := keyFrame{timestamp: timestamp, offset: offset}
+			if typeID == av.TAG_VIDEO {
+				//跳过sequence header，seek后使用之前发送的sequence header
+				var tag Tag
+				if _, err := tag.ParseVideoHeader(buf[:n]); err == nil {
+					header := av.VideoPacketHeader{
+						FrameType:     tag.mediat.frameType,
+						CodecID:       tag.mediat.codecID,
+						AVCPacketType: tag.mediat.avcPacketType,
+					}
+					if header.FrameType == av.FRAME_KEY && !header.IsSeqHeader() {
+						videos = append(videos, kf)
+					}
+				}
+			} else {
+				audios = append(audios, kf)
+			}
+		}
+		if _, err := seeker.Seek(skip, io.SeekCurrent); err != nil {
+			return fmt.Errorf("seek failed, %v", err)
+		}
+		offset += TagHeaderLen + int64(dataSize) + 4
+	}
+	fr.index = videos
+	if len(fr.index) == 0 {
+		fr.index = audios
+	}
+	fr.indexed = true
+	return nil
+}
+
+//Close 如果底层的io.Reader实现了io.Closer，则关闭它
+func (fr *FileReader) Close() error {
+	if c, ok := fr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//解析metadata数据，返回onMetaData中的对象
+func decodeMetaData(data []byte) (amf.Object, error) {
+	data, err := amf.MetaDataReform(data, amf.DEL)
+	if err != nil {
+		return nil, err
+	}
+	decoder := &amf.Decoder{}
+	vs, err := decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(vs) < 2 {
+		return nil, fmt.Errorf("invalid metadata, %v", err)
+	}
+	if name, _ := vs[0].(string); name != amf.OnMetaData {
+		return nil, fmt.Errorf("not onMetaData, %v", vs[0])
+	}
+	obj, ok := vs[1].(amf.Object)
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata type %T", vs[1])
+	}
+	return obj, nil
+}
@@ -0,0 +1,94 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileReader(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := WriteHeader(&buf)
+	assert.NoError(t, err)
+	meta := metadataPacket(t)
+	seq := videoPacket(0, true, true)
+	key := videoPacket(40, true, false)
+	audio := []byte{av.SOUND_AAC<<4 | 0x0f, av.AAC_RAW, 0x21, 0x10}
+	WriteTag(&buf, av.TAG_SCRIPTDATAAMF0, 0, meta.Data)
+	WriteTag(&buf, av.TAG_VIDEO, 0, seq.Data)
+	//未知类型的tag会被跳过
+	WriteTag(&buf, 0x10, 10, []byte{1, 2, 3})
+	WriteTag(&buf, av.TAG_AUDIO, 20, audio)
+	//超过24位的时间戳使用扩展字段
+	WriteTag(&buf, av.TAG_VIDEO, 0x01000040, key.Data)
+
+	reader, err := NewFileReader(&buf)
+	assert.NoError(t, err)
+	assert.True(t, reader.HasAudio())
+	assert.True(t, reader.HasVideo())
+
+	var p av.Packet
+	assert.NoError(t, reader.Read(&p))
+	assert.Equal(t, uint32(av.PacketTypeMetadata), p.PacketType)
+	assert.Equal(t, 1280.0, reader.MetaData()["width"])
+
+	assert.NoError(t, reader.Read(&p))
+	assert.Equal(t, uint32(av.PacketTypeVideo), p.PacketType)
+	assert.Equal(t, uint8(av.AVC_SEQHDR), p.VHeader.AVCPacketType)
+	assert.Equal(t, seq.Data, p.Data)
+
+	assert.NoError(t, reader.Read(&p))
+	assert.Equal(t, uint32(av.PacketTypeAudio), p.PacketType)
+	assert.Equal(t, uint32(20), p.TimeStamp)
+	assert.Equal(t, uint8(av.SOUND_AAC), p.AHeader.SoundFormat)
+	assert.Equal(t, audio, p.Data)
+
+	assert.NoError(t, reader.Read(&p))
+	assert.Equal(t, uint32(0x01000040), p.TimeStamp)
+	assert.Equal(t, uint8(av.FRAME_KEY), p.VHeader.FrameType)
+
+	assert.Equal(t, io.EOF, reader.Read(&p))
+}
+
+func TestFileReaderInvalid(t *testing.T) {
+	_, err := NewFileReader(bytes.NewReader([]byte("FLX\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00")))
+	assert.Equal(t, ErrInvalidHeader, err)
+
+	var buf bytes.Buffer
+	WriteHeader(&buf)
+	WriteTag(&buf, av.TAG_VIDEO, 0, videoPacket(0, true, false).Data)
+	reader, err := NewFileReader(bytes.NewReader(buf.Bytes()[:buf.Len()-6]))
+	assert.NoError(t, err)
+	var p av.Packet
+	assert.Equal(t, io.ErrUnexpectedEOF, reader.Read(&p))
+}
+
+func TestFileReaderSeek(t *testing.T) {
+	var buf bytes.Buffer
+	WriteHeader(&buf)
+	WriteTag(&buf, av.TAG_VIDEO, 0, videoPacket(0, true, true).Data)
+	for ts := uint32(0); ts < 3000; ts += 100 {
+		WriteTag(&buf, av.TAG_VIDEO, ts, videoPacket(ts, ts%1000 == 0, false).Data)
+	}
+
+	reader, err := NewFileReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	var p av.Packet
+	for _, c := range []struct{ target, expect uint32 }{{2500, 2000}, {1000, 1000}, {999, 0}, {5000, 2000}} {
+		ts, err := reader.Seek(c.target)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expect, ts)
+		assert.NoError(t, reader.Read(&p))
+		assert.Equal(t, c.expect, p.TimeStamp)
+		assert.Equal(t, uint8(av.FRAME_KEY), p.VHeader.FrameType)
+		assert.Equal(t, uint8(av.AVC_NALU), p.VHeader.AVCPacketType)
+	}
+
+	reader, err = NewFileReader(bytes.NewBuffer(buf.Bytes()))
+	assert.NoError(t, err)
+	_, err = reader.Seek(1000)
+	assert.Equal(t, ErrNotSeekable, err)
+}
@@ -0,0 +1,418 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol/amf"
+)
+
+const (
+	recorderQueueNum = 1024
+	//DefaultPathTemplate 默认的录制文件路径
+	DefaultPathTemplate = "./record/{app}/{name}_{time}.flv"
+
+	maxFileSuffix = 1000 //文件重名时最多尝试的后缀序号
+)
+
+//RecorderConfig 录制配置
+//PathTemplate支持的变量:
+//	{app}      流的app
+//	{name}     流的名称
+//	{time}     文件创建时的unix时间戳(秒)
+//	{datetime} 文件创建时间，格式为20060102150405
+//	{seq}      同一个录制对象创建的文件序号，从0开始
+//生成的文件已经存在时不会覆盖，在扩展名之前加上_1、_2等后缀
+type RecorderConfig struct {
+	PathTemplate string        //文件路径模板，为空时使用DefaultPathTemplate
+	MaxDuration  time.Duration //单个文件的最大时长，0表示不按时长切割
+	MaxSize      int64         //单个文件的最大字节数，0表示不按大小切割
+}
+
+//Recorder 把流录制成flv文件，实现了protocol.WriteCloser
+//每个文件都会写入metadata和sequence header，有视频时在关键帧处切割文件，
+//文件结束时会重写onMetaData中的duration和filesize
+type Recorder struct {
+	av.RWBaser
+	cfg       RecorderConfig
+	app, name string
+
+	file       *os.File
+	path       string
+	seq        int
+	size       int64
+	startTs    uint32
+	lastTs     uint32
+	metaOffset int64 //onMetaData tag数据在文件中的偏移，小于0表示没有
+	metaLayout metaDataLayout
+	metaData   amf.Object
+	videoSeq   *av.Packet
+	audioSeq   *av.Packet
+
+	closed      int32 //在写文件协程和流循环中访问，使用原子操作
+	closeOnce   sync.Once
+	doneChan    chan struct{}
+	packetQueue chan *av.Packet
+	logger      logger.Logger
+}
+
+//NewRecorder 创建一个录制对象，第一个文件在收到数据后创建
+func NewRecorder(cfg RecorderConfig, app, name string, log logger.Logger) *Recorder {
+	if cfg.PathTemplate == "" {
+		cfg.PathTemplate = DefaultPathTemplate
+	}
+	r := &Recorder{
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		cfg:         cfg,
+		app:         app,
+		name:        name,
+		metaOffset:  -1,
+		doneChan:    make(chan struct{}),
+		packetQueue: make(chan *av.Packet, recorderQueueNum),
+		logger:      log,
+	}
+	go func() {
+		if err := r.SendPacket(); err != nil {
+			r.logger.Infof("Recorder[%s/%s] stop, %v", r.app, r.name, err)
+		}
+		atomic.StoreInt32(&r.closed, 1)
+		if err := r.closeFile(); err != nil {
+			r.logger.Errorf("Recorder[%s/%s] close file failed, %v", r.app, r.name, err)
+		}
+		close(r.doneChan)
+	}()
+	return r
+}
+
+//Write 写入一个数据包，队列满时丢弃，metadata和sequence header不丢弃
+func (r *Recorder) Write(p *av.Packet) (err error) {
+	if r.isClosed() {
+		return errors.New("recorder closed")
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("recorder has already been closed:%v", e)
+		}
+	}()
+	r.SetPreTime()
+
+	if p.IsHeader() {
+		if av.PushHeader(r.packetQueue, p) > 0 {
+			r.logger.Warnf("Recorder[%s/%s] packet droped for sequence header...", r.app, r.name)
+		}
+		return
+	}
+	select {
+	case r.packetQueue <- p:
+	default:
+		r.logger.Warnf("Recorder[%s/%s] packet droped...", r.app, r.name)
+	}
+	return
+}
+
+//QueueSize 返回队列的长度
+func (r *Recorder) QueueSize() int {
+	return cap(r.packetQueue)
+}
+
+//SendPacket 从队列中读取数据包写入文件
+func (r *Recorder) SendPacket() error {
+	for {
+		p, ok := <-r.packetQueue
+		if !ok {
+			return errors.New("closed")
+		}
+		if err := r.writePacket(p); err != nil {
+			return err
+		}
+	}
+}
+
+//Close 关闭录制对象，当前文件会在写完队列中的数据后关闭
+func (r *Recorder) Close() {
+	r.closeOnce.Do(func() {
+		atomic.StoreInt32(&r.closed, 1)
+		close(r.packetQueue)
+	})
+}
+
+func (r *Recorder) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) != 0
+}
+
+//Wait 等待录制结束，返回后文件已经关闭
+func (r *Recorder) Wait() {
+	<-r.doneChan
+}
+
+func (r *Recorder) writePacket(p *av.Packet) error {
+	timestamp := p.TimeStamp + r.BaseTimeStamp()
+	switch p.PacketType {
+	case av.PacketTypeMetadata:
+		//metadata只写在文件开始，中途收到的在下一个文件中生效
+		obj, err := decodeMetaData(p.Data)
+		if err != nil {
+			r.logger.Warnf("Recorder[%s/%s] decode metadata failed, %v", r.app, r.name, err)
+			return nil
+		}
+		r.metaData = obj
+		return nil
+	case av.PacketTypeVideo:
+		if p.VHeader.IsSeqHeader() {
+			r.videoSeq = p
+			return r.writeIfOpen(av.TAG_VIDEO, timestamp, p.Data)
+		}
+	case av.PacketTypeAudio:
+		if p.AHeader.IsSeqHeader() {
+			r.audioSeq = p
+			return r.writeIfOpen(av.TAG_AUDIO, timestamp, p.Data)
+		}
+	default:
+		return nil
+	}
+
+	//有视频时只在关键帧处开始新的文件
+	isVideo := p.PacketType == av.PacketTypeVideo
+	cutPoint := (isVideo && p.VHeader.FrameType == av.FRAME_KEY) || (!isVideo && r.videoSeq == nil)
+	if r.file == nil {
+		if !cutPoint {
+			return nil
+		}
+		if err := r.openFile(timestamp); err != nil {
+			return err
+		}
+	} else if cutPoint && r.needRotate(timestamp) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		if err := r.openFile(timestamp); err != nil {
+			return err
+		}
+	}
+
+	typeID := uint8(av.TAG_AUDIO)
+	if isVideo {
+		typeID = av.TAG_VIDEO
+	}
+	return r.writeTag(typeID, timestamp, p.Data)
+}
+
+func (r *Recorder) needRotate(timestamp uint32) bool {
+	if r.cfg.MaxDuration > 0 && time.Duration(timestamp-r.startTs)*time.Millisecond >= r.cfg.MaxDuration {
+		return true
+	}
+	return r.cfg.MaxSize > 0 && r.size >= r.cfg.MaxSize
+}
+
+func (r *Recorder) writeIfOpen(typeID uint8, timestamp uint32, data []byte) error {
+	if r.file == nil {
+		return nil
+	}
+	return r.writeTag(typeID, timestamp, data)
+}
+
+//写入tag，时间戳相对于文件开始
+func (r *Recorder) writeTag(typeID uint8, timestamp uint32, data []byte) error {
+	var ts uint32
+	if timestamp > r.startTs {
+		ts = timestamp - r.startTs
+	}
+	if ts > r.lastTs {
+		r.lastTs = ts
+	}
+	n, err := WriteTag(r.file, typeID, ts, data)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write tag failed, %v", err)
+	}
+	return nil
+}
+
+func (r *Recorder) openFile(timestamp uint32) error {
+	path, err := r.filePath(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll failed, %v", err)
+	}
+	file, path, err := createFile(path)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile failed, %v", err)
+	}
+	r.path = path
+	r.file = file
+	r.seq++
+	r.size = 0
+	r.startTs = timestamp
+	r.lastTs = 0
+	r.metaOffset = -1
+
+	n, err := WriteHeader(r.file)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write header failed, %v", err)
+	}
+	if data, layout, err := encodeMetaData(r.metaData); err != nil {
+		r.logger.Warnf("Recorder[%s/%s] encode metadata failed, %v", r.app, r.name, err)
+	} else {
+		r.metaOffset = r.size + TagHeaderLen
+		r.metaLayout = layout
+		if err := r.writeTag(av.TAG_SCRIPTDATAAMF0, timestamp, data); err != nil {
+			return err
+		}
+	}
+	if r.videoSeq != nil {
+		if err := r.writeTag(av.TAG_VIDEO, timestamp, r.videoSeq.Data); err != nil {
+			return err
+		}
+	}
+	if r.audioSeq != nil {
+		if err := r.writeTag(av.TAG_AUDIO, timestamp, r.audioSeq.Data); err != nil {
+			return err
+		}
+	}
+	r.logger.Infof("Recorder[%s/%s] start new file:%s", r.app, r.name, r.path)
+	return nil
+}
+
+//关闭当前文件，重写onMetaData中的duration和filesize，只修改这两个数值，
+//文件中途收到的metadata不影响已经写入的tag
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	defer func() {
+		r.file = nil
+	}()
+
+	if r.metaOffset >= 0 {
+		duration := float64(r.lastTs) / 1000
+		err := r.patchNumber(r.metaLayout.duration, duration)
+		if err == nil {
+			err = r.patchNumber(r.metaLayout.filesize, float64(r.size))
+		}
+		if err != nil {
+			r.logger.Warnf("Recorder[%s/%s] rewrite metadata failed, %v", r.app, r.name, err)
+		}
+	}
+	r.logger.Infof("Recorder[%s/%s] close file:%s size:%d duration:%dms", r.app, r.name,
+		r.path, r.size, r.lastTs)
+	return r.file.Close()
+}
+
+//filePath app和name由推流端指定，包含..或者路径分隔符时返回错误，防止写到录制目录之外
+func (r *Recorder) filePath(now time.Time) (string, error) {
+	for _, s := range []string{r.app, r.name} {
+		if strings.Contains(s, "..") || strings.ContainsAny(s, `/\`) {
+			return "", fmt.Errorf("invalid stream path %s/%s", r.app, r.name)
+		}
+	}
+	replacer := strings.NewReplacer(
+		"{app}", r.app,
+		"{name}", r.name,
+		"{time}", strconv.FormatInt(now.Unix(), 10),
+		"{datetime}", now.Format("20060102150405"),
+		"{seq}", strconv.Itoa(r.seq),
+	)
+	return replacer.Replace(r.cfg.PathTemplate), nil
+}
+
+//createFile 创建新文件，不覆盖已有的文件，同一秒内切割或者重新推流时路径可能相同，
+//文件已经存在时在扩展名之前加上_1、_2等后缀，返回实际创建的路径
+func createFile(path string) (*os.File, string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; ; i++ {
+		name := path
+		if i > 0 {
+			name = base + "_" + strconv.Itoa(i) + ext
+		}
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return file, name, nil
+		}
+		if !os.IsExist(err) || i >= maxFileSuffix {
+			return nil, "", err
+		}
+	}
+}
+
+//patchNumber 重写onMetaData中offset处的8字节number
+func (r *Recorder) patchNumber(offset int, v float64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	_, err := r.file.WriteAt(b[:], r.metaOffset+int64(offset))
+	return err
+}
+
+//metaDataLayout onMetaData数据中duration和filesize的number值(不包括类型标记)的偏移
+type metaDataLayout struct {
+	duration int
+	filesize int
+}
+
+//生成onMetaData数据，duration和filesize为0，使用固定长度的number类型，文件结束时按layout原地重写
+func encodeMetaData(src amf.Object) ([]byte, metaDataLayout, error) {
+	obj := make(amf.Object, len(src)+2)
+	for k, v := range src {
+		obj[k] = v
+	}
+	obj["duration"] = 0.0
+	obj["filesize"] = 0.0
+
+	//amf.Object是map，编码顺序不固定，这里按key排序后编码，保证重写时长度和位置一致
+	var buf bytes.Buffer
+	var layout metaDataLayout
+	encoder := &amf.Encoder{}
+	if _, err := encoder.Encode(&buf, amf.OnMetaData, amf.AMF0); err != nil {
+		return nil, layout, err
+	}
+	offsets, err := encodeSortedObject(encoder, &buf, obj)
+	if err != nil {
+		return nil, layout, err
+	}
+	layout.duration = offsets["duration"] + 1
+	layout.filesize = offsets["filesize"] + 1
+	return buf.Bytes(), layout, nil
+}
+
+//encodeSortedObject 按key排序编码，返回每个值在buf中的偏移
+func encodeSortedObject(e *amf.Encoder, w *bytes.Buffer, obj amf.Object) (map[string]int, error) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	offsets := make(map[string]int, len(keys))
+	if err := amf.WriteMarker(w, amf.AMF0_OBJECT_MARKER); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if _, err := e.EncodeAmf0String(w, k, false); err != nil {
+			return nil, err
+		}
+		offsets[k] = w.Len()
+		if _, err := e.EncodeAmf0(w, obj[k]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := e.EncodeAmf0String(w, "", false); err != nil {
+		return nil, err
+	}
+	return offsets, amf.WriteMarker(w, amf.AMF0_OBJECT_END_MARKER)
+}
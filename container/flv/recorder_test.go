@@ -0,0 +1,255 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol/amf"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTag struct {
+	typeID    uint8
+	timestamp uint32
+	data      []byte
+}
+
+func readTestFile(t *testing.T, path string) []testTag {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, FLVHeader, data[:len(FLVHeader)])
+	data = data[len(FLVHeader)+4:]
+
+	var tags []testTag
+	for len(data) > 0 {
+		assert.True(t, len(data) >= TagHeaderLen)
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		ts := uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]) | uint32(data[7])<<24
+		tags = append(tags, testTag{typeID: data[0], timestamp: ts, data: data[TagHeaderLen : TagHeaderLen+size]})
+		assert.Equal(t, uint32(TagHeaderLen+size), binary.BigEndian.Uint32(data[TagHeaderLen+size:]))
+		data = data[TagHeaderLen+size+4:]
+	}
+	return tags
+}
+
+func videoPacket(ts uint32, key, seq bool) *av.Packet {
+	p := &av.Packet{PacketType: av.PacketTypeVideo, TimeStamp: ts}
+	p.VHeader.CodecID = av.VIDEO_H264
+	p.VHeader.FrameType = av.FRAME_INTER
+	if key {
+		p.VHeader.FrameType = av.FRAME_KEY
+	}
+	p.VHeader.AVCPacketType = av.AVC_NALU
+	if seq {
+		p.VHeader.AVCPacketType = av.AVC_SEQHDR
+	}
+	p.Data = []byte{p.VHeader.FrameType<<4 | av.VIDEO_H264, p.VHeader.AVCPacketType, 0, 0, 0, byte(ts)}
+	return p
+}
+
+func metadataPacket(t *testing.T) *av.Packet {
+	var buf bytes.Buffer
+	encoder := &amf.Encoder{}
+	_, err := encoder.Encode(&buf, amf.SetDataFrame, amf.AMF0)
+	assert.NoError(t, err)
+	_, err = encoder.Encode(&buf, amf.OnMetaData, amf.AMF0)
+	assert.NoError(t, err)
+	_, err = encoder.Encode(&buf, amf.Object{"width": 1280.0, "height": 720.0}, amf.AMF0)
+	assert.NoError(t, err)
+	return &av.Packet{PacketType: av.PacketTypeMetadata, Data: buf.Bytes()}
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	cfg := RecorderConfig{
+		PathTemplate: filepath.Join(dir, "{app}", "{name}_{seq}.flv"),
+		MaxDuration:  time.Second,
+	}
+	r := NewRecorder(cfg, "live", "test", log)
+	assert.NoError(t, r.Write(metadataPacket(t)))
+	assert.NoError(t, r.Write(videoPacket(100, true, true)))
+	//第一个关键帧之前的数据不写入
+	assert.NoError(t, r.Write(videoPacket(100, false, false)))
+	for ts := uint32(200); ts <= 2200; ts += 500 {
+		assert.NoError(t, r.Write(videoPacket(ts, ts%1000 == 200, false)))
+	}
+	r.Close()
+	r.Wait()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "live", "*.flv"))
+	assert.Equal(t, []string{
+		filepath.Join(dir, "live", "test_0.flv"),
+		filepath.Join(dir, "live", "test_1.flv"),
+		filepath.Join(dir, "live", "test_2.flv"),
+	}, files)
+
+	tags := readTestFile(t, files[0])
+	assert.Equal(t, 4, len(tags))
+	assert.Equal(t, uint8(av.TAG_SCRIPTDATAAMF0), tags[0].typeID)
+	assert.Equal(t, uint8(av.TAG_VIDEO), tags[1].typeID)
+	assert.Equal(t, byte(av.AVC_SEQHDR), tags[1].data[1])
+	assert.Equal(t, []uint32{0, 0, 0, 500}, []uint32{tags[0].timestamp, tags[1].timestamp,
+		tags[2].timestamp, tags[3].timestamp})
+
+	//文件结束时重写duration和filesize
+	obj, err := decodeMetaData(tags[0].data)
+	assert.NoError(t, err)
+	assert.Equal(t, 1280.0, obj["width"])
+	assert.Equal(t, 0.5, obj["duration"])
+	info, _ := os.Stat(files[0])
+	assert.Equal(t, float64(info.Size()), obj["filesize"])
+
+	//后续文件也以sequence header开始，时间戳从0开始
+	tags = readTestFile(t, files[1])
+	assert.Equal(t, byte(av.AVC_SEQHDR), tags[1].data[1])
+	assert.Equal(t, byte(av.FRAME_KEY<<4|av.VIDEO_H264), tags[2].data[0])
+	assert.Equal(t, uint32(0), tags[2].timestamp)
+
+	assert.Error(t, r.Write(videoPacket(3000, true, false)))
+}
+
+func TestRecorderMetadataChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	r := NewRecorder(RecorderConfig{PathTemplate: filepath.Join(dir, "{name}.flv")}, "live", "test", log)
+	assert.NoError(t, r.Write(metadataPacket(t)))
+	assert.NoError(t, r.Write(videoPacket(0, true, false)))
+	//文件中途收到更长的metadata，关闭时不能覆盖后面的tag
+	var buf bytes.Buffer
+	encoder := &amf.Encoder{}
+	_, err = encoder.Encode(&buf, amf.OnMetaData, amf.AMF0)
+	assert.NoError(t, err)
+	_, err = encoder.Encode(&buf, amf.Object{"width": 1920.0, "height": 1080.0, "encoder": "a long encoder name"}, amf.AMF0)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Write(&av.Packet{PacketType: av.PacketTypeMetadata, Data: buf.Bytes()}))
+	assert.NoError(t, r.Write(videoPacket(1500, false, false)))
+	r.Close()
+	r.Wait()
+
+	path := filepath.Join(dir, "test.flv")
+	tags := readTestFile(t, path)
+	assert.Equal(t, 3, len(tags))
+	obj, err := decodeMetaData(tags[0].data)
+	assert.NoError(t, err)
+	assert.Equal(t, 1280.0, obj["width"])
+	assert.Equal(t, 1.5, obj["duration"])
+	info, _ := os.Stat(path)
+	assert.Equal(t, float64(info.Size()), obj["filesize"])
+}
+
+func TestRecorderNoSeqHeaderCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	//vp6没有sequence header，AVCPacketType为0的帧也要正常写入
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	r := NewRecorder(RecorderConfig{PathTemplate: filepath.Join(dir, "{name}.flv")}, "live", "test", log)
+	for i, key := range []bool{true, false, false} {
+		p := &av.Packet{PacketType: av.PacketTypeVideo, TimeStamp: uint32(i * 40)}
+		p.VHeader = av.VideoPacketHeader{FrameType: av.FRAME_INTER, CodecID: av.VideoVP6}
+		if key {
+			p.VHeader.FrameType = av.FRAME_KEY
+		}
+		p.Data = []byte{p.VHeader.FrameType<<4 | av.VideoVP6, 0, byte(i)}
+		assert.NoError(t, r.Write(p))
+	}
+	r.Close()
+	r.Wait()
+
+	tags := readTestFile(t, filepath.Join(dir, "test.flv"))
+	assert.Equal(t, 4, len(tags))
+	assert.Equal(t, []uint32{0, 0, 40, 80}, []uint32{tags[0].timestamp, tags[1].timestamp,
+		tags[2].timestamp, tags[3].timestamp})
+}
+
+func TestRecorderNoOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	//同一秒内重新推流生成相同的路径，之前的文件不能被覆盖
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	cfg := RecorderConfig{PathTemplate: filepath.Join(dir, "{name}.flv")}
+	for i := 0; i < 3; i++ {
+		r := NewRecorder(cfg, "live", "test", log)
+		for ts := uint32(0); ts <= uint32(i)*40; ts += 40 {
+			assert.NoError(t, r.Write(videoPacket(ts, ts == 0, false)))
+		}
+		r.Close()
+		r.Wait()
+	}
+
+	for i, name := range []string{"test.flv", "test_1.flv", "test_2.flv"} {
+		assert.Equal(t, i+2, len(readTestFile(t, filepath.Join(dir, name))))
+	}
+}
+
+func TestRecorderWriteAfterError(t *testing.T) {
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	cfg := RecorderConfig{PathTemplate: filepath.Join(os.TempDir(), "{name}.flv")}
+	r := NewRecorder(cfg, "live", "../x", log)
+	//写文件协程出错退出的同时流循环继续写入，直到返回错误
+	for ts := uint32(0); r.Write(videoPacket(ts, true, false)) == nil; ts += 40 {
+		time.Sleep(time.Millisecond)
+	}
+	r.Wait()
+}
+
+func TestRecorderFilePath(t *testing.T) {
+	r := &Recorder{cfg: RecorderConfig{PathTemplate: "/data/{app}/{name}/{datetime}_{time}_{seq}.flv"},
+		app: "live", name: "room", seq: 3}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	path, err := r.filePath(now)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("/data/live/room/20200102030405_%d_3.flv", now.Unix()), path)
+
+	//app和name不能访问录制目录之外的文件
+	for _, name := range []string{"../../etc/x", "a/b", `a\b`, ".."} {
+		r.name = name
+		_, err = r.filePath(now)
+		assert.Error(t, err, name)
+	}
+	r.name = "room"
+	r.app = "../live"
+	_, err = r.filePath(now)
+	assert.Error(t, err)
+}
+
+func TestRecorderPathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	cfg := RecorderConfig{PathTemplate: filepath.Join(dir, "record", "{app}", "{name}.flv")}
+	r := NewRecorder(cfg, "live", "../../x", log)
+	assert.NoError(t, r.Write(videoPacket(0, true, false)))
+	r.Wait()
+	assert.Error(t, r.Write(videoPacket(40, true, false)))
+
+	//没有创建任何文件
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	assert.Empty(t, files)
+}
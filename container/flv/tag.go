@@ -9,7 +9,10 @@ import (
 
 	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/media/aac"
+	"github.com/fabo871218/srtmp/media/av1"
 	"github.com/fabo871218/srtmp/media/h264"
+	"github.com/fabo871218/srtmp/media/h265"
+	"github.com/fabo871218/srtmp/media/vp9"
 	"github.com/fabo871218/srtmp/utils"
 )
 
@@ -21,6 +24,15 @@ type flvTag struct {
 	streamID        uint32 //24bit always 0
 }
 
+//marshal 按tag header的格式写入h，h至少TagHeaderLen个字节
+func (t *flvTag) marshal(h []byte) {
+	utils.PutU8(h[0:1], t.fType)
+	utils.PutU24BE(h[1:4], t.dataSize)
+	utils.PutU24BE(h[4:7], t.timeStamp)
+	utils.PutU8(h[7:8], t.timeStampExtend)
+	utils.PutU24BE(h[8:11], t.streamID)
+}
+
 /*
 flv 格式
 Header|PreviousTagSize0|Tag1|PreviousTagSize1|Tag2|PreviousTagSize2|...|TagN|PreviousTagSizeN|
@@ -51,6 +63,9 @@ video tag
 	5: On2 VP6 with alpha channel
 	6: Screen video version 2
 	7: AVC
+	12: HEVC (非标准，国内通用的扩展)
+Enhanced RTMP的视频tag，第一个字节的最高位为1，后面3bit为帧类型，低4bit为包类型(PacketType)，
+接下来4个字节为FourCC，如hvc1，PacketType为CodedFrames时才有3个字节的CompositionTime
 接下来就是具体的video的流数据的封装
 对于AVC(h264)格式的video，除了第一个字节的帧类型和编码id以外，从第二个字节开始，分别为
 
@@ -103,6 +118,9 @@ SoundSize    1bit
 SoundType    1bit
 SoundData    n bytes //音频数据
 
+当SoundFormat == 9 时，为Enhanced RTMP的扩展头，低4bit为包类型(AudioPacketType)，
+接下来4个字节为FourCC，如Opus，PacketType为SequenceStart时数据为OpusHead，CodedFrames时为opus包
+
 当SoundFormat == 10 时，SoundData的数据时AAC格式
 AACAudioData格式如下
 AACPacketType  8bit  0--aac sequence header  1--aac raw
@@ -200,6 +218,7 @@ type mediaTag struct {
 		5: On2 VP6 with alpha channel
 		6: Screen video version 2
 		7: AVC
+		12: HEVC
 	*/
 	codecID uint8
 
@@ -211,6 +230,10 @@ type mediaTag struct {
 	avcPacketType uint8
 
 	compositionTime int32
+
+	//Enhanced RTMP的扩展头，视频信息使用包类型和FourCC表示
+	isExHeader   bool
+	exPacketType uint8
 }
 
 type Tag struct {
@@ -231,13 +254,100 @@ func (tag *Tag) ParseAudioHeader(b []byte) (n int, err error) {
 	tag.mediat.soundType = flags & 0x1
 	n++
 	switch tag.mediat.soundFormat {
+	case av.SOUND_EX_HEADER:
+		return tag.parseExAudioHeader(b)
 	case av.SOUND_AAC:
+		if len(b) < n+1 {
+			err = fmt.Errorf("invalid audiodata len=%d", len(b))
+			return
+		}
 		tag.mediat.aacPacketType = b[1]
 		n++
 	}
 	return
 }
 
+//audioFourCCCodecs Enhanced RTMP音频的FourCC和编码id的对应关系
+var audioFourCCCodecs = map[string]uint8{
+	av.FourCCOpus: av.SOUND_OPUS,
+}
+
+//audioCodecFourCC 获取音频编码id对应的FourCC
+func audioCodecFourCC(soundFormat uint8) (string, bool) {
+	for fourCC, id := range audioFourCCCodecs {
+		if id == soundFormat {
+			return fourCC, true
+		}
+	}
+	return "", false
+}
+
+//parseExAudioHeader 解析Enhanced RTMP的音频扩展头，包类型转换成对应的AACPacketType
+//SoundFormat(4bit)=9|PacketType(4bit)|[ModEx]|FourCC(32bit)
+func (tag *Tag) parseExAudioHeader(b []byte) (n int, err error) {
+	tag.mediat.isExHeader = true
+	packetType := b[0] & 0x0f
+	n++
+
+	for packetType == av.AudioPacketTypeModEx {
+		if len(b) < n+1 {
+			err = fmt.Errorf("invalid modex len=%d", len(b))
+			return
+		}
+		size := int(b[n]) + 1
+		n++
+		if size == 256 {
+			if len(b) < n+2 {
+				err = fmt.Errorf("invalid modex len=%d", len(b))
+				return
+			}
+			size = int(binary.BigEndian.Uint16(b[n:])) + 1
+			n += 2
+		}
+		if len(b) < n+size+1 {
+			err = fmt.Errorf("invalid modex len=%d", len(b))
+			return
+		}
+		n += size
+		packetType = b[n] & 0x0f
+		n++
+	}
+	tag.mediat.exPacketType = packetType
+
+	if packetType == av.AudioPacketTypeMultitrack {
+		err = fmt.Errorf("unsupport multitrack")
+		return
+	}
+	if len(b) < n+4 {
+		err = fmt.Errorf("invalid audiodata len=%d", len(b))
+		return
+	}
+	fourCC := string(b[n : n+4])
+	n += 4
+	soundFormat, ok := audioFourCCCodecs[fourCC]
+	if !ok {
+		err = fmt.Errorf("unsupport fourcc:%q", fourCC)
+		return
+	}
+	//扩展头中没有采样率等信息，opus解码后固定为48kHz
+	tag.mediat.soundFormat = soundFormat
+	tag.mediat.soundRate = av.SOUND_RATE_48Khz
+	tag.mediat.soundSize = av.SOUND_16BIT
+	tag.mediat.soundType = av.SOUND_STEREO
+
+	switch packetType {
+	case av.AudioPacketTypeSequenceStart:
+		tag.mediat.aacPacketType = av.AAC_SEQHDR
+	case av.AudioPacketTypeCodedFrames, av.AudioPacketTypeSequenceEnd,
+		av.AudioPacketTypeMultichannelConfig:
+		//SequenceEnd和MultichannelConfig按普通帧转发，使用者通过ExPacketType区分
+		tag.mediat.aacPacketType = av.AAC_RAW
+	default:
+		err = fmt.Errorf("unsupport packet type:%d", packetType)
+	}
+	return
+}
+
 //ParseVideoHeader ...
 func (tag *Tag) ParseVideoHeader(b []byte) (n int, err error) {
 	if len(b) < n+5 {
@@ -246,25 +356,115 @@ func (tag *Tag) ParseVideoHeader(b []byte) (n int, err error) {
 	}
 	//第一个字节包含帧类型（4bit）和编码id（4bit）
 	flags := b[0]
+	if flags&0x80 != 0 {
+		return tag.parseExVideoHeader(b)
+	}
 	tag.mediat.frameType = flags >> 4 //获取帧类型
 	tag.mediat.codecID = flags & 0xf  //获取编码id
 	n++
-	if tag.mediat.codecID == av.VIDEO_H264 {
-		//如果编码id是avc，再获取avc的视频封装格式
+	if tag.mediat.codecID == av.VIDEO_H264 || tag.mediat.codecID == av.VIDEO_HEVC {
+		//如果编码id是avc，再获取avc的视频封装格式，h265的封装和avc相同
 		tag.mediat.avcPacketType = b[1] //AVCPacketType 0-sequence header 1-nalue 2-end of sequence
 		//获取3个字节的compositionTime
-		for i := 2; i < 5; i++ {
-			tag.mediat.compositionTime = tag.mediat.compositionTime<<8 + int32(b[i])
-		}
+		tag.mediat.compositionTime = utils.I24BE(b[2:5])
 		n += 4
 	}
-	// if tag.mediat.frameType == av.FRAME_INTER || tag.mediat.frameType == av.FRAME_KEY {
-	// 	tag.mediat.avcPacketType = b[1]
-	// 	for i := 2; i < 5; i++ {
-	// 		tag.mediat.compositionTime = tag.mediat.compositionTime<<8 + int32(b[i])
-	// 	}
-	// 	n += 4
-	// }
+	return
+}
+
+//fourCCCodecs Enhanced RTMP的FourCC和编码id的对应关系
+var fourCCCodecs = map[string]uint8{
+	av.FourCCHEVC: av.VIDEO_HEVC,
+	av.FourCCAV1:  av.VIDEO_AV1,
+	av.FourCCVP9:  av.VIDEO_VP9,
+}
+
+//codecFourCC 获取编码id对应的FourCC
+func codecFourCC(codecID uint8) (string, bool) {
+	for fourCC, id := range fourCCCodecs {
+		if id == codecID {
+			return fourCC, true
+		}
+	}
+	return "", false
+}
+
+//parseExVideoHeader 解析Enhanced RTMP的扩展头，包类型转换成对应的AVCPacketType
+//IsExHeader(1bit)|FrameType(3bit)|PacketType(4bit)|[ModEx]|FourCC(32bit)|[CompositionTime(24bit)]
+func (tag *Tag) parseExVideoHeader(b []byte) (n int, err error) {
+	tag.mediat.isExHeader = true
+	tag.mediat.frameType = (b[0] >> 4) & 0x07
+	packetType := b[0] & 0x0f
+	n++
+
+	//v2的ModEx可以有多个，每个的最后4bit为下一个包类型
+	for packetType == av.ExPacketTypeModEx {
+		if len(b) < n+1 {
+			err = fmt.Errorf("invalid modex len=%d", len(b))
+			return
+		}
+		size := int(b[n]) + 1
+		n++
+		if size == 256 {
+			if len(b) < n+2 {
+				err = fmt.Errorf("invalid modex len=%d", len(b))
+				return
+			}
+			size = int(binary.BigEndian.Uint16(b[n:])) + 1
+			n += 2
+		}
+		//跳过ModEx的数据，目前只有纳秒级的时间戳偏移，不需要处理
+		if len(b) < n+size+1 {
+			err = fmt.Errorf("invalid modex len=%d", len(b))
+			return
+		}
+		n += size
+		packetType = b[n] & 0x0f
+		n++
+	}
+	tag.mediat.exPacketType = packetType
+
+	if packetType == av.ExPacketTypeMultitrack {
+		err = fmt.Errorf("unsupport multitrack")
+		return
+	}
+	if len(b) < n+4 {
+		err = fmt.Errorf("invalid videodata len=%d", len(b))
+		return
+	}
+	fourCC := string(b[n : n+4])
+	n += 4
+	codecID, ok := fourCCCodecs[fourCC]
+	if !ok {
+		err = fmt.Errorf("unsupport fourcc:%q", fourCC)
+		return
+	}
+	tag.mediat.codecID = codecID
+
+	switch packetType {
+	case av.ExPacketTypeSequenceStart, av.ExPacketTypeMPEG2TSSequenceStart:
+		tag.mediat.avcPacketType = av.AVC_SEQHDR
+	case av.ExPacketTypeCodedFrames:
+		tag.mediat.avcPacketType = av.AVC_NALU
+		//只有hevc的CodedFrames带有CompositionTime
+		if codecID == av.VIDEO_HEVC {
+			if len(b) < n+3 {
+				err = fmt.Errorf("invalid videodata len=%d", len(b))
+				return
+			}
+			tag.mediat.compositionTime = utils.I24BE(b[n : n+3])
+			n += 3
+		}
+	case av.ExPacketTypeCodedFramesX:
+		tag.mediat.avcPacketType = av.AVC_NALU
+	case av.ExPacketTypeSequenceEnd:
+		tag.mediat.avcPacketType = av.AVC_EOS
+	case av.ExPacketTypeMetadata:
+		//元数据帧按普通帧转发，使用者通过IsMetadataFrame区分
+		tag.mediat.avcPacketType = av.AVC_NALU
+	default:
+		err = fmt.Errorf("unsupport packet type:%d", packetType)
+	}
 	return
 }
 
@@ -275,8 +475,8 @@ func NewAVCSequenceHeader(sps, pps []byte, timeStamp uint32) []byte {
 		flvt: flvTag{
 			fType:           av.TAG_VIDEO,                 //uint8  //8bit tag类型，包括音频tag（8），视频tag（9），脚本tag（18）
 			dataSize:        uint32(len(avcConfigRecord)), //uint32 //24bit 数据长度，从streamID后面算起
-			timeStamp:       timeStamp,                    //uint32 //24bit 时间戳，单位是毫秒，对于脚本类型tag，总是为0
-			timeStampExtend: 0,                            //8bit 时间戳扩展，将时间戳扩展为4bytes，代表时间戳高8位
+			timeStamp:       timeStamp & 0xffffff,         //uint32 //24bit 时间戳，单位是毫秒，对于脚本类型tag，总是为0
+			timeStampExtend: uint8(timeStamp >> 24),       //8bit 时间戳扩展，将时间戳扩展为4bytes，代表时间戳高8位
 			streamID:        0,                            //24bit always 0
 		},
 		mediat: mediaTag{
@@ -371,6 +571,64 @@ func ParseAVCSequenceHeader(data []byte) (spss, ppss [][]byte, err error) {
 	return
 }
 
+//NewHEVCSequenceHeader 生成h265的sequence header，使用CodecID 12的封装
+func NewHEVCSequenceHeader(vps, sps, pps []byte, timeStamp uint32) ([]byte, error) {
+	hevcConfigRecord, err := h265.HEVCDecoderConfigurationRecord(vps, sps, pps)
+	if err != nil {
+		return nil, err
+	}
+	tag := &Tag{
+		flvt: flvTag{
+			fType:           av.TAG_VIDEO,
+			dataSize:        uint32(len(hevcConfigRecord)),
+			timeStamp:       timeStamp & 0xffffff,
+			timeStampExtend: uint8(timeStamp >> 24),
+		},
+		mediat: mediaTag{
+			frameType:     av.FRAME_KEY,
+			codecID:       av.VIDEO_HEVC,
+			avcPacketType: av.AVC_SEQHDR,
+		},
+	}
+	tagBuffer := muxerTagData(tag)
+	buffer := make([]byte, len(tagBuffer)+len(hevcConfigRecord))
+	copy(buffer, tagBuffer)
+	copy(buffer[len(tagBuffer):], hevcConfigRecord)
+	return buffer, nil
+}
+
+//ParseHEVCSequenceHeader 解析vps，sps和pps
+func ParseHEVCSequenceHeader(data []byte) (vpss, spss, ppss [][]byte, err error) {
+	return h265.ParseDecoderConfigurationRecord(data)
+}
+
+//NewExSequenceHeader 使用Enhanced RTMP的扩展头打包sequence header，record为对应编码的解码配置
+func NewExSequenceHeader(codecID uint8, record []byte, timeStamp uint32) ([]byte, error) {
+	if _, ok := codecFourCC(codecID); !ok {
+		return nil, fmt.Errorf("unsupport code id:%d", codecID)
+	}
+	tag := &Tag{
+		flvt: flvTag{
+			fType:           av.TAG_VIDEO,
+			dataSize:        uint32(len(record)),
+			timeStamp:       timeStamp & 0xffffff,
+			timeStampExtend: uint8(timeStamp >> 24),
+		},
+		mediat: mediaTag{
+			frameType:     av.FRAME_KEY,
+			codecID:       codecID,
+			avcPacketType: av.AVC_SEQHDR,
+			isExHeader:    true,
+			exPacketType:  av.ExPacketTypeSequenceStart,
+		},
+	}
+	tagBuffer := muxerTagData(tag)
+	buffer := make([]byte, len(tagBuffer)+len(record))
+	copy(buffer, tagBuffer)
+	copy(buffer[len(tagBuffer):], record)
+	return buffer, nil
+}
+
 //NewAACSequenceHeader comment
 func NewAACSequenceHeader(ah av.AudioPacketHeader) []byte {
 	var (
@@ -446,6 +704,29 @@ func NewAACSequenceHeader(ah av.AudioPacketHeader) []byte {
 	return buffer[:index]
 }
 
+//NewOpusSequenceHeader 使用Enhanced RTMP的扩展头打包OpusHead
+func NewOpusSequenceHeader(head []byte, timeStamp uint32) []byte {
+	tag := &Tag{
+		flvt: flvTag{
+			fType:           av.TAG_AUDIO,
+			dataSize:        uint32(len(head)),
+			timeStamp:       timeStamp & 0xffffff,
+			timeStampExtend: uint8(timeStamp >> 24),
+		},
+		mediat: mediaTag{
+			soundFormat:   av.SOUND_OPUS,
+			aacPacketType: av.AAC_SEQHDR,
+			isExHeader:    true,
+			exPacketType:  av.AudioPacketTypeSequenceStart,
+		},
+	}
+	tagBuffer := muxerTagData(tag)
+	buffer := make([]byte, len(tagBuffer)+len(head))
+	copy(buffer, tagBuffer)
+	copy(buffer[len(tagBuffer):], head)
+	return buffer
+}
+
 // PackVideoData 打包音数据到buffer中，按照flv的video tag的格式打包
 func PackVideoData(header *av.VideoPacketHeader, streamID uint32, src []byte,
 	timeStamp uint32) ([]byte, error) {
@@ -469,24 +750,99 @@ func PackVideoData(header *av.VideoPacketHeader, streamID uint32, src []byte,
 			flvt: flvTag{
 				fType:           av.TAG_VIDEO,
 				dataSize:        uint32(len(src)), //在用rtmp协议发送是，改字段好像不起作用，正常情况是后面mediaTag+数据的长度
-				timeStamp:       timeStamp,
-				timeStampExtend: 0, // todo
+				timeStamp:       timeStamp & 0xffffff,
+				timeStampExtend: uint8(timeStamp >> 24),
 				streamID:        0, // todo
 			},
 			mediat: mediaTag{
 				frameType:       frameType,
 				codecID:         header.CodecID,
 				avcPacketType:   header.AVCPacketType,
-				compositionTime: 0, // todo
+				compositionTime: header.CompositionTime,
 			},
 		}
+	case av.VIDEO_HEVC:
+		//h265的nalu都转换成4字节长度+nalu的格式
+		nalus := h264.ParseNalus(src)
+		if len(nalus) == 0 {
+			return nil, fmt.Errorf("invalid data")
+		}
+		frameType := uint8(av.FRAME_INTER)
+		size := 0
+		for _, nalu := range nalus {
+			naluType := h265.NaluType(nalu)
+			if h265.IsIRAP(naluType) || h265.IsParameterSet(naluType) {
+				frameType = uint8(av.FRAME_KEY)
+			}
+			size += 4 + len(nalu)
+		}
+		tag = &Tag{
+			flvt: flvTag{
+				fType:           av.TAG_VIDEO,
+				dataSize:        uint32(size),
+				timeStamp:       timeStamp & 0xffffff,
+				timeStampExtend: uint8(timeStamp >> 24),
+			},
+			mediat: mediaTag{
+				frameType:       frameType,
+				codecID:         header.CodecID,
+				avcPacketType:   header.AVCPacketType,
+				compositionTime: header.CompositionTime,
+				isExHeader:      header.IsExHeader,
+				exPacketType:    av.ExPacketTypeCodedFrames,
+			},
+		}
+		if header.CompositionTime == 0 {
+			tag.mediat.exPacketType = av.ExPacketTypeCodedFramesX
+		}
+		tagBuffer := muxerTagData(tag)
+		buffer := make([]byte, len(tagBuffer), len(tagBuffer)+size)
+		copy(buffer, tagBuffer)
+		for _, nalu := range nalus {
+			var length [4]byte
+			utils.PutU32BE(length[:], uint32(len(nalu)))
+			buffer = append(buffer, length[:]...)
+			buffer = append(buffer, nalu...)
+		}
+		return buffer, nil
+	case av.VIDEO_AV1, av.VIDEO_VP9:
+		//av1和vp9只能用Enhanced RTMP的扩展头发送，没有CompositionTime
+		if len(src) == 0 {
+			return nil, fmt.Errorf("invalid data")
+		}
+		frameType := uint8(av.FRAME_INTER)
+		if (header.CodecID == av.VIDEO_AV1 && av1.IsKeyFrame(src)) ||
+			(header.CodecID == av.VIDEO_VP9 && vp9.IsKeyFrame(src)) {
+			frameType = uint8(av.FRAME_KEY)
+		}
+		tag = &Tag{
+			flvt: flvTag{
+				fType:           av.TAG_VIDEO,
+				dataSize:        uint32(len(src)),
+				timeStamp:       timeStamp & 0xffffff,
+				timeStampExtend: uint8(timeStamp >> 24),
+			},
+			mediat: mediaTag{
+				frameType:     frameType,
+				codecID:       header.CodecID,
+				avcPacketType: av.AVC_NALU,
+				isExHeader:    true,
+				exPacketType:  av.ExPacketTypeCodedFrames,
+			},
+		}
+		//数据部分不需要长度前缀
+		tagBuffer := muxerTagData(tag)
+		buffer := make([]byte, len(tagBuffer)+len(src))
+		copy(buffer, tagBuffer)
+		copy(buffer[len(tagBuffer):], src)
+		return buffer, nil
 	case av.VIDEO_JPEG, av.VideoH263:
 		tag = &Tag{
 			flvt: flvTag{
 				fType:           av.TAG_VIDEO,
 				dataSize:        uint32(len(src)),
-				timeStamp:       timeStamp,
-				timeStampExtend: 0, // todo 这个需要处理一下
+				timeStamp:       timeStamp & 0xffffff,
+				timeStampExtend: uint8(timeStamp >> 24),
 				streamID:        0, //todo 这个需要设置
 			},
 			mediat: mediaTag{
@@ -608,7 +964,13 @@ func PackVideoData(header *av.VideoPacketHeader, streamID uint32, src []byte,
 // PackAudioData 打包音频数据
 func PackAudioData(ah *av.AudioPacketHeader, streamID uint32, src []byte,
 	timeStamp uint32) ([]byte, error) {
-	if ah.SoundFormat != av.SOUND_AAC {
+	soundRate, soundSize := ah.SoundRate, ah.SoundSize
+	switch ah.SoundFormat {
+	case av.SOUND_AAC, av.SOUND_OPUS, av.SOUND_MP3:
+	case av.SOUND_ALAW, av.SOUND_MULAW:
+		//g711固定为8kHz，flv中没有对应的采样率，和ffmpeg一样写0，采样长度写16bit
+		soundRate, soundSize = av.SOUND_RATE_5_5Khz, av.SOUND_16BIT
+	default:
 		return nil, fmt.Errorf("code %d not support", ah.SoundFormat)
 	}
 
@@ -616,16 +978,18 @@ func PackAudioData(ah *av.AudioPacketHeader, streamID uint32, src []byte,
 		flvt: flvTag{
 			fType:           av.TAG_AUDIO,
 			dataSize:        uint32(len(src)), //可能由上层协议作为一帧的分割，该字段没有效果
-			timeStamp:       timeStamp,
-			timeStampExtend: 0, //todo
+			timeStamp:       timeStamp & 0xffffff,
+			timeStampExtend: uint8(timeStamp >> 24),
 			streamID:        streamID,
 		},
 		mediat: mediaTag{
 			soundFormat:   ah.SoundFormat,
-			soundRate:     ah.SoundRate,
-			soundSize:     ah.SoundSize,
+			soundRate:     soundRate,
+			soundSize:     soundSize,
 			soundType:     ah.SoundType,
 			aacPacketType: av.AAC_RAW,
+			isExHeader:    ah.SoundFormat == av.SOUND_OPUS,
+			exPacketType:  av.AudioPacketTypeCodedFrames,
 		},
 	}
 	tagBuffer := muxerTagData(tag)
@@ -644,8 +1008,8 @@ func NewAACData(ah av.AudioPacketHeader, src []byte, timeStamp uint32) (buffer [
 		flvt: flvTag{
 			fType:           av.TAG_AUDIO,
 			dataSize:        uint32(len(src)), //可能由上层协议作为一帧的分割，该字段没有效果
-			timeStamp:       timeStamp,
-			timeStampExtend: 0,
+			timeStamp:       timeStamp & 0xffffff,
+			timeStampExtend: uint8(timeStamp >> 24),
 			streamID:        0,
 		},
 		mediat: mediaTag{
@@ -671,17 +1035,33 @@ func NewAACData(ah av.AudioPacketHeader, src []byte, timeStamp uint32) (buffer [
 //flvTag不能省略
 func muxerTagData(tag *Tag) []byte {
 	n := 0
-	buffer := make([]byte, 5) //16是按最大的长度来计算，aac有16个字节长度头
-	if tag.flvt.fType == av.TAG_VIDEO {
+	buffer := make([]byte, 8) //16是按最大的长度来计算，aac有16个字节长度头
+	if tag.flvt.fType == av.TAG_VIDEO && tag.mediat.isExHeader {
+		//扩展头 1bit|帧类型 3bit|包类型 4bit|FourCC 32bit
+		fourCC, _ := codecFourCC(tag.mediat.codecID)
+		buffer[n] = 0x80 | (tag.mediat.frameType&0x07)<<4 | (tag.mediat.exPacketType & 0x0F)
+		n++
+		n += copy(buffer[n:], fourCC)
+		if tag.mediat.codecID == av.VIDEO_HEVC && tag.mediat.exPacketType == av.ExPacketTypeCodedFrames {
+			utils.PutU24BE(buffer[n:], uint32(tag.mediat.compositionTime))
+			n += 3
+		}
+	} else if tag.flvt.fType == av.TAG_VIDEO {
 		buffer[n] = (tag.mediat.frameType << 4) | (tag.mediat.codecID & 0x0F) //帧类型 4bit 编码id 4bit
 		n++
-		if tag.mediat.codecID == av.VIDEO_H264 {
-			//如果是h264,有额外的封装
+		if tag.mediat.codecID == av.VIDEO_H264 || tag.mediat.codecID == av.VIDEO_HEVC {
+			//如果是h264或h265,有额外的封装
 			utils.PutU8(buffer[n:], tag.mediat.avcPacketType) //AVCPacketType 8bit
 			n++
 			utils.PutU24BE(buffer[n:], uint32(tag.mediat.compositionTime)) //CompositionTime 24bit
 			n += 3
 		}
+	} else if tag.flvt.fType == av.TAG_AUDIO && tag.mediat.isExHeader {
+		//扩展头 SoundFormat(9) 4bit|包类型 4bit|FourCC 32bit
+		fourCC, _ := audioCodecFourCC(tag.mediat.soundFormat)
+		buffer[n] = av.SOUND_EX_HEADER<<4 | (tag.mediat.exPacketType & 0x0F)
+		n++
+		n += copy(buffer[n:], fourCC)
 	} else if tag.flvt.fType == av.TAG_AUDIO {
 		//音频格式 4bit
 		//采样率 2bit
@@ -1 +1,253 @@
 package flv
+
+import (
+	"testing"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHEVCVideoHeader(t *testing.T) {
+	cases := []struct {
+		data       []byte
+		n          int
+		frameType  uint8
+		packetType uint8
+		cts        int32
+	}{
+		//CodecID 12的封装，和avc相同
+		{[]byte{0x1c, av.AVC_SEQHDR, 0, 0, 0, 1}, 5, av.FRAME_KEY, av.AVC_SEQHDR, 0},
+		{[]byte{0x2c, av.AVC_NALU, 0, 0, 40, 1}, 5, av.FRAME_INTER, av.AVC_NALU, 40},
+		//Enhanced RTMP
+		{[]byte{0x90 | av.ExPacketTypeSequenceStart, 'h', 'v', 'c', '1', 1}, 5, av.FRAME_KEY, av.AVC_SEQHDR, 0},
+		{[]byte{0x90 | av.ExPacketTypeCodedFrames, 'h', 'v', 'c', '1', 0xff, 0xff, 0xd8, 1}, 8, av.FRAME_KEY, av.AVC_NALU, -40},
+		{[]byte{0xa0 | av.ExPacketTypeCodedFramesX, 'h', 'v', 'c', '1', 1}, 5, av.FRAME_INTER, av.AVC_NALU, 0},
+	}
+	for _, c := range cases {
+		p := av.Packet{PacketType: av.PacketTypeVideo, Data: c.data}
+		assert.NoError(t, NewDemuxer().Demux(&p))
+		assert.Equal(t, uint8(av.VIDEO_HEVC), p.VHeader.CodecID)
+		assert.Equal(t, c.frameType, p.VHeader.FrameType)
+		assert.Equal(t, c.packetType, p.VHeader.AVCPacketType)
+		assert.Equal(t, c.cts, p.VHeader.CompositionTime)
+		assert.Equal(t, c.data[c.n:], p.Data)
+	}
+
+	var tag Tag
+	_, err := tag.ParseVideoHeader([]byte{0x91, 'x', 'x', 'x', 'x', 1})
+	assert.Error(t, err)
+}
+
+func TestPackHEVCVideoData(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90,
+		0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	sps := []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93,
+		0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00, 0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98, 0x04}
+	pps := []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+
+	data, err := NewHEVCSequenceHeader(vps, sps, pps, 0)
+	assert.NoError(t, err)
+	p := av.Packet{PacketType: av.PacketTypeVideo, Data: data}
+	assert.NoError(t, NewDemuxer().Demux(&p))
+	assert.True(t, p.VHeader.IsSeqHeader())
+	vpss, spss, ppss, err := ParseHEVCSequenceHeader(p.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{vps}, vpss)
+	assert.Equal(t, [][]byte{sps}, spss)
+	assert.Equal(t, [][]byte{pps}, ppss)
+
+	//IRAP帧标记为关键帧，annexb转换成4字节长度+nalu
+	header := av.VideoPacketHeader{CodecID: av.VIDEO_HEVC, AVCPacketType: av.AVC_NALU}
+	data, err = PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x26, 0x01, 0xaf, 0, 0, 1, 0x02, 0x01, 0xd0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1c, av.AVC_NALU, 0, 0, 0, 0, 0, 0, 3, 0x26, 0x01, 0xaf, 0, 0, 0, 3, 0x02, 0x01, 0xd0}, data)
+
+	data, err = PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x02, 0x01, 0xd0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x2c), data[0])
+}
+
+func TestParseExVideoHeader(t *testing.T) {
+	cases := []struct {
+		data       []byte
+		n          int
+		codecID    uint8
+		frameType  uint8
+		packetType uint8
+		exType     uint8
+	}{
+		{[]byte{0x90 | av.ExPacketTypeSequenceStart, 'a', 'v', '0', '1', 0x81}, 5, av.VIDEO_AV1, av.FRAME_KEY, av.AVC_SEQHDR, av.ExPacketTypeSequenceStart},
+		{[]byte{0x90 | av.ExPacketTypeMPEG2TSSequenceStart, 'a', 'v', '0', '1', 0x80}, 5, av.VIDEO_AV1, av.FRAME_KEY, av.AVC_SEQHDR, av.ExPacketTypeMPEG2TSSequenceStart},
+		//av1和vp9的CodedFrames没有CompositionTime
+		{[]byte{0xa0 | av.ExPacketTypeCodedFrames, 'v', 'p', '0', '9', 0x12}, 5, av.VIDEO_VP9, av.FRAME_INTER, av.AVC_NALU, av.ExPacketTypeCodedFrames},
+		{[]byte{0xd0 | av.ExPacketTypeMetadata, 'h', 'v', 'c', '1', 0x02}, 5, av.VIDEO_HEVC, 5, av.AVC_NALU, av.ExPacketTypeMetadata},
+		//ModEx之后才是真正的包类型
+		{[]byte{0x90 | av.ExPacketTypeModEx, 2, 0, 0, 1, av.ExPacketTypeCodedFramesX, 'h', 'v', 'c', '1', 0x26}, 10, av.VIDEO_HEVC, av.FRAME_KEY, av.AVC_NALU, av.ExPacketTypeCodedFramesX},
+	}
+	for _, c := range cases {
+		p := av.Packet{PacketType: av.PacketTypeVideo, Data: c.data}
+		assert.NoError(t, NewDemuxer().Demux(&p))
+		assert.True(t, p.VHeader.IsExHeader)
+		assert.Equal(t, c.codecID, p.VHeader.CodecID)
+		assert.Equal(t, c.frameType, p.VHeader.FrameType)
+		assert.Equal(t, c.packetType, p.VHeader.AVCPacketType)
+		assert.Equal(t, c.exType, p.VHeader.ExPacketType)
+		assert.Equal(t, c.data[c.n:], p.Data)
+	}
+	assert.True(t, av.VideoPacketHeader{IsExHeader: true, ExPacketType: av.ExPacketTypeMetadata}.IsMetadataFrame())
+
+	var tag Tag
+	_, err := tag.ParseVideoHeader([]byte{0x90 | av.ExPacketTypeMultitrack, 'h', 'v', 'c', '1', 0})
+	assert.Error(t, err)
+	_, err = tag.ParseVideoHeader([]byte{0x90 | av.ExPacketTypeModEx, 8, 0, 0, 1})
+	assert.Error(t, err)
+}
+
+func TestPackExVideoData(t *testing.T) {
+	data, err := NewExSequenceHeader(av.VIDEO_HEVC, []byte{1, 2, 3}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x90 | av.ExPacketTypeSequenceStart, 'h', 'v', 'c', '1', 1, 2, 3}, data)
+	_, err = NewExSequenceHeader(av.VIDEO_H264, []byte{1, 2, 3}, 0)
+	assert.Error(t, err)
+
+	header := av.VideoPacketHeader{CodecID: av.VIDEO_HEVC, AVCPacketType: av.AVC_NALU, IsExHeader: true}
+	data, err = PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x02, 0x01, 0xd0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xa0 | av.ExPacketTypeCodedFramesX, 'h', 'v', 'c', '1', 0, 0, 0, 3, 0x02, 0x01, 0xd0}, data)
+
+	header.CompositionTime = 40
+	data, err = PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x26, 0x01, 0xaf}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x90 | av.ExPacketTypeCodedFrames, 'h', 'v', 'c', '1', 0, 0, 40, 0, 0, 0, 3, 0x26, 0x01, 0xaf}, data)
+}
+
+func TestPackAV1VP9VideoData(t *testing.T) {
+	header := av.VideoPacketHeader{CodecID: av.VIDEO_AV1}
+	frame := []byte{0x12, 0x00, 0x32, 0x02, 0x10, 0x00}
+	data, err := PackVideoData(&header, 0, frame, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte{0x90 | av.ExPacketTypeCodedFrames, 'a', 'v', '0', '1'}, frame...), data)
+
+	p := av.Packet{PacketType: av.PacketTypeVideo, Data: data}
+	assert.NoError(t, NewDemuxer().Demux(&p))
+	assert.Equal(t, uint8(av.VIDEO_AV1), p.VHeader.CodecID)
+	assert.Equal(t, uint8(av.FRAME_KEY), p.VHeader.FrameType)
+	assert.False(t, p.VHeader.IsSeqHeader())
+	assert.Equal(t, frame, p.Data)
+
+	header.CodecID = av.VIDEO_VP9
+	frame = []byte{0x86, 0x00}
+	data, err = PackVideoData(&header, 0, frame, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte{0xa0 | av.ExPacketTypeCodedFrames, 'v', 'p', '0', '9'}, frame...), data)
+}
+
+func TestOpusAudioTag(t *testing.T) {
+	head := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2, 0x38, 0x01, 0x80, 0xbb, 0, 0, 0, 0, 0}
+	data := NewOpusSequenceHeader(head, 0)
+	assert.Equal(t, []byte{0x90 | av.AudioPacketTypeSequenceStart, 'O', 'p', 'u', 's'}, data[:5])
+	p := av.Packet{PacketType: av.PacketTypeAudio, Data: data}
+	assert.NoError(t, NewDemuxer().Demux(&p))
+	assert.Equal(t, uint8(av.SOUND_OPUS), p.AHeader.SoundFormat)
+	assert.True(t, p.AHeader.IsExHeader)
+	assert.True(t, p.AHeader.IsSeqHeader())
+	assert.Equal(t, head, p.Data)
+
+	header := av.AudioPacketHeader{SoundFormat: av.SOUND_OPUS}
+	data, err := PackAudioData(&header, 0, []byte{0xfc, 0x01}, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x90 | av.AudioPacketTypeCodedFrames, 'O', 'p', 'u', 's', 0xfc, 0x01}, data)
+	p = av.Packet{PacketType: av.PacketTypeAudio, Data: data}
+	assert.NoError(t, NewDemuxer().Demux(&p))
+	assert.False(t, p.AHeader.IsSeqHeader())
+	assert.Equal(t, uint8(av.AAC_RAW), p.AHeader.AACPacketType)
+	assert.Equal(t, []byte{0xfc, 0x01}, p.Data)
+
+	//ModEx之后才是真正的包类型
+	p = av.Packet{PacketType: av.PacketTypeAudio,
+		Data: []byte{0x90 | av.AudioPacketTypeModEx, 0x00, 0x00, av.AudioPacketTypeCodedFrames, 'O', 'p', 'u', 's', 0xfc}}
+	assert.NoError(t, NewDemuxer().Demux(&p))
+	assert.Equal(t, uint8(av.AudioPacketTypeCodedFrames), p.AHeader.ExPacketType)
+	assert.Equal(t, []byte{0xfc}, p.Data)
+
+	var tag Tag
+	_, err = tag.ParseAudioHeader([]byte{0x91, 'x', 'x', 'x', 'x', 1})
+	assert.Error(t, err)
+}
+
+func TestPackG711AudioData(t *testing.T) {
+	//g711的采样率固定写0，采样长度写16bit
+	header := av.AudioPacketHeader{SoundFormat: av.SOUND_ALAW, SoundRate: av.SOUND_RATE_8Khz, SoundType: av.SOUND_MONO}
+	data, err := PackAudioData(&header, 0, []byte{0xd5, 0x55}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x72, 0xd5, 0x55}, data)
+
+	header.SoundFormat = av.SOUND_MULAW
+	data, err = PackAudioData(&header, 0, []byte{0xff}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x82, 0xff}, data)
+	p := av.Packet{PacketType: av.PacketTypeAudio, Data: data}
+	assert.NoError(t, NewDemuxer().Demux(&p))
+	assert.Equal(t, uint8(av.SOUND_MULAW), p.AHeader.SoundFormat)
+	assert.Equal(t, []byte{0xff}, p.Data)
+
+	header.SoundFormat = av.SOUND_SPEEX
+	_, err = PackAudioData(&header, 0, []byte{0xff}, 0)
+	assert.Error(t, err)
+}
+
+func TestPackH264CompositionTime(t *testing.T) {
+	header := av.VideoPacketHeader{CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_NALU, CompositionTime: 80}
+	data, err := PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}, 40)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x27, av.AVC_NALU, 0, 0, 80}, data[:5])
+
+	p := av.Packet{PacketType: av.PacketTypeVideo, Data: data}
+	assert.NoError(t, NewDemuxer().DemuxH(&p))
+	assert.Equal(t, int32(80), p.VHeader.CompositionTime)
+
+	header.CompositionTime = -40
+	data, err = PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}, 40)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0xff, 0xd8}, data[2:5])
+}
+
+func TestFlvTagMarshal(t *testing.T) {
+	tag := flvTag{fType: av.TAG_VIDEO, dataSize: 300, timeStamp: 0x345678, timeStampExtend: 0x12}
+	var h [TagHeaderLen]byte
+	tag.marshal(h[:])
+	assert.Equal(t, []byte{av.TAG_VIDEO, 0, 0x01, 0x2c, 0x34, 0x56, 0x78, 0x12, 0, 0, 0}, h[:])
+}
+
+func TestIsDisposable(t *testing.T) {
+	cases := []struct {
+		codecID uint8
+		nalu    []byte
+		expect  bool
+	}{
+		{av.VIDEO_H264, []byte{0x41, 0x9a, 0x02}, false}, //nal_ref_idc为2的P帧
+		{av.VIDEO_H264, []byte{0x01, 0x9e, 0x02}, true},  //nal_ref_idc为0的B帧
+		{av.VIDEO_H264, []byte{0x06, 0x05, 0x01}, false}, //只有sei
+		{av.VIDEO_HEVC, []byte{0x02, 0x01, 0xd0}, false}, //TRAIL_R
+		{av.VIDEO_HEVC, []byte{0x00, 0x01, 0xd0}, true},  //TRAIL_N
+		{av.VIDEO_HEVC, []byte{0x1e, 0x01, 0xd0}, false}, //RSV_VCL_R15
+	}
+	for i, c := range cases {
+		header := av.VideoPacketHeader{FrameType: av.FRAME_INTER, CodecID: c.codecID, AVCPacketType: av.AVC_NALU}
+		data, err := PackVideoData(&header, 0, append([]byte{0, 0, 0, 1}, c.nalu...), 40)
+		assert.NoError(t, err)
+		p := av.Packet{PacketType: av.PacketTypeVideo, Data: data}
+		assert.NoError(t, NewDemuxer().DemuxH(&p))
+		assert.Equal(t, c.expect, IsDisposable(&p), "case %d", i)
+	}
+
+	//标记为关键帧的不丢弃
+	header := av.VideoPacketHeader{FrameType: av.FRAME_INTER, CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_NALU}
+	data, err := PackVideoData(&header, 0, []byte{0, 0, 0, 1, 0x01, 0x9e, 0x02}, 40)
+	assert.NoError(t, err)
+	p := av.Packet{PacketType: av.PacketTypeVideo, Data: data}
+	assert.NoError(t, NewDemuxer().DemuxH(&p))
+	p.VHeader.FrameType = av.FRAME_KEY
+	assert.False(t, IsDisposable(&p))
+}
@@ -11,27 +11,69 @@ const (
 	tsPacketLen      = 188
 	h264DefaultHZ    = 90
 
-	videoPID = 0x100
-	audioPID = 0x101
-	videoSID = 0xe0
-	audioSID = 0xc0
+	videoPID   = 0x100
+	audioPID   = 0x101
+	videoSID   = 0xe0
+	audioSID   = 0xc0
+	privateSID = 0xbd //private_stream_1，opus使用
+
+	streamTypeH264    = 0x1b
+	streamTypeHEVC    = 0x24
+	streamTypeAAC     = 0x0f
+	streamTypeMP3     = 0x03 //MPEG-1 audio
+	streamTypeMP3LSF  = 0x04 //MPEG-2 audio，低采样率的mp3
+	streamTypePrivate = 0x06 //PES private data，opus使用，通过registration descriptor区分
+	streamTypeG711    = 0x90 //GB/T 28181中定义的g711，海康等国内摄像机使用
 )
 
 type Muxer struct {
-	videoCc  byte
-	audioCc  byte
-	patCc    byte
-	pmtCc    byte
-	pat      [tsPacketLen]byte
-	pmt      [tsPacketLen]byte
-	tsPacket [tsPacketLen]byte
+	videoCodec    byte
+	audioChannels byte
+	audioRate     int
+	videoCc       byte
+	audioCc       byte
+	patCc         byte
+	pmtCc         byte
+	pat           [tsPacketLen]byte
+	pmt           [tsPacketLen]byte
+	tsPacket      [tsPacketLen]byte
 }
 
 func NewMuxer() *Muxer {
 	return &Muxer{}
 }
 
+//SetVideoCodec 设置视频的编码id，用于生成pmt中的流类型，默认为h264
+func (muxer *Muxer) SetVideoCodec(codecID byte) {
+	muxer.videoCodec = codecID
+}
+
+//SetAudioChannels 设置音频的声道数，opus需要在pmt的extension descriptor中描述，默认为2
+func (muxer *Muxer) SetAudioChannels(channels byte) {
+	muxer.audioChannels = channels
+}
+
+//SetAudioSampleRate 设置音频的采样率，mp3根据采样率区分MPEG-1和MPEG-2的流类型
+func (muxer *Muxer) SetAudioSampleRate(sampleRate int) {
+	muxer.audioRate = sampleRate
+}
+
+//Mux 封装一帧数据，pts和dts根据p.TimeStamp和CompositionTime计算
 func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
+	dts := int64(p.TimeStamp) * int64(h264DefaultHZ)
+	pts := dts
+	if p.PacketType == av.PacketTypeVideo {
+		pts = dts + int64(p.VHeader.CompositionTime)*int64(h264DefaultHZ)
+		//CompositionTime可以为负数，pts不能小于0
+		if pts < 0 {
+			pts = 0
+		}
+	}
+	return muxer.MuxTs(p, pts, dts, w)
+}
+
+//MuxTs 使用指定的pts和dts(90kHz)封装，p.TimeStamp回绕时由调用方提供展开后的时间戳
+func (muxer *Muxer) MuxTs(p *av.Packet, pts, dts int64, w io.Writer) error {
 	first := true
 	wBytes := 0
 	pesIndex := 0
@@ -39,13 +81,9 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 	dataLen := byte(0)
 
 	var pes pesHeader
-	dts := int64(p.TimeStamp) * int64(h264DefaultHZ)
-	pts := dts
 	pid := audioPID
-	var videoH av.VideoPacketHeader
 	if p.PacketType == av.PacketTypeVideo {
 		pid = videoPID
-		pts = dts + int64(p.VHeader.CompositionTime)*int64(h264DefaultHZ)
 	}
 	err := pes.packet(p, pts, dts)
 	if err != nil {
@@ -97,7 +135,7 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 
 		//关键帧需要加pcr
 		if first && p.PacketType == av.PacketTypeVideo &&
-			videoH.FrameType == av.FRAME_KEY {
+			p.VHeader.FrameType == av.FRAME_KEY {
 			muxer.tsPacket[3] |= 0x20
 			muxer.tsPacket[i] = 7
 			i++
@@ -205,12 +243,17 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	pmtHeader := []byte{0x02, 0xb0, 0xff, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
 	if !hasVideo {
 		pmtHeader[9] = 0x01
-		progInfo = []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
 	} else {
-		progInfo = []byte{0x1b, 0xe1, 0x00, 0xf0, 0x00, //h264 or h265*
-			0x0f, 0xe1, 0x01, 0xf0, 0x00, //mp3 or aac
+		videoType := byte(streamTypeH264)
+		if muxer.videoCodec == av.VIDEO_HEVC {
+			videoType = streamTypeHEVC
 		}
+		progInfo = []byte{videoType, 0xe1, 0x00, 0xf0, 0x00}
 	}
+	audioType, descriptors := muxer.audioStreamInfo(soundFormat)
+	progInfo = append(progInfo, audioType, 0xe1, 0x01,
+		0xf0|byte(len(descriptors)>>8), byte(len(descriptors)))
+	progInfo = append(progInfo, descriptors...)
 	pmtHeader[2] = byte(len(progInfo) + 9 + 4)
 
 	if muxer.pmtCc > 0xf {
@@ -219,15 +262,6 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	tsHeader[3] |= muxer.pmtCc & 0x0f
 	muxer.pmtCc++
 
-	if soundFormat == 2 ||
-		soundFormat == 14 {
-		if hasVideo {
-			progInfo[5] = 0x4
-		} else {
-			progInfo[0] = 0x4
-		}
-	}
-
 	copy(muxer.pmt[i:], tsHeader)
 	i += len(tsHeader)
 
@@ -255,6 +289,30 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	return muxer.pmt[0:]
 }
 
+//audioStreamInfo 返回音频在pmt中的流类型和描述符
+func (muxer *Muxer) audioStreamInfo(soundFormat byte) (byte, []byte) {
+	switch soundFormat {
+	case av.SOUND_MP3:
+		//MPEG-2和MPEG-2.5的采样率低于32kHz，未设置采样率时按MPEG-1处理
+		if muxer.audioRate > 0 && muxer.audioRate < 32000 {
+			return streamTypeMP3LSF, nil
+		}
+		return streamTypeMP3, nil
+	case av.SOUND_MP3_8KHZ:
+		return streamTypeMP3LSF, nil
+	case av.SOUND_ALAW, av.SOUND_MULAW:
+		return streamTypeG711, nil
+	case av.SOUND_OPUS:
+		channels := muxer.audioChannels
+		if channels == 0 {
+			channels = 2
+		}
+		//registration descriptor(Opus) + extension descriptor(opus_audio_descriptor, channel_config_code)
+		return streamTypePrivate, []byte{0x05, 0x04, 'O', 'p', 'u', 's', 0x7f, 0x02, 0x80, channels}
+	}
+	return streamTypeAAC, nil
+}
+
 func (muxer *Muxer) adaptationBufInit(src []byte, remainBytes byte) {
 	src[0] = byte(remainBytes - 1)
 	if remainBytes == 1 {
@@ -302,6 +360,8 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	sid := audioSID
 	if p.PacketType == av.PacketTypeVideo {
 		sid = videoSID
+	} else if p.AHeader.SoundFormat == av.SOUND_OPUS {
+		sid = privateSID
 	}
 	header.data[i] = byte(sid)
 	i++
@@ -344,9 +404,8 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 
 func (header *pesHeader) writeTs(src []byte, i int, fb int, ts int64) {
 	val := uint32(0)
-	if ts > 0x1ffffffff {
-		ts -= 0x1ffffffff
-	}
+	//pts和dts只有33位，超过后回绕
+	ts &= 0x1ffffffff
 	val = uint32(fb<<4) | ((uint32(ts>>30) & 0x07) << 1) | 1
 	src[i] = byte(val)
 	i++
@@ -50,3 +50,86 @@ func TestTSEncoder(t *testing.T) {
 		0x80, 0x00, 0x5b, 0xb7, 0x78, 0x00, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x38, 0x30, 0x00,
 		0x06, 0x00, 0x38})
 }
+
+func TestPMTVideoStreamType(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	//默认为h264
+	at.Equal(byte(0x1b), m.PMT(av.SOUND_AAC, true)[17])
+	m.SetVideoCodec(av.VIDEO_HEVC)
+	pmt := m.PMT(av.SOUND_AAC, true)
+	at.Equal(byte(0x24), pmt[17])
+	at.Equal(byte(0x0f), pmt[22])
+	//crc覆盖的内容改变
+	crc := GenCrc32(pmt[5:27])
+	at.Equal([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}, pmt[27:31])
+}
+
+func TestPMTOpus(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	m.SetAudioChannels(1)
+	pmt := m.PMT(av.SOUND_OPUS, true)
+	//audio es: stream_type 0x06，es_info_length 10
+	at.Equal([]byte{0x06, 0xe1, 0x01, 0xf0, 0x0a}, pmt[22:27])
+	at.Equal([]byte{0x05, 0x04, 'O', 'p', 'u', 's', 0x7f, 0x02, 0x80, 0x01}, pmt[27:37])
+	at.Equal(byte(33), pmt[7])
+	crc := GenCrc32(pmt[5:37])
+	at.Equal([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}, pmt[37:41])
+
+	//opus的pes使用private_stream_1
+	w := &TestWriter{}
+	p := av.Packet{
+		PacketType: av.PacketTypeAudio,
+		AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_OPUS},
+		Data:       []byte{0x7f, 0xe0, 0x02, 0xfc, 0x01},
+	}
+	at.Nil(m.Mux(&p, w))
+	at.Equal([]byte{0x00, 0x00, 0x01, 0xbd}, w.buf[tsPacketLen-len(p.Data)-14:tsPacketLen-len(p.Data)-10])
+}
+
+func TestPMTAudioStreamType(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	//默认按MPEG-1处理
+	at.Equal(byte(0x03), m.PMT(av.SOUND_MP3, true)[22])
+	at.Equal(byte(0x03), m.PMT(av.SOUND_MP3, false)[17])
+	m.SetAudioSampleRate(22050)
+	at.Equal(byte(0x04), m.PMT(av.SOUND_MP3, true)[22])
+	at.Equal(byte(0x04), m.PMT(av.SOUND_MP3_8KHZ, true)[22])
+	at.Equal(byte(0x0f), m.PMT(av.SOUND_AAC, true)[22])
+	at.Equal(byte(0x90), m.PMT(av.SOUND_ALAW, true)[22])
+	at.Equal(byte(0x90), m.PMT(av.SOUND_MULAW, false)[17])
+}
+
+//readTs 解析pes头中的33位时间戳
+func readTs(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func TestPESPtsDts(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	w := &TestWriter{}
+	p := av.Packet{
+		PacketType: av.PacketTypeVideo,
+		TimeStamp:  1000,
+		VHeader:    av.VideoPacketHeader{CodecID: av.VIDEO_H264, CompositionTime: 80},
+		Data:       make([]byte, 100),
+	}
+	at.Nil(m.Mux(&p, w))
+	//有adaptation field，pes头在填充之后
+	pes := w.buf[188-len(p.Data)-19:]
+	at.Equal([]byte{0, 0, 1, 0xe0}, pes[:4])
+	at.Equal(byte(0xc0), pes[7])
+	at.Equal(int64(1080*90), readTs(pes[9:]))
+	at.Equal(int64(1000*90), readTs(pes[14:]))
+
+	//CompositionTime为0时只写pts
+	p.VHeader.CompositionTime = 0
+	p.Data = make([]byte, 100)
+	at.Nil(m.Mux(&p, w))
+	pes = w.buf[188-len(p.Data)-14:]
+	at.Equal(byte(0x80), pes[7])
+	at.Equal(int64(1000*90), readTs(pes[9:]))
+}
@@ -24,6 +24,8 @@ func handleVideoPacket(pkt *av.Packet) {
 		default:
 			//忽略
 		}
+	case av.VIDEO_HEVC:
+		fmt.Printf("receive h265 pkt... nalu type:%d\n", (pkt.Data[0]>>1)&0x3f)
 	case av.VIDEO_JPEG:
 		fmt.Println("receive jpeg pkt... ", len(pkt.Data))
 	default:
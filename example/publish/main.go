@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"time"
 
 	"github.com/fabo871218/srtmp"
 	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
 )
 
 var startCode []byte = []byte{0x00, 0x00, 0x00, 0x01}
@@ -104,9 +106,41 @@ func PushJPEG(client *srtmp.RtmpClient) {
 	}
 }
 
+//PushFLV 按照文件中的时间戳实时推送flv文件
+func PushFLV(client *srtmp.RtmpClient, path string) {
+	reader, err := flv.OpenFile(path)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	var start time.Time
+	var firstTs uint32
+	for {
+		var pkt av.Packet
+		if err := reader.Read(&pkt); err != nil {
+			if err != io.EOF {
+				fmt.Println("Read flv file failed, err:", err)
+			}
+			return
+		}
+		if start.IsZero() {
+			start, firstTs = time.Now(), pkt.TimeStamp
+		} else if pkt.TimeStamp > firstTs {
+			if d := time.Duration(pkt.TimeStamp-firstTs)*time.Millisecond - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if err := client.SendTag(&pkt); err != nil {
+			panic(err)
+		}
+	}
+}
+
 func main() {
 	host := flag.String("host", "", "rtmp server host")
 	port := flag.Int("port", 1935, "rtmp server port")
+	file := flag.String("file", "", "flv file to publish, publish jpeg images if empty")
 	flag.Parse()
 
 	api := srtmp.NewAPI()
@@ -117,5 +151,9 @@ func main() {
 		panic(err)
 	}
 
+	if *file != "" {
+		PushFLV(client, *file)
+		return
+	}
 	PushJPEG(client)
 }
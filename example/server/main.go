@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/fabo871218/srtmp"
+	"github.com/fabo871218/srtmp/container/flv"
 )
 
 // import (
@@ -138,6 +143,12 @@ import (
 
 func main() {
 	port := flag.Int("port", 1935, "rtmp server port")
+	hlsAddr := flag.String("hls-addr", "", "HLS server listen address, disabled if empty")
+	flvAddr := flag.String("httpflv-addr", "", "HTTP-FLV server listen address, disabled if empty")
+	operAddr := flag.String("manage-addr", "", "HTTP manage interface listen address, disabled if empty")
+	recordPath := flag.String("record-path", "", "FLV record path template, e.g. ./record/{app}/{name}_{time}.flv, disabled if empty")
+	vodDir := flag.String("vod-dir", "", "directory of recorded flv files for vod, disabled if empty")
+	recordDuration := flag.Duration("record-duration", 0, "max duration of each record file, 0 means no limit")
 	flag.Parse()
 
 	defer func() {
@@ -146,9 +157,50 @@ func main() {
 			time.Sleep(time.Second * 1)
 		}
 	}()
-	api := srtmp.NewAPI()
+	var opts []srtmp.SettingFunc
+	if *recordPath != "" {
+		opts = append(opts, srtmp.WithRecorder(flv.RecorderConfig{
+			PathTemplate: *recordPath,
+			MaxDuration:  *recordDuration,
+		}))
+	}
+	if *vodDir != "" {
+		opts = append(opts, srtmp.WithVOD(*vodDir))
+	}
+	api := srtmp.NewAPI(opts...)
+	if *hlsAddr != "" {
+		go func() {
+			if err := api.ServeHLS(*hlsAddr); err != nil {
+				fmt.Println("Serve hls failed, err:", err)
+			}
+		}()
+	}
+	if *flvAddr != "" {
+		go func() {
+			if err := api.ServeHTTPFlv(*flvAddr); err != nil {
+				fmt.Println("Serve http-flv failed, err:", err)
+			}
+		}()
+	}
 	addr := fmt.Sprintf(":%d", *port)
-	if err := api.ServeRtmp(addr); err != nil {
+	if *operAddr != "" {
+		go func() {
+			if err := api.ServeHTTPOpera(*operAddr, addr); err != nil {
+				fmt.Println("Serve http opera failed, err:", err)
+			}
+		}()
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := api.Shutdown(ctx); err != nil {
+			fmt.Println("Shutdown rtmp server failed, err:", err)
+		}
+	}()
+	if err := api.ServeRtmp(addr); err != nil && err != srtmp.ErrServerClosed {
 		fmt.Println("Servr rtmp failed, err:", err)
 		return
 	}
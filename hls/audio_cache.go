@@ -1,44 +1,45 @@
-// package hls
-
-// import "bytes"
-
-// const (
-// 	cache_max_frames byte = 6
-// 	audio_cache_len  int  = 10 * 1024
-// )
-
-// type audioCache struct {
-// 	soundFormat byte
-// 	num         byte
-// 	offset      int
-// 	pts         uint64
-// 	buf         *bytes.Buffer
-// }
-
-// func newAudioCache() *audioCache {
-// 	return &audioCache{
-// 		buf: bytes.NewBuffer(make([]byte, audio_cache_len)),
-// 	}
-// }
-
-// func (a *audioCache) Cache(src []byte, pts uint64) bool {
-// 	if a.num == 0 {
-// 		a.offset = 0
-// 		a.pts = pts
-// 		a.buf.Reset()
-// 	}
-// 	a.buf.Write(src)
-// 	a.offset += len(src)
-// 	a.num++
-
-// 	return false
-// }
-
-// func (a *audioCache) GetFrame() (int, uint64, []byte) {
-// 	a.num = 0
-// 	return a.offset, a.pts, a.buf.Bytes()
-// }
-
-// func (a *audioCache) CacheNum() byte {
-// 	return a.num
-// }
+package hls
+
+import "bytes"
+
+const (
+	cacheMaxFrames byte = 6
+	audioCacheLen  int  = 10 * 1024
+)
+
+//audioCache 缓存多个音频帧，合并成一个pes包写入ts
+type audioCache struct {
+	soundFormat byte
+	num         byte
+	offset      int
+	pts         uint64
+	buf         *bytes.Buffer
+}
+
+func newAudioCache() *audioCache {
+	return &audioCache{
+		buf: bytes.NewBuffer(make([]byte, audioCacheLen)),
+	}
+}
+
+func (a *audioCache) Cache(src []byte, pts uint64) bool {
+	if a.num == 0 {
+		a.offset = 0
+		a.pts = pts
+		a.buf.Reset()
+	}
+	a.buf.Write(src)
+	a.offset += len(src)
+	a.num++
+
+	return false
+}
+
+func (a *audioCache) GetFrame() (int, uint64, []byte) {
+	a.num = 0
+	return a.offset, a.pts, a.buf.Bytes()
+}
+
+func (a *audioCache) CacheNum() byte {
+	return a.num
+}
@@ -1,156 +1,224 @@
-// package hls
-
-// import (
-// 	"errors"
-// 	"fmt"
-// 	"net"
-// 	"net/http"
-// 	"path"
-// 	"strconv"
-// 	"strings"
-// 	"time"
-
-// 	cmap "github.com/orcaman/concurrent-map"
-// 	"github.com/fabo871218/srtmp/av"
-// )
-
-// const (
-// 	duration = 3000
-// )
-
-// var (
-// 	ErrNoPublisher         = errors.New("No publisher")
-// 	ErrInvalidReq          = errors.New("invalid req url path")
-// 	ErrNoSupportVideoCodec = errors.New("no support video codec")
-// 	ErrNoSupportAudioCodec = errors.New("no support audio codec")
-// )
-
-// var crossdomainxml = []byte(`<?xml version="1.0" ?>
-// <cross-domain-policy>
-// 	<allow-access-from domain="*" />
-// 	<allow-http-request-headers-from domain="*" headers="*"/>
-// </cross-domain-policy>`)
-
-// type Server struct {
-// 	listener net.Listener
-// 	conns    cmap.ConcurrentMap
-// }
-
-// func NewServer() *Server {
-// 	ret := &Server{
-// 		conns: cmap.New(),
-// 	}
-// 	go ret.checkStop()
-// 	return ret
-// }
-
-// func (server *Server) Serve(listener net.Listener) error {
-// 	mux := http.NewServeMux()
-// 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-// 		server.handle(w, r)
-// 	})
-// 	server.listener = listener
-// 	http.Serve(listener, mux)
-// 	return nil
-// }
-
-// func (server *Server) NewWriter(streamInfo av.StreamInfo) (av.WriteCloser, error) {
-// 	var s *Source
-// 	ok := server.conns.Has(streamInfo.Key)
-// 	if !ok {
-// 		s = NewSource(streamInfo)
-// 		server.conns.Set(streamInfo.Key, s)
-// 	} else {
-// 		v, _ := server.conns.Get(streamInfo.Key)
-// 		s = v.(*Source)
-// 	}
-// 	return s, nil
-// }
-
-// func (server *Server) getConn(key string) *Source {
-// 	v, ok := server.conns.Get(key)
-// 	if !ok {
-// 		return nil
-// 	}
-// 	return v.(*Source)
-// }
-
-// func (server *Server) checkStop() {
-// 	for {
-// 		<-time.After(5 * time.Second)
-// 		for item := range server.conns.IterBuffered() {
-// 			v := item.Val.(*Source)
-// 			if !v.Alive() {
-// 				server.conns.Remove(item.Key)
-// 			}
-// 		}
-// 	}
-// }
-
-// func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
-// 	if path.Base(r.URL.Path) == "crossdomain.xml" {
-// 		w.Header().Set("Content-Type", "application/xml")
-// 		w.Write(crossdomainxml)
-// 		return
-// 	}
-// 	switch path.Ext(r.URL.Path) {
-// 	case ".m3u8":
-// 		key, _ := server.parseM3u8(r.URL.Path)
-// 		conn := server.getConn(key)
-// 		if conn == nil {
-// 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
-// 			return
-// 		}
-// 		tsCache := conn.GetCacheInc()
-// 		if tsCache == nil {
-// 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
-// 			return
-// 		}
-// 		body, err := tsCache.GenM3U8PlayList()
-// 		if err != nil {
-// 			http.Error(w, err.Error(), http.StatusBadRequest)
-// 			return
-// 		}
-
-// 		w.Header().Set("Access-Control-Allow-Origin", "*")
-// 		w.Header().Set("Cache-Control", "no-cache")
-// 		w.Header().Set("Content-Type", "application/x-mpegURL")
-// 		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-// 		w.Write(body)
-// 	case ".ts":
-// 		key, _ := server.parseTs(r.URL.Path)
-// 		conn := server.getConn(key)
-// 		if conn == nil {
-// 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
-// 			return
-// 		}
-// 		tsCache := conn.GetCacheInc()
-// 		item, err := tsCache.GetItem(r.URL.Path)
-// 		if err != nil {
-// 			fmt.Printf("GetItem error: %v\n", err)
-// 			http.Error(w, err.Error(), http.StatusBadRequest)
-// 			return
-// 		}
-// 		w.Header().Set("Access-Control-Allow-Origin", "*")
-// 		w.Header().Set("Content-Type", "video/mp2ts")
-// 		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
-// 		w.Write(item.Data)
-// 	}
-// }
-
-// func (server *Server) parseM3u8(pathstr string) (key string, err error) {
-// 	pathstr = strings.TrimLeft(pathstr, "/")
-// 	key = strings.TrimRight(pathstr, path.Ext(pathstr))
-// 	return
-// }
-
-// func (server *Server) parseTs(pathstr string) (key string, err error) {
-// 	pathstr = strings.TrimLeft(pathstr, "/")
-// 	paths := strings.SplitN(pathstr, "/", 3)
-// 	if len(paths) != 3 {
-// 		err = fmt.Errorf("invalid path=%s", pathstr)
-// 		return
-// 	}
-// 	key = paths[0] + "/" + paths[1]
-// 	return
-// }
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+)
+
+const (
+	duration = 3000
+)
+
+var (
+	ErrNoPublisher         = errors.New("No publisher")
+	ErrInvalidReq          = errors.New("invalid req url path")
+	ErrNoSupportVideoCodec = errors.New("no support video codec")
+	ErrNoSupportAudioCodec = errors.New("no support audio codec")
+	ErrServerClosed        = errors.New("hls server closed")
+)
+
+var crossdomainxml = []byte(`<?xml version="1.0" ?>
+<cross-domain-policy>
+	<allow-access-from domain="*" />
+	<allow-http-request-headers-from domain="*" headers="*"/>
+</cross-domain-policy>`)
+
+//Server hls服务，为每一路发布的流创建一个Source，并通过http提供m3u8和ts
+type Server struct {
+	mutex      sync.Mutex
+	httpServer *http.Server
+	conns      map[string]*Source
+	closeOnce  sync.Once
+	closeChan  chan struct{}
+	logger     logger.Logger
+}
+
+//NewServer 创建一个hls服务
+func NewServer(log logger.Logger) *Server {
+	ret := &Server{
+		conns:     make(map[string]*Source),
+		closeChan: make(chan struct{}),
+		logger:    log,
+	}
+	go ret.checkStop()
+	return ret
+}
+
+//Serve 在listener上提供hls的http服务，Close之后返回http.ErrServerClosed
+func (server *Server) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		server.handle(w, r)
+	})
+	httpServer := &http.Server{Handler: mux}
+	server.mutex.Lock()
+	select {
+	case <-server.closeChan:
+		server.mutex.Unlock()
+		listener.Close()
+		return http.ErrServerClosed
+	default:
+	}
+	server.httpServer = httpServer
+	server.mutex.Unlock()
+	return httpServer.Serve(listener)
+}
+
+//Close 关闭http服务和所有Source，停止检查协程
+func (server *Server) Close() error {
+	if httpServer := server.stop(); httpServer != nil {
+		return httpServer.Close()
+	}
+	return nil
+}
+
+//Shutdown 关闭所有Source，等待正在处理的http请求完成，参考http.Server.Shutdown
+func (server *Server) Shutdown(ctx context.Context) error {
+	if httpServer := server.stop(); httpServer != nil {
+		return httpServer.Shutdown(ctx)
+	}
+	return nil
+}
+
+//stop 停止检查协程并关闭所有Source，返回需要关闭的http服务
+func (server *Server) stop() *http.Server {
+	server.closeOnce.Do(func() {
+		close(server.closeChan)
+	})
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for key, s := range server.conns {
+		s.Close()
+		delete(server.conns, key)
+	}
+	return server.httpServer
+}
+
+//NewWriter 实现protocol.WriterFactory，为发布的流创建hls输出
+func (server *Server) NewWriter(streamInfo protocol.StreamInfo) (protocol.WriteCloser, error) {
+	key := streamKey(streamInfo)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	select {
+	case <-server.closeChan:
+		return nil, ErrServerClosed
+	default:
+	}
+	if s, ok := server.conns[key]; ok && !s.isClosed() {
+		return s, nil
+	}
+	s := NewSource(streamInfo, server.logger)
+	server.conns[key] = s
+	return s, nil
+}
+
+func (server *Server) getConn(key string) *Source {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.conns[key]
+}
+
+func (server *Server) checkStop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-server.closeChan:
+			return
+		}
+		server.mutex.Lock()
+		for key, s := range server.conns {
+			if !s.Alive() {
+				s.Close()
+				delete(server.conns, key)
+			}
+		}
+		server.mutex.Unlock()
+	}
+}
+
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if path.Base(r.URL.Path) == "crossdomain.xml" {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(crossdomainxml)
+		return
+	}
+	switch path.Ext(r.URL.Path) {
+	case ".m3u8":
+		key, _ := server.parseM3u8(r.URL.Path)
+		conn := server.getConn(key)
+		if conn == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		tsCache := conn.GetCacheInc()
+		body, err := tsCache.GenM3U8PlayList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/x-mpegURL")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	case ".ts":
+		key, err := server.parseTs(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conn := server.getConn(key)
+		if conn == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		tsCache := conn.GetCacheInc()
+		item, err := tsCache.GetItem(r.URL.Path)
+		if err != nil {
+			server.logger.Debugf("GetItem failed, path:%s %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "video/mp2ts")
+		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
+		w.Write(item.Data)
+	default:
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+	}
+}
+
+func (server *Server) parseM3u8(pathstr string) (key string, err error) {
+	pathstr = strings.TrimLeft(pathstr, "/")
+	key = strings.TrimSuffix(pathstr, path.Ext(pathstr))
+	return
+}
+
+func (server *Server) parseTs(pathstr string) (key string, err error) {
+	pathstr = strings.TrimLeft(pathstr, "/")
+	paths := strings.SplitN(pathstr, "/", 3)
+	if len(paths) != 3 {
+		err = fmt.Errorf("invalid path=%s", pathstr)
+		return
+	}
+	key = paths[0] + "/" + paths[1]
+	return
+}
+
+func streamKey(info protocol.StreamInfo) string {
+	return info.App + "/" + info.Name
+}
@@ -0,0 +1,162 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+var testInfo = protocol.StreamInfo{App: "live", Name: "test"}
+
+func testLogger() logger.Logger {
+	return logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+}
+
+//aacPacket 44.1khz双声道aac，seq为true时是AudioSpecificConfig
+func aacPacket(ts uint32, seq bool) *av.Packet {
+	p := &av.Packet{PacketType: av.PacketTypeAudio, TimeStamp: ts}
+	if seq {
+		p.Data = []byte{0xaf, av.AAC_SEQHDR, 0x12, 0x10}
+	} else {
+		p.Data = []byte{0xaf, av.AAC_RAW, 0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c}
+	}
+	return p
+}
+
+func h264Packet(ts uint32, key, seq bool) *av.Packet {
+	p := &av.Packet{PacketType: av.PacketTypeVideo, TimeStamp: ts}
+	frameType := byte(av.FRAME_INTER)
+	if key || seq {
+		frameType = av.FRAME_KEY
+	}
+	switch {
+	case seq:
+		p.Data = append([]byte{frameType<<4 | av.VIDEO_H264, av.AVC_SEQHDR, 0, 0, 0},
+			0x01, 0x4d, 0x00, 0x1e, 0xff, 0xe1, 0x00, 0x17, 0x67, 0x4d, 0x00,
+			0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28, 0x28, 0x2f,
+			0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a, 0x01, 0x00,
+			0x04, 0x68, 0xde, 0x31, 0x12)
+	case key:
+		p.Data = []byte{frameType<<4 | av.VIDEO_H264, av.AVC_NALU, 0, 0, 0, 0, 0, 0, 3, 0x65, 0x88, 0x84}
+	default:
+		p.Data = []byte{frameType<<4 | av.VIDEO_H264, av.AVC_NALU, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}
+	}
+	return p
+}
+
+//waitSegments 等待发送协程生成n个分片，返回播放列表
+func waitSegments(t *testing.T, source *Source, n int) string {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if body, err := source.GetCacheInc().GenM3U8PlayList(); err == nil &&
+			bytes.Count(body, []byte("#EXTINF")) >= n {
+			return string(body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("wait %d segments timeout", n)
+	return ""
+}
+
+func TestSourceVideoSegments(t *testing.T) {
+	source := NewSource(testInfo, testLogger())
+	defer source.Close()
+	assert.Nil(t, source.Write(h264Packet(0, true, true)))
+	//每秒一个关键帧，分片时长超过3秒后在下一个关键帧处切片
+	for ts := uint32(0); ts <= 8000; ts += 40 {
+		assert.Nil(t, source.Write(h264Packet(ts, ts%1000 == 0, false)))
+		time.Sleep(time.Millisecond)
+	}
+	playlist := waitSegments(t, source, 2)
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:4\n"+
+		"#EXT-X-MEDIA-SEQUENCE:1\n\n#EXTINF:3.960,\n/live/test/1.ts\n#EXTINF:3.960,\n/live/test/2.ts\n", playlist)
+
+	item, err := source.GetCacheInc().GetItem("/live/test/1.ts")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(item.Data)%188)
+	assert.Equal(t, byte(0x47), item.Data[0])
+}
+
+func TestSourceAudioOnly(t *testing.T) {
+	source := NewSource(testInfo, testLogger())
+	defer source.Close()
+	assert.Nil(t, source.Write(aacPacket(0, true)))
+	//没有视频时按时长切片
+	for i := uint32(0); i < 200; i++ {
+		assert.Nil(t, source.Write(aacPacket(i*23, false)))
+		time.Sleep(time.Millisecond)
+	}
+	playlist := waitSegments(t, source, 1)
+	assert.Contains(t, playlist, "#EXTINF:3.013,\n/live/test/1.ts\n")
+
+	item, err := source.GetCacheInc().GetItem("/live/test/1.ts")
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x47), item.Data[0])
+}
+
+func TestTSCachePlaylist(t *testing.T) {
+	cache := NewTSCacheItem("live/test")
+	_, err := cache.GenM3U8PlayList()
+	assert.Equal(t, ErrNoKey, err)
+
+	//超过缓存数量时淘汰最早的分片，media sequence跟随第一个分片
+	for seq := 1; seq <= 4; seq++ {
+		name := fmt.Sprintf("/live/test/%d.ts", seq)
+		cache.SetItem(name, NewTSItem(name, 2000+seq*500, seq, []byte{0x47}))
+	}
+	body, err := cache.GenM3U8PlayList()
+	assert.Nil(t, err)
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:5\n"+
+		"#EXT-X-MEDIA-SEQUENCE:2\n\n#EXTINF:3.000,\n/live/test/2.ts\n#EXTINF:3.500,\n/live/test/3.ts\n"+
+		"#EXTINF:4.000,\n/live/test/4.ts\n", string(body))
+	_, err = cache.GetItem("/live/test/1.ts")
+	assert.Equal(t, ErrNoKey, err)
+}
+
+func TestServer(t *testing.T) {
+	server := NewServer(testLogger())
+	w, err := server.NewWriter(testInfo)
+	assert.Nil(t, err)
+	source := w.(*Source)
+	assert.Nil(t, source.Write(aacPacket(0, true)))
+	for i := uint32(0); i < 200; i++ {
+		assert.Nil(t, source.Write(aacPacket(i*23, false)))
+		time.Sleep(time.Millisecond)
+	}
+	waitSegments(t, source, 1)
+
+	rec := httptest.NewRecorder()
+	server.handle(rec, httptest.NewRequest("GET", "/live/test.m3u8", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "/live/test/1.ts")
+	rec = httptest.NewRecorder()
+	server.handle(rec, httptest.NewRequest("GET", "/live/test/1.ts", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "video/mp2ts", rec.Header().Get("Content-Type"))
+	rec = httptest.NewRecorder()
+	server.handle(rec, httptest.NewRequest("GET", "/live/other.m3u8", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	//Close之后Serve返回，Source被关闭
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(l)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, server.Close())
+	assert.Equal(t, http.ErrServerClosed, <-serveErr)
+	assert.NotNil(t, source.Write(aacPacket(5000, false)))
+	_, err = server.NewWriter(testInfo)
+	assert.Equal(t, ErrServerClosed, err)
+}
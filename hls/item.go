@@ -1,18 +1,20 @@
-// package hls
+package hls
 
-// type TSItem struct {
-// 	Name     string
-// 	SeqNum   int
-// 	Duration int
-// 	Data     []byte
-// }
+//TSItem 一个ts分片
+type TSItem struct {
+	Name     string
+	SeqNum   int
+	Duration int
+	Data     []byte
+}
 
-// func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
-// 	var item TSItem
-// 	item.Name = name
-// 	item.SeqNum = seqNum
-// 	item.Duration = duration
-// 	item.Data = make([]byte, len(b))
-// 	copy(item.Data, b)
-// 	return item
-// }
+//NewTSItem 创建一个ts分片，会拷贝b中的数据
+func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
+	var item TSItem
+	item.Name = name
+	item.SeqNum = seqNum
+	item.Duration = duration
+	item.Data = make([]byte, len(b))
+	copy(item.Data, b)
+	return item
+}
@@ -1,283 +1,296 @@
-// package hls
+package hls
 
-// import (
-// 	"bytes"
-// 	"errors"
-// 	"fmt"
-// 	"time"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
-// 	"github.com/fabo871218/srtmp/av"
-// 	"github.com/fabo871218/srtmp/container/flv"
-// 	"github.com/fabo871218/srtmp/container/ts"
-// 	parser "github.com/fabo871218/srtmp/media"
-// )
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/container/ts"
+	"github.com/fabo871218/srtmp/logger"
+	parser "github.com/fabo871218/srtmp/media"
+	"github.com/fabo871218/srtmp/protocol"
+)
 
-// const (
-// 	videoHZ      = 90000
-// 	aacSampleLen = 1024
-// 	maxQueueNum  = 512
+const (
+	videoHZ     = 90000
+	maxQueueNum = 512
 
-// 	h264_default_hz uint64 = 90
-// )
+	h264DefaultHZ uint64 = 90
+)
 
-// type Source struct {
-// 	av.RWBaser
-// 	seq         int
-// 	streamInfo  av.StreamInfo
-// 	bwriter     *bytes.Buffer
-// 	btswriter   *bytes.Buffer
-// 	demuxer     *flv.Demuxer
-// 	muxer       *ts.Muxer
-// 	pts, dts    uint64
-// 	stat        *status
-// 	align       *align
-// 	cache       *audioCache
-// 	tsCache     *TSCacheItem
-// 	tsparser    *parser.CodecParser
-// 	closed      bool
-// 	packetQueue chan *av.Packet
-// }
+//Source 一路流对应的hls输出，实现了protocol.WriteCloser
+//收到的数据包会被转换成ts，在关键帧处切片，纯音频流按时长切片
+type Source struct {
+	av.RWBaser
+	seq         int
+	key         string
+	streamInfo  protocol.StreamInfo
+	bwriter     *bytes.Buffer
+	btswriter   *bytes.Buffer
+	demuxer     *flv.Demuxer
+	muxer       *ts.Muxer
+	pts, dts    uint64
+	soundFormat uint8
+	stat        *status
+	align       *align
+	cache       *audioCache
+	tsCache     *TSCacheItem
+	tsparser    *parser.CodecParser
+	hasVideo    bool  //是否收到过支持的视频，没有视频时按音频切片
+	closed      int32 //在发送协程和流循环中访问，使用原子操作
+	closeOnce   sync.Once
+	packetQueue chan *av.Packet
+	logger      logger.Logger
+}
 
-// func NewSource(streamInfo av.StreamInfo) *Source {
-// 	streamInfo.Inter = true
-// 	s := &Source{
-// 		streamInfo:  streamInfo,
-// 		align:       &align{},
-// 		stat:        newStatus(),
-// 		RWBaser:     av.NewRWBaser(time.Second * 10),
-// 		cache:       newAudioCache(),
-// 		demuxer:     flv.NewDemuxer(),
-// 		muxer:       ts.NewMuxer(),
-// 		tsCache:     NewTSCacheItem(streamInfo.Key),
-// 		tsparser:    parser.NewCodecParser(),
-// 		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
-// 		packetQueue: make(chan *av.Packet, maxQueueNum),
-// 	}
-// 	go func() {
-// 		err := s.SendPacket()
-// 		if err != nil {
-// 			fmt.Printf("send packet error: %v\n", err)
-// 			s.closed = true
-// 		}
-// 	}()
-// 	return s
-// }
+//NewSource 创建一个hls输出
+func NewSource(streamInfo protocol.StreamInfo, log logger.Logger) *Source {
+	key := streamKey(streamInfo)
+	s := &Source{
+		key:         key,
+		streamInfo:  streamInfo,
+		align:       &align{},
+		stat:        newStatus(),
+		soundFormat: av.SOUND_AAC,
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		cache:       newAudioCache(),
+		demuxer:     flv.NewDemuxer(),
+		muxer:       ts.NewMuxer(),
+		tsCache:     NewTSCacheItem(key),
+		tsparser:    parser.NewCodecParser(),
+		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
+		packetQueue: make(chan *av.Packet, maxQueueNum),
+		logger:      log,
+	}
+	go func() {
+		if err := s.SendPacket(); err != nil {
+			s.logger.Infof("Hls source[%s] stop sending, %v", s.key, err)
+			atomic.StoreInt32(&s.closed, 1)
+		}
+	}()
+	return s
+}
 
-// func (source *Source) GetCacheInc() *TSCacheItem {
-// 	return source.tsCache
-// }
+//GetCacheInc 获取ts分片缓存
+func (source *Source) GetCacheInc() *TSCacheItem {
+	return source.tsCache
+}
 
-// func (source *Source) DropPacket(pktQue chan *av.Packet, streamInfo av.StreamInfo) {
-// 	fmt.Printf("[%v] packet queue max!!!\n", streamInfo)
-// 	for i := 0; i < maxQueueNum-84; i++ {
-// 		tmpPkt, ok := <-pktQue
-// 		// try to don't drop audio
-// 		if !ok {
-// 			continue
-// 		}
+//Write 写入一个数据包，队列满时丢弃，metadata和sequence header不丢弃
+func (source *Source) Write(p *av.Packet) (err error) {
+	if source.isClosed() {
+		return errors.New("hls source closed")
+	}
+	source.SetPreTime()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("hls source has already been closed:%v", e)
+		}
+	}()
 
-// 		switch tmpPkt.PacketType {
-// 		case av.PacketTypeAudio:
-// 			if len(pktQue) > maxQueueNum-2 {
-// 				<-pktQue
-// 			} else {
-// 				pktQue <- tmpPkt
-// 			}
-// 		case av.PacketTypeVideo:
-// 			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-// 			// dont't drop sps config and dont't drop key frame
-// 			if ok && videoPkt.FrameType == av.FRAME_KEY {
-// 				pktQue <- tmpPkt
-// 			}
-// 			if len(pktQue) > maxQueueNum-10 {
-// 				<-pktQue
-// 			}
-// 		default:
-// 		}
-// 	}
-// 	fmt.Printf("packet queue len:%d\n", len(pktQue))
-// }
+	if p.IsHeader() {
+		if av.PushHeader(source.packetQueue, p) > 0 {
+			source.logger.Warnf("Hls source[%s] packet droped for sequence header...", source.key)
+		}
+		return
+	}
+	select {
+	case source.packetQueue <- p:
+	default:
+		source.logger.Warnf("Hls source[%s] packet droped...", source.key)
+	}
+	return
+}
 
-// func (source *Source) Write(p *av.Packet) (err error) {
-// 	err = nil
-// 	if source.closed {
-// 		err = errors.New("hls source closed")
-// 		return
-// 	}
-// 	source.SetPreTime()
-// 	defer func() {
-// 		if e := recover(); e != nil {
-// 			errString := fmt.Sprintf("hls source has already been closed:%v", e)
-// 			err = errors.New(errString)
-// 		}
-// 	}()
-// 	if len(source.packetQueue) >= maxQueueNum-24 {
-// 		source.DropPacket(source.packetQueue, source.streamInfo)
-// 	} else {
-// 		if !source.closed {
-// 			source.packetQueue <- p
-// 		}
-// 	}
-// 	return
-// }
+//QueueSize 返回队列的长度
+func (source *Source) QueueSize() int {
+	return cap(source.packetQueue)
+}
 
-// func (source *Source) SendPacket() error {
-// 	defer func() {
-// 		fmt.Printf("[%v] hls sender stop\n", source.streamInfo)
-// 		if r := recover(); r != nil {
-// 			fmt.Printf("hls SendPacket panic: %v\n", r)
-// 		}
-// 	}()
+//SendPacket 从队列中读取数据包，转换成ts，出现panic时返回错误，source会被标记为关闭
+func (source *Source) SendPacket() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			source.logger.Errorf("Hls source[%s] SendPacket panic:%v", source.key, r)
+			err = fmt.Errorf("SendPacket panic:%v", r)
+		}
+	}()
 
-// 	fmt.Printf("[%v] hls sender start\n", source.streamInfo)
-// 	for {
-// 		if source.closed {
-// 			return errors.New("closed")
-// 		}
+	for {
+		p, ok := <-source.packetQueue
+		if !ok {
+			return errors.New("closed")
+		}
+		if p.PacketType == av.PacketTypeMetadata {
+			continue
+		}
 
-// 		p, ok := <-source.packetQueue
-// 		if ok {
-// 			if p.PacketType == av.PacketTypeMetadata {
-// 				continue
-// 			}
+		//数据包会被多个writer共享，这里拷贝一份再处理
+		pkt := *p
+		if err := source.demuxer.Demux(&pkt); err != nil {
+			return fmt.Errorf("demuxer.Demux failed, %v", err)
+		}
+		if pkt.PacketType == av.PacketTypeVideo &&
+			(pkt.VHeader.AVCPacketType == av.AVC_EOS || pkt.VHeader.IsMetadataFrame()) {
+			continue
+		}
+		if pkt.PacketType == av.PacketTypeAudio && pkt.AHeader.IsExHeader &&
+			pkt.AHeader.ExPacketType != av.AudioPacketTypeSequenceStart &&
+			pkt.AHeader.ExPacketType != av.AudioPacketTypeCodedFrames {
+			continue
+		}
+		compositionTime, isSeq, err := source.parse(&pkt)
+		if err != nil {
+			source.logger.Debugf("Hls source[%s] parse failed, %v", source.key, err)
+		}
+		if err != nil || isSeq {
+			continue
+		}
+		if source.btswriter != nil {
+			isVideo := pkt.PacketType == av.PacketTypeVideo
+			//时间戳回绕后继续递增，分片时长和pts/dts都按展开后的时间戳计算
+			ts := source.Unwrap(pkt.TimeStamp)
+			source.stat.update(isVideo, ts)
+			source.calcPtsDts(isVideo, ts, compositionTime)
+			if err := source.tsMux(&pkt); err != nil {
+				source.logger.Errorf("Hls source[%s] ts mux failed, %v", source.key, err)
+			}
+		}
+	}
+}
 
-// 			err := source.demuxer.Demux(p)
-// 			if err == flv.ErrAvcEndSEQ {
-// 				fmt.Printf("flv.ErrAvcEndSEQ\n")
-// 				continue
-// 			} else {
-// 				if err != nil {
-// 					return fmt.Errorf("demuxer.Demux failed, %v", err)
-// 				}
-// 			}
-// 			compositionTime, isSeq, err := source.parse(p)
-// 			if err != nil {
-// 				fmt.Printf("source.parse failed, %v\n", err)
-// 			}
-// 			if err != nil || isSeq {
-// 				continue
-// 			}
-// 			if source.btswriter != nil {
-// 				isVideo := p.PacketType == av.PacketTypeVideo
-// 				source.stat.update(isVideo, p.TimeStamp)
-// 				source.calcPtsDts(isVideo, p.TimeStamp, uint32(compositionTime))
-// 				source.tsMux(p)
-// 			}
-// 		} else {
-// 			return errors.New("closed")
-// 		}
-// 	}
-// }
+//StreamInfo 返回流信息
+func (source *Source) StreamInfo() protocol.StreamInfo {
+	return source.streamInfo
+}
 
-// func (source *Source) StreamInfo() (ret av.StreamInfo) {
-// 	return source.streamInfo
-// }
+//Close 关闭输出，已经生成的分片在Server移除该Source前仍然可以访问
+func (source *Source) Close() {
+	source.closeOnce.Do(func() {
+		atomic.StoreInt32(&source.closed, 1)
+		close(source.packetQueue)
+		source.logger.Infof("Hls source[%s] closed.", source.key)
+	})
+}
 
-// func (source *Source) cleanup() {
-// 	close(source.packetQueue)
-// 	source.bwriter = nil
-// 	source.btswriter = nil
-// 	source.cache = nil
-// 	source.tsCache = nil
-// }
+func (source *Source) isClosed() bool {
+	return atomic.LoadInt32(&source.closed) != 0
+}
 
-// func (source *Source) Close() {
-// 	fmt.Printf("hls source closed: %v\n", source.streamInfo)
-// 	if !source.closed {
-// 		source.cleanup()
-// 	}
-// 	source.closed = true
-// }
+func (source *Source) cut() {
+	newf := true
+	if source.btswriter == nil {
+		source.btswriter = bytes.NewBuffer(nil)
+	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
+		source.flushAudio()
 
-// func (source *Source) cut() {
-// 	newf := true
-// 	if source.btswriter == nil {
-// 		source.btswriter = bytes.NewBuffer(nil)
-// 	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
-// 		source.flushAudio()
+		source.seq++
+		filename := fmt.Sprintf("/%s/%d.ts", source.key, source.seq)
+		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
+		source.tsCache.SetItem(filename, item)
 
-// 		source.seq++
-// 		filename := fmt.Sprintf("/%s/%d.ts", source.streamInfo.Key, time.Now().Unix())
-// 		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
-// 		source.tsCache.SetItem(filename, item)
+		source.btswriter.Reset()
+		source.stat.resetAndNew()
+	} else {
+		newf = false
+	}
+	if newf {
+		source.btswriter.Write(source.muxer.PAT())
+		source.muxer.SetAudioChannels(byte(source.tsparser.Channels()))
+		if sampleRate, err := source.tsparser.SampleRate(); err == nil {
+			source.muxer.SetAudioSampleRate(sampleRate)
+		}
+		source.btswriter.Write(source.muxer.PMT(source.soundFormat, true))
+	}
+}
 
-// 		source.btswriter.Reset()
-// 		source.stat.resetAndNew()
-// 	} else {
-// 		newf = false
-// 	}
-// 	if newf {
-// 		source.btswriter.Write(source.muxer.PAT())
-// 		source.btswriter.Write(source.muxer.PMT(av.SOUND_AAC, true))
-// 	}
-// }
+func (source *Source) parse(p *av.Packet) (int32, bool, error) {
+	var compositionTime int32
+	switch p.PacketType {
+	case av.PacketTypeVideo:
+		if p.VHeader.CodecID != av.VIDEO_H264 && p.VHeader.CodecID != av.VIDEO_HEVC {
+			return compositionTime, false, ErrNoSupportVideoCodec
+		}
+		source.hasVideo = true
+		compositionTime = p.VHeader.CompositionTime
+		if p.VHeader.IsSeqHeader() {
+			//pmt中的视频流类型跟随sequence header的编码
+			source.muxer.SetVideoCodec(p.VHeader.CodecID)
+			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
+		}
+	case av.PacketTypeAudio:
+		switch p.AHeader.SoundFormat {
+		case av.SOUND_AAC, av.SOUND_OPUS, av.SOUND_MP3, av.SOUND_ALAW, av.SOUND_MULAW:
+		default:
+			return compositionTime, false, ErrNoSupportAudioCodec
+		}
+		//pmt中的音频流类型跟随收到的音频编码
+		source.soundFormat = p.AHeader.SoundFormat
+		if p.AHeader.IsSeqHeader() {
+			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
+		}
+	}
 
-// func (source *Source) parse(p *av.Packet) (int32, bool, error) {
-// 	var compositionTime int32
-// 	var ah av.AudioPacketHeader
-// 	var vh av.VideoPacketHeader
-// 	switch p.PacketType {
-// 	case av.PacketTypeVideo:
-// 		vh = p.Header.(av.VideoPacketHeader)
-// 		if vh.CodecID != av.VIDEO_H264 {
-// 			return compositionTime, false, ErrNoSupportVideoCodec
-// 		}
-// 		compositionTime = vh.CompositionTime
-// 		if vh.FrameType == av.FRAME_KEY && vh.AVCPacketType == av.AVC_SEQHDR {
-// 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
-// 		}
-// 	case av.PacketTypeAudio:
-// 		ah = p.Header.(av.AudioPacketHeader)
-// 		if ah.SoundFormat != av.SOUND_AAC {
-// 			return compositionTime, false, ErrNoSupportAudioCodec
-// 		}
-// 		if ah.AACPacketType == av.AAC_SEQHDR {
-// 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
-// 		}
-// 	}
+	source.bwriter.Reset()
+	if err := source.tsparser.Parse(p, source.bwriter); err != nil {
+		return compositionTime, false, err
+	}
+	p.Data = source.bwriter.Bytes()
 
-// 	source.bwriter.Reset()
-// 	if err := source.tsparser.Parse(p, source.bwriter); err != nil {
-// 		return compositionTime, false, err
-// 	}
-// 	p.Data = source.bwriter.Bytes()
+	//有视频时在关键帧处切片，纯音频流每一帧都可以作为切片的开始
+	if p.PacketType == av.PacketTypeVideo && p.VHeader.FrameType == av.FRAME_KEY {
+		source.cut()
+	} else if p.PacketType == av.PacketTypeAudio && !source.hasVideo {
+		source.cut()
+	}
+	return compositionTime, false, nil
+}
 
-// 	if p.PacketType == av.PacketTypeVideo && vh.FrameType == av.FRAME_KEY {
-// 		source.cut()
-// 	}
-// 	return compositionTime, false, nil
-// }
+func (source *Source) calcPtsDts(isVideo bool, ts uint64, compositionTs int32) {
+	source.dts = ts * h264DefaultHZ
+	if isVideo {
+		//CompositionTime可以为负数，pts不能小于0
+		pts := int64(source.dts) + int64(compositionTs)*int64(h264DefaultHZ)
+		if pts < 0 {
+			pts = 0
+		}
+		source.pts = uint64(pts)
+	} else {
+		//opus和g711的帧长不固定，不做对齐
+		sampleRate, _ := source.tsparser.SampleRate()
+		if frameSamples := source.tsparser.FrameSamples(); sampleRate > 0 && frameSamples > 0 {
+			source.align.align(&source.dts, uint32(videoHZ*frameSamples/sampleRate))
+		}
+		source.pts = source.dts
+	}
+}
 
-// func (source *Source) calcPtsDts(isVideo bool, ts, compositionTs uint32) {
-// 	source.dts = uint64(ts) * h264_default_hz
-// 	if isVideo {
-// 		source.pts = source.dts + uint64(compositionTs)*h264_default_hz
-// 	} else {
-// 		sampleRate, _ := source.tsparser.SampleRate()
-// 		source.align.align(&source.dts, uint32(videoHZ*aacSampleLen/sampleRate))
-// 		source.pts = source.dts
-// 	}
-// }
-// func (source *Source) flushAudio() error {
-// 	return source.muxAudio(1)
-// }
+func (source *Source) flushAudio() error {
+	return source.muxAudio(1)
+}
 
-// func (source *Source) muxAudio(limit byte) error {
-// 	if source.cache.CacheNum() < limit {
-// 		return nil
-// 	}
-// 	var p av.Packet
-// 	_, pts, buf := source.cache.GetFrame()
-// 	p.Data = buf
-// 	p.TimeStamp = uint32(pts / h264_default_hz)
-// 	return source.muxer.Mux(&p, source.btswriter)
-// }
+func (source *Source) muxAudio(limit byte) error {
+	if source.cache.CacheNum() < limit {
+		return nil
+	}
+	var p av.Packet
+	_, pts, buf := source.cache.GetFrame()
+	p.PacketType = av.PacketTypeAudio
+	p.AHeader.SoundFormat = source.soundFormat
+	p.Data = buf
+	p.TimeStamp = uint32(pts / h264DefaultHZ)
+	return source.muxer.MuxTs(&p, int64(pts), int64(pts), source.btswriter)
+}
 
-// func (source *Source) tsMux(p *av.Packet) error {
-// 	if p.PacketType == av.PacketTypeVideo {
-// 		return source.muxer.Mux(p, source.btswriter)
-// 	} else {
-// 		source.cache.Cache(p.Data, source.pts)
-// 		return source.muxAudio(cache_max_frames)
-// 	}
-// }
+func (source *Source) tsMux(p *av.Packet) error {
+	if p.PacketType == av.PacketTypeVideo {
+		return source.muxer.MuxTs(p, int64(source.pts), int64(source.dts), source.btswriter)
+	}
+	source.cache.Cache(p.Data, source.pts)
+	return source.muxAudio(cacheMaxFrames)
+}
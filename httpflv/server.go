@@ -1,133 +1,133 @@
-// package httpflv
-
-// import (
-// 	"encoding/json"
-// 	"fmt"
-// 	"net"
-// 	"net/http"
-// 	"strings"
-
-// 	"github.com/fabo871218/srtmp/av"
-// )
-
-// type Server struct {
-// 	handler av.Handler
-// }
-
-// type stream struct {
-// 	Key string `json:"key"`
-// 	Id  string `json:"id"`
-// }
-
-// type streams struct {
-// 	Publishers []stream `json:"publishers"`
-// 	Players    []stream `json:"players"`
-// }
-
-// func NewServer(h av.Handler) *Server {
-// 	return &Server{
-// 		handler: h,
-// 	}
-// }
-
-// func (server *Server) Serve(l net.Listener) error {
-// 	mux := http.NewServeMux()
-// 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-// 		server.handleConn(w, r)
-// 	})
-// 	mux.HandleFunc("/streams", func(w http.ResponseWriter, r *http.Request) {
-// 		server.getStream(w, r)
-// 	})
-// 	http.Serve(l, mux)
-// 	return nil
-// }
-
-// // 获取发布和播放器的信息
-// func (server *Server) getStreams(w http.ResponseWriter, r *http.Request) *streams {
-// 	// streamHandler := server.handler.(*protocol.StreamHandler)
-// 	// if streamHandler == nil {
-// 	// 	return nil
-// 	// }
-// 	// msgs := new(streams)
-// 	// for item := range streamHandler.GetStreams().IterBuffered() {
-// 	// 	if s, ok := item.Val.(*protocol.RtmpStream); ok {
-// 	// 		if s.GetReader() != nil {
-// 	// 			msg := stream{item.Key, s.GetReader().StreamInfo().UID}
-// 	// 			msgs.Publishers = append(msgs.Publishers, msg)
-// 	// 		}
-// 	// 	}
-// 	// }
-
-// 	// for item := range streamHandler.GetStreams().IterBuffered() {
-// 	// 	ws := item.Val.(*protocol.RtmpStream).GetWs()
-// 	// 	for s := range ws.IterBuffered() {
-// 	// 		if pw, ok := s.Val.(*protocol.PackWriterCloser); ok {
-// 	// 			if writer, err := pw.NewWriter(); err == nil && writer != nil {
-// 	// 				msg := stream{item.Key, writer.StreamInfo().UID}
-// 	// 				msgs.Players = append(msgs.Players, msg)
-// 	// 			}
-// 	// 		}
-// 	// 	}
-// 	// }
-
-// 	// return msgs
-// 	return nil
-// }
-
-// func (server *Server) getStream(w http.ResponseWriter, r *http.Request) {
-// 	msgs := server.getStreams(w, r)
-// 	if msgs == nil {
-// 		return
-// 	}
-// 	resp, _ := json.Marshal(msgs)
-// 	w.Header().Set("Content-Type", "application/json")
-// 	w.Write(resp)
-// }
-
-// func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
-// 	defer func() {
-// 		if r := recover(); r != nil {
-// 			fmt.Printf("http flv handleConn panic: %v\n", r)
-// 		}
-// 	}()
-
-// 	url := r.URL.String()
-// 	u := r.URL.Path
-// 	if pos := strings.LastIndex(u, "."); pos < 0 || u[pos:] != ".flv" {
-// 		http.Error(w, "invalid path", http.StatusBadRequest)
-// 		return
-// 	}
-// 	path := strings.TrimSuffix(strings.TrimLeft(u, "/"), ".flv")
-// 	paths := strings.SplitN(path, "/", 2)
-// 	fmt.Printf("url:%s path:%s paths:%s\n", u, path, paths)
-
-// 	if len(paths) != 2 {
-// 		http.Error(w, "invalid path", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	// 判断视屏流是否发布,如果没有发布,直接返回404
-// 	msgs := server.getStreams(w, r)
-// 	if msgs == nil || len(msgs.Publishers) == 0 {
-// 		http.Error(w, "invalid path", http.StatusNotFound)
-// 		return
-// 	} else {
-// 		include := false
-// 		for _, item := range msgs.Publishers {
-// 			if item.Key == path {
-// 				include = true
-// 				break
-// 			}
-// 		}
-// 		if include == false {
-// 			http.Error(w, "invalid path", http.StatusNotFound)
-// 			return
-// 		}
-// 	}
-
-// 	w.Header().Set("Access-Control-Allow-Origin", "*")
-// 	writer := NewFLVWriter(paths[0], paths[1], url, w)
-
-// 	server.handler.HandleWriter(writer)
-// 	writer.Wait()
-// }
+package httpflv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/fabo871218/srtmp/protocol/core"
+)
+
+//Server http-flv服务，通过 http://addr/app/name.flv 播放rtmp服务上发布的流
+type Server struct {
+	mutex      sync.Mutex
+	httpServer *http.Server
+	closed     bool
+	handler    *protocol.StreamHandler
+	logger     logger.Logger
+}
+
+//NewServer 创建一个http-flv服务
+func NewServer(h *protocol.StreamHandler, log logger.Logger) *Server {
+	return &Server{
+		handler: h,
+		logger:  log,
+	}
+}
+
+//Serve 在listener上提供http-flv服务，Close或者Shutdown之后返回http.ErrServerClosed
+func (server *Server) Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		server.handleConn(w, r)
+	})
+	httpServer := &http.Server{Handler: mux}
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		l.Close()
+		return http.ErrServerClosed
+	}
+	server.httpServer = httpServer
+	server.mutex.Unlock()
+	return httpServer.Serve(l)
+}
+
+//Close 立即关闭http服务和所有播放连接
+func (server *Server) Close() error {
+	if httpServer := server.stop(); httpServer != nil {
+		return httpServer.Close()
+	}
+	return nil
+}
+
+//Shutdown 关闭监听并等待播放连接结束，播放端在流停止发布后断开，参考http.Server.Shutdown
+func (server *Server) Shutdown(ctx context.Context) error {
+	if httpServer := server.stop(); httpServer != nil {
+		return httpServer.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (server *Server) stop() *http.Server {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.closed = true
+	return server.httpServer
+}
+
+func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.Errorf("http flv handleConn panic:%v", r)
+		}
+	}()
+
+	url := r.URL.String()
+	u := r.URL.Path
+	if pos := strings.LastIndex(u, "."); pos < 0 || u[pos:] != ".flv" {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	path := strings.TrimSuffix(strings.TrimLeft(u, "/"), ".flv")
+	paths := strings.SplitN(path, "/", 2)
+	if len(paths) != 2 {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	//和rtmp播放端使用同样的鉴权，包括webhook的on_play，query作为鉴权参数
+	info := protocol.AuthInfo{
+		ConnInfo: core.ConnectInfo{
+			App:     paths[0],
+			TcURL:   "http://" + r.Host + "/" + paths[0],
+			PageURL: r.Referer(),
+		},
+		Name:       paths[1],
+		Query:      r.URL.RawQuery,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if err := server.handler.AuthenticateInfo(info); err != nil {
+		server.logger.Warnf("Http-flv player rejected, remote:%s url:%s %v", r.RemoteAddr, url, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 判断视频流是否发布,如果没有发布,直接返回404
+	stream := server.handler.GetStream(paths[0], paths[1])
+	if stream == nil || stream.GetReader() == nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/x-flv")
+	writer := NewFLVWriter(paths[0], paths[1], url, w, server.logger)
+	writer.remoteAddr = r.RemoteAddr
+	if err := stream.AddWriter(writer); err != nil {
+		writer.Close()
+		return
+	}
+	server.logger.Infof("New http-flv player, remote:%s url:%s", r.RemoteAddr, url)
+
+	select {
+	case <-writer.closedChan:
+	case <-r.Context().Done():
+		writer.Close()
+		writer.Wait()
+	}
+}
@@ -1,182 +1,187 @@
-// package httpflv
-
-// import (
-// 	"errors"
-// 	"fmt"
-// 	"net/http"
-// 	"time"
-
-// 	"github.com/fabo871218/srtmp/av"
-// 	"github.com/fabo871218/srtmp/protocol/amf"
-// 	"github.com/fabo871218/srtmp/utils"
-// )
-
-// const (
-// 	headerLen   = 11
-// 	maxQueueNum = 1024
-// )
-
-// type FLVWriter struct {
-// 	Uid string
-// 	av.RWBaser
-// 	app, title, url string
-// 	buf             []byte
-// 	closed          bool
-// 	closedChan      chan struct{}
-// 	ctx             http.ResponseWriter
-// 	packetQueue     chan *av.Packet
-// }
-
-// func NewFLVWriter(app, title, url string, ctx http.ResponseWriter) *FLVWriter {
-// 	ret := &FLVWriter{
-// 		Uid:         utils.NewId(),
-// 		app:         app,
-// 		title:       title,
-// 		url:         url,
-// 		ctx:         ctx,
-// 		RWBaser:     av.NewRWBaser(time.Second * 10),
-// 		closedChan:  make(chan struct{}),
-// 		buf:         make([]byte, headerLen),
-// 		packetQueue: make(chan *av.Packet, maxQueueNum),
-// 	}
-
-// 	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09})
-// 	utils.PutI32BE(ret.buf[:4], 0)
-// 	ret.ctx.Write(ret.buf[:4])
-// 	go func() {
-// 		err := ret.SendPacket()
-// 		if err != nil {
-// 			fmt.Printf("SendPacket failed, %v\n", err)
-// 			ret.closed = true
-// 		}
-// 	}()
-// 	return ret
-// }
-
-// func (flvWriter *FLVWriter) DropPacket(pktQue chan *av.Packet, streamInfo av.StreamInfo) {
-// 	fmt.Printf("[%v] packet queue max!!!\n", streamInfo)
-// 	for i := 0; i < maxQueueNum-84; i++ {
-// 		tmpPkt, ok := <-pktQue
-// 		if !ok {
-// 			continue
-// 		}
-
-// 		switch tmpPkt.PacketType {
-// 		case av.PacketTypeVideo:
-// 			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-// 			// dont't drop sps config and dont't drop key frame
-// 			if ok && videoPkt.FrameType == av.FRAME_KEY {
-// 				fmt.Println("insert keyframe to queue")
-// 				pktQue <- tmpPkt
-// 			}
-
-// 			if len(pktQue) > maxQueueNum-10 {
-// 				<-pktQue
-// 			}
-// 			// drop other packet
-// 			<-pktQue
-// 		case av.PacketTypeAudio:
-// 			fmt.Println("insert audio to queue")
-// 			pktQue <- tmpPkt
-// 		default:
-// 		}
-// 	}
-// 	fmt.Printf("packet queue len: %d\n", len(pktQue))
-// }
-
-// func (flvWriter *FLVWriter) Write(p *av.Packet) (err error) {
-// 	err = nil
-// 	if flvWriter.closed {
-// 		err = errors.New("flvwrite source closed")
-// 		return
-// 	}
-// 	defer func() {
-// 		if e := recover(); e != nil {
-// 			errString := fmt.Sprintf("FLVWriter has already been closed:%v", e)
-// 			err = errors.New(errString)
-// 		}
-// 	}()
-// 	if len(flvWriter.packetQueue) >= maxQueueNum-24 {
-// 		flvWriter.DropPacket(flvWriter.packetQueue, flvWriter.StreamInfo())
-// 	} else {
-// 		flvWriter.packetQueue <- p
-// 	}
-
-// 	return
-// }
-
-// func (flvWriter *FLVWriter) SendPacket() error {
-// 	for {
-// 		p, ok := <-flvWriter.packetQueue
-// 		if ok {
-// 			flvWriter.RWBaser.SetPreTime()
-// 			h := flvWriter.buf[:headerLen]
-// 			typeID := av.TAG_VIDEO
-// 			switch p.PacketType {
-// 			case av.PacketTypeVideo:
-// 				typeID = av.TAG_VIDEO
-// 			case av.PacketTypeAudio:
-// 				typeID = av.TAG_AUDIO
-// 			case av.PacketTypeMetadata:
-// 				var err error
-// 				typeID = av.TAG_SCRIPTDATAAMF0
-// 				p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
-// 				if err != nil {
-// 					return err
-// 				}
-// 			}
-// 			dataLen := len(p.Data)
-// 			timestamp := p.TimeStamp
-// 			timestamp += flvWriter.BaseTimeStamp()
-// 			flvWriter.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
-
-// 			preDataLen := dataLen + headerLen
-// 			timestampbase := timestamp & 0xffffff
-// 			timestampExt := timestamp >> 24 & 0xff
-
-// 			utils.PutU8(h[0:1], uint8(typeID))
-// 			utils.PutI24BE(h[1:4], int32(dataLen))
-// 			utils.PutI24BE(h[4:7], int32(timestampbase))
-// 			utils.PutU8(h[7:8], uint8(timestampExt))
-
-// 			if _, err := flvWriter.ctx.Write(h); err != nil {
-// 				return err
-// 			}
-
-// 			if _, err := flvWriter.ctx.Write(p.Data); err != nil {
-// 				return err
-// 			}
-
-// 			utils.PutI32BE(h[:4], int32(preDataLen))
-// 			if _, err := flvWriter.ctx.Write(h[:4]); err != nil {
-// 				return err
-// 			}
-// 		} else {
-// 			return errors.New("closed")
-// 		}
-// 	}
-// }
-
-// func (flvWriter *FLVWriter) Wait() {
-// 	select {
-// 	case <-flvWriter.closedChan:
-// 		return
-// 	}
-// }
-
-// func (flvWriter *FLVWriter) Close() {
-// 	fmt.Println("http flv closed")
-// 	if !flvWriter.closed {
-// 		close(flvWriter.packetQueue)
-// 		close(flvWriter.closedChan)
-// 	}
-// 	flvWriter.closed = true
-// }
-
-// func (flvWriter *FLVWriter) StreamInfo() (ret av.StreamInfo) {
-// 	ret.UID = flvWriter.Uid
-// 	ret.URL = flvWriter.url
-// 	ret.Key = flvWriter.app + "/" + flvWriter.title
-// 	ret.Inter = true
-// 	return
-// }
+package httpflv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/fabo871218/srtmp/protocol/amf"
+	"github.com/fabo871218/srtmp/utils"
+)
+
+const (
+	maxQueueNum = 1024
+)
+
+//FLVWriter http-flv的写对象，实现了protocol.WriteCloser
+type FLVWriter struct {
+	UID string
+	av.RWBaser
+	app, title, url string
+	remoteAddr      string
+	closed          int32 //在发送协程和流循环中访问，使用原子操作
+	closeOnce       sync.Once
+	keyframeNeed    bool
+	closedChan      chan struct{}
+	ctx             http.ResponseWriter
+	packetQueue     chan *av.Packet
+	bwLock          sync.Mutex //bwInfo在发送协程中更新，在http协程中读取
+	bwInfo          protocol.StaticsBW
+	logger          logger.Logger
+}
+
+//NewFLVWriter 创建一个http-flv写对象，会先写入flv文件头
+func NewFLVWriter(app, title, url string, ctx http.ResponseWriter, log logger.Logger) *FLVWriter {
+	ret := &FLVWriter{
+		UID:          utils.NewId(),
+		app:          app,
+		title:        title,
+		url:          url,
+		ctx:          ctx,
+		RWBaser:      av.NewRWBaser(time.Second * 10),
+		closedChan:   make(chan struct{}),
+		keyframeNeed: true,
+		packetQueue:  make(chan *av.Packet, maxQueueNum),
+		logger:       log,
+	}
+
+	//立即发送http头和flv文件头，不等待第一个数据包
+	flv.WriteHeader(ret.ctx)
+	if flusher, ok := ret.ctx.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	go func() {
+		if err := ret.SendPacket(); err != nil {
+			ret.logger.Infof("Http-flv writer[%s] stop sending, %v", ret.UID, err)
+		}
+		ret.Close()
+		close(ret.closedChan)
+	}()
+	return ret
+}
+
+//Write 写入一个数据包，队列满时丢弃，并等待下一个关键帧，metadata和sequence header不丢弃
+func (flvWriter *FLVWriter) Write(p *av.Packet) (err error) {
+	if flvWriter.isClosed() {
+		return errors.New("flvwrite source closed")
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("FLVWriter has already been closed:%v", e)
+		}
+	}()
+
+	//metadata和sequence header直接发送，队列满时丢弃最早的数据包，不作为关键帧
+	if p.IsHeader() {
+		if av.PushHeader(flvWriter.packetQueue, p) > 0 {
+			flvWriter.keyframeNeed = true
+			flvWriter.logger.Warnf("Http-flv writer[%s] packet droped for sequence header...", flvWriter.UID)
+		}
+		return
+	}
+	if p.PacketType == av.PacketTypeVideo && p.VHeader.AVCPacketType != av.AVC_SEQHDR {
+		if flvWriter.keyframeNeed {
+			if p.VHeader.FrameType != av.FRAME_KEY {
+				return
+			}
+			flvWriter.keyframeNeed = false
+		}
+	}
+
+	select {
+	case flvWriter.packetQueue <- p:
+	default:
+		if p.PacketType == av.PacketTypeVideo {
+			flvWriter.keyframeNeed = true
+		}
+		flvWriter.logger.Warnf("Http-flv writer[%s] packet droped...", flvWriter.UID)
+	}
+	return
+}
+
+//QueueSize 返回发送队列的长度
+func (flvWriter *FLVWriter) QueueSize() int {
+	return cap(flvWriter.packetQueue)
+}
+
+//SendPacket 从队列中读取数据包，打包成flv tag发送
+func (flvWriter *FLVWriter) SendPacket() error {
+	flusher, _ := flvWriter.ctx.(http.Flusher)
+	for {
+		p, ok := <-flvWriter.packetQueue
+		if !ok {
+			return errors.New("closed")
+		}
+
+		flvWriter.RWBaser.SetPreTime()
+		data := p.Data
+		typeID := av.TAG_VIDEO
+		switch p.PacketType {
+		case av.PacketTypeVideo:
+			typeID = av.TAG_VIDEO
+		case av.PacketTypeAudio:
+			typeID = av.TAG_AUDIO
+		case av.PacketTypeMetadata:
+			var err error
+			typeID = av.TAG_SCRIPTDATAAMF0
+			if data, err = amf.MetaDataReform(data, amf.DEL); err != nil {
+				return err
+			}
+		}
+		timestamp := p.TimeStamp
+		timestamp += flvWriter.BaseTimeStamp()
+		flvWriter.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
+		flvWriter.bwLock.Lock()
+		flvWriter.bwInfo.Add(p.StreamID, uint64(len(data)), typeID == av.TAG_VIDEO)
+		flvWriter.bwLock.Unlock()
+		if _, err := flv.WriteTag(flvWriter.ctx, uint8(typeID), timestamp, data); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+//RemoteAddr 返回播放端地址
+func (flvWriter *FLVWriter) RemoteAddr() string {
+	return flvWriter.remoteAddr
+}
+
+//URL 返回播放端请求的url
+func (flvWriter *FLVWriter) URL() string {
+	return flvWriter.url
+}
+
+//Statics 返回发送的带宽统计信息
+func (flvWriter *FLVWriter) Statics() protocol.StaticsBW {
+	flvWriter.bwLock.Lock()
+	defer flvWriter.bwLock.Unlock()
+	return flvWriter.bwInfo
+}
+
+//Wait 等待写对象关闭，返回后不会再写入http.ResponseWriter
+func (flvWriter *FLVWriter) Wait() {
+	<-flvWriter.closedChan
+}
+
+//Close 关闭写对象，可以多次调用
+func (flvWriter *FLVWriter) Close() {
+	flvWriter.closeOnce.Do(func() {
+		atomic.StoreInt32(&flvWriter.closed, 1)
+		close(flvWriter.packetQueue)
+		flvWriter.logger.Infof("Http-flv writer[%s] closed, %s/%s", flvWriter.UID,
+			flvWriter.app, flvWriter.title)
+	})
+}
+
+func (flvWriter *FLVWriter) isClosed() bool {
+	return atomic.LoadInt32(&flvWriter.closed) != 0
+}
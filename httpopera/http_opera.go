@@ -1,236 +1,311 @@
-// package httpopera
-
-// import (
-// 	"encoding/json"
-// 	"fmt"
-// 	"io"
-// 	"net"
-// 	"net/http"
-
-// 	"github.com/fabo871218/srtmp/av"
-// 	"github.com/fabo871218/srtmp/protocol"
-// )
-
-// type Response struct {
-// 	w       http.ResponseWriter
-// 	Status  int    `json:"status"`
-// 	Message string `json:"message"`
-// }
-
-// func (r *Response) SendJson() (int, error) {
-// 	resp, _ := json.Marshal(r)
-// 	r.w.Header().Set("Content-Type", "application/json")
-// 	return r.w.Write(resp)
-// }
-
-// type Operation struct {
-// 	Method string `json:"method"`
-// 	URL    string `json:"url"`
-// 	Stop   bool   `json:"stop"`
-// }
-
-// type OperationChange struct {
-// 	Method    string `json:"method"`
-// 	SourceURL string `json:"source_url"`
-// 	TargetURL string `json:"target_url"`
-// 	Stop      bool   `json:"stop"`
-// }
-
-// type ClientInfo struct {
-// 	url              string
-// 	rtmpRemoteClient *protocol.Client
-// 	rtmpLocalClient  *protocol.Client
-// }
-
-// type Server struct {
-// 	handler  av.Handler
-// 	session  map[string]*protocol.RtmpRelay
-// 	rtmpAddr string
-// }
-
-// func NewServer(h av.Handler, rtmpAddr string) *Server {
-// 	return &Server{
-// 		handler:  h,
-// 		session:  make(map[string]*protocol.RtmpRelay),
-// 		rtmpAddr: rtmpAddr,
-// 	}
-// }
-
-// func (s *Server) Serve(l net.Listener) error {
-// 	mux := http.NewServeMux()
-
-// 	mux.Handle("/statics", http.FileServer(http.Dir("statics")))
-
-// 	mux.HandleFunc("/control/push", func(w http.ResponseWriter, r *http.Request) {
-// 		s.handlePush(w, r)
-// 	})
-// 	mux.HandleFunc("/control/pull", func(w http.ResponseWriter, r *http.Request) {
-// 		s.handlePull(w, r)
-// 	})
-// 	mux.HandleFunc("/stat/livestat", func(w http.ResponseWriter, r *http.Request) {
-// 		s.GetLiveStatics(w, r)
-// 	})
-// 	http.Serve(l, mux)
-// 	return nil
-// }
-
-// type stream struct {
-// 	Key             string `json:"key"`
-// 	Url             string `json:"Url"`
-// 	StreamId        uint32 `json:"StreamId"`
-// 	VideoTotalBytes uint64 `json:123456`
-// 	VideoSpeed      uint64 `json:123456`
-// 	AudioTotalBytes uint64 `json:123456`
-// 	AudioSpeed      uint64 `json:123456`
-// }
-
-// type streams struct {
-// 	Publishers []stream `json:"publishers"`
-// 	Players    []stream `json:"players"`
-// }
-
-// //http://127.0.0.1:8090/stat/livestat
-// func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
-// 	streamHandler := server.handler.(*protocol.StreamHandler)
-// 	if streamHandler == nil {
-// 		io.WriteString(w, "<h1>Get rtmp stream information error</h1>")
-// 		return
-// 	}
-
-// 	msgs := new(streams)
-// 	for _, s := range streamHandler.GetStreams() {
-// 		if s.GetReader() != nil {
-// 			switch s.GetReader().(type) {
-// 			case *protocol.StreamReader:
-// 				v := s.GetReader().(*protocol.StreamReader)
-// 				msg := stream{v.StreamInfo().Key, v.StreamInfo().URL, v.ReadBWInfo.StreamID, v.ReadBWInfo.VideoSpeedInBytesperMS,
-// 					v.ReadBWInfo.AudioDatainBytes, v.ReadBWInfo.AudioSpeedInBytesperMS}
-// 				msgs.Publishers = append(msgs.Publishers, msg)
-// 			}
-// 		}
-// 	}
-
-// 	// for item := range streamHandler.GetStreams().IterBuffered() {
-// 	// 	ws := item.Val.(*protocol.RtmpStream).GetWs()
-// 	// 	for s := range ws.IterBuffered() {
-// 	// 		if pw, ok := s.Val.(*protocol.PackWriterCloser); ok {
-// 	// 			if writer, err := pw.NewWriter(); err == nil && writer != nil {
-// 	// 				switch writer.(type) {
-// 	// 				case *protocol.PeerWriter:
-// 	// 					v := writer.(*protocol.PeerWriter)
-// 	// 					msg := stream{item.Key, v.StreamInfo().URL, v.WriteBWInfo.StreamID, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
-// 	// 						v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
-// 	// 					msgs.Players = append(msgs.Players, msg)
-// 	// 				}
-// 	// 			}
-// 	// 		}
-// 	// 	}
-// 	// }
-// 	resp, _ := json.Marshal(msgs)
-// 	w.Header().Set("Content-Type", "application/json")
-// 	w.Write(resp)
-// }
-
-// //http://127.0.0.1:8090/control/push?&oper=start&app=live&name=123456&url=rtmp://192.168.16.136/live/123456
-// func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
-// 	var retString string
-// 	var err error
-
-// 	req.ParseForm()
-
-// 	oper := req.Form["oper"]
-// 	app := req.Form["app"]
-// 	name := req.Form["name"]
-// 	url := req.Form["url"]
-
-// 	fmt.Printf("control pull: oper=%v, app=%v, name=%v, url=%v\n", oper, app, name, url)
-// 	if (len(app) <= 0) || (len(name) <= 0) || (len(url) <= 0) {
-// 		io.WriteString(w, "control push parameter error, please check them.</br>")
-// 		return
-// 	}
-
-// 	remoteurl := "rtmp://127.0.0.1" + s.rtmpAddr + "/" + app[0] + "/" + name[0]
-// 	localurl := url[0]
-
-// 	keyString := "pull:" + app[0] + "/" + name[0]
-// 	if oper[0] == "stop" {
-// 		pullRtmprelay, found := s.session[keyString]
-
-// 		if !found {
-// 			retString = fmt.Sprintf("session key[%s] not exist, please check it again.", keyString)
-// 			io.WriteString(w, retString)
-// 			return
-// 		}
-// 		fmt.Printf("rtmprelay stop push %s from %s\n", remoteurl, localurl)
-// 		pullRtmprelay.Stop()
-
-// 		delete(s.session, keyString)
-// 		retString = fmt.Sprintf("<h1>push url stop %s ok</h1></br>", url[0])
-// 		io.WriteString(w, retString)
-// 		fmt.Printf("pull stop return %s\n", retString)
-// 	} else {
-// 		pullRtmprelay := protocol.NewRtmpRelay(&localurl, &remoteurl)
-// 		fmt.Printf("rtmprelay start push %s from %s\n", remoteurl, localurl)
-// 		err = pullRtmprelay.Start()
-// 		if err != nil {
-// 			retString = fmt.Sprintf("push error=%v", err)
-// 		} else {
-// 			s.session[keyString] = pullRtmprelay
-// 			retString = fmt.Sprintf("<h1>push url start %s ok</h1></br>", url[0])
-// 		}
-// 		io.WriteString(w, retString)
-// 		fmt.Printf("pull start return %s\n", retString)
-// 	}
-// }
-
-// //http://127.0.0.1:8090/control/push?&oper=start&app=live&name=123456&url=rtmp://192.168.16.136/live/123456
-// func (s *Server) handlePush(w http.ResponseWriter, req *http.Request) {
-// 	var retString string
-// 	var err error
-
-// 	req.ParseForm()
-
-// 	oper := req.Form["oper"]
-// 	app := req.Form["app"]
-// 	name := req.Form["name"]
-// 	url := req.Form["url"]
-
-// 	fmt.Printf("control push: oper=%v, app=%v, name=%v, url=%v\n", oper, app, name, url)
-// 	if (len(app) <= 0) || (len(name) <= 0) || (len(url) <= 0) {
-// 		io.WriteString(w, "control push parameter error, please check them.</br>")
-// 		return
-// 	}
-
-// 	localurl := "rtmp://127.0.0.1" + s.rtmpAddr + "/" + app[0] + "/" + name[0]
-// 	remoteurl := url[0]
-
-// 	keyString := "push:" + app[0] + "/" + name[0]
-// 	if oper[0] == "stop" {
-// 		pushRtmprelay, found := s.session[keyString]
-// 		if !found {
-// 			retString = fmt.Sprintf("<h1>session key[%s] not exist, please check it again.</h1>", keyString)
-// 			io.WriteString(w, retString)
-// 			return
-// 		}
-// 		fmt.Printf("rtmprelay stop push %s from %s\n", remoteurl, localurl)
-// 		pushRtmprelay.Stop()
-
-// 		delete(s.session, keyString)
-// 		retString = fmt.Sprintf("<h1>push url stop %s ok</h1></br>", url[0])
-// 		io.WriteString(w, retString)
-// 		fmt.Printf("push stop return %s\n", retString)
-// 	} else {
-// 		pushRtmprelay := protocol.NewRtmpRelay(&localurl, &remoteurl)
-// 		fmt.Printf("rtmprelay start push %s from %s\n", remoteurl, localurl)
-// 		err = pushRtmprelay.Start()
-// 		if err != nil {
-// 			retString = fmt.Sprintf("push error=%v", err)
-// 		} else {
-// 			retString = fmt.Sprintf("<h1>push url start %s ok</h1></br>", url[0])
-// 			s.session[keyString] = pushRtmprelay
-// 		}
-
-// 		io.WriteString(w, retString)
-// 		fmt.Printf("push start return %s\n", retString)
-// 	}
-// }
+package httpopera
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+)
+
+//Response 控制接口的返回
+type Response struct {
+	w       http.ResponseWriter
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+//SendJson 以json格式发送返回
+func (r *Response) SendJson() (int, error) {
+	resp, _ := json.Marshal(r)
+	r.w.Header().Set("Content-Type", "application/json")
+	r.w.WriteHeader(r.Status)
+	return r.w.Write(resp)
+}
+
+//Server http控制服务，提供转推、拉流以及流信息统计接口
+type Server struct {
+	mutex      sync.Mutex
+	httpServer *http.Server
+	closed     bool
+	handler    *protocol.StreamHandler
+	session    map[string]*protocol.RtmpRelay
+	starting   map[string]bool //正在连接的转推，值为true表示连接完成后要停止
+	rtmpAddr   string
+	logger     logger.Logger
+}
+
+//NewServer 创建一个http控制服务，rtmpAddr为本地rtmp服务的监听地址
+func NewServer(h *protocol.StreamHandler, rtmpAddr string, log logger.Logger) *Server {
+	return &Server{
+		handler:  h,
+		session:  make(map[string]*protocol.RtmpRelay),
+		starting: make(map[string]bool),
+		rtmpAddr: rtmpAddr,
+		logger:   log,
+	}
+}
+
+//Serve 在listener上提供http控制服务，Close或者Shutdown之后返回http.ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	httpServer := &http.Server{Handler: s.newServeMux()}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return http.ErrServerClosed
+	}
+	s.httpServer = httpServer
+	s.mutex.Unlock()
+	return httpServer.Serve(l)
+}
+
+//Close 立即关闭http服务，并停止所有转推和拉流
+func (s *Server) Close() error {
+	if httpServer := s.stop(); httpServer != nil {
+		return httpServer.Close()
+	}
+	return nil
+}
+
+//Shutdown 停止所有转推和拉流，等待正在处理的请求完成，参考http.Server.Shutdown
+func (s *Server) Shutdown(ctx context.Context) error {
+	if httpServer := s.stop(); httpServer != nil {
+		return httpServer.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (s *Server) stop() *http.Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for key, relay := range s.session {
+		relay.Stop()
+		delete(s.session, key)
+	}
+	return s.httpServer
+}
+
+func (s *Server) newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/push", func(w http.ResponseWriter, r *http.Request) {
+		s.handlePush(w, r)
+	})
+	mux.HandleFunc("/control/pull", func(w http.ResponseWriter, r *http.Request) {
+		s.handlePull(w, r)
+	})
+	mux.HandleFunc("/stat/livestat", func(w http.ResponseWriter, r *http.Request) {
+		s.GetLiveStatics(w, r)
+	})
+	return mux
+}
+
+type stream struct {
+	Key             string `json:"key"`
+	URL             string `json:"url"`
+	RemoteAddr      string `json:"remote_addr"`
+	StreamID        uint32 `json:"stream_id"`
+	VideoTotalBytes uint64 `json:"video_total_bytes"`
+	VideoSpeed      uint64 `json:"video_speed"`
+	AudioTotalBytes uint64 `json:"audio_total_bytes"`
+	AudioSpeed      uint64 `json:"audio_speed"`
+	//发布端时间戳的修正次数
+	Timestamp *protocol.TimestampStats `json:"timestamp,omitempty"`
+	//播放端发送队列的状态
+	Queue *protocol.WriterQueueStats `json:"queue,omitempty"`
+}
+
+//queueStatser rtmp播放端提供发送队列的状态
+type queueStatser interface {
+	QueueStats() protocol.WriterQueueStats
+}
+
+type streams struct {
+	Publishers []stream `json:"publishers"`
+	Players    []stream `json:"players"`
+}
+
+func newStream(key string, info protocol.BWStatics) stream {
+	bw := info.Statics()
+	return stream{
+		Key:             key,
+		URL:             info.URL(),
+		RemoteAddr:      info.RemoteAddr(),
+		StreamID:        bw.StreamID,
+		VideoTotalBytes: bw.VideoDatainBytes,
+		VideoSpeed:      bw.VideoSpeedInBytesperMS,
+		AudioTotalBytes: bw.AudioDatainBytes,
+		AudioSpeed:      bw.AudioSpeedInBytesperMS,
+	}
+}
+
+//GetLiveStatics 返回所有发布端和播放端的带宽统计信息
+//http://127.0.0.1:8090/stat/livestat
+func (s *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
+	msgs := &streams{
+		Publishers: make([]stream, 0),
+		Players:    make([]stream, 0),
+	}
+	for _, st := range s.handler.GetStreams() {
+		info := st.StreamInfo()
+		key := info.App + "/" + info.Name
+		if r, ok := st.GetReader().(protocol.BWStatics); ok {
+			pub := newStream(key, r)
+			stats := st.TimestampStats()
+			pub.Timestamp = &stats
+			msgs.Publishers = append(msgs.Publishers, pub)
+		}
+		for _, writer := range st.GetWriters() {
+			pw, ok := writer.(protocol.BWStatics)
+			if !ok {
+				continue
+			}
+			player := newStream(key, pw)
+			if qs, ok := writer.(queueStatser); ok {
+				queue := qs.QueueStats()
+				player.Queue = &queue
+			}
+			msgs.Players = append(msgs.Players, player)
+		}
+	}
+	resp, _ := json.Marshal(msgs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+//http://127.0.0.1:8090/control/pull?&oper=start&app=live&name=123456&url=rtmp://192.168.16.136/live/123456
+func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
+	s.handleRelay(w, req, "pull")
+}
+
+//http://127.0.0.1:8090/control/push?&oper=start&app=live&name=123456&url=rtmp://192.168.16.136/live/123456
+func (s *Server) handlePush(w http.ResponseWriter, req *http.Request) {
+	s.handleRelay(w, req, "push")
+}
+
+//pull从url拉流并发布到本地，push从本地拉流并推送到url
+func (s *Server) handleRelay(w http.ResponseWriter, req *http.Request, method string) {
+	res := &Response{
+		w:      w,
+		Status: http.StatusOK,
+	}
+	defer res.SendJson()
+
+	if err := req.ParseForm(); err != nil {
+		res.Status = http.StatusBadRequest
+		res.Message = fmt.Sprintf("parse form failed, %v", err)
+		return
+	}
+	oper := req.Form.Get("oper")
+	app := req.Form.Get("app")
+	name := req.Form.Get("name")
+	url := req.Form.Get("url")
+	s.logger.Infof("Control %s: oper=%s, app=%s, name=%s, url=%s", method, oper, app, name, url)
+	if app == "" || name == "" || url == "" || (oper != "start" && oper != "stop") {
+		res.Status = http.StatusBadRequest
+		res.Message = fmt.Sprintf("control %s parameter error, please check them.", method)
+		return
+	}
+
+	localURL := s.localURL(app, name)
+	playURL, publishURL := localURL, url
+	if method == "pull" {
+		playURL, publishURL = url, localURL
+	}
+
+	key := method + ":" + app + "/" + name
+	if oper == "stop" {
+		if !s.stopRelay(key) {
+			res.Status = http.StatusNotFound
+			res.Message = fmt.Sprintf("session key[%s] not exist, please check it again.", key)
+			return
+		}
+		res.Message = fmt.Sprintf("%s url stop %s ok", method, url)
+		return
+	}
+
+	if status, err := s.reserveRelay(key); err != nil {
+		res.Status = status
+		res.Message = err.Error()
+		return
+	}
+	//连接可能很慢，不持有锁
+	relay := protocol.NewRtmpRelay(&playURL, &publishURL, s.logger)
+	err := relay.Start()
+	if !s.commitRelay(key, relay, err) {
+		if err != nil {
+			res.Status = http.StatusInternalServerError
+			res.Message = fmt.Sprintf("%s error=%v", method, err)
+			return
+		}
+		relay.Stop()
+		res.Status = http.StatusConflict
+		res.Message = fmt.Sprintf("session key[%s] stopped while starting.", key)
+		return
+	}
+	res.Message = fmt.Sprintf("%s url start %s ok", method, url)
+}
+
+//reserveRelay 占用key，同一个key同时只有一个请求在连接，失败时返回http状态码
+func (s *Server) reserveRelay(key string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return http.StatusServiceUnavailable, errors.New("server closed")
+	}
+	if _, ok := s.starting[key]; ok {
+		return http.StatusConflict, fmt.Errorf("session key[%s] is starting.", key)
+	}
+	if relay, found := s.session[key]; found && relay.IsStart() {
+		return http.StatusConflict, fmt.Errorf("session key[%s] already started.", key)
+	}
+	s.starting[key] = false
+	return http.StatusOK, nil
+}
+
+//commitRelay 释放reserveRelay占用的key，启动成功并且期间没有被停止时保存relay
+func (s *Server) commitRelay(key string, relay *protocol.RtmpRelay, err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cancelled := s.starting[key] || s.closed
+	delete(s.starting, key)
+	if err != nil || cancelled {
+		return false
+	}
+	s.session[key] = relay
+	return true
+}
+
+//stopRelay 停止key对应的转推，正在连接时连接完成后停止，key不存在时返回false
+func (s *Server) stopRelay(key string) bool {
+	s.mutex.Lock()
+	if _, ok := s.starting[key]; ok {
+		s.starting[key] = true
+		s.mutex.Unlock()
+		return true
+	}
+	relay, found := s.session[key]
+	delete(s.session, key)
+	s.mutex.Unlock()
+	if found {
+		relay.Stop()
+	}
+	return found
+}
+
+func (s *Server) localURL(app, name string) string {
+	host, port, err := net.SplitHostPort(s.rtmpAddr)
+	if err != nil {
+		host, port = "", "1935"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("rtmp://%s/%s/%s", net.JoinHostPort(host, port), app, name)
+}
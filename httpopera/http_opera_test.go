@@ -0,0 +1,121 @@
+package httpopera
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer() *Server {
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	return NewServer(protocol.NewStreamHandler(log), ":1935", log)
+}
+
+func TestLiveStatEmpty(t *testing.T) {
+	s := newTestServer()
+	rec := httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(rec, httptest.NewRequest("GET", "/stat/livestat", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var msgs streams
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &msgs))
+	assert.Equal(t, 0, len(msgs.Publishers))
+	assert.Equal(t, 0, len(msgs.Players))
+}
+
+func TestRelayParameter(t *testing.T) {
+	s := newTestServer()
+	mux := s.newServeMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/control/push?oper=start&app=live", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/control/pull?oper=stop&app=live&name=a&url=rtmp://127.0.0.1/live/a", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	var res Response
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, http.StatusNotFound, res.Status)
+}
+
+func TestLocalURL(t *testing.T) {
+	s := newTestServer()
+	assert.Equal(t, "rtmp://127.0.0.1:1935/live/a", s.localURL("live", "a"))
+	s.rtmpAddr = "10.0.0.1:19350"
+	assert.Equal(t, "rtmp://10.0.0.1:19350/live/a", s.localURL("live", "a"))
+}
+
+func TestRelayStartUnlocked(t *testing.T) {
+	//接受连接但是不回复握手，拉流一直阻塞在Start中
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	s := newTestServer()
+	mux := s.newServeMux()
+	pull := "/control/pull?oper=%s&app=live&name=a&url=rtmp://" + l.Addr().String() + "/live/a"
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf(pull, "start"), nil))
+		done <- rec
+	}()
+	conn := <-accepted
+	defer conn.Close()
+
+	//连接时其他请求不被阻塞，同一个key不能重复启动
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/stat/livestat", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf(pull, "start"), nil))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf(pull, "stop"), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, s.Close())
+
+	//连接失败后释放key
+	conn.Close()
+	select {
+	case rec = <-done:
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay start blocked")
+	}
+	assert.Equal(t, 0, len(s.starting))
+	assert.Equal(t, 0, len(s.session))
+}
+
+func TestCommitRelay(t *testing.T) {
+	s := newTestServer()
+	relay := protocol.NewRtmpRelay(new(string), new(string), s.logger)
+	_, err := s.reserveRelay("pull:live/a")
+	assert.Nil(t, err)
+	assert.True(t, s.commitRelay("pull:live/a", relay, nil))
+	assert.Equal(t, relay, s.session["pull:live/a"])
+
+	//连接期间被停止，不再保存
+	_, err = s.reserveRelay("pull:live/b")
+	assert.Nil(t, err)
+	assert.True(t, s.stopRelay("pull:live/b"))
+	assert.False(t, s.commitRelay("pull:live/b", relay, nil))
+	_, found := s.session["pull:live/b"]
+	assert.False(t, found)
+}
@@ -0,0 +1,426 @@
+package aac
+
+import (
+	"errors"
+	"math"
+	"math/cmplx"
+
+	"github.com/fabo871218/srtmp/utils"
+)
+
+const (
+	//FrameSamples aac-lc每帧的采样数
+	FrameSamples = 1024
+
+	windowLen  = 2 * FrameSamples
+	sfOffset   = 100 //反量化时scalefactor减去的偏移，见ISO 14496-3 4.6.2.3.3
+	maxSf      = 255
+	maxSfDiff  = 60 //相邻scalefactor的最大差值，scalefactor码表的范围
+	zeroHcb    = 0
+	sectEsc    = 31
+	elemSCE    = 0
+	elemEND    = 7
+	magicRound = 0.4054 //量化时的舍入偏移，见ISO 14496-3 4.6.1.3
+
+	//bandLevel 频带的均方根量化到该值，决定量化噪声相对于信号的大小
+	bandLevel = 6.0
+	//量化步长小于该值的频带认为是静音，约为pcm中1的白噪声
+	minStep = 8.0
+	//defaultBitrate 每帧的码率上限，超过时整体增大量化步长
+	defaultBitrate = 32000
+	//maxLav 量化值的最大绝对值，等于码表9和10的lav
+	maxLav = 12
+)
+
+var errSampleRate = errors.New("aac encoder only support 8000Hz")
+
+//8kHz长窗的scalefactor band划分，见ISO 14496-3 表4.143
+var swbOffset8k = []int{0, 12, 24, 36, 48, 60, 72, 84, 96, 108, 120, 132, 144, 156, 172, 188,
+	204, 220, 236, 252, 268, 288, 308, 328, 348, 372, 396, 420, 448, 476, 508, 544, 580, 620,
+	664, 712, 764, 820, 880, 944, 1024}
+
+//Encoder 纯go实现的单声道aac-lc编码器，用于把g711等8kHz的语音转换成aac。
+//只使用长窗，每个频带按能量选择scalefactor，按ISO 14496-3的非均匀量化得到完整的量化值，
+//再选择码字最短的huffman码表，每帧的码率不超过32kbps
+//
+//限制：只支持8000Hz单声道；没有心理声学模型、TNS和块切换，量化值不超过12(不使用转义码表)，
+//瞬态信号会有前回声，音乐或者需要高保真的场景应该使用完整的aac编码器
+type Encoder struct {
+	sampleRate int
+	frameBits  int //每帧的最大比特数
+	swbOffset  []int
+	window     []float64
+	prev       []float64 //上一帧的输入，和当前帧组成2048点的窗
+	twiddle    []complex128
+	post       []complex128
+	fft        []complex128
+	spec       []float64
+}
+
+//NewEncoder 创建编码器，目前只支持8000Hz
+func NewEncoder(sampleRate int) (*Encoder, error) {
+	if sampleRate != 8000 {
+		return nil, errSampleRate
+	}
+	e := &Encoder{
+		sampleRate: sampleRate,
+		frameBits:  defaultBitrate * FrameSamples / sampleRate,
+		swbOffset:  swbOffset8k,
+		window:     make([]float64, windowLen),
+		prev:       make([]float64, FrameSamples),
+		twiddle:    make([]complex128, FrameSamples/2),
+		post:       make([]complex128, FrameSamples/2),
+		fft:        make([]complex128, FrameSamples/2),
+		spec:       make([]float64, FrameSamples),
+	}
+	for n := range e.window {
+		e.window[n] = math.Sin(math.Pi / windowLen * (float64(n) + 0.5))
+	}
+	for n := range e.twiddle {
+		e.twiddle[n] = cmplx.Exp(complex(0, -math.Pi*(4*float64(n)+1)/(4*FrameSamples)))
+		e.post[n] = cmplx.Exp(complex(0, -math.Pi*float64(n)/FrameSamples))
+	}
+	return e, nil
+}
+
+//SpecificConfig 返回编码器对应的AudioSpecificConfig
+func (e *Encoder) SpecificConfig() []byte {
+	return SpecificConfig(2, 11, 1)
+}
+
+//SampleRate ...
+func (e *Encoder) SampleRate() int {
+	return e.sampleRate
+}
+
+//Encode 编码1024个采样，返回raw_data_block。输出有一帧的延迟，第n次输出的帧
+//解码后对应第n-1次输入的采样
+func (e *Encoder) Encode(pcm []int16) ([]byte, error) {
+	if len(pcm) != FrameSamples {
+		return nil, errors.New("aac encoder need 1024 samples")
+	}
+	e.mdct(pcm)
+
+	nsfb := len(e.swbOffset) - 1
+	sf := make([]int, nsfb)
+	for b := 0; b < nsfb; b++ {
+		sf[b] = chooseScalefactor(e.spec[e.swbOffset[b]:e.swbOffset[b+1]])
+	}
+	//超过码率上限时所有频带的量化步长增大约3dB，scalefactor足够大时所有频带都是静音
+	for boost := 0; ; boost += 2 {
+		data := e.encodeBlock(sf, boost)
+		if len(data)*8 <= e.frameBits {
+			return data, nil
+		}
+	}
+}
+
+//encodeBlock 所有非静音频带的scalefactor增加boost后量化并编码
+func (e *Encoder) encodeBlock(chosen []int, boost int) []byte {
+	nsfb := len(chosen)
+	sf := make([]int, nsfb)
+	for b, v := range chosen {
+		sf[b] = -1
+		if v >= 0 {
+			sf[b] = v + boost
+			if sf[b] > maxSf {
+				sf[b] = maxSf
+			}
+		}
+	}
+	quant := make([]int, FrameSamples)
+	cbs := make([]int, nsfb)
+	//量化之后全为0的频带改为静音，相邻的scalefactor变化后重新检查差值
+	for changed := true; changed; {
+		changed = false
+		limitScalefactors(sf)
+		for b := range sf {
+			q := quant[e.swbOffset[b]:e.swbOffset[b+1]]
+			if sf[b] < 0 {
+				clearBand(q)
+				continue
+			}
+			if !quantizeBand(e.spec[e.swbOffset[b]:e.swbOffset[b+1]], sf[b], q) {
+				sf[b] = -1
+				changed = true
+			}
+		}
+	}
+	maxSfb := 0
+	for b, v := range sf {
+		if v >= 0 {
+			cbs[b] = bestCodebook(quant[e.swbOffset[b]:e.swbOffset[b+1]])
+			maxSfb = b + 1
+		}
+	}
+	return e.writeBlock(sf[:maxSfb], cbs[:maxSfb], quant)
+}
+
+//mdct 对上一帧和当前帧加正弦窗后做mdct，结果写入e.spec，
+//X[k] = 2 * sum(z[n] * cos(2π/N * (n + n0) * (k + 1/2)))，见ISO 14496-3 4.6.11
+func (e *Encoder) mdct(pcm []int16) {
+	const m = FrameSamples
+	z := make([]float64, windowLen)
+	for n := 0; n < m; n++ {
+		z[n] = e.prev[n] * e.window[n]
+		cur := float64(pcm[n])
+		z[m+n] = cur * e.window[m+n]
+		e.prev[n] = cur
+	}
+	//折叠成m点的DCT-IV输入：(-c_r-d, a-b_r)
+	v := make([]float64, m)
+	h := m / 2
+	for n := 0; n < h; n++ {
+		v[n] = -z[3*h-1-n] - z[3*h+n]
+		v[h+n] = z[n] - z[m-1-n]
+	}
+	//m点的DCT-IV通过m/2点的复数fft计算
+	for n := 0; n < h; n++ {
+		e.fft[n] = complex(v[2*n], v[m-1-2*n]) * e.twiddle[n]
+	}
+	fft(e.fft)
+	for k := 0; k < h; k++ {
+		y := e.fft[k] * e.post[k]
+		e.spec[2*k] = 2 * real(y)
+		e.spec[m-1-2*k] = -2 * imag(y)
+	}
+}
+
+//chooseScalefactor 使频带的均方根量化到bandLevel，并且最大的系数不超过码表的lav，静音频带返回-1
+func chooseScalefactor(spec []float64) int {
+	energy, peak := 0.0, 0.0
+	for _, x := range spec {
+		energy += x * x
+		peak = math.Max(peak, math.Abs(x))
+	}
+	step := math.Sqrt(energy/float64(len(spec))) / math.Pow(bandLevel, 4.0/3)
+	if step < minStep {
+		return -1
+	}
+	sf := sfOffset + int(math.Ceil(4*math.Log2(step)))
+	for sf < maxSf && quantize(peak, sf) > maxLav {
+		sf++
+	}
+	if sf > maxSf {
+		sf = maxSf
+	}
+	return sf
+}
+
+//limitScalefactors 相邻两个非静音频带的scalefactor差值不能超过maxSfDiff，
+//较小的scalefactor增大到满足限制，量化值只会变小
+func limitScalefactors(sf []int) {
+	last := -1
+	for b, v := range sf {
+		if v < 0 {
+			continue
+		}
+		if last >= 0 && v < sf[last]-maxSfDiff {
+			sf[b] = sf[last] - maxSfDiff
+		}
+		last = b
+	}
+	last = -1
+	for b := len(sf) - 1; b >= 0; b-- {
+		if sf[b] < 0 {
+			continue
+		}
+		if last >= 0 && sf[b] < sf[last]-maxSfDiff {
+			sf[b] = sf[last] - maxSfDiff
+		}
+		last = b
+	}
+}
+
+//quantize 按ISO 14496-3 4.6.1.3量化，反量化为|q|^(4/3) * 2^((sf-100)/4)
+func quantize(x float64, sf int) int {
+	step := math.Pow(2, float64(sf-sfOffset)/4)
+	return int(math.Pow(math.Abs(x)/step, 0.75) + magicRound)
+}
+
+//quantizeBand 量化频带的系数，全为0时返回false
+func quantizeBand(spec []float64, sf int, quant []int) bool {
+	nonzero := false
+	for i, x := range spec {
+		quant[i] = quantize(x, sf)
+		if quant[i] > maxLav {
+			quant[i] = maxLav
+		}
+		if x < 0 {
+			quant[i] = -quant[i]
+		}
+		nonzero = nonzero || quant[i] != 0
+	}
+	return nonzero
+}
+
+func clearBand(quant []int) {
+	for i := range quant {
+		quant[i] = 0
+	}
+}
+
+//bestCodebook 返回能表示频带所有量化值、并且比特数最少的码表，全为0时返回ZERO_HCB
+func bestCodebook(quant []int) int {
+	peak := 0
+	for _, v := range quant {
+		if v < 0 {
+			v = -v
+		}
+		if v > peak {
+			peak = v
+		}
+	}
+	if peak == 0 {
+		return zeroHcb
+	}
+	best, bestBits := zeroHcb, 0
+	for n, cb := range spectrumCodebooks {
+		if cb == nil || cb.lav < peak {
+			continue
+		}
+		if bits := cb.cost(quant); best == zeroHcb || bits < bestBits {
+			best, bestBits = n, bits
+		}
+	}
+	return best
+}
+
+//index 返回一组系数对应的码字下标
+func (cb *spectrumCodebook) index(q []int) int {
+	idx := 0
+	for _, v := range q {
+		if cb.unsigned {
+			if v < 0 {
+				v = -v
+			}
+			idx = idx*(cb.lav+1) + v
+		} else {
+			idx = idx*(2*cb.lav+1) + v + cb.lav
+		}
+	}
+	return idx
+}
+
+//cost 返回编码quant需要的比特数，包括符号位
+func (cb *spectrumCodebook) cost(quant []int) int {
+	bits := 0
+	for i := 0; i < len(quant); i += cb.dim {
+		bits += int(cb.bits[cb.index(quant[i:i+cb.dim])])
+		if cb.unsigned {
+			for _, v := range quant[i : i+cb.dim] {
+				if v != 0 {
+					bits++
+				}
+			}
+		}
+	}
+	return bits
+}
+
+//write 写入quant的码字，无符号码表的码字后面跟非零系数的符号位，1表示负数
+func (cb *spectrumCodebook) write(bw *utils.BitWriter, quant []int) {
+	for i := 0; i < len(quant); i += cb.dim {
+		q := quant[i : i+cb.dim]
+		idx := cb.index(q)
+		bw.WriteBits(uint32(cb.codes[idx]), int(cb.bits[idx]))
+		if cb.unsigned {
+			for _, v := range q {
+				if v != 0 {
+					bw.WriteFlag(v < 0)
+				}
+			}
+		}
+	}
+}
+
+//writeBlock 写入单声道的raw_data_block，码表为ZERO_HCB的频带没有scalefactor和频谱数据
+func (e *Encoder) writeBlock(sf, cbs []int, quant []int) []byte {
+	bw := utils.NewBitWriter(256)
+	bw.WriteBits(elemSCE, 3)
+	bw.WriteBits(0, 4) //element_instance_tag
+
+	//global_gain等于第一个非静音频带的scalefactor
+	globalGain := sfOffset
+	for _, v := range sf {
+		if v >= 0 {
+			globalGain = v
+			break
+		}
+	}
+	bw.WriteBits(uint32(globalGain), 8)
+
+	//ics_info: ics_reserved_bit, ONLY_LONG_SEQUENCE, 正弦窗, max_sfb, predictor_data_present
+	bw.WriteBits(0, 1)
+	bw.WriteBits(0, 2)
+	bw.WriteBits(0, 1)
+	bw.WriteBits(uint32(len(sf)), 6)
+	bw.WriteBits(0, 1)
+
+	//section_data，相邻使用相同码表的频带合并为一个section
+	for b := 0; b < len(cbs); {
+		n := 1
+		for b+n < len(cbs) && cbs[b+n] == cbs[b] {
+			n++
+		}
+		bw.WriteBits(uint32(cbs[b]), 4)
+		left := n
+		for ; left >= sectEsc; left -= sectEsc {
+			bw.WriteBits(sectEsc, 5)
+		}
+		bw.WriteBits(uint32(left), 5)
+		b += n
+	}
+
+	//scale_factor_data，第一个差值相对于global_gain
+	last := globalGain
+	for b, v := range sf {
+		if cbs[b] == zeroHcb {
+			continue
+		}
+		d := v - last + maxSfDiff
+		bw.WriteBits(sfCodes[d], int(sfBits[d]))
+		last = v
+	}
+
+	//pulse_data_present, tns_data_present, gain_control_data_present
+	bw.WriteBits(0, 3)
+
+	//spectral_data
+	for b, n := range cbs {
+		if n != zeroHcb {
+			spectrumCodebooks[n].write(bw, quant[e.swbOffset[b]:e.swbOffset[b+1]])
+		}
+	}
+
+	bw.WriteBits(elemEND, 3)
+	return bw.Bytes()
+}
+
+//fft 原地计算基2的复数fft，len(a)必须是2的幂
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wn := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := a[start+k]
+				t := wn * a[start+k+size/2]
+				a[start+k] = u + t
+				a[start+k+size/2] = u - t
+				wn *= w
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package aac
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fabo871218/srtmp/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+//按ISO 14496-3 4.6.11的公式计算imdct，x[n] = 2/N * sum(X[k] * cos(2π/N * (n + n0) * (k + 1/2)))
+func imdct(spec []float64) []float64 {
+	n0 := float64(windowLen)/4 + 0.5
+	out := make([]float64, windowLen)
+	for n := range out {
+		sum := 0.0
+		for k, x := range spec {
+			sum += x * math.Cos(2*math.Pi/windowLen*(float64(n)+n0)*(float64(k)+0.5))
+		}
+		out[n] = 2 / float64(windowLen) * sum
+	}
+	return out
+}
+
+//只解析Encoder输出的码流子集，返回反量化后的频谱
+func decodeBlock(t *testing.T, data []byte) []float64 {
+	br := utils.NewBitReader(data)
+	assert.Equal(t, uint32(elemSCE), br.ReadBits(3))
+	br.Skip(4)
+	globalGain := int(br.ReadBits(8))
+	assert.Equal(t, uint32(0), br.ReadBits(4))
+	maxSfb := int(br.ReadBits(6))
+	assert.False(t, br.ReadFlag())
+
+	cbs := make([]int, 0, maxSfb)
+	for len(cbs) < maxSfb {
+		cb := int(br.ReadBits(4))
+		n := 0
+		for {
+			incr := int(br.ReadBits(5))
+			n += incr
+			if incr != sectEsc {
+				break
+			}
+		}
+		for i := 0; i < n; i++ {
+			cbs = append(cbs, cb)
+		}
+	}
+
+	readCode := func(codes map[uint32]int) int {
+		code, bits := uint32(0), 0
+		for bits < 19 {
+			code = code<<1 | br.ReadBits(1)
+			bits++
+			if v, ok := codes[uint32(bits)<<24|code]; ok {
+				return v
+			}
+		}
+		t.Fatalf("invalid code %x", code)
+		return 0
+	}
+	sfTable := map[uint32]int{}
+	for i, c := range sfCodes {
+		sfTable[uint32(sfBits[i])<<24|c] = i - maxSfDiff
+	}
+
+	sf := make([]int, maxSfb)
+	last := globalGain
+	for b, cb := range cbs {
+		if cb != zeroHcb {
+			last += readCode(sfTable)
+			sf[b] = last
+		}
+	}
+	assert.Equal(t, uint32(0), br.ReadBits(3))
+
+	spec := make([]float64, FrameSamples)
+	for b, n := range cbs {
+		if n == zeroHcb {
+			continue
+		}
+		cb := spectrumCodebooks[n]
+		table := map[uint32]int{}
+		for i, c := range cb.codes {
+			table[uint32(cb.bits[i])<<24|uint32(c)] = i
+		}
+		gain := math.Pow(2, float64(sf[b]-sfOffset)/4)
+		for i := swbOffset8k[b]; i < swbOffset8k[b+1]; i += cb.dim {
+			q := make([]int, cb.dim)
+			idx := readCode(table)
+			for j := cb.dim - 1; j >= 0; j-- {
+				if cb.unsigned {
+					q[j] = idx % (cb.lav + 1)
+					idx /= cb.lav + 1
+				} else {
+					q[j] = idx%(2*cb.lav+1) - cb.lav
+					idx /= 2*cb.lav + 1
+				}
+			}
+			for j, v := range q {
+				if cb.unsigned && v != 0 && br.ReadFlag() {
+					v = -v
+				}
+				spec[i+j] = math.Copysign(math.Pow(math.Abs(float64(v)), 4.0/3), float64(v)) * gain
+			}
+		}
+	}
+	assert.Equal(t, uint32(elemEND), br.ReadBits(3))
+	assert.Nil(t, br.Err())
+	assert.True(t, len(data)*8-br.Pos() < 8)
+	return spec
+}
+
+//码表必须是完整的前缀码：Kraft和等于1，并且没有码字是另一个码字的前缀
+func checkPrefixCode(t *testing.T, codes []uint32, bits []uint8) {
+	assert.Equal(t, len(codes), len(bits))
+	kraft := 0.0
+	words := make([]string, len(codes))
+	for i, c := range codes {
+		assert.True(t, c < 1<<bits[i])
+		kraft += math.Pow(2, -float64(bits[i]))
+		words[i] = fmt.Sprintf("%0*b", bits[i], c)
+	}
+	assert.InDelta(t, 1, kraft, 1e-12)
+	sort.Strings(words)
+	for i := 1; i < len(words); i++ {
+		assert.False(t, strings.HasPrefix(words[i], words[i-1]), "%s is prefix of %s", words[i-1], words[i])
+	}
+}
+
+func TestHuffmanTables(t *testing.T) {
+	assert.Equal(t, 2*maxSfDiff+1, len(sfCodes))
+	checkPrefixCode(t, sfCodes, sfBits)
+	for n, cb := range spectrumCodebooks {
+		if cb == nil {
+			continue
+		}
+		size := cb.lav + 1
+		if !cb.unsigned {
+			size = 2*cb.lav + 1
+		}
+		assert.Equal(t, int(math.Pow(float64(size), float64(cb.dim))), len(cb.codes), "codebook %d", n)
+		codes := make([]uint32, len(cb.codes))
+		for i, c := range cb.codes {
+			codes[i] = uint32(c)
+		}
+		checkPrefixCode(t, codes, cb.bits)
+	}
+	//全为0时码字最短
+	assert.Equal(t, 1, int(spectrumCodebooks[3].bits[0]))
+	assert.Equal(t, 1, int(spectrumCodebooks[5].bits[40]))
+}
+
+func TestMDCTReconstruct(t *testing.T) {
+	e, err := NewEncoder(8000)
+	assert.Nil(t, err)
+
+	pcm := make([]int16, 3*FrameSamples)
+	for i := range pcm {
+		pcm[i] = int16(8000*math.Sin(2*math.Pi*440*float64(i)/8000) + 3000*math.Sin(float64(i)))
+	}
+	var prev []float64
+	for f := 0; f < 3; f++ {
+		e.mdct(pcm[f*FrameSamples : (f+1)*FrameSamples])
+		out := imdct(e.spec)
+		for n := range out {
+			out[n] *= e.window[n]
+		}
+		if prev != nil {
+			//重叠相加后得到上一帧的输入
+			for n := 0; n < FrameSamples; n++ {
+				assert.InDelta(t, float64(pcm[(f-1)*FrameSamples+n]), prev[FrameSamples+n]+out[n], 0.01)
+			}
+		}
+		prev = out
+	}
+}
+
+func TestEncodeTone(t *testing.T) {
+	_, err := NewEncoder(44100)
+	assert.NotNil(t, err)
+
+	e, err := NewEncoder(8000)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x15, 0x88}, e.SpecificConfig())
+
+	_, err = e.Encode(make([]int16, 100))
+	assert.NotNil(t, err)
+
+	//静音只有头部
+	data, err := e.Encode(make([]int16, FrameSamples))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(data))
+
+	pcm := make([]int16, 4*FrameSamples)
+	for i := range pcm {
+		pcm[i] = int16(6000*math.Sin(2*math.Pi*440*float64(i)/8000) +
+			2000*math.Sin(2*math.Pi*1250*float64(i)/8000))
+	}
+	e, _ = NewEncoder(8000)
+	var prev []float64
+	for f := 0; f < 4; f++ {
+		data, err := e.Encode(pcm[f*FrameSamples : (f+1)*FrameSamples])
+		assert.Nil(t, err)
+		assert.True(t, len(data) < 768)
+		out := imdct(decodeBlock(t, data))
+		for n := range out {
+			out[n] *= e.window[n]
+		}
+		if prev != nil && f >= 2 {
+			//比较解码后的波形和输入的相关系数
+			var xy, xx, yy float64
+			for n := 0; n < FrameSamples; n++ {
+				x := float64(pcm[(f-1)*FrameSamples+n])
+				y := prev[FrameSamples+n] + out[n]
+				xy += x * y
+				xx += x * x
+				yy += y * y
+			}
+			corr := xy / math.Sqrt(xx*yy)
+			assert.True(t, corr > 0.99, "corr %f", corr)
+			assert.InDelta(t, 1, math.Sqrt(yy/xx), 0.1)
+		}
+		prev = out
+	}
+}
+
+func TestEncodeBitrate(t *testing.T) {
+	//满幅的白噪声超过码率上限，增大量化步长后仍然可以解码
+	rnd := rand.New(rand.NewSource(1))
+	pcm := make([]int16, FrameSamples)
+	e, _ := NewEncoder(8000)
+	for f := 0; f < 3; f++ {
+		for i := range pcm {
+			pcm[i] = int16(rnd.Intn(65536) - 32768)
+		}
+		data, err := e.Encode(pcm)
+		assert.Nil(t, err)
+		assert.True(t, len(data)*8 <= e.frameBits, "frame bits %d", len(data)*8)
+		spec := decodeBlock(t, data)
+		if f > 0 {
+			assert.NotZero(t, spec[100])
+		}
+	}
+}
+
+func TestBestCodebook(t *testing.T) {
+	assert.Equal(t, zeroHcb, bestCodebook(make([]int, 12)))
+	small := []int{0, 1, 0, -1, 1, 0, 0, 0, 2, 0, 0, 0}
+	cb := bestCodebook(small)
+	assert.True(t, cb >= 3 && cb <= 6, "codebook %d", cb)
+	large := []int{12, -3, 0, 5, 7, 1, 0, 0, 2, 0, 0, 0}
+	cb = bestCodebook(large)
+	assert.True(t, cb == 9 || cb == 10, "codebook %d", cb)
+	assert.Equal(t, spectrumCodebooks[cb].cost(large), func() int {
+		bw := utils.NewBitWriter(16)
+		spectrumCodebooks[cb].write(bw, large)
+		return bw.Pos()
+	}())
+}
@@ -0,0 +1,258 @@
+package aac
+
+//scalefactor差值的huffman码表，下标为差值+maxSfDiff，见ISO 14496-3 表4.A.1
+var sfCodes = []uint32{
+	0x3ffe8, 0x3ffe6, 0x3ffe7, 0x3ffe5, 0x7fff5, 0x7fff1, 0x7ffed, 0x7fff6,
+	0x7ffee, 0x7ffef, 0x7fff0, 0x7fffc, 0x7fffd, 0x7ffff, 0x7fffe, 0x7fff7,
+	0x7fff8, 0x7fffb, 0x7fff9, 0x3ffe4, 0x7fffa, 0x3ffe3, 0x1ffef, 0x1fff0,
+	0x0fff5, 0x1ffee, 0x0fff2, 0x0fff3, 0x0fff4, 0x0fff1, 0x07ff6, 0x07ff7,
+	0x03ff9, 0x03ff5, 0x03ff7, 0x03ff3, 0x03ff6, 0x03ff2, 0x01ff7, 0x01ff5,
+	0x00ff9, 0x00ff7, 0x00ff6, 0x007f9, 0x00ff4, 0x007f8, 0x003f9, 0x003f7,
+	0x003f5, 0x001f8, 0x001f7, 0x000fa, 0x000f8, 0x000f6, 0x00079, 0x0003a,
+	0x00038, 0x0001a, 0x0000b, 0x00004, 0x00000, 0x0000a, 0x0000c, 0x0001b,
+	0x00039, 0x0003b, 0x00078, 0x0007a, 0x000f7, 0x000f9, 0x001f6, 0x001f9,
+	0x003f4, 0x003f6, 0x003f8, 0x007f5, 0x007f4, 0x007f6, 0x007f7, 0x00ff5,
+	0x00ff8, 0x01ff4, 0x01ff6, 0x01ff8, 0x03ff8, 0x03ff4, 0x0fff0, 0x07ff4,
+	0x0fff6, 0x07ff5, 0x3ffe2, 0x7ffd9, 0x7ffda, 0x7ffdb, 0x7ffdc, 0x7ffdd,
+	0x7ffde, 0x7ffd8, 0x7ffd2, 0x7ffd3, 0x7ffd4, 0x7ffd5, 0x7ffd6, 0x7fff2,
+	0x7ffdf, 0x7ffe7, 0x7ffe8, 0x7ffe9, 0x7ffea, 0x7ffeb, 0x7ffe6, 0x7ffe0,
+	0x7ffe1, 0x7ffe2, 0x7ffe3, 0x7ffe4, 0x7ffe5, 0x7ffd7, 0x7ffec, 0x7fff4,
+	0x7fff3,
+}
+
+var sfBits = []uint8{
+	18, 18, 18, 18, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19,
+	19, 19, 19, 18, 19, 18, 17, 17, 16, 17, 16, 16, 16, 16, 15, 15,
+	14, 14, 14, 14, 14, 14, 13, 13, 12, 12, 12, 11, 12, 11, 10, 10,
+	10, 9, 9, 8, 8, 8, 7, 6, 6, 5, 4, 3, 1, 4, 4, 5,
+	6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 10, 11, 11, 11, 11, 12,
+	12, 13, 13, 13, 14, 14, 16, 15, 16, 15, 18, 19, 19, 19, 19, 19,
+	19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19,
+	19, 19, 19, 19, 19, 19, 19, 19, 19,
+}
+
+//spectrumCodebook 频谱系数的huffman码表，见ISO 14496-3 表4.A.2~4.A.12
+type spectrumCodebook struct {
+	dim      int  //每个码字编码的系数个数
+	lav      int  //系数绝对值的最大值
+	unsigned bool //码字只编码绝对值，非零系数后面跟符号位
+	codes    []uint16
+	bits     []uint8
+}
+
+//spectrumCodebooks 下标为码表编号。码表1和2的取值范围被3和4覆盖，没有使用；
+//没有使用转义码表11，量化值不超过码表9和10的lav
+var spectrumCodebooks = [...]*spectrumCodebook{
+	3:  {dim: 4, lav: 2, unsigned: true, codes: codes3, bits: bits3},
+	4:  {dim: 4, lav: 2, unsigned: true, codes: codes4, bits: bits4},
+	5:  {dim: 2, lav: 4, unsigned: false, codes: codes5, bits: bits5},
+	6:  {dim: 2, lav: 4, unsigned: false, codes: codes6, bits: bits6},
+	7:  {dim: 2, lav: 7, unsigned: true, codes: codes7, bits: bits7},
+	8:  {dim: 2, lav: 7, unsigned: true, codes: codes8, bits: bits8},
+	9:  {dim: 2, lav: 12, unsigned: true, codes: codes9, bits: bits9},
+	10: {dim: 2, lav: 12, unsigned: true, codes: codes10, bits: bits10},
+}
+
+var codes3 = []uint16{
+	0x000, 0x009, 0x0ef, 0x00b, 0x019, 0x0f0, 0x1eb, 0x1e6, 0x3f2,
+	0x00a, 0x035, 0x1ef, 0x034, 0x037, 0x1e9, 0x1ed, 0x1e7, 0x3f3,
+	0x1ee, 0x3ed, 0x1ffa, 0x1ec, 0x1f2, 0x7f9, 0x7f8, 0x3f8, 0xff8,
+	0x008, 0x038, 0x3f6, 0x036, 0x075, 0x3f1, 0x3eb, 0x3ec, 0xff4,
+	0x018, 0x076, 0x7f4, 0x039, 0x074, 0x3ef, 0x1f3, 0x1f4, 0x7f6,
+	0x1e8, 0x3ea, 0x1ffc, 0x0f2, 0x1f1, 0xffb, 0x3f5, 0x7f3, 0xffc,
+	0x0ee, 0x3f7, 0x7ffe, 0x1f0, 0x7f5, 0x7ffd, 0x1ffb, 0x3ffa, 0xffff,
+	0x0f1, 0x3f0, 0x3ffc, 0x1ea, 0x3ee, 0x3ffb, 0xff6, 0xffa, 0x7ffc,
+	0x7f2, 0xff5, 0xfffe, 0x3f4, 0x7f7, 0x7ffb, 0xff7, 0xff9, 0x7ffa,
+}
+
+var bits3 = []uint8{
+	1, 4, 8, 4, 5, 8, 9, 9, 10,
+	4, 6, 9, 6, 6, 9, 9, 9, 10,
+	9, 10, 13, 9, 9, 11, 11, 10, 12,
+	4, 6, 10, 6, 7, 10, 10, 10, 12,
+	5, 7, 11, 6, 7, 10, 9, 9, 11,
+	9, 10, 13, 8, 9, 12, 10, 11, 12,
+	8, 10, 15, 9, 11, 15, 13, 14, 16,
+	8, 10, 14, 9, 10, 14, 12, 12, 15,
+	11, 12, 16, 10, 11, 15, 12, 12, 15,
+}
+
+var codes4 = []uint16{
+	0x007, 0x016, 0x0f6, 0x018, 0x008, 0x0ef, 0x1ef, 0x0f3, 0x7f8,
+	0x019, 0x017, 0x0ed, 0x015, 0x001, 0x0e2, 0x0f0, 0x070, 0x3f0,
+	0x1ee, 0x0f1, 0x7fa, 0x0ee, 0x0e4, 0x3f2, 0x7f6, 0x3ef, 0x7fd,
+	0x005, 0x014, 0x0f2, 0x009, 0x004, 0x0e5, 0x0f4, 0x0e8, 0x3f4,
+	0x006, 0x002, 0x0e7, 0x003, 0x000, 0x06b, 0x0e3, 0x069, 0x1f3,
+	0x0eb, 0x0e6, 0x3f6, 0x06e, 0x06a, 0x1f4, 0x3ec, 0x1f0, 0x3f9,
+	0x0f5, 0x0ec, 0x7fb, 0x0ea, 0x06f, 0x3f7, 0x7f9, 0x3f3, 0xfff,
+	0x0e9, 0x06d, 0x3f8, 0x06c, 0x068, 0x1f5, 0x3ee, 0x1f2, 0x7f4,
+	0x7f7, 0x3f1, 0xffe, 0x3ed, 0x1f1, 0x7f5, 0x7fe, 0x3f5, 0x7fc,
+}
+
+var bits4 = []uint8{
+	4, 5, 8, 5, 4, 8, 9, 8, 11,
+	5, 5, 8, 5, 4, 8, 8, 7, 10,
+	9, 8, 11, 8, 8, 10, 11, 10, 11,
+	4, 5, 8, 4, 4, 8, 8, 8, 10,
+	4, 4, 8, 4, 4, 7, 8, 7, 9,
+	8, 8, 10, 7, 7, 9, 10, 9, 10,
+	8, 8, 11, 8, 7, 10, 11, 10, 12,
+	8, 7, 10, 7, 7, 9, 10, 9, 11,
+	11, 10, 12, 10, 9, 11, 11, 10, 11,
+}
+
+var codes5 = []uint16{
+	0x1fff, 0x0ff7, 0x07f4, 0x07e8, 0x03f1, 0x07ee, 0x07f9, 0x0ff8, 0x1ffd,
+	0x0ffd, 0x07f1, 0x03e8, 0x01e8, 0x00f0, 0x01ec, 0x03ee, 0x07f2, 0x0ffa,
+	0x0ff4, 0x03ef, 0x01f2, 0x00e8, 0x0070, 0x00ec, 0x01f0, 0x03ea, 0x07f3,
+	0x07eb, 0x01eb, 0x00ea, 0x001a, 0x0008, 0x0019, 0x00ee, 0x01ef, 0x07ed,
+	0x03f0, 0x00f2, 0x0073, 0x000b, 0x0000, 0x000a, 0x0071, 0x00f3, 0x07e9,
+	0x07ef, 0x01ee, 0x00ef, 0x0018, 0x0009, 0x001b, 0x00eb, 0x01e9, 0x07ec,
+	0x07f6, 0x03eb, 0x01f3, 0x00ed, 0x0072, 0x00e9, 0x01f1, 0x03ed, 0x07f7,
+	0x0ff6, 0x07f0, 0x03e9, 0x01ed, 0x00f1, 0x01ea, 0x03ec, 0x07f8, 0x0ff9,
+	0x1ffc, 0x0ffc, 0x0ff5, 0x07ea, 0x03f3, 0x03f2, 0x07f5, 0x0ffb, 0x1ffe,
+}
+
+var bits5 = []uint8{
+	13, 12, 11, 11, 10, 11, 11, 12, 13,
+	12, 11, 10, 9, 8, 9, 10, 11, 12,
+	12, 10, 9, 8, 7, 8, 9, 10, 11,
+	11, 9, 8, 5, 4, 5, 8, 9, 11,
+	10, 8, 7, 4, 1, 4, 7, 8, 11,
+	11, 9, 8, 5, 4, 5, 8, 9, 11,
+	11, 10, 9, 8, 7, 8, 9, 10, 11,
+	12, 11, 10, 9, 8, 9, 10, 11, 12,
+	13, 12, 12, 11, 10, 10, 11, 12, 13,
+}
+
+var codes6 = []uint16{
+	0x7fe, 0x3fd, 0x1f1, 0x1eb, 0x1f4, 0x1ea, 0x1f0, 0x3fc, 0x7fd,
+	0x3f6, 0x1e5, 0x0ea, 0x06c, 0x071, 0x068, 0x0f0, 0x1e6, 0x3f7,
+	0x1f3, 0x0ef, 0x032, 0x027, 0x028, 0x026, 0x031, 0x0eb, 0x1f7,
+	0x1e8, 0x06f, 0x02e, 0x008, 0x004, 0x006, 0x029, 0x06b, 0x1ee,
+	0x1ef, 0x072, 0x02d, 0x002, 0x000, 0x003, 0x02f, 0x073, 0x1fa,
+	0x1e7, 0x06e, 0x02b, 0x007, 0x001, 0x005, 0x02c, 0x06d, 0x1ec,
+	0x1f9, 0x0ee, 0x030, 0x024, 0x02a, 0x025, 0x033, 0x0ec, 0x1f2,
+	0x3f8, 0x1e4, 0x0ed, 0x06a, 0x070, 0x069, 0x074, 0x0f1, 0x3fa,
+	0x7ff, 0x3f9, 0x1f6, 0x1ed, 0x1f8, 0x1e9, 0x1f5, 0x3fb, 0x7fc,
+}
+
+var bits6 = []uint8{
+	11, 10, 9, 9, 9, 9, 9, 10, 11,
+	10, 9, 8, 7, 7, 7, 8, 9, 10,
+	9, 8, 6, 6, 6, 6, 6, 8, 9,
+	9, 7, 6, 4, 4, 4, 6, 7, 9,
+	9, 7, 6, 4, 4, 4, 6, 7, 9,
+	9, 7, 6, 4, 4, 4, 6, 7, 9,
+	9, 8, 6, 6, 6, 6, 6, 8, 9,
+	10, 9, 8, 7, 7, 7, 7, 8, 10,
+	11, 10, 9, 9, 9, 9, 9, 10, 11,
+}
+
+var codes7 = []uint16{
+	0x000, 0x005, 0x037, 0x074, 0x0f2, 0x1eb, 0x3ed, 0x7f7,
+	0x004, 0x00c, 0x035, 0x071, 0x0ec, 0x0ee, 0x1ee, 0x1f5,
+	0x036, 0x034, 0x072, 0x0ea, 0x0f1, 0x1e9, 0x1f3, 0x3f5,
+	0x073, 0x070, 0x0eb, 0x0f0, 0x1f1, 0x1f0, 0x3ec, 0x3fa,
+	0x0f3, 0x0ed, 0x1e8, 0x1ef, 0x3ef, 0x3f1, 0x3f9, 0x7fb,
+	0x1ed, 0x0ef, 0x1ea, 0x1f2, 0x3f3, 0x3f8, 0x7f9, 0x7fc,
+	0x3ee, 0x1ec, 0x1f4, 0x3f4, 0x3f7, 0x7f8, 0xffd, 0xffe,
+	0x7f6, 0x3f0, 0x3f2, 0x3f6, 0x7fa, 0x7fd, 0xffc, 0xfff,
+}
+
+var bits7 = []uint8{
+	1, 3, 6, 7, 8, 9, 10, 11,
+	3, 4, 6, 7, 8, 8, 9, 9,
+	6, 6, 7, 8, 8, 9, 9, 10,
+	7, 7, 8, 8, 9, 9, 10, 10,
+	8, 8, 9, 9, 10, 10, 10, 11,
+	9, 8, 9, 9, 10, 10, 11, 11,
+	10, 9, 9, 10, 10, 11, 12, 12,
+	11, 10, 10, 10, 11, 11, 12, 12,
+}
+
+var codes8 = []uint16{
+	0x00e, 0x005, 0x010, 0x030, 0x06f, 0x0f1, 0x1fa, 0x3fe,
+	0x003, 0x000, 0x004, 0x012, 0x02c, 0x06a, 0x075, 0x0f8,
+	0x00f, 0x002, 0x006, 0x014, 0x02e, 0x069, 0x072, 0x0f5,
+	0x02f, 0x011, 0x013, 0x02a, 0x032, 0x06c, 0x0ec, 0x0fa,
+	0x071, 0x02b, 0x02d, 0x031, 0x06d, 0x070, 0x0f2, 0x1f9,
+	0x0ef, 0x068, 0x033, 0x06b, 0x06e, 0x0ee, 0x0f9, 0x3fc,
+	0x1f8, 0x074, 0x073, 0x0ed, 0x0f0, 0x0f6, 0x1f6, 0x1fd,
+	0x3fd, 0x0f3, 0x0f4, 0x0f7, 0x1f7, 0x1fb, 0x1fc, 0x3ff,
+}
+
+var bits8 = []uint8{
+	5, 4, 5, 6, 7, 8, 9, 10,
+	4, 3, 4, 5, 6, 7, 7, 8,
+	5, 4, 4, 5, 6, 7, 7, 8,
+	6, 5, 5, 6, 6, 7, 8, 8,
+	7, 6, 6, 6, 7, 7, 8, 9,
+	8, 7, 6, 7, 7, 8, 8, 10,
+	9, 7, 7, 8, 8, 8, 9, 9,
+	10, 8, 8, 8, 9, 9, 9, 10,
+}
+
+var codes9 = []uint16{
+	0x0000, 0x0005, 0x0037, 0x00e7, 0x01de, 0x03ce, 0x03d9, 0x07c8, 0x07cd, 0x0fc8, 0x0fdd, 0x1fe4, 0x1fec,
+	0x0004, 0x000c, 0x0035, 0x0072, 0x00ea, 0x00ed, 0x01e2, 0x03d1, 0x03d3, 0x03e0, 0x07d8, 0x0fcf, 0x0fd5,
+	0x0036, 0x0034, 0x0071, 0x00e8, 0x00ec, 0x01e1, 0x03cf, 0x03dd, 0x03db, 0x07d0, 0x0fc7, 0x0fd4, 0x0fe4,
+	0x00e6, 0x0070, 0x00e9, 0x01dd, 0x01e3, 0x03d2, 0x03dc, 0x07cc, 0x07ca, 0x07de, 0x0fd8, 0x0fea, 0x1fdb,
+	0x01df, 0x00eb, 0x01dc, 0x01e6, 0x03d5, 0x03de, 0x07cb, 0x07dd, 0x07dc, 0x0fcd, 0x0fe2, 0x0fe7, 0x1fe1,
+	0x03d0, 0x01e0, 0x01e4, 0x03d6, 0x07c5, 0x07d1, 0x07db, 0x0fd2, 0x07e0, 0x0fd9, 0x0feb, 0x1fe3, 0x1fe9,
+	0x07c4, 0x01e5, 0x03d7, 0x07c6, 0x07cf, 0x07da, 0x0fcb, 0x0fda, 0x0fe3, 0x0fe9, 0x1fe6, 0x1ff3, 0x1ff7,
+	0x07d3, 0x03d8, 0x03e1, 0x07d4, 0x07d9, 0x0fd3, 0x0fde, 0x1fdd, 0x1fd9, 0x1fe2, 0x1fea, 0x1ff1, 0x1ff6,
+	0x07d2, 0x03d4, 0x03da, 0x07c7, 0x07d7, 0x07e2, 0x0fce, 0x0fdb, 0x1fd8, 0x1fee, 0x3ff0, 0x1ff4, 0x3ff2,
+	0x07e1, 0x03df, 0x07c9, 0x07d6, 0x0fca, 0x0fd0, 0x0fe5, 0x0fe6, 0x1feb, 0x1fef, 0x3ff3, 0x3ff4, 0x3ff5,
+	0x0fe0, 0x07ce, 0x07d5, 0x0fc6, 0x0fd1, 0x0fe1, 0x1fe0, 0x1fe8, 0x1ff0, 0x3ff1, 0x3ff8, 0x3ff6, 0x7ffc,
+	0x0fe8, 0x07df, 0x0fc9, 0x0fd7, 0x0fdc, 0x1fdc, 0x1fdf, 0x1fed, 0x1ff5, 0x3ff9, 0x3ffb, 0x7ffd, 0x7ffe,
+	0x1fe7, 0x0fcc, 0x0fd6, 0x0fdf, 0x1fde, 0x1fda, 0x1fe5, 0x1ff2, 0x3ffa, 0x3ff7, 0x3ffc, 0x3ffd, 0x7fff,
+}
+
+var bits9 = []uint8{
+	1, 3, 6, 8, 9, 10, 10, 11, 11, 12, 12, 13, 13,
+	3, 4, 6, 7, 8, 8, 9, 10, 10, 10, 11, 12, 12,
+	6, 6, 7, 8, 8, 9, 10, 10, 10, 11, 12, 12, 12,
+	8, 7, 8, 9, 9, 10, 10, 11, 11, 11, 12, 12, 13,
+	9, 8, 9, 9, 10, 10, 11, 11, 11, 12, 12, 12, 13,
+	10, 9, 9, 10, 11, 11, 11, 12, 11, 12, 12, 13, 13,
+	11, 9, 10, 11, 11, 11, 12, 12, 12, 12, 13, 13, 13,
+	11, 10, 10, 11, 11, 12, 12, 13, 13, 13, 13, 13, 13,
+	11, 10, 10, 11, 11, 11, 12, 12, 13, 13, 14, 13, 14,
+	11, 10, 11, 11, 12, 12, 12, 12, 13, 13, 14, 14, 14,
+	12, 11, 11, 12, 12, 12, 13, 13, 13, 14, 14, 14, 15,
+	12, 11, 12, 12, 12, 13, 13, 13, 13, 14, 14, 15, 15,
+	13, 12, 12, 12, 13, 13, 13, 13, 14, 14, 14, 14, 15,
+}
+
+var codes10 = []uint16{
+	0x022, 0x008, 0x01d, 0x026, 0x05f, 0x0d3, 0x1cf, 0x3d0, 0x3d7, 0x3ed, 0x7f0, 0x7f6, 0xffd,
+	0x007, 0x000, 0x001, 0x009, 0x020, 0x054, 0x060, 0x0d5, 0x0dc, 0x1d4, 0x3cd, 0x3de, 0x7e7,
+	0x01c, 0x002, 0x006, 0x00c, 0x01e, 0x028, 0x05b, 0x0cd, 0x0d9, 0x1ce, 0x1dc, 0x3d9, 0x3f1,
+	0x025, 0x00b, 0x00a, 0x00d, 0x024, 0x057, 0x061, 0x0cc, 0x0dd, 0x1cc, 0x1de, 0x3d3, 0x3e7,
+	0x05d, 0x021, 0x01f, 0x023, 0x027, 0x059, 0x064, 0x0d8, 0x0df, 0x1d2, 0x1e2, 0x3dd, 0x3ee,
+	0x0d1, 0x055, 0x029, 0x056, 0x058, 0x062, 0x0ce, 0x0e0, 0x0e2, 0x1da, 0x3d4, 0x3e3, 0x7eb,
+	0x1c9, 0x05e, 0x05a, 0x05c, 0x063, 0x0ca, 0x0da, 0x1c7, 0x1ca, 0x1e0, 0x3db, 0x3e8, 0x7ec,
+	0x1e3, 0x0d2, 0x0cb, 0x0d0, 0x0d7, 0x0db, 0x1c6, 0x1d5, 0x1d8, 0x3ca, 0x3da, 0x7ea, 0x7f1,
+	0x1e1, 0x0d4, 0x0cf, 0x0d6, 0x0de, 0x0e1, 0x1d0, 0x1d6, 0x3d1, 0x3d5, 0x3f2, 0x7ee, 0x7fb,
+	0x3e9, 0x1cd, 0x1c8, 0x1cb, 0x1d1, 0x1d7, 0x1df, 0x3cf, 0x3e0, 0x3ef, 0x7e6, 0x7f8, 0xffa,
+	0x3eb, 0x1dd, 0x1d3, 0x1d9, 0x1db, 0x3d2, 0x3cc, 0x3dc, 0x3ea, 0x7ed, 0x7f3, 0x7f9, 0xff9,
+	0x7f2, 0x3ce, 0x1e4, 0x3cb, 0x3d8, 0x3d6, 0x3e2, 0x3e5, 0x7e8, 0x7f4, 0x7f5, 0x7f7, 0xffb,
+	0x7fa, 0x3ec, 0x3df, 0x3e1, 0x3e4, 0x3e6, 0x3f0, 0x7e9, 0x7ef, 0xff8, 0xffe, 0xffc, 0xfff,
+}
+
+var bits10 = []uint8{
+	6, 5, 6, 6, 7, 8, 9, 10, 10, 10, 11, 11, 12,
+	5, 4, 4, 5, 6, 7, 7, 8, 8, 9, 10, 10, 11,
+	6, 4, 5, 5, 6, 6, 7, 8, 8, 9, 9, 10, 10,
+	6, 5, 5, 5, 6, 7, 7, 8, 8, 9, 9, 10, 10,
+	7, 6, 6, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10,
+	8, 7, 6, 7, 7, 7, 8, 8, 8, 9, 10, 10, 11,
+	9, 7, 7, 7, 7, 8, 8, 9, 9, 9, 10, 10, 11,
+	9, 8, 8, 8, 8, 8, 9, 9, 9, 10, 10, 11, 11,
+	9, 8, 8, 8, 8, 8, 9, 9, 10, 10, 10, 11, 11,
+	10, 9, 9, 9, 9, 9, 9, 10, 10, 10, 11, 11, 12,
+	10, 9, 9, 9, 9, 10, 10, 10, 10, 11, 11, 11, 12,
+	11, 10, 9, 10, 10, 10, 10, 10, 11, 11, 11, 11, 12,
+	11, 10, 10, 10, 10, 10, 10, 11, 11, 12, 12, 12, 12,
+}
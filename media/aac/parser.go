@@ -103,6 +103,11 @@ func (parser *Parser) SampleRate() int {
 	return rate
 }
 
+//Channels 返回AudioSpecificConfig中的声道配置
+func (parser *Parser) Channels() int {
+	return int(parser.cfgInfo.channel)
+}
+
 func (parser *Parser) Parse(b []byte, packetType uint8, w io.Writer) (err error) {
 	switch packetType {
 	case av.AAC_SEQHDR:
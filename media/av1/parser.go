@@ -0,0 +1,349 @@
+package av1
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fabo871218/srtmp/utils"
+)
+
+//OBU类型
+const (
+	OBUSequenceHeader       byte = 1
+	OBUTemporalDelimiter    byte = 2
+	OBUFrameHeader          byte = 3
+	OBUTileGroup            byte = 4
+	OBUMetadata             byte = 5
+	OBUFrame                byte = 6
+	OBURedundantFrameHeader byte = 7
+	OBUTileList             byte = 8
+	OBUPadding              byte = 15
+)
+
+const (
+	configRecordLen   = 4
+	frameTypeKeyFrame = 0
+)
+
+var (
+	errOBUTooShort       = errors.New("obu too short")
+	errNoSequenceHeader  = errors.New("no sequence header obu")
+	errInvalidRecord     = errors.New("invalid av1 codec configuration record")
+	errInvalidSeqHeader  = errors.New("invalid sequence header")
+	errUnsupportRecordV1 = errors.New("marker and version should be 0x81")
+)
+
+//OBU 一个Open Bitstream Unit，Data包含了OBU头
+type OBU struct {
+	Type    byte
+	Header  []byte //OBU头，包括扩展头
+	Payload []byte
+	Data    []byte //完整的OBU
+}
+
+//ParseOBUs 解析低开销格式(Low Overhead Bitstream Format)的数据，每个OBU都需要带有长度
+func ParseOBUs(data []byte) (obus []OBU, err error) {
+	for index := 0; index < len(data); {
+		start := index
+		header := data[index]
+		if header&0x80 != 0 {
+			return nil, fmt.Errorf("obu forbidden bit set")
+		}
+		obuType := (header >> 3) & 0x0f
+		headerLen := 1
+		if header&0x04 != 0 {
+			//obu_extension_flag
+			headerLen++
+		}
+		if len(data[index:]) < headerLen {
+			return nil, errOBUTooShort
+		}
+		index += headerLen
+		size := len(data) - index
+		if header&0x02 != 0 {
+			//obu_has_size_field
+			var n int
+			if size, n, err = readLeb128(data[index:]); err != nil {
+				return nil, err
+			}
+			index += n
+		}
+		if size < 0 || len(data[index:]) < size {
+			return nil, errOBUTooShort
+		}
+		obus = append(obus, OBU{
+			Type:    obuType,
+			Header:  data[start : start+headerLen],
+			Payload: data[index : index+size],
+			Data:    data[start : index+size],
+		})
+		index += size
+	}
+	return
+}
+
+//readLeb128 读取leb128编码的长度，返回值和占用的字节数
+func readLeb128(data []byte) (value int, n int, err error) {
+	for i := 0; i < 8; i++ {
+		if i >= len(data) {
+			return 0, 0, errOBUTooShort
+		}
+		value |= int(data[i]&0x7f) << uint(i*7)
+		n++
+		if data[i]&0x80 == 0 {
+			return
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid leb128")
+}
+
+//SequenceHeader 生成AV1CodecConfigurationRecord需要的信息
+type SequenceHeader struct {
+	Profile              byte
+	Level                byte //seq_level_idx[0]
+	Tier                 byte //seq_tier[0]
+	HighBitdepth         byte
+	TwelveBit            byte
+	Monochrome           byte
+	ChromaSubsamplingX   byte
+	ChromaSubsamplingY   byte
+	ChromaSamplePosition byte
+	ReducedStillPicture  bool
+}
+
+//ParseSequenceHeader 解析sequence header OBU的负载
+func ParseSequenceHeader(payload []byte) (*SequenceHeader, error) {
+	br := utils.NewBitReader(payload)
+	seq := &SequenceHeader{}
+	seq.Profile = byte(br.ReadBits(3))
+	br.Skip(1) //still_picture
+	seq.ReducedStillPicture = br.ReadFlag()
+	if seq.ReducedStillPicture {
+		seq.Level = byte(br.ReadBits(5))
+	} else {
+		var bufferDelayLen int
+		decoderModelInfoPresent := false
+		if br.ReadFlag() {
+			//timing_info_present_flag
+			br.Skip(64) //num_units_in_display_tick time_scale
+			if br.ReadFlag() {
+				//equal_picture_interval，num_ticks_per_picture_minus_1为uvlc编码
+				zeros := 0
+				for !br.ReadFlag() && br.Err() == nil && zeros < 32 {
+					zeros++
+				}
+				br.Skip(zeros)
+			}
+			decoderModelInfoPresent = br.ReadFlag()
+			if decoderModelInfoPresent {
+				bufferDelayLen = int(br.ReadBits(5)) + 1
+				br.Skip(32 + 5 + 5) //num_units_in_decoding_tick, buffer_removal_time_length_minus_1, frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelayPresent := br.ReadFlag()
+		operatingPoints := int(br.ReadBits(5)) + 1
+		for i := 0; i < operatingPoints; i++ {
+			br.Skip(12) //operating_point_idc
+			level := byte(br.ReadBits(5))
+			var tier byte
+			if level > 7 {
+				tier = byte(br.ReadBits(1))
+			}
+			if i == 0 {
+				seq.Level = level
+				seq.Tier = tier
+			}
+			if decoderModelInfoPresent && br.ReadFlag() {
+				//decoder_buffer_delay encoder_buffer_delay low_delay_mode_flag
+				br.Skip(2*bufferDelayLen + 1)
+			}
+			if initialDisplayDelayPresent && br.ReadFlag() {
+				br.Skip(4)
+			}
+		}
+	}
+
+	widthBits := int(br.ReadBits(4)) + 1
+	heightBits := int(br.ReadBits(4)) + 1
+	br.Skip(widthBits + heightBits) //max_frame_width_minus_1 max_frame_height_minus_1
+	if !seq.ReducedStillPicture && br.ReadFlag() {
+		//frame_id_numbers_present_flag
+		br.Skip(4 + 3)
+	}
+	br.Skip(3) //use_128x128_superblock enable_filter_intra enable_intra_edge_filter
+	if !seq.ReducedStillPicture {
+		br.Skip(4) //enable_interintra_compound enable_masked_compound enable_warped_motion enable_dual_filter
+		enableOrderHint := br.ReadFlag()
+		if enableOrderHint {
+			br.Skip(2) //enable_jnt_comp enable_ref_frame_mvs
+		}
+		forceScreenContentTools := uint32(2)
+		if !br.ReadFlag() {
+			//seq_choose_screen_content_tools
+			forceScreenContentTools = br.ReadBits(1)
+		}
+		if forceScreenContentTools > 0 && !br.ReadFlag() {
+			//seq_choose_integer_mv
+			br.Skip(1)
+		}
+		if enableOrderHint {
+			br.Skip(3) //order_hint_bits_minus_1
+		}
+	}
+	br.Skip(3) //enable_superres enable_cdef enable_restoration
+
+	//color_config
+	seq.HighBitdepth = byte(br.ReadBits(1))
+	if seq.Profile == 2 && seq.HighBitdepth == 1 {
+		seq.TwelveBit = byte(br.ReadBits(1))
+	}
+	if seq.Profile != 1 {
+		seq.Monochrome = byte(br.ReadBits(1))
+	}
+	colorPrimaries, transfer, matrix := uint32(2), uint32(2), uint32(2)
+	if br.ReadFlag() {
+		//color_description_present_flag
+		colorPrimaries = br.ReadBits(8)
+		transfer = br.ReadBits(8)
+		matrix = br.ReadBits(8)
+	}
+	if seq.Monochrome == 1 {
+		br.Skip(1) //color_range
+		seq.ChromaSubsamplingX, seq.ChromaSubsamplingY = 1, 1
+	} else if colorPrimaries == 1 && transfer == 13 && matrix == 0 {
+		//sRGB
+		seq.ChromaSubsamplingX, seq.ChromaSubsamplingY = 0, 0
+	} else {
+		br.Skip(1) //color_range
+		switch seq.Profile {
+		case 0:
+			seq.ChromaSubsamplingX, seq.ChromaSubsamplingY = 1, 1
+		case 1:
+			seq.ChromaSubsamplingX, seq.ChromaSubsamplingY = 0, 0
+		default:
+			if seq.TwelveBit == 1 {
+				seq.ChromaSubsamplingX = byte(br.ReadBits(1))
+				if seq.ChromaSubsamplingX == 1 {
+					seq.ChromaSubsamplingY = byte(br.ReadBits(1))
+				}
+			} else {
+				seq.ChromaSubsamplingX, seq.ChromaSubsamplingY = 1, 0
+			}
+		}
+		if seq.ChromaSubsamplingX == 1 && seq.ChromaSubsamplingY == 1 {
+			seq.ChromaSamplePosition = byte(br.ReadBits(2))
+		}
+	}
+	if br.Err() != nil {
+		return nil, errInvalidSeqHeader
+	}
+	return seq, nil
+}
+
+/*
+aligned(8) class AV1CodecConfigurationRecord {
+	unsigned int(1) marker = 1;
+	unsigned int(7) version = 1;
+	unsigned int(3) seq_profile;
+	unsigned int(5) seq_level_idx_0;
+	unsigned int(1) seq_tier_0;
+	unsigned int(1) high_bitdepth;
+	unsigned int(1) twelve_bit;
+	unsigned int(1) monochrome;
+	unsigned int(1) chroma_subsampling_x;
+	unsigned int(1) chroma_subsampling_y;
+	unsigned int(2) chroma_sample_position;
+	unsigned int(3) reserved = 0;
+	unsigned int(1) initial_presentation_delay_present;
+	unsigned int(4) initial_presentation_delay_minus_one/reserved;
+	unsigned int(8) configOBUs[];
+}
+*/
+
+//CodecConfigurationRecord 从包含sequence header OBU的数据中生成AV1CodecConfigurationRecord
+func CodecConfigurationRecord(data []byte) ([]byte, error) {
+	obus, err := ParseOBUs(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, obu := range obus {
+		if obu.Type != OBUSequenceHeader {
+			continue
+		}
+		seq, err := ParseSequenceHeader(obu.Payload)
+		if err != nil {
+			return nil, err
+		}
+		record := make([]byte, configRecordLen, configRecordLen+len(obu.Data))
+		record[0] = 0x81
+		record[1] = seq.Profile<<5 | seq.Level&0x1f
+		record[2] = seq.Tier<<7 | seq.HighBitdepth<<6 | seq.TwelveBit<<5 | seq.Monochrome<<4 |
+			seq.ChromaSubsamplingX<<3 | seq.ChromaSubsamplingY<<2 | seq.ChromaSamplePosition&0x03
+		return append(record, obu.Data...), nil
+	}
+	return nil, errNoSequenceHeader
+}
+
+//ParseCodecConfigurationRecord 解析AV1CodecConfigurationRecord，返回configOBUs中的sequence header
+func ParseCodecConfigurationRecord(data []byte) (*SequenceHeader, []byte, error) {
+	if len(data) < configRecordLen {
+		return nil, nil, errInvalidRecord
+	}
+	if data[0] != 0x81 {
+		return nil, nil, errUnsupportRecordV1
+	}
+	seq := &SequenceHeader{
+		Profile:              data[1] >> 5,
+		Level:                data[1] & 0x1f,
+		Tier:                 data[2] >> 7,
+		HighBitdepth:         (data[2] >> 6) & 0x01,
+		TwelveBit:            (data[2] >> 5) & 0x01,
+		Monochrome:           (data[2] >> 4) & 0x01,
+		ChromaSubsamplingX:   (data[2] >> 3) & 0x01,
+		ChromaSubsamplingY:   (data[2] >> 2) & 0x01,
+		ChromaSamplePosition: data[2] & 0x03,
+	}
+	return seq, data[configRecordLen:], nil
+}
+
+//IsKeyFrame 判断一个temporal unit是否是关键帧，第一个帧头的frame_type为KEY_FRAME
+func IsKeyFrame(data []byte) bool {
+	obus, err := ParseOBUs(data)
+	if err != nil {
+		return false
+	}
+	for _, obu := range obus {
+		if obu.Type != OBUFrame && obu.Type != OBUFrameHeader {
+			continue
+		}
+		br := utils.NewBitReader(obu.Payload)
+		if br.ReadFlag() {
+			//show_existing_frame
+			return false
+		}
+		return br.ReadBits(2) == frameTypeKeyFrame && br.Err() == nil
+	}
+	return false
+}
+
+//Parser av1的数据不需要转换，只记录sequence header
+type Parser struct {
+	seqHeader  *SequenceHeader
+	configOBUs []byte
+}
+
+//NewParser ...
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//Parse isSeq为true时，b为AV1CodecConfigurationRecord，否则为OBU数据，直接写入w
+func (parser *Parser) Parse(b []byte, isSeq bool, w io.Writer) (err error) {
+	if isSeq {
+		parser.seqHeader, parser.configOBUs, err = ParseCodecConfigurationRecord(b)
+		return
+	}
+	_, err = w.Write(b)
+	return
+}
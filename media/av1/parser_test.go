@@ -0,0 +1,84 @@
+package av1
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (bw *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bw.pos%8 == 0 {
+			bw.data = append(bw.data, 0)
+		}
+		bw.data[len(bw.data)-1] |= byte((v>>uint(i))&0x01) << uint(7-bw.pos%8)
+		bw.pos++
+	}
+}
+
+//testSequenceHeader main profile，level 4.0(8)，1920x1080，4:2:0 8bit
+func testSequenceHeader() []byte {
+	bw := &bitWriter{}
+	bw.write(0, 3)     //seq_profile
+	bw.write(0, 2)     //still_picture reduced_still_picture_header
+	bw.write(0, 2)     //timing_info_present_flag initial_display_delay_present_flag
+	bw.write(0, 5)     //operating_points_cnt_minus_1
+	bw.write(0, 12)    //operating_point_idc
+	bw.write(8, 5)     //seq_level_idx
+	bw.write(0, 1)     //seq_tier
+	bw.write(10, 4)    //frame_width_bits_minus_1
+	bw.write(10, 4)    //frame_height_bits_minus_1
+	bw.write(1919, 11) //max_frame_width_minus_1
+	bw.write(1079, 11) //max_frame_height_minus_1
+	bw.write(0, 2)     //frame_id_numbers_present_flag use_128x128_superblock
+	bw.write(0x7f, 7)  //enable_filter_intra ... enable_order_hint
+	bw.write(3, 2)     //enable_jnt_comp enable_ref_frame_mvs
+	bw.write(1, 1)     //seq_choose_screen_content_tools
+	bw.write(1, 1)     //seq_choose_integer_mv
+	bw.write(6, 3)     //order_hint_bits_minus_1
+	bw.write(3, 3)     //enable_superres enable_cdef enable_restoration
+	bw.write(0, 3)     //high_bitdepth mono_chrome color_description_present_flag
+	bw.write(0, 3)     //color_range chroma_sample_position
+	bw.write(0, 1)     //film_grain_params_present
+	bw.write(1, 1)     //trailing_one_bit
+	return append([]byte{0x0a, byte(len(bw.data))}, bw.data...)
+}
+
+func TestCodecConfigurationRecord(t *testing.T) {
+	at := assert.New(t)
+	seqOBU := testSequenceHeader()
+	//temporal delimiter + sequence header + frame
+	tu := append([]byte{0x12, 0x00}, seqOBU...)
+	tu = append(tu, 0x32, 0x02, 0x10, 0x00)
+
+	record, err := CodecConfigurationRecord(tu)
+	at.Nil(err)
+	at.Equal([]byte{0x81, 0x08, 0x0c, 0x00}, record[:configRecordLen])
+	at.True(bytes.Equal(seqOBU, record[configRecordLen:]))
+
+	seq, configOBUs, err := ParseCodecConfigurationRecord(record)
+	at.Nil(err)
+	at.Equal(byte(8), seq.Level)
+	at.Equal(byte(1), seq.ChromaSubsamplingX)
+	at.Equal(byte(1), seq.ChromaSubsamplingY)
+	at.Equal(seqOBU, configOBUs)
+
+	_, err = CodecConfigurationRecord([]byte{0x12, 0x00})
+	at.NotNil(err)
+	_, err = CodecConfigurationRecord(seqOBU[:len(seqOBU)-3])
+	at.NotNil(err)
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	at := assert.New(t)
+	at.True(IsKeyFrame([]byte{0x12, 0x00, 0x32, 0x02, 0x10, 0x00}))
+	at.False(IsKeyFrame([]byte{0x12, 0x00, 0x32, 0x02, 0x30, 0x00}))
+	at.False(IsKeyFrame([]byte{0x12, 0x00}))
+	at.False(IsKeyFrame([]byte{0x12, 0x05, 0x00}))
+}
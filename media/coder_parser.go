@@ -7,8 +7,13 @@ import (
 
 	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/media/aac"
+	"github.com/fabo871218/srtmp/media/av1"
+	"github.com/fabo871218/srtmp/media/g711"
 	"github.com/fabo871218/srtmp/media/h264"
+	"github.com/fabo871218/srtmp/media/h265"
 	"github.com/fabo871218/srtmp/media/mp3"
+	"github.com/fabo871218/srtmp/media/opus"
+	"github.com/fabo871218/srtmp/media/vp9"
 )
 
 var (
@@ -18,7 +23,12 @@ var (
 type CodecParser struct {
 	aac  *aac.Parser
 	mp3  *mp3.Parser
+	opus *opus.Parser
+	g711 *g711.Parser
 	h264 *h264.Parser
+	h265 *h265.Parser
+	av1  *av1.Parser
+	vp9  *vp9.Parser
 }
 
 func NewCodecParser() *CodecParser {
@@ -26,25 +36,74 @@ func NewCodecParser() *CodecParser {
 }
 
 func (codeParser *CodecParser) SampleRate() (int, error) {
-	if codeParser.aac == nil && codeParser.mp3 == nil {
+	if codeParser.aac == nil && codeParser.mp3 == nil && codeParser.opus == nil &&
+		codeParser.g711 == nil {
 		return 0, errNoAudio
 	}
 	if codeParser.aac != nil {
 		return codeParser.aac.SampleRate(), nil
 	}
+	if codeParser.opus != nil {
+		return codeParser.opus.SampleRate(), nil
+	}
+	if codeParser.g711 != nil {
+		return codeParser.g711.SampleRate(), nil
+	}
 	return codeParser.mp3.SampleRate(), nil
 }
 
+//Channels 返回音频的声道数，未知时返回0
+func (codeParser *CodecParser) Channels() int {
+	if codeParser.aac != nil {
+		return codeParser.aac.Channels()
+	}
+	if codeParser.opus != nil {
+		return codeParser.opus.Channels()
+	}
+	if codeParser.mp3 != nil {
+		return codeParser.mp3.Channels()
+	}
+	if codeParser.g711 != nil {
+		return codeParser.g711.Channels()
+	}
+	return 0
+}
+
+//FrameSamples 返回每个音频帧的采样数，帧长不固定(opus，g711)或者未知时返回0
+func (codeParser *CodecParser) FrameSamples() int {
+	if codeParser.aac != nil {
+		return aac.FrameSamples
+	}
+	if codeParser.mp3 != nil {
+		return codeParser.mp3.Samples()
+	}
+	return 0
+}
+
 func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 	switch p.PacketType {
 	case av.PacketTypeVideo:
-
-		if p.VHeader.CodecID == av.VIDEO_H264 {
+		switch p.VHeader.CodecID {
+		case av.VIDEO_H264:
 			if codeParser.h264 == nil {
 				codeParser.h264 = h264.NewParser()
 			}
-			isSeq := p.VHeader.FrameType == av.FRAME_KEY && p.VHeader.AVCPacketType == av.AVC_SEQHDR
-			err = codeParser.h264.Parse(p.Data, isSeq, w)
+			err = codeParser.h264.Parse(p.Data, p.VHeader.IsSeqHeader(), w)
+		case av.VIDEO_HEVC:
+			if codeParser.h265 == nil {
+				codeParser.h265 = h265.NewParser()
+			}
+			err = codeParser.h265.Parse(p.Data, p.VHeader.IsSeqHeader(), w)
+		case av.VIDEO_AV1:
+			if codeParser.av1 == nil {
+				codeParser.av1 = av1.NewParser()
+			}
+			err = codeParser.av1.Parse(p.Data, p.VHeader.IsSeqHeader(), w)
+		case av.VIDEO_VP9:
+			if codeParser.vp9 == nil {
+				codeParser.vp9 = vp9.NewParser()
+			}
+			err = codeParser.vp9.Parse(p.Data, p.VHeader.IsSeqHeader(), w)
 		}
 
 	case av.PacketTypeAudio:
@@ -58,7 +117,17 @@ func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 			if codeParser.mp3 == nil {
 				codeParser.mp3 = mp3.NewParser()
 			}
-			err = codeParser.mp3.Parse(p.Data)
+			err = codeParser.mp3.Parse(p.Data, w)
+		case av.SOUND_OPUS:
+			if codeParser.opus == nil {
+				codeParser.opus = opus.NewParser()
+			}
+			err = codeParser.opus.Parse(p.Data, p.AHeader.AACPacketType, w)
+		case av.SOUND_ALAW, av.SOUND_MULAW:
+			if codeParser.g711 == nil {
+				codeParser.g711 = g711.NewParser()
+			}
+			err = codeParser.g711.Parse(p.Data, p.AHeader.SoundType == av.SOUND_STEREO, w)
 		}
 	default:
 		err = fmt.Errorf("Unknow packet type:%d", p.PacketType)
@@ -0,0 +1,144 @@
+package g711
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	//SampleRate g711固定为8kHz单声道，每个字节一个采样
+	SampleRate = 8000
+
+	alawMask = 0x55
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+var errDataInvalid = errors.New("g711 data invalid")
+
+//ALawToPCM 把一个A-law采样解码成16bit线性PCM
+func ALawToPCM(a byte) int16 {
+	a ^= alawMask
+	t := int16(a&0x0f) << 4
+	seg := (a & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+//PCMToALaw 把16bit线性PCM编码成A-law
+func PCMToALaw(pcm int16) byte {
+	mask := byte(0xd5)
+	v := int(pcm) >> 3
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+	seg := 0
+	for end := 0x1f; seg < 8 && v > end; end = end<<1 | 1 {
+		seg++
+	}
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	a := byte(seg << 4)
+	if seg < 2 {
+		a |= byte(v>>1) & 0x0f
+	} else {
+		a |= byte(v>>uint(seg)) & 0x0f
+	}
+	return a ^ mask
+}
+
+//MuLawToPCM 把一个µ-law采样解码成16bit线性PCM
+func MuLawToPCM(u byte) int16 {
+	u = ^u
+	t := (int16(u&0x0f) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return ulawBias - t
+	}
+	return t - ulawBias
+}
+
+//PCMToMuLaw 把16bit线性PCM编码成µ-law
+func PCMToMuLaw(pcm int16) byte {
+	v := int(pcm)
+	mask := byte(0xff)
+	if v < 0 {
+		v = -v
+		mask = 0x7f
+	}
+	if v > ulawClip {
+		v = ulawClip
+	}
+	v += ulawBias
+	seg := 0
+	for end := 0xff; seg < 8 && v > end; end = end<<1 | 1 {
+		seg++
+	}
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	u := byte(seg<<4) | byte(v>>uint(seg+3))&0x0f
+	return u ^ mask
+}
+
+//DecodeALaw 解码A-law数据，结果追加到dst后返回
+func DecodeALaw(dst []int16, src []byte) []int16 {
+	for _, a := range src {
+		dst = append(dst, ALawToPCM(a))
+	}
+	return dst
+}
+
+//DecodeMuLaw 解码µ-law数据，结果追加到dst后返回
+func DecodeMuLaw(dst []int16, src []byte) []int16 {
+	for _, u := range src {
+		dst = append(dst, MuLawToPCM(u))
+	}
+	return dst
+}
+
+//Parser g711的数据不需要转换，直接写入w
+type Parser struct {
+	channels int
+}
+
+//NewParser ...
+func NewParser() *Parser {
+	return &Parser{channels: 1}
+}
+
+//Parse b为g711的采样数据，stereo表示flv tag中声明为双声道
+func (parser *Parser) Parse(b []byte, stereo bool, w io.Writer) error {
+	if len(b) == 0 {
+		return errDataInvalid
+	}
+	parser.channels = 1
+	if stereo {
+		parser.channels = 2
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+//SampleRate g711固定为8kHz
+func (parser *Parser) SampleRate() int {
+	return SampleRate
+}
+
+//Channels 返回声道数
+func (parser *Parser) Channels() int {
+	return parser.channels
+}
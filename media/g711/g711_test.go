@@ -0,0 +1,52 @@
+package g711
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestALaw(t *testing.T) {
+	at := assert.New(t)
+	at.Equal(int16(8), ALawToPCM(0xd5))
+	at.Equal(int16(-8), ALawToPCM(0x55))
+	at.Equal(int16(32256), ALawToPCM(0xaa))
+	at.Equal(int16(-32256), ALawToPCM(0x2a))
+	at.Equal(byte(0xd5), PCMToALaw(0))
+	at.Equal(byte(0xaa), PCMToALaw(32767))
+	at.Equal(byte(0x2a), PCMToALaw(-32768))
+	//解码后再编码得到相同的值
+	for i := 0; i < 256; i++ {
+		at.Equal(byte(i), PCMToALaw(ALawToPCM(byte(i))))
+	}
+}
+
+func TestMuLaw(t *testing.T) {
+	at := assert.New(t)
+	at.Equal(int16(0), MuLawToPCM(0xff))
+	at.Equal(int16(-32124), MuLawToPCM(0x00))
+	at.Equal(int16(32124), MuLawToPCM(0x80))
+	at.Equal(byte(0xff), PCMToMuLaw(0))
+	at.Equal(byte(0x80), PCMToMuLaw(32767))
+	at.Equal(byte(0x00), PCMToMuLaw(-32768))
+	//0x7f和0xff都是0，只有0x7f例外
+	for i := 0; i < 256; i++ {
+		if i != 0x7f {
+			at.Equal(byte(i), PCMToMuLaw(MuLawToPCM(byte(i))))
+		}
+	}
+}
+
+func TestParser(t *testing.T) {
+	at := assert.New(t)
+	parser := NewParser()
+	var w bytes.Buffer
+	at.Error(parser.Parse(nil, false, &w))
+	at.Nil(parser.Parse([]byte{0xd5, 0x55}, true, &w))
+	at.Equal([]byte{0xd5, 0x55}, w.Bytes())
+	at.Equal(2, parser.Channels())
+	at.Equal(8000, parser.SampleRate())
+	at.Equal([]int16{8, -8}, DecodeALaw(nil, w.Bytes()))
+	at.Equal([]int16{0, -32124}, DecodeMuLaw(nil, []byte{0xff, 0x00}))
+}
@@ -144,6 +144,7 @@ func (parser *Parser) parseSpecificInfo(src []byte) error {
 	pps = append(pps, StartCode4...)
 	pps = append(pps, tmpBuf[3:]...)
 
+	parser.specificInfo = parser.specificInfo[:0]
 	parser.specificInfo = append(parser.specificInfo, sps...)
 	parser.specificInfo = append(parser.specificInfo, pps...)
 
@@ -309,6 +310,11 @@ func ParseNalusN(src []byte, n int) (nalus [][]byte) {
 			}
 			index += startCodeLength
 			pre = index
+			//剩余的数据不足一个start code，不用继续查找
+			if index+4 > len(src) {
+				index = len(src)
+				break
+			}
 			continue
 		}
 
@@ -348,6 +354,12 @@ func AVCDecoderConfigurationRecord(sps, pps []byte) []byte {
 		spsLen:               len(sps),
 		ppsLen:               len(pps),
 	}
+	if len(sps) >= 4 {
+		//profile和level跟随sps，带B帧的main和high profile不能声明为baseline
+		sHeader.avcProfileIndication = sps[1]
+		sHeader.profileCompatility = sps[2]
+		sHeader.avcLevelIndication = sps[3]
+	}
 
 	index := 0
 	buffer := make([]byte, 11+len(sps)+len(pps))
@@ -43,7 +43,7 @@ func TestH264SeqEncode(t *testing.T) {
 		0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a}
 	pps := []byte{0x68, 0xde, 0x31, 0x12}
 	
-	data := EncodeSequenceHeader(sps, pps)
+	data := AVCDecoderConfigurationRecord(sps, pps)
 	at.Equal(data, seq)
 }
 
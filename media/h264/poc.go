@@ -0,0 +1,500 @@
+package h264
+
+import (
+	"errors"
+
+	"github.com/fabo871218/srtmp/utils"
+)
+
+const (
+	//没有时间信息时按25fps计算帧间隔，单位毫秒
+	defaultFrameDuration = 40
+)
+
+var (
+	errSpsInvalid   = errors.New("invalid sps")
+	errSliceInvalid = errors.New("invalid slice header")
+	errNoSps        = errors.New("sps not received")
+	errNoSlice      = errors.New("no slice in access unit")
+)
+
+//SPS 计算图像顺序需要的sps字段
+type SPS struct {
+	ProfileIdc              byte
+	LevelIdc                byte
+	SeparateColourPlane     bool
+	Log2MaxFrameNum         uint32
+	PicOrderCntType         uint32
+	Log2MaxPicOrderCntLsb   uint32 //PicOrderCntType为0时有效
+	DeltaPicOrderAlwaysZero bool   //PicOrderCntType为1时有效
+	OffsetForNonRefPic      int32
+	OffsetForTopToBottom    int32
+	OffsetForRefFrame       []int32
+	FrameMbsOnly            bool
+	//vui中的时间信息，NumUnitsInTick为0表示没有
+	NumUnitsInTick uint32
+	TimeScale      uint32
+	//vui中的max_num_reorder_frames，-1表示没有
+	MaxNumReorderFrames int
+}
+
+//ParseSPS 解析sps，nalu包含1个字节的nalu头，不包含start code
+func ParseSPS(nalu []byte) (*SPS, error) {
+	rbsp := RemoveEmulationPrevention(nalu)
+	if len(rbsp) < 4 || rbsp[0]&0x1f != nalu_type_sps {
+		return nil, errSpsInvalid
+	}
+	sps := &SPS{
+		ProfileIdc:          rbsp[1],
+		LevelIdc:            rbsp[3],
+		MaxNumReorderFrames: -1,
+	}
+	br := utils.NewBitReader(rbsp[4:])
+	br.ReadUE() //seq_parameter_set_id
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat := br.ReadUE()
+		if chromaFormat == 3 {
+			sps.SeparateColourPlane = br.ReadFlag()
+		}
+		br.ReadUE() //bit_depth_luma_minus8
+		br.ReadUE() //bit_depth_chroma_minus8
+		br.Skip(1)  //qpprime_y_zero_transform_bypass_flag
+		if br.ReadFlag() {
+			//seq_scaling_matrix_present_flag
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if !br.ReadFlag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipScalingList(br, size)
+			}
+		}
+	}
+	sps.Log2MaxFrameNum = br.ReadUE() + 4
+	sps.PicOrderCntType = br.ReadUE()
+	switch sps.PicOrderCntType {
+	case 0:
+		sps.Log2MaxPicOrderCntLsb = br.ReadUE() + 4
+	case 1:
+		sps.DeltaPicOrderAlwaysZero = br.ReadFlag()
+		sps.OffsetForNonRefPic = br.ReadSE()
+		sps.OffsetForTopToBottom = br.ReadSE()
+		n := br.ReadUE()
+		if n > 255 {
+			return nil, errSpsInvalid
+		}
+		for i := uint32(0); i < n; i++ {
+			sps.OffsetForRefFrame = append(sps.OffsetForRefFrame, br.ReadSE())
+		}
+	case 2:
+	default:
+		return nil, errSpsInvalid
+	}
+	br.ReadUE() //max_num_ref_frames
+	br.Skip(1)  //gaps_in_frame_num_value_allowed_flag
+	br.ReadUE() //pic_width_in_mbs_minus1
+	br.ReadUE() //pic_height_in_map_units_minus1
+	sps.FrameMbsOnly = br.ReadFlag()
+	if !sps.FrameMbsOnly {
+		br.Skip(1) //mb_adaptive_frame_field_flag
+	}
+	br.Skip(1) //direct_8x8_inference_flag
+	if br.ReadFlag() {
+		//frame_cropping_flag
+		for i := 0; i < 4; i++ {
+			br.ReadUE()
+		}
+	}
+	if br.Err() != nil || sps.Log2MaxFrameNum > 16 || sps.Log2MaxPicOrderCntLsb > 16 {
+		return nil, errSpsInvalid
+	}
+	if br.ReadFlag() {
+		//vui_parameters_present_flag，vui解析失败不影响前面的字段
+		parseVUI(br, sps)
+	}
+	return sps, nil
+}
+
+//parseVUI 只取出时间信息和max_num_reorder_frames
+func parseVUI(br *utils.BitReader, sps *SPS) {
+	if br.ReadFlag() {
+		//aspect_ratio_info_present_flag
+		if br.ReadBits(8) == 255 {
+			br.Skip(32) //sar_width sar_height
+		}
+	}
+	if br.ReadFlag() {
+		br.Skip(1) //overscan_appropriate_flag
+	}
+	if br.ReadFlag() {
+		//video_signal_type_present_flag
+		br.Skip(4)
+		if br.ReadFlag() {
+			br.Skip(24) //colour_primaries transfer_characteristics matrix_coefficients
+		}
+	}
+	if br.ReadFlag() {
+		//chroma_loc_info_present_flag
+		br.ReadUE()
+		br.ReadUE()
+	}
+	var numUnitsInTick, timeScale uint32
+	if br.ReadFlag() {
+		//timing_info_present_flag
+		numUnitsInTick = br.ReadBits(32)
+		timeScale = br.ReadBits(32)
+		br.Skip(1) //fixed_frame_rate_flag
+	}
+	nalHrd := br.ReadFlag()
+	if nalHrd {
+		skipHRD(br)
+	}
+	vclHrd := br.ReadFlag()
+	if vclHrd {
+		skipHRD(br)
+	}
+	if nalHrd || vclHrd {
+		br.Skip(1) //low_delay_hrd_flag
+	}
+	br.Skip(1) //pic_struct_present_flag
+	reorder := -1
+	if br.ReadFlag() {
+		//bitstream_restriction_flag
+		br.Skip(1) //motion_vectors_over_pic_boundaries_flag
+		for i := 0; i < 4; i++ {
+			br.ReadUE()
+		}
+		reorder = int(br.ReadUE())
+		br.ReadUE() //max_dec_frame_buffering
+	}
+	if br.Err() != nil {
+		return
+	}
+	sps.NumUnitsInTick, sps.TimeScale = numUnitsInTick, timeScale
+	sps.MaxNumReorderFrames = reorder
+}
+
+func skipHRD(br *utils.BitReader) {
+	cpbCnt := br.ReadUE() + 1
+	br.Skip(8) //bit_rate_scale cpb_size_scale
+	for i := uint32(0); i < cpbCnt && br.Err() == nil; i++ {
+		br.ReadUE()
+		br.ReadUE()
+		br.Skip(1)
+	}
+	br.Skip(20)
+}
+
+func skipScalingList(br *utils.BitReader, size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size && br.Err() == nil; j++ {
+		if next != 0 {
+			next = (last + br.ReadSE() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+//FrameDuration 根据vui中的时间信息计算帧间隔(毫秒)，没有时返回0
+func (sps *SPS) FrameDuration() uint32 {
+	if sps.NumUnitsInTick == 0 || sps.TimeScale == 0 {
+		return 0
+	}
+	//time_scale按场计算，一帧是两个tick
+	return uint32(uint64(sps.NumUnitsInTick) * 2 * 1000 / uint64(sps.TimeScale))
+}
+
+//SliceHeader 计算POC需要的slice header字段
+type SliceHeader struct {
+	NaluType         byte
+	NalRefIdc        byte
+	SliceType        uint32
+	FrameNum         uint32
+	FieldPic         bool
+	BottomField      bool
+	PicOrderCntLsb   uint32
+	DeltaPicOrderCnt [2]int32
+}
+
+//IsIDR ...
+func (h *SliceHeader) IsIDR() bool {
+	return h.NaluType == nalu_type_idr
+}
+
+//ParseSliceHeader 解析slice header的前面部分，nalu为类型1或5的slice
+func ParseSliceHeader(nalu []byte, sps *SPS) (*SliceHeader, error) {
+	if len(nalu) < 2 {
+		return nil, errSliceInvalid
+	}
+	header := &SliceHeader{
+		NaluType:  nalu[0] & 0x1f,
+		NalRefIdc: (nalu[0] >> 5) & 0x03,
+	}
+	if header.NaluType != nalu_type_slice && header.NaluType != nalu_type_idr {
+		return nil, errSliceInvalid
+	}
+	//slice header的前面部分不会太长，只处理开头的数据
+	end := len(nalu)
+	if end > 64 {
+		end = 64
+	}
+	br := utils.NewBitReader(RemoveEmulationPrevention(nalu[1:end]))
+	br.ReadUE() //first_mb_in_slice
+	header.SliceType = br.ReadUE() % 5
+	br.ReadUE() //pic_parameter_set_id
+	if sps.SeparateColourPlane {
+		br.Skip(2) //colour_plane_id
+	}
+	header.FrameNum = br.ReadBits(int(sps.Log2MaxFrameNum))
+	if !sps.FrameMbsOnly {
+		header.FieldPic = br.ReadFlag()
+		if header.FieldPic {
+			header.BottomField = br.ReadFlag()
+		}
+	}
+	if header.IsIDR() {
+		br.ReadUE() //idr_pic_id
+	}
+	switch sps.PicOrderCntType {
+	case 0:
+		header.PicOrderCntLsb = br.ReadBits(int(sps.Log2MaxPicOrderCntLsb))
+	case 1:
+		if !sps.DeltaPicOrderAlwaysZero {
+			header.DeltaPicOrderCnt[0] = br.ReadSE()
+		}
+	}
+	if br.Err() != nil {
+		return nil, errSliceInvalid
+	}
+	return header, nil
+}
+
+//POCCalculator 按ISO 14496-10 8.2.1计算每帧的图像顺序号(POC)，只计算顶场或帧的POC
+type POCCalculator struct {
+	sps                *SPS
+	prevPocMsb         int32
+	prevPocLsb         int32
+	prevFrameNum       uint32
+	prevFrameNumOffset int32
+}
+
+//SetSPS 更新sps
+func (c *POCCalculator) SetSPS(sps *SPS) {
+	c.sps = sps
+}
+
+//POC 计算slice所在图像的POC，同一帧的多个slice只需要计算第一个
+func (c *POCCalculator) POC(header *SliceHeader) (int32, error) {
+	if c.sps == nil {
+		return 0, errNoSps
+	}
+	switch c.sps.PicOrderCntType {
+	case 0:
+		return c.poc0(header), nil
+	case 1:
+		return c.poc1(header), nil
+	}
+	return c.poc2(header), nil
+}
+
+func (c *POCCalculator) poc0(header *SliceHeader) int32 {
+	if header.IsIDR() {
+		c.prevPocMsb, c.prevPocLsb = 0, 0
+	}
+	maxLsb := int32(1) << c.sps.Log2MaxPicOrderCntLsb
+	lsb := int32(header.PicOrderCntLsb)
+	msb := c.prevPocMsb
+	if lsb < c.prevPocLsb && c.prevPocLsb-lsb >= maxLsb/2 {
+		msb += maxLsb
+	} else if lsb > c.prevPocLsb && lsb-c.prevPocLsb > maxLsb/2 {
+		msb -= maxLsb
+	}
+	//只有参考帧会作为下一帧计算的基准
+	if header.NalRefIdc != 0 {
+		c.prevPocMsb, c.prevPocLsb = msb, lsb
+	}
+	return msb + lsb
+}
+
+//frameNumOffset PicOrderCntType为1和2时，frame_num回绕后累加的偏移
+func (c *POCCalculator) frameNumOffset(header *SliceHeader) int32 {
+	offset := c.prevFrameNumOffset
+	if header.IsIDR() {
+		offset = 0
+	} else if c.prevFrameNum > header.FrameNum {
+		offset += int32(1) << c.sps.Log2MaxFrameNum
+	}
+	c.prevFrameNum = header.FrameNum
+	c.prevFrameNumOffset = offset
+	return offset
+}
+
+func (c *POCCalculator) poc1(header *SliceHeader) int32 {
+	offset := c.frameNumOffset(header)
+	cycle := int32(len(c.sps.OffsetForRefFrame))
+	absFrameNum := int32(0)
+	if cycle != 0 {
+		absFrameNum = offset + int32(header.FrameNum)
+	}
+	if header.NalRefIdc == 0 && absFrameNum > 0 {
+		absFrameNum--
+	}
+	expected := int32(0)
+	if absFrameNum > 0 {
+		deltaPerCycle := int32(0)
+		for _, v := range c.sps.OffsetForRefFrame {
+			deltaPerCycle += v
+		}
+		expected = (absFrameNum - 1) / cycle * deltaPerCycle
+		for i := int32(0); i <= (absFrameNum-1)%cycle; i++ {
+			expected += c.sps.OffsetForRefFrame[i]
+		}
+	}
+	if header.NalRefIdc == 0 {
+		expected += c.sps.OffsetForNonRefPic
+	}
+	return expected + header.DeltaPicOrderCnt[0]
+}
+
+func (c *POCCalculator) poc2(header *SliceHeader) int32 {
+	offset := c.frameNumOffset(header)
+	if header.IsIDR() {
+		return 0
+	}
+	poc := 2 * (offset + int32(header.FrameNum))
+	if header.NalRefIdc == 0 {
+		poc--
+	}
+	return poc
+}
+
+//FrameOrderer 根据annexb格式的h264帧的slice header推算显示顺序，生成flv中的CompositionTime，
+//用于发布端没有提供pts的情况。假设帧率固定，pts = dts + (显示序号 - 解码序号 + 重排序深度) * 帧间隔
+//
+//限制：帧不做缓存，立即返回结果。sps的vui中没有max_num_reorder_frames时，重排序深度从0开始，
+//遇到更深的重排序才增大，只对之后的帧生效，之前已经返回的帧的CompositionTime偏小，
+//可能出现pts回退，通常只影响开头的几帧。帧间隔取相邻两帧dts的差值，帧率变化或者dts有抖动时
+//推算的pts不准确。需要准确的pts时，应该由调用方通过CompositionTime传入
+type FrameOrderer struct {
+	poc         POCCalculator
+	sps         *SPS
+	started     bool
+	basePoc     int32 //idr帧的POC，之后的显示序号都相对于它计算
+	lastPoc     int32
+	pocStep     int32 //相邻两帧POC的最小差值，默认为2，编码器每帧POC加1时为1
+	decodeIndex int32
+	delay       int32 //重排序深度，保证CompositionTime不小于0
+	lastDts     uint32
+	duration    uint32
+}
+
+//NewFrameOrderer ...
+func NewFrameOrderer() *FrameOrderer {
+	return &FrameOrderer{pocStep: 2}
+}
+
+//CompositionTime 输入annexb格式的一帧数据和它的dts(毫秒)，返回CompositionTime(毫秒)，
+//帧中的sps会被记录下来，没有收到sps或者帧中没有slice时返回错误，结果的准确性参考FrameOrderer的限制
+func (o *FrameOrderer) CompositionTime(au []byte, dts uint32) (int32, error) {
+	var slice []byte
+	for _, nalu := range ParseNalus(au) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case nalu_type_sps:
+			sps, err := ParseSPS(nalu)
+			if err != nil {
+				return 0, err
+			}
+			o.sps = sps
+			o.poc.SetSPS(sps)
+		case nalu_type_slice, nalu_type_idr:
+			if slice == nil {
+				slice = nalu
+			}
+		}
+	}
+	if o.sps == nil {
+		return 0, errNoSps
+	}
+	if slice == nil {
+		return 0, errNoSlice
+	}
+	header, err := ParseSliceHeader(slice, o.sps)
+	if err != nil {
+		return 0, err
+	}
+	poc, err := o.poc.POC(header)
+	if err != nil {
+		return 0, err
+	}
+	o.updateDuration(dts)
+
+	if !o.started || header.IsIDR() {
+		o.started = true
+		o.basePoc = poc
+		o.decodeIndex = 0
+	} else {
+		o.decodeIndex++
+		if diff := poc - o.lastPoc; diff == 1 || diff == -1 {
+			o.pocStep = 1
+		}
+	}
+	o.lastPoc = poc
+
+	//POC为2时没有B帧，vui中有max_num_reorder_frames时直接使用
+	if o.sps.PicOrderCntType == 2 {
+		o.delay = 0
+	} else if o.sps.MaxNumReorderFrames > int(o.delay) {
+		o.delay = int32(o.sps.MaxNumReorderFrames)
+	}
+	offset := (poc-o.basePoc)/o.pocStep - o.decodeIndex
+	//重排序深度不够时增大，之后的帧都按新的深度计算
+	if offset+o.delay < 0 {
+		o.delay = -offset
+	}
+	return (offset + o.delay) * int32(o.duration), nil
+}
+
+//updateDuration 优先使用相邻两帧dts的差值作为帧间隔，其次是vui中的时间信息
+func (o *FrameOrderer) updateDuration(dts uint32) {
+	if o.started && dts > o.lastDts {
+		o.duration = dts - o.lastDts
+	} else if o.duration == 0 {
+		o.duration = o.sps.FrameDuration()
+		if o.duration == 0 {
+			o.duration = defaultFrameDuration
+		}
+	}
+	o.lastDts = dts
+}
+
+//RemoveEmulationPrevention 去掉防竞争字节，00 00 03 -> 00 00
+func RemoveEmulationPrevention(src []byte) []byte {
+	dst := make([]byte, 0, len(src))
+	zeros := 0
+	for _, b := range src {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
@@ -0,0 +1,201 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/fabo871218/srtmp/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+//生成main profile的sps，pocType为0或2，reorder小于0时不带vui
+func testSPS(pocType uint32, reorder int) []byte {
+	bw := utils.NewBitWriter(32)
+	bw.WriteBits(0x674d001e, 32)
+	bw.WriteUE(0) //seq_parameter_set_id
+	bw.WriteUE(0) //log2_max_frame_num_minus4
+	bw.WriteUE(pocType)
+	if pocType == 0 {
+		bw.WriteUE(4) //log2_max_pic_order_cnt_lsb_minus4
+	}
+	bw.WriteUE(2) //max_num_ref_frames
+	bw.WriteBits(0, 1)
+	bw.WriteUE(19)     //pic_width_in_mbs_minus1
+	bw.WriteUE(14)     //pic_height_in_map_units_minus1
+	bw.WriteBits(1, 1) //frame_mbs_only_flag
+	bw.WriteBits(1, 1) //direct_8x8_inference_flag
+	bw.WriteBits(0, 1) //frame_cropping_flag
+	bw.WriteFlag(reorder >= 0)
+	if reorder >= 0 {
+		bw.WriteBits(0, 4)
+		//timing_info，25fps
+		bw.WriteBits(1, 1)
+		bw.WriteBits(1, 32)
+		bw.WriteBits(50, 32)
+		bw.WriteBits(1, 1)
+		bw.WriteBits(0, 3)
+		//bitstream_restriction
+		bw.WriteBits(1, 1)
+		bw.WriteBits(1, 1)
+		bw.WriteUE(0)
+		bw.WriteUE(0)
+		bw.WriteUE(16)
+		bw.WriteUE(16)
+		bw.WriteUE(uint32(reorder))
+		bw.WriteUE(3)
+	}
+	bw.WriteBits(1, 1) //rbsp_stop_one_bit
+	return addEmulationPrevention(bw.Bytes())
+}
+
+//addEmulationPrevention 在00 00后面出现小于等于3的字节时插入03
+func addEmulationPrevention(src []byte) []byte {
+	dst := make([]byte, 0, len(src)+4)
+	zeros := 0
+	for _, b := range src {
+		if zeros >= 2 && b <= 3 {
+			dst = append(dst, 0x03)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+//生成slice header，frame_num为4位，pic_order_cnt_lsb为8位
+func testSlice(naluHeader byte, sliceType, frameNum, pocLsb uint32, pocType uint32) []byte {
+	bw := utils.NewBitWriter(16)
+	bw.WriteBits(uint32(naluHeader), 8)
+	bw.WriteUE(0) //first_mb_in_slice
+	bw.WriteUE(sliceType)
+	bw.WriteUE(0) //pic_parameter_set_id
+	bw.WriteBits(frameNum, 4)
+	if naluHeader&0x1f == nalu_type_idr {
+		bw.WriteUE(0) //idr_pic_id
+	}
+	if pocType == 0 {
+		bw.WriteBits(pocLsb, 8)
+	}
+	bw.WriteBits(0xff, 8)
+	return addEmulationPrevention(bw.Bytes())
+}
+
+type testFrame struct {
+	nalu     byte
+	typ      uint32
+	frameNum uint32
+	poc      uint32
+}
+
+//IBBP结构，解码顺序为I0 P3 B1 B2 P6 B4 B5
+var ibbp = []testFrame{
+	{0x65, 7, 0, 0}, {0x41, 5, 1, 6}, {0x01, 6, 2, 2}, {0x01, 6, 2, 4},
+	{0x41, 5, 2, 12}, {0x01, 6, 3, 8}, {0x01, 6, 3, 10},
+}
+
+func annexb(nalus ...[]byte) []byte {
+	var au []byte
+	for _, nalu := range nalus {
+		au = append(au, StartCode4...)
+		au = append(au, nalu...)
+	}
+	return au
+}
+
+func TestParseSPS(t *testing.T) {
+	sps, err := ParseSPS(testSPS(0, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(77), sps.ProfileIdc)
+	assert.Equal(t, uint32(4), sps.Log2MaxFrameNum)
+	assert.Equal(t, uint32(0), sps.PicOrderCntType)
+	assert.Equal(t, uint32(8), sps.Log2MaxPicOrderCntLsb)
+	assert.True(t, sps.FrameMbsOnly)
+	assert.Equal(t, 1, sps.MaxNumReorderFrames)
+	assert.Equal(t, uint32(40), sps.FrameDuration())
+
+	sps, err = ParseSPS(testSPS(2, -1))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), sps.PicOrderCntType)
+	assert.Equal(t, -1, sps.MaxNumReorderFrames)
+	assert.Equal(t, uint32(0), sps.FrameDuration())
+
+	_, err = ParseSPS([]byte{0x68, 0xde, 0x31, 0x12})
+	assert.NotNil(t, err)
+}
+
+func TestPOCWrap(t *testing.T) {
+	sps, _ := ParseSPS(testSPS(0, 1))
+	var c POCCalculator
+	c.SetSPS(sps)
+	//pic_order_cnt_lsb为8位，超过256后回绕
+	expected := []int32{0, 100, 200, 300, 400, 510}
+	lsbs := []uint32{0, 100, 200, 44, 144, 254}
+	for i, lsb := range lsbs {
+		naluHeader := byte(0x41)
+		if i == 0 {
+			naluHeader = 0x65
+		}
+		header, err := ParseSliceHeader(testSlice(naluHeader, 5, uint32(i), lsb, 0), sps)
+		assert.Nil(t, err)
+		poc, err := c.POC(header)
+		assert.Nil(t, err)
+		assert.Equal(t, expected[i], poc)
+	}
+}
+
+func TestFrameOrderer(t *testing.T) {
+	o := NewFrameOrderer()
+	_, err := o.CompositionTime(annexb(testSlice(0x65, 7, 0, 0, 0)), 0)
+	assert.NotNil(t, err)
+
+	//vui中带有max_num_reorder_frames时，第一帧就能得到正确的CompositionTime
+	o = NewFrameOrderer()
+	sps := testSPS(0, 1)
+	expected := []int32{40, 120, 0, 0, 120, 0, 0}
+	for i, f := range ibbp {
+		au := annexb(testSlice(f.nalu, f.typ, f.frameNum, f.poc, 0))
+		if i == 0 {
+			au = annexb(sps, []byte{0x68, 0xde, 0x31, 0x12}, testSlice(f.nalu, f.typ, f.frameNum, f.poc, 0))
+		}
+		ct, err := o.CompositionTime(au, uint32(i*40))
+		assert.Nil(t, err)
+		assert.Equal(t, expected[i], ct, "frame %d", i)
+	}
+
+	//没有vui时根据出现的B帧调整重排序深度，第二个gop开始和上面相同
+	o = NewFrameOrderer()
+	sps = testSPS(0, -1)
+	dts := uint32(1000)
+	for gop := 0; gop < 2; gop++ {
+		for i, f := range ibbp {
+			au := annexb(testSlice(f.nalu, f.typ, f.frameNum, f.poc, 0))
+			if i == 0 {
+				au = annexb(sps, testSlice(f.nalu, f.typ, f.frameNum, f.poc, 0))
+			}
+			ct, err := o.CompositionTime(au, dts)
+			assert.Nil(t, err)
+			assert.True(t, ct >= 0)
+			if gop == 1 {
+				assert.Equal(t, expected[i], ct, "frame %d", i)
+			}
+			dts += 40
+		}
+	}
+
+	//pic_order_cnt_type为2时没有B帧
+	o = NewFrameOrderer()
+	sps = testSPS(2, -1)
+	for i := uint32(0); i < 5; i++ {
+		naluHeader := byte(0x41)
+		if i == 0 {
+			naluHeader = 0x65
+		}
+		ct, err := o.CompositionTime(annexb(sps, testSlice(naluHeader, 5, i, 0, 2)), i*33)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(0), ct)
+	}
+}
@@ -0,0 +1,314 @@
+package h265
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fabo871218/srtmp/media/h264"
+	"github.com/fabo871218/srtmp/utils"
+)
+
+//h265 nalu类型，nalu头为2个字节，类型为第一个字节的第2~7位
+const (
+	NaluTypeBLAWLP   byte = 16 //16~23为IRAP帧，可以作为随机访问点
+	NaluTypeIDRWRADL byte = 19
+	NaluTypeIDRNLP   byte = 20
+	NaluTypeCRA      byte = 21
+	NaluTypeRSVIRAP  byte = 23
+	NaluTypeVPS      byte = 32
+	NaluTypeSPS      byte = 33
+	NaluTypePPS      byte = 34
+	NaluTypeAUD      byte = 35
+	NaluTypeSEI      byte = 39
+)
+
+const (
+	naluBytesLen  int = 4
+	recordHeadLen int = 23
+)
+
+var (
+	errSpsTooShort    = errors.New("sps too short")
+	errRecordTooShort = errors.New("record too short")
+	errNaluBodyLen    = errors.New("nalu body len error")
+)
+
+var naluAud = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+
+//NaluType 获取nalu类型，nalu不包含start code
+func NaluType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return (nalu[0] >> 1) & 0x3f
+}
+
+//IsIRAP 是否是随机访问点(BLA/IDR/CRA)，相当于h264的idr帧
+func IsIRAP(naluType byte) bool {
+	return naluType >= NaluTypeBLAWLP && naluType <= NaluTypeRSVIRAP
+}
+
+//IsParameterSet 是否是vps，sps或pps
+func IsParameterSet(naluType byte) bool {
+	return naluType == NaluTypeVPS || naluType == NaluTypeSPS || naluType == NaluTypePPS
+}
+
+/*
+aligned(8) class HEVCDecoderConfigurationRecord {
+	unsigned int(8) configurationVersion = 1;
+	unsigned int(2) general_profile_space;
+	unsigned int(1) general_tier_flag;
+	unsigned int(5) general_profile_idc;
+	unsigned int(32) general_profile_compatibility_flags;
+	unsigned int(48) general_constraint_indicator_flags;
+	unsigned int(8) general_level_idc;
+	bit(4) reserved = '1111'b;
+	unsigned int(12) min_spatial_segmentation_idc;
+	bit(6) reserved = '111111'b;
+	unsigned int(2) parallelismType;
+	bit(6) reserved = '111111'b;
+	unsigned int(2) chromaFormat;
+	bit(5) reserved = '11111'b;
+	unsigned int(3) bitDepthLumaMinus8;
+	bit(5) reserved = '11111'b;
+	unsigned int(3) bitDepthChromaMinus8;
+	bit(16) avgFrameRate;
+	bit(2) constantFrameRate;
+	bit(3) numTemporalLayers;
+	bit(1) temporalIdNested;
+	unsigned int(2) lengthSizeMinusOne;
+	unsigned int(8) numOfArrays;
+	for (j=0; j < numOfArrays; j++) {
+		bit(1) array_completeness;
+		unsigned int(1) reserved = 0;
+		unsigned int(6) NAL_unit_type;
+		unsigned int(16) numNalus;
+		for (i=0; i< numNalus; i++) {
+			unsigned int(16) nalUnitLength;
+			bit(8*nalUnitLength) nalUnit;
+		}
+	}
+}
+*/
+
+//spsInfo 生成HEVCDecoderConfigurationRecord需要从sps中获取的信息
+type spsInfo struct {
+	profileTierLevel  [12]byte //从general_profile_space到general_level_idc
+	maxSubLayers      byte
+	temporalIDNesting byte
+	chromaFormat      byte
+	bitDepthLuma      byte //减8以后的值
+	bitDepthChroma    byte //减8以后的值
+}
+
+//HEVCDecoderConfigurationRecord 生成h265的sequence header，vps sps pps不包含start code
+func HEVCDecoderConfigurationRecord(vps, sps, pps []byte) ([]byte, error) {
+	vps = bytes.TrimPrefix(vps, h264.StartCode4)
+	sps = bytes.TrimPrefix(sps, h264.StartCode4)
+	pps = bytes.TrimPrefix(pps, h264.StartCode4)
+	info, err := parseSps(sps)
+	if err != nil {
+		return nil, fmt.Errorf("parse sps failed, %v", err)
+	}
+
+	buffer := make([]byte, recordHeadLen, recordHeadLen+15+len(vps)+len(sps)+len(pps))
+	buffer[0] = 1
+	copy(buffer[1:], info.profileTierLevel[:])
+	buffer[13] = 0xf0 //min_spatial_segmentation_idc 为0
+	buffer[14] = 0x00
+	buffer[15] = 0xfc //parallelismType 为0
+	buffer[16] = 0xfc | info.chromaFormat
+	buffer[17] = 0xf8 | info.bitDepthLuma
+	buffer[18] = 0xf8 | info.bitDepthChroma
+	//avgFrameRate和constantFrameRate为0，表示未指定，nalu长度固定为4个字节
+	buffer[21] = info.maxSubLayers<<3 | info.temporalIDNesting<<2 | 0x03
+	buffer[22] = 3
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		var arrayHead [5]byte
+		arrayHead[0] = 0x80 | NaluType(nalu)
+		binary.BigEndian.PutUint16(arrayHead[1:], 1)
+		binary.BigEndian.PutUint16(arrayHead[3:], uint16(len(nalu)))
+		buffer = append(buffer, arrayHead[:]...)
+		buffer = append(buffer, nalu...)
+	}
+	return buffer, nil
+}
+
+//ParseDecoderConfigurationRecord 从sequence header中解析出vps sps pps
+func ParseDecoderConfigurationRecord(data []byte) (vpss, spss, ppss [][]byte, err error) {
+	if len(data) < recordHeadLen {
+		err = errRecordTooShort
+		return
+	}
+	if data[0] != 0x01 {
+		err = errors.New("version should be 0x01")
+		return
+	}
+	numOfArrays := int(data[22])
+	index := recordHeadLen
+	for i := 0; i < numOfArrays; i++ {
+		if len(data[index:]) < 3 {
+			err = errRecordTooShort
+			return
+		}
+		naluType := data[index] & 0x3f
+		numNalus := int(binary.BigEndian.Uint16(data[index+1:]))
+		index += 3
+		for j := 0; j < numNalus; j++ {
+			if len(data[index:]) < 2 {
+				err = errRecordTooShort
+				return
+			}
+			length := int(binary.BigEndian.Uint16(data[index:]))
+			index += 2
+			if len(data[index:]) < length {
+				err = errNaluBodyLen
+				return
+			}
+			nalu := make([]byte, length)
+			copy(nalu, data[index:index+length])
+			index += length
+			switch naluType {
+			case NaluTypeVPS:
+				vpss = append(vpss, nalu)
+			case NaluTypeSPS:
+				spss = append(spss, nalu)
+			case NaluTypePPS:
+				ppss = append(ppss, nalu)
+			}
+		}
+	}
+	return
+}
+
+//parseSps 解析sps中的profile_tier_level，色度格式和位深
+func parseSps(sps []byte) (info spsInfo, err error) {
+	//2个字节的nalu头，1个字节的vps id等信息，12个字节的profile_tier_level
+	rbsp := h264.RemoveEmulationPrevention(sps)
+	if len(rbsp) < 15 {
+		err = errSpsTooShort
+		return
+	}
+	maxSubLayersMinus1 := (rbsp[2] >> 1) & 0x07
+	info.maxSubLayers = maxSubLayersMinus1 + 1
+	info.temporalIDNesting = rbsp[2] & 0x01
+	copy(info.profileTierLevel[:], rbsp[3:15])
+
+	br := utils.NewBitReader(rbsp[15:])
+	subLayerProfile := make([]bool, maxSubLayersMinus1)
+	subLayerLevel := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < int(maxSubLayersMinus1); i++ {
+		subLayerProfile[i] = br.ReadFlag()
+		subLayerLevel[i] = br.ReadFlag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		br.Skip(2 * (8 - int(maxSubLayersMinus1)))
+	}
+	for i := 0; i < int(maxSubLayersMinus1); i++ {
+		if subLayerProfile[i] {
+			br.Skip(88)
+		}
+		if subLayerLevel[i] {
+			br.Skip(8)
+		}
+	}
+	br.ReadUE() //sps_seq_parameter_set_id
+	chromaFormat := br.ReadUE()
+	if chromaFormat == 3 {
+		br.Skip(1) //separate_colour_plane_flag
+	}
+	br.ReadUE() //pic_width_in_luma_samples
+	br.ReadUE() //pic_height_in_luma_samples
+	if br.ReadFlag() {
+		//conformance_window_flag
+		for i := 0; i < 4; i++ {
+			br.ReadUE()
+		}
+	}
+	bitDepthLuma := br.ReadUE()
+	bitDepthChroma := br.ReadUE()
+	if br.Err() != nil {
+		err = errSpsTooShort
+		return
+	}
+	info.chromaFormat = byte(chromaFormat & 0x03)
+	info.bitDepthLuma = byte(bitDepthLuma & 0x07)
+	info.bitDepthChroma = byte(bitDepthChroma & 0x07)
+	return
+}
+
+//Parser 把flv中的h265数据转换成annexb格式
+type Parser struct {
+	paramSets []byte //annexb格式的vps sps pps
+}
+
+//NewParser ...
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//Parse isSeq为true时，b为HEVCDecoderConfigurationRecord，否则为4字节长度+nalu的数据
+func (parser *Parser) Parse(b []byte, isSeq bool, w io.Writer) error {
+	if isSeq {
+		vpss, spss, ppss, err := ParseDecoderConfigurationRecord(b)
+		if err != nil {
+			return err
+		}
+		parser.paramSets = parser.paramSets[:0]
+		for _, nalus := range [][][]byte{vpss, spss, ppss} {
+			for _, nalu := range nalus {
+				parser.paramSets = append(parser.paramSets, h264.StartCode4...)
+				parser.paramSets = append(parser.paramSets, nalu...)
+			}
+		}
+		return nil
+	}
+	if bytes.HasPrefix(b, h264.StartCode4) || bytes.HasPrefix(b, h264.StartCode3) {
+		_, err := w.Write(b)
+		return err
+	}
+	return parser.getAnnexbH265(b, w)
+}
+
+func (parser *Parser) getAnnexbH265(src []byte, w io.Writer) error {
+	if _, err := w.Write(naluAud); err != nil {
+		return err
+	}
+	//带内的参数集优先，否则在第一个IRAP帧前插入sequence header中的参数集
+	hasParamSets := false
+	for index := 0; index < len(src); {
+		if len(src[index:]) < naluBytesLen {
+			return errNaluBodyLen
+		}
+		nalLen := int(binary.BigEndian.Uint32(src[index:]))
+		index += naluBytesLen
+		if nalLen <= 0 || len(src[index:]) < nalLen {
+			return errNaluBodyLen
+		}
+		nalu := src[index : index+nalLen]
+		index += nalLen
+
+		naluType := NaluType(nalu)
+		if naluType == NaluTypeAUD {
+			continue
+		}
+		if IsParameterSet(naluType) {
+			hasParamSets = true
+		} else if IsIRAP(naluType) && !hasParamSets {
+			hasParamSets = true
+			if _, err := w.Write(parser.paramSets); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(h264.StartCode4); err != nil {
+			return err
+		}
+		if _, err := w.Write(nalu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package h265
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testVps = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90,
+		0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	testSps = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93,
+		0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00, 0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98, 0x04}
+	testPps = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+func TestHEVCDecoderConfigurationRecord(t *testing.T) {
+	at := assert.New(t)
+	record, err := HEVCDecoderConfigurationRecord(append([]byte{0, 0, 0, 1}, testVps...), testSps, testPps)
+	at.Nil(err)
+	at.Equal([]byte{0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5d,
+		0xf0, 0x00, 0xfc, 0xfd, 0xf8, 0xf8, 0x00, 0x00, 0x0f, 0x03}, record[:recordHeadLen])
+
+	vpss, spss, ppss, err := ParseDecoderConfigurationRecord(record)
+	at.Nil(err)
+	at.Equal([][]byte{testVps}, vpss)
+	at.Equal([][]byte{testSps}, spss)
+	at.Equal([][]byte{testPps}, ppss)
+
+	_, _, _, err = ParseDecoderConfigurationRecord(record[:len(record)-1])
+	at.NotNil(err)
+	_, err = HEVCDecoderConfigurationRecord(testVps, testSps[:10], testPps)
+	at.NotNil(err)
+}
+
+func TestH265AnnexbDemux(t *testing.T) {
+	at := assert.New(t)
+	record, err := HEVCDecoderConfigurationRecord(testVps, testSps, testPps)
+	at.Nil(err)
+	parser := NewParser()
+	at.Nil(parser.Parse(record, true, nil))
+
+	//IRAP帧之前插入参数集
+	idr := []byte{0x26, 0x01, 0xaf, 0x09}
+	w := bytes.NewBuffer(nil)
+	at.Nil(parser.Parse([]byte{0x00, 0x00, 0x00, 0x04, 0x26, 0x01, 0xaf, 0x09}, false, w))
+	var expect []byte
+	expect = append(expect, naluAud...)
+	for _, nalu := range [][]byte{testVps, testSps, testPps, idr} {
+		expect = append(expect, 0x00, 0x00, 0x00, 0x01)
+		expect = append(expect, nalu...)
+	}
+	at.Equal(expect, w.Bytes())
+	at.True(IsIRAP(NaluType(idr)))
+
+	//非IRAP帧直接转换
+	w.Reset()
+	at.Nil(parser.Parse([]byte{0x00, 0x00, 0x00, 0x03, 0x02, 0x01, 0xd0}, false, w))
+	at.Equal(append(append([]byte{}, naluAud...), 0x00, 0x00, 0x00, 0x01, 0x02, 0x01, 0xd0), w.Bytes())
+
+	w.Reset()
+	at.NotNil(parser.Parse([]byte{0x00, 0x00, 0x00, 0x09, 0x02, 0x01}, false, w))
+}
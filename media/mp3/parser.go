@@ -1,36 +1,178 @@
 package mp3
 
-import "errors"
+import (
+	"errors"
+	"io"
+)
 
-type Parser struct {
-	samplingFrequency int
-}
+//MPEG音频版本
+const (
+	Version25 = 0 //MPEG 2.5，非标准扩展，支持更低的采样率
+	Version2  = 2
+	Version1  = 3
+)
 
-func NewParser() *Parser {
-	return &Parser{}
-}
+//声道模式
+const (
+	ChannelStereo      = 0
+	ChannelJointStereo = 1
+	ChannelDual        = 2
+	ChannelMono        = 3
+)
+
+const (
+	headerLen  = 4
+	layerIII   = 1 //layer字段中01表示Layer III
+	freeFormat = 0
+)
 
 // sampling_frequency - indicates the sampling frequency, according to the following table.
 // '00' 44.1 kHz
 // '01' 48 kHz
 // '10' 32 kHz
 // '11' reserved
+// MPEG2为MPEG1的一半，MPEG2.5为MPEG1的四分之一
 var mp3Rates = []int{44100, 48000, 32000}
+
+//bitrate_index对应的码率(kbps)，0为free format，15为保留值
+var (
+	bitratesV1 = []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	bitratesV2 = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+)
+
 var (
 	errMp3DataInvalid = errors.New("mp3data  invalid")
 	errIndexInvalid   = errors.New("invalid rate index")
+	errInvalidHeader  = errors.New("invalid frame header")
+	errNoFrame        = errors.New("no mp3 frame found")
 )
 
-func (parser *Parser) Parse(src []byte) error {
-	if len(src) < 3 {
-		return errMp3DataInvalid
+//FrameHeader MPEG-1/2 Layer III的帧头
+type FrameHeader struct {
+	Version     byte
+	Protection  bool //为true时帧头后有2字节crc
+	Bitrate     int  //kbps
+	SampleRate  int
+	Padding     bool
+	ChannelMode byte
+	ModeExt     byte
+	FrameLen    int //包括帧头的帧长度
+	Samples     int //每帧的采样数
+}
+
+//Channels 返回声道数
+func (h *FrameHeader) Channels() int {
+	if h.ChannelMode == ChannelMono {
+		return 1
+	}
+	return 2
+}
+
+//ParseFrameHeader 解析4个字节的帧头，只支持Layer III，不支持free format
+func ParseFrameHeader(b []byte) (*FrameHeader, error) {
+	if len(b) < headerLen {
+		return nil, errMp3DataInvalid
+	}
+	//11bit的同步字
+	if b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return nil, errInvalidHeader
+	}
+	version := (b[1] >> 3) & 0x03
+	if version == 1 || (b[1]>>1)&0x03 != layerIII {
+		return nil, errInvalidHeader
+	}
+	bitrateIndex := b[2] >> 4
+	rateIndex := (b[2] >> 2) & 0x03
+	if bitrateIndex == freeFormat || bitrateIndex == 0x0f {
+		return nil, errInvalidHeader
+	}
+	if rateIndex >= byte(len(mp3Rates)) {
+		return nil, errIndexInvalid
+	}
+
+	header := &FrameHeader{
+		Version:     version,
+		Protection:  b[1]&0x01 == 0,
+		Padding:     (b[2]>>1)&0x01 == 1,
+		ChannelMode: b[3] >> 6,
+		ModeExt:     (b[3] >> 4) & 0x03,
 	}
-	index := (src[2] >> 2) & 0x3
-	if index <= byte(len(mp3Rates)-1) {
-		parser.samplingFrequency = mp3Rates[index]
-		return nil
+	header.SampleRate = mp3Rates[rateIndex]
+	slots := 144
+	switch version {
+	case Version1:
+		header.Bitrate = bitratesV1[bitrateIndex]
+		header.Samples = 1152
+	case Version2:
+		header.Bitrate = bitratesV2[bitrateIndex]
+		header.SampleRate /= 2
+		header.Samples = 576
+		slots = 72
+	case Version25:
+		header.Bitrate = bitratesV2[bitrateIndex]
+		header.SampleRate /= 4
+		header.Samples = 576
+		slots = 72
 	}
-	return errIndexInvalid
+	header.FrameLen = slots * header.Bitrate * 1000 / header.SampleRate
+	if header.Padding {
+		header.FrameLen++
+	}
+	return header, nil
+}
+
+//SameConfig 判断两帧的版本，采样率和声道模式是否相同，数据不是有效的帧头时返回false
+func SameConfig(a, b []byte) bool {
+	ha, err := ParseFrameHeader(a)
+	if err != nil {
+		return false
+	}
+	hb, err := ParseFrameHeader(b)
+	if err != nil {
+		return false
+	}
+	return ha.Version == hb.Version && ha.SampleRate == hb.SampleRate && ha.ChannelMode == hb.ChannelMode
+}
+
+//Parser 把数据拆分成完整的mp3帧，记录最近一帧的参数
+type Parser struct {
+	header            *FrameHeader
+	samplingFrequency int
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//Parse 解析src中的mp3帧，把完整的帧写入w，遇到无效的数据时向后查找下一个同步字
+func (parser *Parser) Parse(src []byte, w io.Writer) error {
+	found := false
+	for index := 0; index+headerLen <= len(src); {
+		header, err := ParseFrameHeader(src[index:])
+		if err != nil || index+header.FrameLen > len(src) {
+			//resync，跳过一个字节继续查找同步字
+			index++
+			continue
+		}
+		found = true
+		parser.header = header
+		parser.samplingFrequency = header.SampleRate
+		if w != nil {
+			if _, err := w.Write(src[index : index+header.FrameLen]); err != nil {
+				return err
+			}
+		}
+		index += header.FrameLen
+	}
+	if !found {
+		return errNoFrame
+	}
+	return nil
+}
+
+//Header 返回最近解析到的帧头，没有时返回nil
+func (parser *Parser) Header() *FrameHeader {
+	return parser.header
 }
 
 func (parser *Parser) SampleRate() int {
@@ -39,3 +181,19 @@ func (parser *Parser) SampleRate() int {
 	}
 	return parser.samplingFrequency
 }
+
+//Samples 返回每帧的采样数，没有解析到帧时按MPEG1计算
+func (parser *Parser) Samples() int {
+	if parser.header == nil {
+		return 1152
+	}
+	return parser.header.Samples
+}
+
+//Channels 返回声道数，没有解析到帧时返回0
+func (parser *Parser) Channels() int {
+	if parser.header == nil {
+		return 0
+	}
+	return parser.header.Channels()
+}
@@ -0,0 +1,79 @@
+package mp3
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//frame 生成一个帧头为header，长度为size的帧
+func frame(header []byte, size int) []byte {
+	data := make([]byte, size)
+	copy(data, header)
+	return data
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	cases := []struct {
+		header     []byte
+		version    byte
+		bitrate    int
+		sampleRate int
+		channels   int
+		frameLen   int
+		samples    int
+	}{
+		//MPEG1 128kbps 44.1kHz joint stereo
+		{[]byte{0xff, 0xfb, 0x90, 0x44}, Version1, 128, 44100, 2, 417, 1152},
+		//带padding
+		{[]byte{0xff, 0xfb, 0x92, 0x44}, Version1, 128, 44100, 2, 418, 1152},
+		//MPEG2 64kbps 24kHz mono
+		{[]byte{0xff, 0xf3, 0x84, 0xc4}, Version2, 64, 24000, 1, 192, 576},
+		//MPEG2.5 8kbps 8kHz mono
+		{[]byte{0xff, 0xe3, 0x18, 0xc4}, Version25, 8, 8000, 1, 72, 576},
+	}
+	for _, c := range cases {
+		header, err := ParseFrameHeader(c.header)
+		assert.Nil(t, err)
+		assert.Equal(t, c.version, header.Version)
+		assert.Equal(t, c.bitrate, header.Bitrate)
+		assert.Equal(t, c.sampleRate, header.SampleRate)
+		assert.Equal(t, c.channels, header.Channels())
+		assert.Equal(t, c.frameLen, header.FrameLen)
+		assert.Equal(t, c.samples, header.Samples)
+	}
+
+	//layer I，free format，保留的采样率
+	for _, b := range [][]byte{{0xff, 0xff, 0x90, 0x44}, {0xff, 0xfb, 0x00, 0x44}, {0xff, 0xfb, 0x9c, 0x44}, {0xff, 0xfb}} {
+		_, err := ParseFrameHeader(b)
+		assert.Error(t, err)
+	}
+	assert.True(t, SameConfig([]byte{0xff, 0xfb, 0x90, 0x44}, []byte{0xff, 0xfb, 0xa2, 0x40}))
+	assert.False(t, SameConfig([]byte{0xff, 0xfb, 0x90, 0x44}, []byte{0xff, 0xfb, 0x90, 0xc4}))
+}
+
+func TestParser(t *testing.T) {
+	at := assert.New(t)
+	f1 := frame([]byte{0xff, 0xf3, 0x84, 0xc4}, 192)
+	f2 := frame([]byte{0xff, 0xf3, 0x84, 0xc4, 0x01}, 192)
+
+	//两帧之间的垃圾数据和末尾不完整的帧都被丢弃
+	var src []byte
+	src = append(src, 0x00, 0xff, 0x12)
+	src = append(src, f1...)
+	src = append(src, 0xff, 0xf0)
+	src = append(src, f2...)
+	src = append(src, f1[:100]...)
+
+	parser := NewParser()
+	at.Equal(44100, parser.SampleRate())
+	var w bytes.Buffer
+	at.Nil(parser.Parse(src, &w))
+	at.Equal(append(append([]byte{}, f1...), f2...), w.Bytes())
+	at.Equal(24000, parser.SampleRate())
+	at.Equal(576, parser.Samples())
+	at.Equal(1, parser.Channels())
+
+	at.Error(parser.Parse([]byte{0x00, 0x01, 0x02, 0x03, 0x04}, &w))
+}
@@ -0,0 +1,184 @@
+package opus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/fabo871218/srtmp/av"
+)
+
+const (
+	headMagic   = "OpusHead"
+	headMinLen  = 19
+	headVersion = 1
+
+	//SampleRate opus解码输出的采样率固定为48000，时间戳都按48kHz计算
+	SampleRate = 48000
+	//DefaultPreSkip libopus编码器默认的pre-skip，单位为48kHz的采样数
+	DefaultPreSkip = 312
+)
+
+var (
+	errHeadTooShort  = errors.New("opus head too short")
+	errInvalidMagic  = errors.New("magic should be OpusHead")
+	errInvalidHead   = errors.New("invalid opus head")
+	errPacketInvalid = errors.New("invalid opus packet")
+	errNoHead        = errors.New("opus head not received")
+)
+
+//Head OpusHead(RFC 7845 5.1)，Enhanced RTMP中作为opus的sequence header
+type Head struct {
+	Version         byte
+	Channels        byte
+	PreSkip         uint16
+	InputSampleRate uint32
+	OutputGain      int16
+	MappingFamily   byte
+	StreamCount     byte   //MappingFamily不为0时有效
+	CoupledCount    byte   //MappingFamily不为0时有效
+	ChannelMapping  []byte //MappingFamily不为0时有效
+}
+
+//ParseHead 解析OpusHead
+func ParseHead(data []byte) (*Head, error) {
+	if len(data) < headMinLen {
+		return nil, errHeadTooShort
+	}
+	if string(data[:8]) != headMagic {
+		return nil, errInvalidMagic
+	}
+	head := &Head{
+		Version:         data[8],
+		Channels:        data[9],
+		PreSkip:         binary.LittleEndian.Uint16(data[10:]),
+		InputSampleRate: binary.LittleEndian.Uint32(data[12:]),
+		OutputGain:      int16(binary.LittleEndian.Uint16(data[16:])),
+		MappingFamily:   data[18],
+	}
+	//版本号高4位为主版本，只支持主版本0
+	if head.Version>>4 != 0 || head.Channels == 0 {
+		return nil, errInvalidHead
+	}
+	if head.MappingFamily != 0 {
+		if len(data) < headMinLen+2+int(head.Channels) {
+			return nil, errHeadTooShort
+		}
+		head.StreamCount = data[19]
+		head.CoupledCount = data[20]
+		head.ChannelMapping = append([]byte{}, data[21:21+int(head.Channels)]...)
+	} else if head.Channels > 2 {
+		return nil, errInvalidHead
+	}
+	return head, nil
+}
+
+//NewHead 生成单声道或立体声的OpusHead，inputSampleRate为编码前的采样率，只作为信息使用
+func NewHead(channels byte, inputSampleRate uint32, preSkip uint16) []byte {
+	data := make([]byte, headMinLen)
+	copy(data, headMagic)
+	data[8] = headVersion
+	data[9] = channels
+	binary.LittleEndian.PutUint16(data[10:], preSkip)
+	binary.LittleEndian.PutUint32(data[12:], inputSampleRate)
+	//OutputGain和MappingFamily都为0
+	return data
+}
+
+//IsHead 判断数据是否是OpusHead
+func IsHead(data []byte) bool {
+	return len(data) >= headMinLen && string(data[:8]) == headMagic
+}
+
+//frameSamples 每个config对应的帧长，单位为48kHz的采样数，见RFC 6716 3.1
+func frameSamples(config byte) int {
+	switch {
+	case config < 12:
+		//SILK 10,20,40,60ms
+		return []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		//Hybrid 10,20ms
+		return []int{480, 960}[config%2]
+	default:
+		//CELT 2.5,5,10,20ms
+		return []int{120, 240, 480, 960}[config%4]
+	}
+}
+
+//PacketSamples 根据TOC计算一个opus包包含的采样数(48kHz)
+func PacketSamples(packet []byte) (int, error) {
+	if len(packet) < 1 {
+		return 0, errPacketInvalid
+	}
+	toc := packet[0]
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errPacketInvalid
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	samples := frames * frameSamples(toc>>3)
+	//一个包最多120ms
+	if frames == 0 || samples > 5760 {
+		return 0, errPacketInvalid
+	}
+	return samples, nil
+}
+
+//ControlHeader 生成ts中opus access unit前的opus_control_header，不带trim和扩展
+//0x7fe0(11bit前缀和3个标志位) + au_size(每个0xff代表255，最后一个字节小于0xff)
+func ControlHeader(size int) []byte {
+	header := make([]byte, 2, 2+size/255+1)
+	header[0] = 0x7f
+	header[1] = 0xe0
+	for ; size >= 0xff; size -= 0xff {
+		header = append(header, 0xff)
+	}
+	return append(header, byte(size))
+}
+
+//Parser 记录OpusHead，把opus包转换成ts中的access unit
+type Parser struct {
+	head *Head
+}
+
+//NewParser ...
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//Parse packetType为AAC_SEQHDR时，b为OpusHead，否则为opus包，加上opus_control_header写入w
+func (parser *Parser) Parse(b []byte, packetType uint8, w io.Writer) (err error) {
+	if packetType == av.AAC_SEQHDR {
+		parser.head, err = ParseHead(b)
+		return
+	}
+	if parser.head == nil {
+		return errNoHead
+	}
+	if len(b) == 0 {
+		return errPacketInvalid
+	}
+	if _, err = w.Write(ControlHeader(len(b))); err != nil {
+		return
+	}
+	_, err = w.Write(b)
+	return
+}
+
+//SampleRate opus的时间戳总是按48kHz计算
+func (parser *Parser) SampleRate() int {
+	return SampleRate
+}
+
+//Channels 返回OpusHead中的声道数，没有收到OpusHead时返回0
+func (parser *Parser) Channels() int {
+	if parser.head == nil {
+		return 0
+	}
+	return int(parser.head.Channels)
+}
@@ -0,0 +1,75 @@
+package opus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpusHead(t *testing.T) {
+	at := assert.New(t)
+	data := NewHead(2, 44100, DefaultPreSkip)
+	at.Equal([]byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2, 0x38, 0x01, 0x44, 0xac, 0, 0, 0, 0, 0}, data)
+	at.True(IsHead(data))
+
+	head, err := ParseHead(data)
+	at.Nil(err)
+	at.Equal(byte(2), head.Channels)
+	at.Equal(uint16(DefaultPreSkip), head.PreSkip)
+	at.Equal(uint32(44100), head.InputSampleRate)
+
+	//mapping family 1需要带有声道映射表
+	data = append(NewHead(3, 48000, 0), 1, 0, 0, 1, 2)
+	data[18] = 1
+	_, err = ParseHead(data[:len(data)-1])
+	at.Error(err)
+	head, err = ParseHead(data)
+	at.Nil(err)
+	at.Equal([]byte{0, 1, 2}, head.ChannelMapping)
+
+	_, err = ParseHead(NewHead(3, 48000, 0))
+	at.Error(err)
+	_, err = ParseHead([]byte("OpusTags"))
+	at.Error(err)
+}
+
+func TestPacketSamples(t *testing.T) {
+	cases := []struct {
+		packet  []byte
+		samples int
+	}{
+		{[]byte{0xfc, 0x01}, 960},        //CELT 20ms，1帧
+		{[]byte{0x09, 0x01}, 1920},       //SILK 40ms，1帧
+		{[]byte{0x79, 0x01}, 1920},       //Hybrid 20ms，2帧
+		{[]byte{0xe3, 0x05, 0x01}, 600},  //CELT 2.5ms，5帧
+		{[]byte{0x1b, 0x03, 0x01}, 8640}, //SILK 60ms，3帧，超过120ms
+		{[]byte{0x03}, 0},
+	}
+	for _, c := range cases {
+		samples, err := PacketSamples(c.packet)
+		if c.samples > 5760 || c.samples == 0 {
+			assert.Error(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, c.samples, samples)
+	}
+}
+
+func TestParser(t *testing.T) {
+	at := assert.New(t)
+	parser := NewParser()
+	var w bytes.Buffer
+	at.Error(parser.Parse([]byte{0xfc, 0x01}, av.AAC_RAW, &w))
+	at.Nil(parser.Parse(NewHead(1, 48000, 0), av.AAC_SEQHDR, &w))
+	at.Equal(1, parser.Channels())
+	at.Equal(48000, parser.SampleRate())
+
+	at.Nil(parser.Parse([]byte{0xfc, 0x01, 0x02}, av.AAC_RAW, &w))
+	at.Equal([]byte{0x7f, 0xe0, 0x03, 0xfc, 0x01, 0x02}, w.Bytes())
+
+	at.Equal([]byte{0x7f, 0xe0, 0xff, 0x00}, ControlHeader(255))
+	at.Equal([]byte{0x7f, 0xe0, 0xff, 0xff, 0x02}, ControlHeader(512))
+}
@@ -0,0 +1,156 @@
+package transcode
+
+import (
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/media/aac"
+	"github.com/fabo871218/srtmp/media/g711"
+)
+
+const (
+	//输入时间戳和按采样数推算的时间戳相差超过该值(毫秒)时，认为流不连续，重新开始编码
+	maxDrift = 1000
+)
+
+//G711ToAAC 把g711音频转换成8kHz单声道的aac-lc，其他数据包原样输出，实现av.Transformer
+type G711ToAAC struct {
+	encoder  *aac.Encoder
+	demuxer  *flv.Demuxer
+	pcm      []int16
+	started  bool
+	seqSent  bool
+	baseTs   uint32 //第一个采样的时间戳
+	consumed uint64 //已经送入编码器的采样数
+	frames   uint64 //已经编码的帧数
+	streamID uint32
+}
+
+//NewG711ToAAC ...
+func NewG711ToAAC() *G711ToAAC {
+	return &G711ToAAC{
+		demuxer: flv.NewDemuxer(),
+	}
+}
+
+//Transform 实现av.Transformer，g711包会被缓存到凑满1024个采样，可能返回0个或多个aac包
+func (t *G711ToAAC) Transform(pkt *av.Packet) ([]*av.Packet, error) {
+	if pkt.PacketType != av.PacketTypeAudio ||
+		(pkt.AHeader.SoundFormat != av.SOUND_ALAW && pkt.AHeader.SoundFormat != av.SOUND_MULAW) {
+		return []*av.Packet{pkt}, nil
+	}
+	//去掉1个字节的flv音频头
+	if len(pkt.Data) <= 1 {
+		return nil, nil
+	}
+	data := pkt.Data[1:]
+	if t.started && t.drift(pkt.TimeStamp) > maxDrift {
+		t.reset()
+	}
+	if !t.started {
+		encoder, err := aac.NewEncoder(g711.SampleRate)
+		if err != nil {
+			return nil, err
+		}
+		t.encoder = encoder
+		t.started = true
+		t.baseTs = pkt.TimeStamp
+	}
+	t.streamID = pkt.StreamID
+
+	pcm := make([]int16, 0, len(data))
+	if pkt.AHeader.SoundFormat == av.SOUND_ALAW {
+		pcm = g711.DecodeALaw(pcm, data)
+	} else {
+		pcm = g711.DecodeMuLaw(pcm, data)
+	}
+	if pkt.AHeader.SoundType == av.SOUND_STEREO {
+		//交织的双声道混合成单声道
+		for i := 0; i+1 < len(pcm); i += 2 {
+			pcm[i/2] = int16((int(pcm[i]) + int(pcm[i+1])) / 2)
+		}
+		pcm = pcm[:len(pcm)/2]
+	}
+	t.pcm = append(t.pcm, pcm...)
+
+	var pkts []*av.Packet
+	for len(t.pcm) >= aac.FrameSamples {
+		frame, err := t.encoder.Encode(t.pcm[:aac.FrameSamples])
+		if err != nil {
+			return pkts, err
+		}
+		t.pcm = t.pcm[aac.FrameSamples:]
+		t.consumed += aac.FrameSamples
+		t.frames++
+		//编码器有一帧的延迟，第一帧只包含之前的静音，直接丢弃，
+		//第n帧解码后对应第n-1个1024采样，时间戳也按这个计算
+		if t.frames == 1 {
+			continue
+		}
+		ts := t.timestamp((t.frames - 2) * aac.FrameSamples)
+		if !t.seqSent {
+			p, err := t.packet(flv.NewAACSequenceHeader(t.header()), ts)
+			if err != nil {
+				return pkts, err
+			}
+			pkts = append(pkts, p)
+			t.seqSent = true
+		}
+		ah := t.header()
+		data, err := flv.PackAudioData(&ah, t.streamID, frame, ts)
+		if err != nil {
+			return pkts, err
+		}
+		p, err := t.packet(data, ts)
+		if err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, p)
+	}
+	return pkts, nil
+}
+
+//header 输出的aac固定为8kHz单声道
+func (t *G711ToAAC) header() av.AudioPacketHeader {
+	return av.AudioPacketHeader{
+		SoundFormat: av.SOUND_AAC,
+		SoundRate:   av.SOUND_RATE_8Khz,
+		SoundSize:   av.SOUND_16BIT,
+		SoundType:   av.SOUND_MONO,
+	}
+}
+
+//packet 生成flv格式的音频包，包头通过demuxer解析，和从连接读取的包保持一致
+func (t *G711ToAAC) packet(data []byte, ts uint32) (*av.Packet, error) {
+	p := &av.Packet{
+		PacketType: av.PacketTypeAudio,
+		TimeStamp:  ts,
+		StreamID:   t.streamID,
+		Data:       data,
+	}
+	if err := t.demuxer.DemuxH(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//timestamp 返回第samples个采样对应的时间戳
+func (t *G711ToAAC) timestamp(samples uint64) uint32 {
+	return t.baseTs + uint32(samples*1000/g711.SampleRate)
+}
+
+//drift 输入时间戳和按已收到的采样数推算的时间戳之差
+func (t *G711ToAAC) drift(ts uint32) uint32 {
+	expected := t.timestamp(t.consumed + uint64(len(t.pcm)))
+	if ts > expected {
+		return ts - expected
+	}
+	return expected - ts
+}
+
+//reset 流不连续时丢弃缓存的采样重新开始编码，aac的配置不变，不需要重新发送sequence header
+func (t *G711ToAAC) reset() {
+	t.started = false
+	t.pcm = t.pcm[:0]
+	t.consumed = 0
+	t.frames = 0
+}
@@ -0,0 +1,90 @@
+package transcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/media/aac"
+	"github.com/fabo871218/srtmp/media/g711"
+	"github.com/stretchr/testify/assert"
+)
+
+//生成flv格式的g711包，每个包samples个采样
+func g711Packet(t *testing.T, format uint8, ts uint32, samples int) *av.Packet {
+	data := make([]byte, samples)
+	for i := range data {
+		pcm := int16(4000 * math.Sin(2*math.Pi*500*float64(i)/8000))
+		if format == av.SOUND_ALAW {
+			data[i] = g711.PCMToALaw(pcm)
+		} else {
+			data[i] = g711.PCMToMuLaw(pcm)
+		}
+	}
+	ah := av.AudioPacketHeader{SoundFormat: format, SoundType: av.SOUND_MONO}
+	tag, err := flv.PackAudioData(&ah, 1, data, ts)
+	assert.Nil(t, err)
+	pkt := &av.Packet{PacketType: av.PacketTypeAudio, TimeStamp: ts, StreamID: 1, Data: tag}
+	assert.Nil(t, flv.NewDemuxer().DemuxH(pkt))
+	return pkt
+}
+
+func TestG711ToAAC(t *testing.T) {
+	tr := NewG711ToAAC()
+
+	//视频和其他音频原样输出
+	video := &av.Packet{PacketType: av.PacketTypeVideo, TimeStamp: 1}
+	pkts, err := tr.Transform(video)
+	assert.Nil(t, err)
+	assert.Equal(t, []*av.Packet{video}, pkts)
+
+	//每个包20ms，160个采样，凑满两帧之后才有输出
+	var out []*av.Packet
+	for ts := uint32(1000); ts < 1000+20*20; ts += 20 {
+		pkts, err := tr.Transform(g711Packet(t, av.SOUND_ALAW, ts, 160))
+		assert.Nil(t, err)
+		out = append(out, pkts...)
+	}
+	//3200个采样编码了3帧，第一帧被丢弃
+	assert.Equal(t, 3, len(out))
+	assert.True(t, out[0].AHeader.IsSeqHeader())
+	assert.Equal(t, uint8(av.SOUND_AAC), out[0].AHeader.SoundFormat)
+	assert.Equal(t, aac.SpecificConfig(2, 11, 1), out[0].Data[2:])
+	assert.Equal(t, uint32(1000), out[0].TimeStamp)
+	for i, p := range out[1:] {
+		assert.Equal(t, uint8(av.SOUND_AAC), p.AHeader.SoundFormat)
+		assert.Equal(t, uint8(av.AAC_RAW), p.AHeader.AACPacketType)
+		assert.Equal(t, uint32(1000+128*i), p.TimeStamp)
+		assert.Equal(t, uint32(1), p.StreamID)
+		assert.True(t, len(p.Data) > 2)
+	}
+
+	//时间戳跳变后重新开始编码，不再发送sequence header
+	out = out[:0]
+	for ts := uint32(10000); ts < 10000+20*20; ts += 20 {
+		pkts, err := tr.Transform(g711Packet(t, av.SOUND_MULAW, ts, 160))
+		assert.Nil(t, err)
+		out = append(out, pkts...)
+	}
+	assert.Equal(t, 2, len(out))
+	assert.Equal(t, uint32(10000), out[0].TimeStamp)
+	assert.Equal(t, uint32(10128), out[1].TimeStamp)
+	assert.False(t, out[0].AHeader.IsSeqHeader())
+}
+
+func TestG711ToAACStereo(t *testing.T) {
+	tr := NewG711ToAAC()
+	var out []*av.Packet
+	for ts := uint32(0); ts < 3*128; ts += 128 {
+		pkt := g711Packet(t, av.SOUND_ALAW, ts, 2048)
+		pkt.AHeader.SoundType = av.SOUND_STEREO
+		pkts, err := tr.Transform(pkt)
+		assert.Nil(t, err)
+		out = append(out, pkts...)
+	}
+	//双声道混合成单声道，每个包1024个采样
+	assert.Equal(t, 3, len(out))
+	assert.Equal(t, uint32(0), out[1].TimeStamp)
+	assert.Equal(t, uint32(128), out[2].TimeStamp)
+}
@@ -0,0 +1,248 @@
+package vp9
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fabo871218/srtmp/utils"
+)
+
+//color_space的取值
+const (
+	ColorSpaceUnknown  byte = 0
+	ColorSpaceBT601    byte = 1
+	ColorSpaceBT709    byte = 2
+	ColorSpaceSMPTE170 byte = 3
+	ColorSpaceSMPTE240 byte = 4
+	ColorSpaceBT2020   byte = 5
+	ColorSpaceReserved byte = 6
+	ColorSpaceSRGB     byte = 7
+)
+
+const (
+	configRecordLen          = 12
+	frameMarker       uint32 = 2
+	frameTypeKeyFrame uint32 = 0
+	frameSyncCode     uint32 = 0x498342
+)
+
+//vpcC中的chromaSubsampling
+const (
+	chroma420Vertical byte = 0
+	chroma422         byte = 2
+	chroma444         byte = 3
+)
+
+var (
+	errNotKeyFrame    = errors.New("not key frame")
+	errInvalidHeader  = errors.New("invalid uncompressed header")
+	errRecordTooShort = errors.New("record too short")
+)
+
+//levels vp9的level和对应的最大亮度图像大小，不考虑码率时按图像大小取最小的level
+var levels = []struct {
+	level   byte
+	maxSize int
+}{
+	{10, 36864},
+	{11, 73728},
+	{20, 122880},
+	{21, 245760},
+	{30, 552960},
+	{31, 983040},
+	{40, 2228224},
+	{50, 8912896},
+	{60, 35651584},
+}
+
+//FrameHeader 关键帧的uncompressed header中生成vpcC需要的信息
+type FrameHeader struct {
+	Profile           byte
+	ShowExistingFrame bool
+	KeyFrame          bool
+	BitDepth          byte
+	ColorSpace        byte
+	FullRange         byte
+	SubsamplingX      byte
+	SubsamplingY      byte
+	Width             int
+	Height            int
+}
+
+//ParseFrameHeader 解析uncompressed header，非关键帧只解析到frame_type
+func ParseFrameHeader(data []byte) (*FrameHeader, error) {
+	br := utils.NewBitReader(data)
+	if br.ReadBits(2) != frameMarker {
+		return nil, errInvalidHeader
+	}
+	header := &FrameHeader{}
+	profileLow := br.ReadBits(1)
+	header.Profile = byte(br.ReadBits(1)<<1 | profileLow)
+	if header.Profile == 3 {
+		br.Skip(1) //reserved_zero
+	}
+	if header.ShowExistingFrame = br.ReadFlag(); header.ShowExistingFrame {
+		return header, nil
+	}
+	header.KeyFrame = br.ReadBits(1) == frameTypeKeyFrame
+	br.Skip(2) //show_frame error_resilient_mode
+	if !header.KeyFrame {
+		if br.Err() != nil {
+			return nil, errInvalidHeader
+		}
+		return header, nil
+	}
+	if br.ReadBits(24) != frameSyncCode {
+		return nil, errInvalidHeader
+	}
+
+	//color_config
+	header.BitDepth = 8
+	if header.Profile >= 2 {
+		header.BitDepth = 10
+		if br.ReadFlag() {
+			header.BitDepth = 12
+		}
+	}
+	header.ColorSpace = byte(br.ReadBits(3))
+	if header.ColorSpace != ColorSpaceSRGB {
+		header.FullRange = byte(br.ReadBits(1))
+		header.SubsamplingX, header.SubsamplingY = 1, 1
+		if header.Profile == 1 || header.Profile == 3 {
+			header.SubsamplingX = byte(br.ReadBits(1))
+			header.SubsamplingY = byte(br.ReadBits(1))
+			br.Skip(1) //reserved_zero
+		}
+	} else {
+		header.FullRange = 1
+		if header.Profile == 1 || header.Profile == 3 {
+			br.Skip(1) //reserved_zero
+		}
+	}
+
+	//frame_size
+	header.Width = int(br.ReadBits(16)) + 1
+	header.Height = int(br.ReadBits(16)) + 1
+	if br.Err() != nil {
+		return nil, errInvalidHeader
+	}
+	return header, nil
+}
+
+//IsKeyFrame 判断是否是关键帧，superframe的第一帧在数据的开始位置
+func IsKeyFrame(data []byte) bool {
+	header, err := ParseFrameHeader(data)
+	return err == nil && header.KeyFrame
+}
+
+/*
+aligned (8) class VPCodecConfigurationRecord {
+	unsigned int(8) version = 1;
+	unsigned int(24) flags = 0;
+	unsigned int(8) profile;
+	unsigned int(8) level;
+	unsigned int(4) bitDepth;
+	unsigned int(3) chromaSubsampling;
+	unsigned int(1) videoFullRangeFlag;
+	unsigned int(8) colourPrimaries;
+	unsigned int(8) transferCharacteristics;
+	unsigned int(8) matrixCoefficients;
+	unsigned int(16) codecIntializationDataSize;
+	unsigned int(8)[] codecIntializationData;
+}
+*/
+
+//VPCodecConfigurationRecord 从关键帧中生成vpcC，vp9的codecIntializationData为空
+func VPCodecConfigurationRecord(keyFrame []byte) ([]byte, error) {
+	header, err := ParseFrameHeader(keyFrame)
+	if err != nil {
+		return nil, fmt.Errorf("parse frame header failed, %v", err)
+	}
+	if !header.KeyFrame {
+		return nil, errNotKeyFrame
+	}
+
+	record := make([]byte, configRecordLen)
+	record[0] = 1
+	record[4] = header.Profile
+	record[5] = level(header.Width * header.Height)
+	record[6] = header.BitDepth<<4 | chromaSubsampling(header)<<1 | header.FullRange
+	record[7], record[8], record[9] = colorDescription(header)
+	return record, nil
+}
+
+//ParseVPCodecConfigurationRecord 解析vpcC，返回profile，level和位深
+func ParseVPCodecConfigurationRecord(data []byte) (profile, level, bitDepth byte, err error) {
+	if len(data) < configRecordLen {
+		err = errRecordTooShort
+		return
+	}
+	if data[0] != 1 {
+		err = errors.New("version should be 0x01")
+		return
+	}
+	return data[4], data[5], data[6] >> 4, nil
+}
+
+func level(pictureSize int) byte {
+	for _, l := range levels {
+		if pictureSize <= l.maxSize {
+			return l.level
+		}
+	}
+	return levels[len(levels)-1].level
+}
+
+func chromaSubsampling(header *FrameHeader) byte {
+	switch {
+	case header.SubsamplingX == 1 && header.SubsamplingY == 1:
+		return chroma420Vertical
+	case header.SubsamplingX == 1:
+		return chroma422
+	default:
+		return chroma444
+	}
+}
+
+//colorDescription 把color_space转换成ISO/IEC 23001-8中的colourPrimaries，transferCharacteristics和matrixCoefficients
+func colorDescription(header *FrameHeader) (primaries, transfer, matrix byte) {
+	switch header.ColorSpace {
+	case ColorSpaceBT601, ColorSpaceSMPTE170:
+		return 6, 6, 6
+	case ColorSpaceBT709:
+		return 1, 1, 1
+	case ColorSpaceSMPTE240:
+		return 7, 7, 7
+	case ColorSpaceBT2020:
+		if header.BitDepth > 10 {
+			return 9, 15, 9
+		}
+		return 9, 14, 9
+	case ColorSpaceSRGB:
+		return 1, 13, 0
+	default:
+		return 2, 2, 2
+	}
+}
+
+//Parser vp9的数据不需要转换，只记录vpcC
+type Parser struct {
+	profile  byte
+	bitDepth byte
+}
+
+//NewParser ...
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//Parse isSeq为true时，b为VPCodecConfigurationRecord，否则为帧数据，直接写入w
+func (parser *Parser) Parse(b []byte, isSeq bool, w io.Writer) (err error) {
+	if isSeq {
+		parser.profile, _, parser.bitDepth, err = ParseVPCodecConfigurationRecord(b)
+		return
+	}
+	_, err = w.Write(b)
+	return
+}
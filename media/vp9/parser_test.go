@@ -0,0 +1,41 @@
+package vp9
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testKeyFrame profile 0，bt709，1280x720的关键帧头
+var testKeyFrame = []byte{0x82, 0x49, 0x83, 0x42, 0x40, 0x4f, 0xf0, 0x2c, 0xf0}
+
+func TestVPCodecConfigurationRecord(t *testing.T) {
+	at := assert.New(t)
+	header, err := ParseFrameHeader(testKeyFrame)
+	at.Nil(err)
+	at.True(header.KeyFrame)
+	at.Equal(1280, header.Width)
+	at.Equal(720, header.Height)
+
+	record, err := VPCodecConfigurationRecord(testKeyFrame)
+	at.Nil(err)
+	at.Equal([]byte{0x01, 0x00, 0x00, 0x00, 0x00, 31, 0x80, 0x01, 0x01, 0x01, 0x00, 0x00}, record)
+
+	profile, level, bitDepth, err := ParseVPCodecConfigurationRecord(record)
+	at.Nil(err)
+	at.Equal(byte(0), profile)
+	at.Equal(byte(31), level)
+	at.Equal(byte(8), bitDepth)
+
+	_, err = VPCodecConfigurationRecord([]byte{0x86, 0x00})
+	at.NotNil(err)
+	_, err = VPCodecConfigurationRecord(testKeyFrame[:5])
+	at.NotNil(err)
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	at := assert.New(t)
+	at.True(IsKeyFrame(testKeyFrame))
+	at.False(IsKeyFrame([]byte{0x86, 0x00}))
+	at.False(IsKeyFrame([]byte{0x49, 0x83, 0x42}))
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/logger"
+)
+
+//dropWarnInterval 队列满丢弃数据时，两次告警日志的最小间隔
+const dropWarnInterval = 10 * time.Second
+
+//asyncWriter 给没有发送队列的写对象(比如WriterFactory创建的写对象)启动单独的写入协程，
+//队列满时和rtmp播放端一样丢弃到下一个关键帧，写入失败后Write返回错误，流循环会关闭它
+type asyncWriter struct {
+	WriteCloser
+	queue     *gopQueue
+	mutex     sync.Mutex
+	err       error
+	closeOnce sync.Once
+	lastWarn  time.Time //上次打印丢弃日志的时间，只在流循环中访问
+	logger    logger.Logger
+}
+
+//retainingAsyncWriter 被包装的写对象实现了av.PacketRetainer时使用，流循环不用Detach数据包
+type retainingAsyncWriter struct {
+	*asyncWriter
+}
+
+//RetainsPackets 数据包在队列中时持有引用，写入被包装的写对象之后释放
+func (w retainingAsyncWriter) RetainsPackets() {}
+
+//newAsyncWriter 被包装的写对象实现了av.PacketRetainer时，返回的写对象也实现av.PacketRetainer
+func newAsyncWriter(w WriteCloser, size int, log logger.Logger) WriteCloser {
+	aw := &asyncWriter{
+		WriteCloser: w,
+		queue:       newGopQueue(size, SlowConsumerPolicy{Strategy: DropToNextGop}),
+		logger:      log,
+	}
+	go aw.run()
+	if _, ok := w.(av.PacketRetainer); ok {
+		return retainingAsyncWriter{aw}
+	}
+	return aw
+}
+
+func (aw *asyncWriter) run() {
+	for {
+		p, ok := aw.queue.pop()
+		if !ok {
+			return
+		}
+		err := aw.WriteCloser.Write(p.Packet)
+		p.release()
+		if err != nil {
+			aw.mutex.Lock()
+			aw.err = err
+			aw.mutex.Unlock()
+			aw.Close()
+			return
+		}
+	}
+}
+
+//Write 写入队列，metadata和sequence header不丢弃
+func (aw *asyncWriter) Write(p *av.Packet) error {
+	aw.mutex.Lock()
+	err := aw.err
+	aw.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	qp := queuedPacket{Packet: p}
+	qp.retain()
+	if aw.queue.push(qp) && time.Since(aw.lastWarn) >= dropWarnInterval {
+		aw.lastWarn = time.Now()
+		aw.logger.Warnf("Async writer %s queue full, dropped video %d audio %d", aw.RemoteAddr(),
+			atomic.LoadUint64(&aw.queue.droppedVideo), atomic.LoadUint64(&aw.queue.droppedAudio))
+	}
+	return nil
+}
+
+//Close 丢弃队列中剩余的数据，直接关闭被包装的写对象，阻塞在Write上的写入协程随之返回
+func (aw *asyncWriter) Close() {
+	aw.closeOnce.Do(func() {
+		aw.queue.clear()
+		aw.WriteCloser.Close()
+	})
+}
+
+//QueueSize 返回队列的长度
+func (aw *asyncWriter) QueueSize() int {
+	return aw.queue.size
+}
+
+//RemoteAddr 返回写对象的对端地址
+func (aw *asyncWriter) RemoteAddr() string {
+	return remoteAddrOf(aw.WriteCloser)
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+//blockWriter Write阻塞到release关闭，Close之后Write返回错误
+type blockWriter struct {
+	written   chan uint32
+	release   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBlockWriter() *blockWriter {
+	return &blockWriter{
+		written: make(chan uint32, 16),
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (w *blockWriter) Alive() bool        { return true }
+func (w *blockWriter) CalcBaseTimestamp() {}
+
+func (w *blockWriter) Write(p *av.Packet) error {
+	w.written <- p.TimeStamp
+	select {
+	case <-w.release:
+		return nil
+	case <-w.closed:
+		return errors.New("closed")
+	}
+}
+
+func (w *blockWriter) Close() {
+	w.closeOnce.Do(func() { close(w.closed) })
+}
+
+type retainBlockWriter struct {
+	*blockWriter
+}
+
+func (w retainBlockWriter) RetainsPackets() {}
+
+func queuedAsync(aw *asyncWriter) []uint32 {
+	aw.queue.mutex.Lock()
+	defer aw.queue.mutex.Unlock()
+	ts := make([]uint32, 0, len(aw.queue.pkts))
+	for _, p := range aw.queue.pkts {
+		ts = append(ts, p.TimeStamp)
+	}
+	return ts
+}
+
+func TestAsyncWriterDropToNextGop(t *testing.T) {
+	w := newBlockWriter()
+	aw := newAsyncWriter(w, 2, logger.NewDefaultFactory().NewLogger(logger.LogLevelError)).(*asyncWriter)
+	defer aw.Close()
+	_, retainer := WriteCloser(aw).(av.PacketRetainer)
+	assert.False(t, retainer)
+
+	//第一帧阻塞在被包装的写对象上
+	assert.Nil(t, aw.Write(h264Packet(t, 0, av.FRAME_KEY, 0x65)))
+	assert.Equal(t, uint32(0), <-w.written)
+	assert.Nil(t, aw.Write(h264Packet(t, 40, av.FRAME_INTER, 0x41)))
+	assert.Nil(t, aw.Write(h264Packet(t, 80, av.FRAME_INTER, 0x41)))
+	assert.True(t, aw.lastWarn.IsZero())
+	//队列满时丢弃gop剩余的视频，直到下一个关键帧
+	assert.Nil(t, aw.Write(h264Packet(t, 120, av.FRAME_INTER, 0x41)))
+	assert.Equal(t, []uint32{}, queuedAsync(aw))
+	warned := aw.lastWarn
+	assert.False(t, warned.IsZero())
+	assert.Nil(t, aw.Write(audioPacket(130)))
+	assert.Nil(t, aw.Write(h264Packet(t, 160, av.FRAME_INTER, 0x41)))
+	assert.Nil(t, aw.Write(h264Packet(t, 200, av.FRAME_KEY, 0x65)))
+	assert.Equal(t, []uint32{130, 200}, queuedAsync(aw))
+	assert.Equal(t, uint64(4), aw.queue.droppedVideo)
+	//日志限频
+	assert.Equal(t, warned, aw.lastWarn)
+
+	close(w.release)
+	assert.Equal(t, uint32(130), <-w.written)
+	assert.Equal(t, uint32(200), <-w.written)
+}
+
+func TestAsyncWriterCloseBlocked(t *testing.T) {
+	pool := &countPool{}
+	w := newBlockWriter()
+	aw := newAsyncWriter(retainBlockWriter{w}, 4, logger.NewDefaultFactory().NewLogger(logger.LogLevelError))
+	_, retainer := aw.(av.PacketRetainer)
+	assert.True(t, retainer)
+
+	//流循环持有的引用释放后，数据包在队列中和写入时不归还pool
+	p1 := audioPacket(0)
+	p1.SetBuffer(pool, &p1.Data)
+	assert.Nil(t, aw.Write(p1))
+	p1.Release()
+	assert.Equal(t, uint32(0), <-w.written)
+	p2 := audioPacket(20)
+	p2.SetBuffer(pool, &p2.Data)
+	assert.Nil(t, aw.Write(p2))
+	p2.Release()
+
+	//写入阻塞时Close直接关闭被包装的写对象，剩余的数据包归还pool
+	done := make(chan struct{})
+	go func() {
+		aw.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked")
+	}
+	inner := aw.(retainingAsyncWriter).asyncWriter
+	assert.Eventually(t, func() bool {
+		inner.mutex.Lock()
+		defer inner.mutex.Unlock()
+		return inner.err != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, pool.puts)
+	assert.NotNil(t, aw.Write(audioPacket(40)))
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"github.com/fabo871218/srtmp/protocol/core"
+)
+
+//AuthInfo 鉴权信息，在回复客户端publish或play之前生成
+type AuthInfo struct {
+	ConnInfo   core.ConnectInfo //connect命令中的信息，包括app、tcUrl、pageUrl、flashVer等
+	Name       string           //流名称，不包含query
+	Query      string           //流名称中?之后的部分，比如 token=xxx
+	RemoteAddr string           //客户端地址
+	IsPublish  bool             //true-推流 false-拉流
+}
+
+//Authenticator 推流和拉流鉴权，返回nil表示允许，否则拒绝，错误信息作为拒绝原因返回给客户端
+//推流被拒绝时回复NetStream.Publish.BadName，拉流被拒绝时回复NetConnection.Connect.Rejected
+type Authenticator interface {
+	Authenticate(info AuthInfo) error
+}
+
+//AuthenticatorFunc 函数形式的Authenticator
+type AuthenticatorFunc func(info AuthInfo) error
+
+//Authenticate 实现Authenticator
+func (f AuthenticatorFunc) Authenticate(info AuthInfo) error {
+	return f(info)
+}
+
+//NewAuthInfo 根据连接生成鉴权信息
+func NewAuthInfo(conn *core.ForwardConnect) AuthInfo {
+	return AuthInfo{
+		ConnInfo:   conn.ConnInfo,
+		Name:       conn.PublishInfo.Name,
+		Query:      conn.PublishInfo.Query,
+		RemoteAddr: conn.RemoteAddr(),
+		IsPublish:  conn.IsPublisher(),
+	}
+}
+
+//ChainAuthenticator 依次调用多个Authenticator，任何一个拒绝都会拒绝，nil会被忽略
+func ChainAuthenticator(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(info AuthInfo) error {
+		for _, auth := range auths {
+			if auth == nil {
+				continue
+			}
+			if err := auth.Authenticate(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -1,29 +1,33 @@
 package cache
 
 import (
-	"errors"
-	"flag"
-	"fmt"
+	"sync"
 
 	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/media/mp3"
 )
 
-var (
-	gopNum = flag.Int("gopNum", 1, "gop num")
-)
+// PacketWriter 接收缓存数据的对象
+type PacketWriter interface {
+	Write(*av.Packet) error
+}
 
-// Cache ...
+// Cache 缓存metadata，sequence header和最近的gop，读取协程写入，
+// 后加入的播放端通过Snapshot共享缓存的数据包。缓存的数据包持有一个引用，被替换或者丢弃时释放
 type Cache struct {
+	mutex    sync.RWMutex
 	gop      *GopCache
 	videoSeq *av.Packet
 	audioSeq *av.Packet
 	metadata *av.Packet
+	hasVideo bool   //是否收到过视频帧
+	lastTs   uint32 //最后一个音视频数据包的时间戳
 }
 
 // NewCache ...
-func NewCache() *Cache {
+func NewCache(policy Policy) *Cache {
 	return &Cache{
-		gop:      NewGopCache(*gopNum),
+		gop:      NewGopCache(policy),
 		videoSeq: nil,
 		audioSeq: nil,
 		metadata: nil,
@@ -31,62 +35,142 @@ func NewCache() *Cache {
 }
 
 func (cache *Cache) Write(p *av.Packet) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if p.PacketType != av.PacketTypeMetadata {
+		cache.lastTs = p.TimeStamp
+	}
 	switch p.PacketType {
 	case av.PacketTypeAudio:
-		// 目前只处理aac的sequence header，如果后续要支持更多的格式
-		// 可在此添加
-		if p.AHeader.SoundFormat == av.SOUND_AAC && p.AHeader.AACPacketType == av.AAC_SEQHDR {
-			cache.audioSeq = p
+		// 目前只处理aac和opus的sequence header，如果后续要支持更多的格式
+		// 可在av.AudioPacketHeader.IsSeqHeader中添加
+		if p.AHeader.IsSeqHeader() {
+			cache.audioSeq = replace(cache.audioSeq, p)
 			return
 		}
+		// mp3没有sequence header，缓存参数变化后的第一帧作为音频配置，
+		// 后加入的播放端可以先拿到采样率和声道数
+		if p.AHeader.SoundFormat == av.SOUND_MP3 && len(p.Data) > 1 &&
+			(cache.audioSeq == nil || !mp3.SameConfig(cache.audioSeq.Data[1:], p.Data[1:])) {
+			cache.audioSeq = replace(cache.audioSeq, p)
+			return
+		}
+		cache.gop.Write(p)
 	case av.PacketTypeVideo:
-		// 这里目前只处理h264的sequence和gop缓存
-		if p.VHeader.CodecID == av.VIDEO_H264 {
-			if p.VHeader.FrameType == av.FRAME_KEY {
-				if p.VHeader.AVCPacketType == av.AVC_SEQHDR {
-					cache.videoSeq = p
-				} else {
-					cache.gop.Write(p, true)
-				}
-			}
-			cache.gop.Write(p, false)
+		// h264，h265，av1和vp9有sequence header，h265的IRAP帧在flv tag中标记为关键帧，
+		// 其他编码直接按关键帧缓存
+		if isSeqHeaderVideo(p.VHeader.CodecID) && p.VHeader.IsSeqHeader() {
+			cache.videoSeq = replace(cache.videoSeq, p)
+			return
 		}
+		cache.hasVideo = true
+		cache.gop.Write(p)
 	case av.PacketTypeMetadata:
-		cache.metadata = p
+		cache.metadata = replace(cache.metadata, p)
 	}
 }
 
-// Send ...
-func (cache *Cache) Send(inputChan chan<- *av.Packet) error {
-	cachePkts := make([]*av.Packet, 3)
-	cachePkts = cachePkts[:0]
-	if cache.metadata != nil {
-		cachePkts = append(cachePkts, cache.metadata)
+//replace 缓存新的数据包，释放之前的
+func replace(old, p *av.Packet) *av.Packet {
+	p.Retain()
+	if old != nil {
+		old.Release()
 	}
-	if cache.videoSeq != nil {
-		cachePkts = append(cachePkts, cache.videoSeq)
+	return p
+}
+
+func isSeqHeaderVideo(codecID uint8) bool {
+	switch codecID {
+	case av.VIDEO_H264, av.VIDEO_HEVC, av.VIDEO_AV1, av.VIDEO_VP9:
+		return true
 	}
-	if cache.audioSeq != nil {
-		cachePkts = append(cachePkts, cache.audioSeq)
+	return false
+}
+
+// Snapshot 按发送顺序返回播放端加入时要发送的metadata，sequence header和缓存的数据包，
+// 数据包被所有播放端共享，不能修改，返回的每个数据包都持有一个引用，使用完之后调用Release。limit为写对象的队列长度，小于等于0表示不限制，
+// 缓存的数据超过limit时从更晚的关键帧开始，避免在队列中被丢弃。
+// waitKeyframe为true时，写对象在收到下一个视频关键帧之前要丢弃音视频数据
+func (cache *Cache) Snapshot(join JoinStrategy, limit int) (pkts []*av.Packet, waitKeyframe bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	headers := make([]*av.Packet, 0, 3)
+	for _, p := range []*av.Packet{cache.metadata, cache.videoSeq, cache.audioSeq} {
+		if p != nil {
+			headers = append(headers, p)
+		}
 	}
 
-	// 发送sequence header
-	for _, pkt := range cachePkts {
-		select {
-		case inputChan <- pkt:
-			fmt.Println("Input pkt....")
-		default:
-			return errors.New("send sequence failed")
+	gops := cache.gop.Gops()
+	start := 0
+	switch join {
+	case JoinKeyframe:
+		if len(gops) > 0 {
+			start = len(gops) - 1
+		}
+	case JoinNextKeyframe:
+		start = len(gops)
+	}
+	if limit > 0 {
+		for ; start < len(gops); start++ {
+			n := len(headers)
+			for _, g := range gops[start:] {
+				n += len(g)
+			}
+			if n <= limit {
+				break
+			}
 		}
 	}
 
-	// 发送视频帧
-	for _, pkt := range cache.gop.gops {
-		select {
-		case inputChan <- pkt:
-			fmt.Println("Input pkt....")
-		default:
+	//metadata和sequence header的时间戳对齐到第一个发送的数据包，
+	//避免播放端的时间戳从0跳到当前时间
+	base := cache.lastTs
+	if start < len(gops) {
+		base = gops[start][0].TimeStamp
+	} else {
+		waitKeyframe = cache.hasVideo
+	}
+	pkts = make([]*av.Packet, 0, len(headers))
+	for _, p := range headers {
+		if p.TimeStamp != base {
+			rebased := *p
+			rebased.TimeStamp = base
+			p = &rebased
+		}
+		pkts = append(pkts, p)
+	}
+	for _, g := range gops[start:] {
+		for _, p := range g {
+			//音频和视频交错，关键帧之后可能有时间戳更早的音频，对齐到关键帧
+			if p.PacketType == av.PacketTypeAudio && p.TimeStamp < base {
+				continue
+			}
+			pkts = append(pkts, p)
+		}
+	}
+	for _, p := range pkts {
+		p.Retain()
+	}
+	return pkts, waitKeyframe
+}
+
+// Send 把Snapshot返回的数据包写入w，w没有实现av.PacketRetainer时数据包的内存不再归还pool
+func (cache *Cache) Send(w PacketWriter, join JoinStrategy, limit int) (waitKeyframe bool, err error) {
+	pkts, waitKeyframe := cache.Snapshot(join, limit)
+	_, retainer := w.(av.PacketRetainer)
+	for i, pkt := range pkts {
+		if !retainer {
+			pkt.Detach()
+		}
+		err = w.Write(pkt)
+		pkt.Release()
+		if err != nil {
+			for _, p := range pkts[i+1:] {
+				p.Release()
+			}
+			return false, err
 		}
 	}
-	return nil
+	return waitKeyframe, nil
 }
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/stretchr/testify/assert"
+)
+
+func videoPacket(ts uint32, key bool, size int) *av.Packet {
+	p := &av.Packet{
+		PacketType: av.PacketTypeVideo,
+		TimeStamp:  ts,
+		Data:       make([]byte, size),
+		VHeader:    av.VideoPacketHeader{FrameType: av.FRAME_INTER, CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_NALU},
+	}
+	if key {
+		p.VHeader.FrameType = av.FRAME_KEY
+	}
+	return p
+}
+
+func audioPacket(ts uint32) *av.Packet {
+	return &av.Packet{
+		PacketType: av.PacketTypeAudio,
+		TimeStamp:  ts,
+		Data:       make([]byte, 10),
+		AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_AAC, AACPacketType: av.AAC_RAW},
+	}
+}
+
+func timestamps(pkts []*av.Packet) []uint32 {
+	ts := make([]uint32, 0, len(pkts))
+	for _, p := range pkts {
+		ts = append(ts, p.TimeStamp)
+	}
+	return ts
+}
+
+type packetRecorder struct {
+	pkts []*av.Packet
+}
+
+func (r *packetRecorder) Write(p *av.Packet) error {
+	r.pkts = append(r.pkts, p)
+	return nil
+}
+
+func TestCacheSend(t *testing.T) {
+	c := NewCache(DefaultPolicy)
+	seq := videoPacket(0, true, 10)
+	seq.VHeader.AVCPacketType = av.AVC_SEQHDR
+	aseq := audioPacket(0)
+	aseq.AHeader.AACPacketType = av.AAC_SEQHDR
+	c.Write(&av.Packet{PacketType: av.PacketTypeMetadata})
+	c.Write(seq)
+	c.Write(aseq)
+	//第一个关键帧之前的数据不缓存
+	c.Write(audioPacket(0))
+	c.Write(videoPacket(0, false, 10))
+	c.Write(videoPacket(40, true, 10))
+	c.Write(audioPacket(50))
+	c.Write(videoPacket(80, false, 10))
+
+	snapshot, wait := c.Snapshot(JoinGop, 0)
+	assert.False(t, wait)
+	var r packetRecorder
+	wait, err := c.Send(&r, JoinGop, 0)
+	assert.Nil(t, err)
+	assert.False(t, wait)
+	assert.Equal(t, snapshot, r.pkts)
+	assert.Equal(t, 6, len(r.pkts))
+	assert.Equal(t, uint32(av.PacketTypeMetadata), r.pkts[0].PacketType)
+	//sequence header的时间戳对齐到关键帧，缓存的数据包不修改
+	assert.Equal(t, seq.VHeader, r.pkts[1].VHeader)
+	assert.Equal(t, aseq.AHeader, r.pkts[2].AHeader)
+	assert.Equal(t, []uint32{40, 40, 40, 40, 50, 80}, timestamps(r.pkts))
+	assert.Equal(t, uint32(0), seq.TimeStamp)
+
+	//新的gop不影响之前的快照
+	c.Write(videoPacket(120, true, 10))
+	assert.Equal(t, []uint32{40, 50, 80}, timestamps(snapshot[3:]))
+	snapshot, _ = c.Snapshot(JoinGop, 0)
+	assert.Equal(t, []uint32{120}, timestamps(snapshot[3:]))
+}
+
+func TestCacheJoin(t *testing.T) {
+	c := NewCache(Policy{GopNum: 3})
+	seq := videoPacket(0, true, 10)
+	seq.VHeader.AVCPacketType = av.AVC_SEQHDR
+	c.Write(seq)
+	for i := uint32(0); i < 9; i++ {
+		c.Write(videoPacket(i*40, i%3 == 0, 10))
+		c.Write(audioPacket(i*40 + 30))
+	}
+	//从这个关键帧开始播放时，之后时间戳更早的音频被丢弃
+	c.Write(videoPacket(360, true, 10))
+	c.Write(audioPacket(350))
+	c.Write(audioPacket(370))
+
+	pkts, wait := c.Snapshot(JoinGop, 0)
+	assert.False(t, wait)
+	assert.Equal(t, uint32(120), pkts[0].TimeStamp)
+	assert.Equal(t, 1+12+3, len(pkts))
+
+	pkts, wait = c.Snapshot(JoinKeyframe, 0)
+	assert.False(t, wait)
+	assert.Equal(t, []uint32{360, 360, 370}, timestamps(pkts))
+
+	pkts, wait = c.Snapshot(JoinNextKeyframe, 0)
+	assert.True(t, wait)
+	assert.Equal(t, []uint32{370}, timestamps(pkts))
+	assert.True(t, pkts[0].VHeader.IsSeqHeader())
+
+	//超过写对象的队列长度时从更晚的关键帧开始
+	pkts, wait = c.Snapshot(JoinGop, 11)
+	assert.False(t, wait)
+	assert.Equal(t, []uint32{240, 240, 270, 280, 310, 320, 350, 360, 350, 370}, timestamps(pkts))
+	pkts, wait = c.Snapshot(JoinGop, 2)
+	assert.True(t, wait)
+	assert.Equal(t, 1, len(pkts))
+
+	//纯音频流不需要等待关键帧
+	c = NewCache(DefaultPolicy)
+	c.Write(audioPacket(0))
+	pkts, wait = c.Snapshot(JoinNextKeyframe, 0)
+	assert.False(t, wait)
+	assert.Equal(t, 0, len(pkts))
+}
+
+func TestGopCachePolicy(t *testing.T) {
+	//不缓存
+	gc := NewGopCache(Policy{})
+	gc.Write(videoPacket(0, true, 10))
+	assert.Equal(t, 0, len(gc.Packets()))
+
+	gc = NewGopCache(Policy{GopNum: 2})
+	for i := uint32(0); i < 9; i++ {
+		gc.Write(videoPacket(i*40, i%3 == 0, 10))
+	}
+	assert.Equal(t, []uint32{120, 160, 200, 240, 280, 320}, timestamps(gc.Packets()))
+	assert.Equal(t, 60, gc.Bytes())
+
+	//超过字节数时丢弃最早的gop，当前gop超过时丢弃到下一个关键帧
+	gc = NewGopCache(Policy{GopNum: 3, MaxBytes: 250})
+	gc.Write(videoPacket(0, true, 100))
+	gc.Write(videoPacket(40, true, 100))
+	gc.Write(videoPacket(80, false, 40))
+	assert.Equal(t, []uint32{0, 40, 80}, timestamps(gc.Packets()))
+	gc.Write(videoPacket(120, false, 40))
+	assert.Equal(t, []uint32{40, 80, 120}, timestamps(gc.Packets()))
+	gc.Write(videoPacket(160, false, 100))
+	assert.Equal(t, 0, len(gc.Packets()))
+	assert.Equal(t, 0, gc.Bytes())
+	gc.Write(videoPacket(200, false, 10))
+	assert.Equal(t, 0, len(gc.Packets()))
+	gc.Write(videoPacket(240, true, 10))
+	assert.Equal(t, []uint32{240}, timestamps(gc.Packets()))
+
+	//超过时长时丢弃最早的gop，至少保留当前gop
+	gc = NewGopCache(Policy{GopNum: 10, MaxDuration: time.Second})
+	for i := uint32(0); i < 50; i++ {
+		gc.Write(videoPacket(i*40, i%10 == 0, 10))
+	}
+	assert.Equal(t, uint32(1200), gc.Packets()[0].TimeStamp)
+	gc = NewGopCache(Policy{GopNum: 10, MaxDuration: time.Second})
+	for i := uint32(0); i < 50; i++ {
+		gc.Write(videoPacket(i*40, i == 0, 10))
+	}
+	assert.Equal(t, 50, len(gc.Packets()))
+}
+
+func TestGopCacheCodecs(t *testing.T) {
+	//没有sequence header的编码也按关键帧缓存
+	c := NewCache(DefaultPolicy)
+	p := videoPacket(0, true, 10)
+	p.VHeader.CodecID = av.VideoVP6
+	c.Write(p)
+	pkts, _ := c.Snapshot(JoinGop, 0)
+	assert.Equal(t, []*av.Packet{p}, pkts)
+
+	//纯音频流按时长分组
+	gc := NewGopCache(Policy{GopNum: 2})
+	for i := uint32(0); i < 100; i++ {
+		gc.Write(audioPacket(i * 23))
+	}
+	pkts = gc.Packets()
+	assert.Equal(t, uint32(1012), pkts[0].TimeStamp)
+	assert.Equal(t, uint32(99*23), pkts[len(pkts)-1].TimeStamp)
+
+	//出现视频后从关键帧开始缓存
+	gc.Write(videoPacket(2300, false, 10))
+	assert.Equal(t, 0, len(gc.Packets()))
+	gc.Write(videoPacket(2340, true, 10))
+	gc.Write(audioPacket(2350))
+	assert.Equal(t, []uint32{2340, 2350}, timestamps(gc.Packets()))
+}
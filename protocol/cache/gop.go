@@ -1,33 +1,160 @@
 package cache
 
 import (
+	"time"
+
 	"github.com/fabo871218/srtmp/av"
 )
 
-// GopCache ...
+const (
+	//纯音频流没有关键帧，按这个时长(毫秒)分组，每组相当于一个gop
+	audioGopDuration = 1000
+)
+
+// JoinStrategy 后加入的播放端从哪里开始播放
+type JoinStrategy int
+
+const (
+	JoinGop          JoinStrategy = iota //从缓存中最早的关键帧开始，起播最快
+	JoinKeyframe                         //从缓存中最新的关键帧开始，延迟最低
+	JoinNextKeyframe                     //不发送缓存的数据，等待下一个关键帧
+)
+
+// Policy gop缓存策略，后加入的播放端按Join从缓存的关键帧开始播放
+type Policy struct {
+	GopNum      int           //缓存的gop个数，小于等于0时不缓存
+	MaxBytes    int           //缓存数据的最大字节数，0表示不限制，当前gop超过时也会被丢弃，直到下一个关键帧
+	MaxDuration time.Duration //缓存的最大时长，0表示不限制，超过时丢弃最早的gop，至少保留当前gop
+	Join        JoinStrategy  //播放端加入的方式，默认为JoinGop
+}
+
+// DefaultPolicy 默认缓存1个gop
+var DefaultPolicy = Policy{GopNum: 1}
+
+type gop struct {
+	pkts  []*av.Packet
+	bytes int
+	start uint32 //第一个包的时间戳
+	end   uint32 //最后一个包的时间戳
+}
+
+func (g *gop) release() {
+	for _, p := range g.pkts {
+		p.Release()
+	}
+}
+
+// GopCache 缓存最近的几个gop，包括gop之间的音频，数据包不拷贝，缓存时增加引用，丢弃时释放
 type GopCache struct {
-	maxNumber int
-	count     int
-	gops      []*av.Packet
+	policy   Policy
+	gops     []*gop
+	bytes    int
+	hasVideo bool
+	dropping bool //当前gop超过MaxBytes，丢弃到下一个关键帧
 }
 
 // NewGopCache ...
-func NewGopCache(maxNumber int) *GopCache {
+func NewGopCache(policy Policy) *GopCache {
 	return &GopCache{
-		count: 0,
-		gops:  make([]*av.Packet, 0),
+		policy: policy,
+		gops:   make([]*gop, 0, policy.GopNum+1),
+	}
+}
+
+// Write 视频关键帧开始新的gop，纯音频流按时长分组
+func (gc *GopCache) Write(p *av.Packet) {
+	if gc.policy.GopNum <= 0 {
+		return
+	}
+	isVideo := p.PacketType == av.PacketTypeVideo
+	if isVideo && !gc.hasVideo {
+		//之前缓存的纯音频分组没有关键帧，丢弃
+		gc.hasVideo = true
+		gc.reset()
+	}
+
+	var cur *gop
+	if len(gc.gops) > 0 {
+		cur = gc.gops[len(gc.gops)-1]
+	}
+	var newGop bool
+	if gc.hasVideo {
+		newGop = isVideo && p.VHeader.FrameType == av.FRAME_KEY
+	} else {
+		newGop = cur == nil || p.TimeStamp-cur.start >= audioGopDuration
+	}
+	if newGop {
+		cur = &gop{start: p.TimeStamp}
+		gc.gops = append(gc.gops, cur)
+		gc.dropping = false
+	} else if cur == nil || gc.dropping {
+		return
+	}
+	p.Retain()
+	cur.pkts = append(cur.pkts, p)
+	cur.bytes += len(p.Data)
+	cur.end = p.TimeStamp
+	gc.bytes += len(p.Data)
+	gc.trim()
+}
+
+//trim 超过限制时丢弃最早的gop
+func (gc *GopCache) trim() {
+	maxDuration := uint32(gc.policy.MaxDuration / time.Millisecond)
+	for len(gc.gops) > 0 {
+		last := gc.gops[len(gc.gops)-1]
+		switch {
+		case len(gc.gops) > gc.policy.GopNum:
+		case gc.policy.MaxBytes > 0 && gc.bytes > gc.policy.MaxBytes:
+			if len(gc.gops) == 1 {
+				gc.dropping = true
+			}
+		case maxDuration > 0 && len(gc.gops) > 1 && last.end-gc.gops[0].start > maxDuration:
+		default:
+			return
+		}
+		gc.bytes -= gc.gops[0].bytes
+		gc.gops[0].release()
+		gc.gops[0] = nil
+		gc.gops = gc.gops[1:]
+	}
+}
+
+func (gc *GopCache) reset() {
+	for i, g := range gc.gops {
+		g.release()
+		gc.gops[i] = nil
 	}
+	gc.gops = gc.gops[:0]
+	gc.bytes = 0
+	gc.dropping = false
 }
 
-func (gc *GopCache) Write(p *av.Packet, bKeyFrame bool) {
-	if bKeyFrame {
-		gc.gops = gc.gops[:0]
-		gc.count = 0
+// Packets 按顺序返回缓存的数据包，返回的切片可以在Write之后继续使用
+func (gc *GopCache) Packets() []*av.Packet {
+	n := 0
+	for _, g := range gc.gops {
+		n += len(g.pkts)
 	}
+	pkts := make([]*av.Packet, 0, n)
+	for _, g := range gc.gops {
+		pkts = append(pkts, g.pkts...)
+	}
+	return pkts
+}
 
-	// todo 是否需要拷贝
-	if gc.count < gc.maxNumber {
-		gc.gops = append(gc.gops, p)
-		gc.count++
+// Gops 按顺序返回缓存的每个gop，每个gop从关键帧开始(纯音频流为一组音频)，
+// 返回的切片可以在Write之后继续使用
+func (gc *GopCache) Gops() [][]*av.Packet {
+	gops := make([][]*av.Packet, 0, len(gc.gops))
+	for _, g := range gc.gops {
+		//限制容量，之后追加的数据包不会出现在返回的切片中
+		gops = append(gops, g.pkts[:len(g.pkts):len(g.pkts)])
 	}
+	return gops
+}
+
+// Bytes 返回缓存数据的字节数
+func (gc *GopCache) Bytes() int {
+	return gc.bytes
 }
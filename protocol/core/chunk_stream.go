@@ -126,11 +126,16 @@ type ChunkStream struct {
 	Dts       uint32
 
 	timeDelta uint32 //时间戳扩展
-	exted     bool
+	exted     bool   //最近一个类型0，1，2的header是否带有扩展时间戳
+	extTs     uint32 //扩展时间戳字段的值，类型3的chunk会重复这个值
 	index     uint32
 	remain    uint32
 	complete  bool
 	tmpFromat uint32
+
+	buf    *[]byte     //Data使用的内存，从pool中分配时不为nil
+	pool   *utils.Pool //分配message内存的pool，为nil时每个message都重新分配
+	header [11]byte    //读取message header的缓存，作为局部变量时每个chunk都会在堆上分配
 }
 
 func (cs *ChunkStream) isComplete() bool {
@@ -141,57 +146,94 @@ func (cs *ChunkStream) alloc() {
 	cs.complete = false
 	cs.index = 0
 	cs.remain = cs.Length
-	if len(cs.Data) < int(cs.Length) {
+	//读取完成的数据会直接返回给上层，可能被缓存，所以每个message都需要新的内存，
+	//上一个message没有读取完成时(被abort或者新的header覆盖)，内存还属于这个chunk stream，直接重用
+	if cs.pool == nil {
 		cs.Data = make([]byte, cs.Length)
+		return
+	}
+	if cs.buf != nil {
+		cs.pool.Put(cs.buf)
+	}
+	cs.buf = cs.pool.Get(int(cs.Length))
+	cs.Data = *cs.buf
+}
+
+//Release 把Data使用的内存放回pool，之后不能再访问Data，没有从pool中分配内存时只清空Data，
+//如果Data需要在Release之后继续使用，调用TakeBuffer取得内存的所有权
+func (cs *ChunkStream) Release() {
+	if cs.buf != nil {
+		cs.pool.Put(cs.buf)
 	}
+	cs.buf = nil
+	cs.pool = nil
+	cs.Data = nil
+}
+
+//TakeBuffer 取得Data内存的所有权，返回分配内存的pool和内存，没有从pool中分配时返回nil，
+//之后Release不再归还这块内存，由调用者在不再使用Data时调用pool.Put
+func (cs *ChunkStream) TakeBuffer() (*utils.Pool, *[]byte) {
+	pool, buf := cs.pool, cs.buf
+	cs.buf = nil
+	cs.pool = nil
+	return pool, buf
 }
 
 func (cs *ChunkStream) writeHeader(w *ReadWriter) error {
+	var buf [18]byte
+	h, err := cs.appendHeader(buf[:0])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(h)
+	return err
+}
+
+//appendHeader 把chunk header追加到b后面，最长18字节
+func (cs *ChunkStream) appendHeader(b []byte) ([]byte, error) {
 	//Chunk Basic Header
-	h := cs.Format << 6
+	h := byte(cs.Format << 6)
 	switch {
 	case cs.CSID < 64:
-		h |= cs.CSID
-		w.WriteUintBE(h, 1)
+		b = append(b, h|byte(cs.CSID))
 	case cs.CSID-64 < 256:
-		h |= 0
-		w.WriteUintBE(h, 1)
-		w.WriteUintLE(cs.CSID-64, 1)
+		b = append(b, h, byte(cs.CSID-64))
 	case cs.CSID-64 < 65536:
-		h |= 1
-		w.WriteUintBE(h, 1)
-		w.WriteUintLE(cs.CSID-64, 2)
-	}
-	//Chunk Message Header
-	ts := cs.Timestamp
-	if cs.Format == 3 {
-		goto END
+		b = append(b, h|1, byte(cs.CSID-64), byte((cs.CSID-64)>>8))
 	}
-	if cs.Timestamp > 0xffffff {
-		ts = 0xffffff
-	}
-	w.WriteUintBE(ts, 3)
-	if cs.Format == 2 {
-		goto END
+	//Chunk Message Header，类型0写时间戳，类型1和2写时间差，
+	//类型3沿用上一个header，上一个header有扩展时间戳时也要带上
+	if cs.Format != 3 {
+		ts := cs.Timestamp
+		if cs.Format != 0 {
+			ts = cs.timeDelta
+		}
+		cs.exted = ts >= 0xffffff
+		cs.extTs = ts
+		if cs.exted {
+			b = append(b, 0xff, 0xff, 0xff)
+		} else {
+			b = append(b, byte(ts>>16), byte(ts>>8), byte(ts))
+		}
 	}
-	if cs.Length > 0xffffff {
-		return fmt.Errorf("length=%d", cs.Length)
+	if cs.Format == 0 || cs.Format == 1 {
+		if cs.Length > 0xffffff {
+			return b, fmt.Errorf("length=%d", cs.Length)
+		}
+		b = append(b, byte(cs.Length>>16), byte(cs.Length>>8), byte(cs.Length), byte(cs.TypeID))
 	}
-	w.WriteUintBE(cs.Length, 3)
-	w.WriteUintBE(cs.TypeID, 1)
-	if cs.Format == 1 {
-		goto END
+	if cs.Format == 0 {
+		b = append(b, byte(cs.StreamID), byte(cs.StreamID>>8), byte(cs.StreamID>>16), byte(cs.StreamID>>24))
 	}
-	w.WriteUintLE(cs.StreamID, 4)
-END:
 	//Extended Timestamp
-	if ts >= 0xffffff {
-		w.WriteUintBE(cs.Timestamp, 4)
+	if cs.exted {
+		b = append(b, byte(cs.extTs>>24), byte(cs.extTs>>16), byte(cs.extTs>>8), byte(cs.extTs))
 	}
-	return w.WriteError()
+	return b, nil
 }
 
-func (cs *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
+//setCSID 音频、视频和metadata使用固定的csid
+func (cs *ChunkStream) setCSID() {
 	if cs.TypeID == av.TAG_AUDIO {
 		cs.CSID = 4
 	} else if cs.TypeID == av.TAG_VIDEO ||
@@ -199,6 +241,10 @@ func (cs *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
 		cs.TypeID == av.TAG_SCRIPTDATAAMF3 {
 		cs.CSID = 6
 	}
+}
+
+func (cs *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
+	cs.setCSID()
 
 	totalLen := uint32(0)
 	numChunks := (cs.Length / uint32(chunkSize))
@@ -229,80 +275,110 @@ func (cs *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
 	return nil
 }
 
-func (cs *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32) error {
-	var rmark bool = false //表示是不是读取一个message的第一个chunk
-	if cs.remain == 0 {
-		//如果一个ChunkStream没有剩余的内容没有读取，那么就应该人为上一个message已经结束
-		//设置rmark为true
-		rmark = true
+//EncodeChunks 把message按chunkSize拆分成chunk追加到b后面，和writeChunk写出的数据相同，
+//第一个chunk为类型0，之后为类型3，不依赖连接之前发送的chunk，可以写入多个chunk size相同的连接
+func (cs *ChunkStream) EncodeChunks(b []byte, chunkSize int) ([]byte, error) {
+	cs.setCSID()
+	var err error
+	for start := 0; start < len(cs.Data); start += chunkSize {
+		cs.Format = 0
+		if start > 0 {
+			cs.Format = 3
+		}
+		if b, err = cs.appendHeader(b); err != nil {
+			return b, err
+		}
+		end := start + chunkSize
+		if end > len(cs.Data) {
+			end = len(cs.Data)
+		}
+		b = append(b, cs.Data[start:end]...)
 	}
+	return b, nil
+}
+
+//EncodedLen 返回EncodeChunks编码后的最大长度，用于预先分配内存
+func (cs *ChunkStream) EncodedLen(chunkSize int) int {
+	chunks := (len(cs.Data) + chunkSize - 1) / chunkSize
+	return len(cs.Data) + chunks*18
+}
 
-	var messageHeader [11]byte //message hader最长11个字节长度
-	var timeExtend bool = false
+func (cs *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32) error {
+	//类型0，1，2的header表示一个新的message，类型3在上一个message读取完成时也表示一个新的message
+	first := cs.remain == 0 || cs.tmpFromat != 3
+
+	messageHeader := cs.header[:] //message hader最长11个字节长度
+	var ts uint32                 //类型0为时间戳，类型1和2为时间差
 	switch cs.tmpFromat {
 	case 0: //全类型，一般是一个chunk stream的开始,11个字节长度
 		if _, err := r.Read(messageHeader[0:]); err != nil {
 			return fmt.Errorf("read message header failed, %v", err)
 		}
-		cs.Format = cs.tmpFromat
-		cs.Timestamp = utils.U24BE(messageHeader[0:]) //timestamp 3个字节
-		cs.Length = utils.U24BE(messageHeader[3:])    //3字节
-		cs.TypeID = uint32(messageHeader[6])          //一个字节长度
-		cs.StreamID = utils.U32LE(messageHeader[7:])  //4个字节
-		if cs.Timestamp == 0xFFFFFF {
-			timeExtend = true
-		}
+		ts = utils.U24BE(messageHeader[0:])          //timestamp 3个字节
+		cs.Length = utils.U24BE(messageHeader[3:])   //3字节
+		cs.TypeID = uint32(messageHeader[6])         //一个字节长度
+		cs.StreamID = utils.U32LE(messageHeader[7:]) //4个字节
 	case 1: //与上一个属于同一个流, 7个字节长度
 		if _, err := r.Read(messageHeader[0:7]); err != nil {
 			return fmt.Errorf("read message header failed, %v", err)
 		}
-		cs.Format = cs.tmpFromat
-		cs.timeDelta = utils.U24BE(messageHeader[0:]) //timeDelta 3个字节
-		cs.Length = utils.U24BE(messageHeader[3:])    //3字节
-		cs.TypeID = uint32(messageHeader[6])          //一个字节长度
-		if cs.timeDelta == 0xFFFFFF {
-			timeExtend = true
-		}
+		ts = utils.U24BE(messageHeader[0:])        //timeDelta 3个字节
+		cs.Length = utils.U24BE(messageHeader[3:]) //3字节
+		cs.TypeID = uint32(messageHeader[6])       //一个字节长度
 	case 2: //3个字节长度
 		if _, err := r.Read(messageHeader[0:3]); err != nil {
 			return fmt.Errorf("read message header failed, %v", err)
 		}
-		cs.Format = cs.tmpFromat
-		cs.timeDelta = utils.U24BE(messageHeader[0:]) //timeDelta 3个字节
-		if cs.timeDelta == 0xFFFFFF {
-			timeExtend = true
-		}
-	case 3: //0个字节长度
-		if cs.timeDelta == 0xFFFFFF {
-			timeExtend = true
-		}
+		ts = utils.U24BE(messageHeader[0:]) //timeDelta 3个字节
+	case 3: //0个字节长度，沿用上一个header
 	default:
 		return fmt.Errorf("invalid fmt type:%d", cs.tmpFromat)
 	}
+	if cs.tmpFromat != 3 {
+		cs.Format = cs.tmpFromat
+		cs.exted = ts == 0xffffff
+	}
+
 	//如果有扩展时间戳，读取扩展时间戳
-	if timeExtend {
-		if _, err := r.Read(messageHeader[0:4]); err != nil {
-			return fmt.Errorf("read time extend failed, %v", err)
+	if cs.exted {
+		if cs.tmpFromat == 3 && !first {
+			//同一个message后续的类型3的chunk，大部分实现会重复扩展时间戳，也有不带的，
+			//和当前扩展时间戳相同时才认为是扩展时间戳
+			if b, err := r.Peek(4); err == nil && binary.BigEndian.Uint32(b) == cs.extTs {
+				r.Discard(4)
+			}
+		} else {
+			if _, err := r.Read(messageHeader[0:4]); err != nil {
+				return fmt.Errorf("read time extend failed, %v", err)
+			}
+			ts = utils.U32BE(messageHeader[0:])
+			cs.extTs = ts
 		}
 	}
 
-	//如果是第一个chunk，设置pts的值，分配空间
-	if rmark {
+	//如果是第一个chunk，计算时间戳，分配空间
+	if first {
 		cs.alloc()
 		switch cs.tmpFromat {
 		case 0:
-			if timeExtend {
-				cs.Pts = utils.U32BE(messageHeader[0:])
-			} else {
-				cs.Pts = cs.Timestamp
-			}
-		case 1, 2, 3:
-			if timeExtend {
-				cs.Pts += utils.U32BE(messageHeader[0:])
+			cs.Timestamp = ts
+			cs.timeDelta = 0
+		case 1, 2:
+			cs.timeDelta = ts
+			cs.Timestamp += ts
+		case 3:
+			//类型3开始的新message，时间差和上一个message相同，上一个header为类型0时，
+			//如果有扩展时间戳则使用新的扩展时间戳
+			if cs.exted && cs.Format == 0 {
+				cs.Timestamp = ts
 			} else {
-				cs.Pts += cs.timeDelta
+				if cs.exted {
+					cs.timeDelta = ts
+				}
+				cs.Timestamp += cs.timeDelta
 			}
 		}
+		cs.Pts = cs.Timestamp
 	}
 
 	size := int(cs.remain)
@@ -322,103 +398,3 @@ func (cs *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32) error {
 	}
 	return nil
 }
-
-func (cs *ChunkStream) readChunk1(r *ReadWriter, chunkSize uint32, pool *utils.Pool) error {
-	if cs.remain != 0 && cs.tmpFromat != 3 {
-		//如果remain != 0，说明还有消息没有读取完，所有fmt为类型3？
-		return fmt.Errorf("inlaid remin = %d", cs.remain)
-	}
-
-	switch cs.tmpFromat {
-	case 0: //全类型，一般是一个chunk stream的开始
-		cs.Format = cs.tmpFromat
-		cs.Timestamp, _ = r.ReadUintBE(3)
-		cs.Length, _ = r.ReadUintBE(3)
-		cs.TypeID, _ = r.ReadUintBE(1)
-		cs.StreamID, _ = r.ReadUintLE(4)
-		if cs.Timestamp == 0xffffff {
-			cs.Timestamp, _ = r.ReadUintBE(4)
-			cs.exted = true
-		} else {
-			cs.exted = false
-		}
-		cs.alloc()
-	case 1: //与上一个属于同一个流
-		cs.Format = cs.tmpFromat
-		timeStamp, _ := r.ReadUintBE(3)
-		cs.Length, _ = r.ReadUintBE(3)
-		cs.TypeID, _ = r.ReadUintBE(1)
-		if timeStamp == 0xffffff {
-			timeStamp, _ = r.ReadUintBE(4)
-			cs.exted = true
-		} else {
-			cs.exted = false
-		}
-		cs.timeDelta = timeStamp
-		cs.Timestamp += timeStamp
-		cs.alloc()
-	case 2: //时间戳不一样
-		cs.Format = cs.tmpFromat
-		timeStamp, _ := r.ReadUintBE(3)
-		if timeStamp == 0xffffff {
-			timeStamp, _ = r.ReadUintBE(4)
-			cs.exted = true
-		} else {
-			cs.exted = false
-		}
-		cs.timeDelta = timeStamp
-		cs.Timestamp += timeStamp
-		cs.alloc()
-	case 3: //都一样
-		if cs.remain == 0 {
-			//如果cs.remain == 0，表示是该message的第一个包，要处理时间戳，
-			//所有的同一个message的chunk，时间戳应该是一样的，只处理第一个就可以了
-			switch cs.Format {
-			case 0:
-				if cs.exted {
-					timestamp, _ := r.ReadUintBE(4)
-					cs.Timestamp = timestamp
-				}
-			case 1, 2:
-				var timedet uint32
-				if cs.exted {
-					timedet, _ = r.ReadUintBE(4)
-				} else {
-					timedet = cs.timeDelta
-				}
-				cs.Timestamp += timedet
-			}
-			cs.alloc()
-		} else {
-			if cs.exted {
-				b, err := r.Peek(4)
-				if err != nil {
-					return err
-				}
-				tmpts := binary.BigEndian.Uint32(b)
-				if tmpts == cs.Timestamp {
-					r.Discard(4)
-				}
-			}
-		}
-	default:
-		return fmt.Errorf("invalid format=%d", cs.Format)
-	}
-
-	size := int(cs.remain)
-	if size > int(chunkSize) {
-		size = int(chunkSize)
-	}
-
-	buf := cs.Data[cs.index : cs.index+uint32(size)]
-	//读取数据
-	if _, err := r.Read(buf); err != nil {
-		return err
-	}
-	cs.index += uint32(size)
-	cs.remain -= uint32(size)
-	if cs.remain == 0 {
-		cs.complete = true
-	}
-	return r.readError
-}
@@ -5,7 +5,6 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/fabo871218/srtmp/utils"
 )
 
 func TestChunkRead1(t *testing.T) {
@@ -28,7 +27,7 @@ func TestChunkRead1(t *testing.T) {
 		h, _ := rw.ReadUintBE(1)
 		chunkinc.tmpFromat = h >> 6
 		chunkinc.CSID = h & 0x3f
-		chunkinc.readChunk(rw, 128, utils.NewPool())
+		chunkinc.readChunk(rw, 128)
 		if chunkinc.remain == 0 {
 			break
 		}
@@ -56,17 +55,17 @@ func TestChunkRead1(t *testing.T) {
 	h, _ := rw.ReadUintBE(1)
 	chunkinc.tmpFromat = h >> 6
 	chunkinc.CSID = h & 0x3f
-	chunkinc.readChunk(rw, 128, utils.NewPool())
+	chunkinc.readChunk(rw, 128)
 
 	h, _ = rw.ReadUintBE(1)
 	chunkinc.tmpFromat = h >> 6
 	chunkinc.CSID = h & 0x3f
-	chunkinc.readChunk(rw, 128, utils.NewPool())
+	chunkinc.readChunk(rw, 128)
 
 	h, _ = rw.ReadUintBE(1)
 	chunkinc.tmpFromat = h >> 6
 	chunkinc.CSID = h & 0x3f
-	chunkinc.readChunk(rw, 128, utils.NewPool())
+	chunkinc.readChunk(rw, 128)
 
 	at.Equal(int(chunkinc.Length), 307)
 	at.Equal(int(chunkinc.TypeID), 9)
@@ -95,3 +94,108 @@ func TestWriteChunk(t *testing.T) {
 	at.Equal(err, nil)
 	at.Equal(len(bf.Bytes()), 321)
 }
+
+//writeMessage 第一个chunk使用指定的format，后面的chunk使用类型3
+func writeMessage(w *ReadWriter, cs *ChunkStream, format uint32, chunkSize int) error {
+	for i := 0; i < len(cs.Data); i += chunkSize {
+		cs.Format = 3
+		if i == 0 {
+			cs.Format = format
+		}
+		if err := cs.writeHeader(w); err != nil {
+			return err
+		}
+		end := i + chunkSize
+		if end > len(cs.Data) {
+			end = len(cs.Data)
+		}
+		w.Write(cs.Data[i:end])
+	}
+	return nil
+}
+
+func TestExtendedTimestamp(t *testing.T) {
+	at := assert.New(t)
+	cases := []struct {
+		format    uint32
+		timestamp uint32 //类型0为时间戳
+		delta     uint32 //类型1和2为时间差
+		expected  uint32
+	}{
+		{0, 0xfffff0, 0, 0xfffff0},
+		{1, 0, 0x01000000, 0x01fffff0},
+		{2, 0, 40, 0x02000018},
+		{3, 0, 0, 0x02000040},
+		{2, 0, 0xffffff, 0x0300003f},
+		{3, 0, 0, 0x0400003e},
+		{0, 0xffffff, 0, 0xffffff},
+		{3, 0, 0, 0xffffff},
+		{0, 0xffffffff, 0, 0xffffffff},
+		//32位回绕
+		{1, 0, 40, 39},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := NewReadWriter(buf, 1024)
+	cs := &ChunkStream{CSID: 6, TypeID: 9, StreamID: 1, Length: 300}
+	for _, c := range cases {
+		cs.Data = make([]byte, 300)
+		cs.Data[0], cs.Data[128], cs.Data[256] = 1, 2, 3
+		cs.Timestamp = c.timestamp
+		cs.timeDelta = c.delta
+		at.Nil(writeMessage(w, cs, c.format, 128))
+	}
+	at.Nil(w.Flush())
+
+	conn := &RtmpConn{
+		rw:                  NewReadWriter(buf, 1024),
+		remoteChunkSize:     128,
+		windowAckSize:       2500000,
+		remoteWindowAckSize: 2500000,
+		chunks:              make(map[uint32]*ChunkStream),
+	}
+	for i, c := range cases {
+		msg, err := conn.Read()
+		at.Nil(err)
+		at.Equal(c.expected, msg.Timestamp, "message %d", i)
+		//扩展时间戳没有被当作数据读取
+		at.Equal([]byte{1, 2, 3}, []byte{msg.Data[0], msg.Data[128], msg.Data[256]})
+	}
+}
+
+//模拟长时间推流，每帧40ms，时间戳超过24位后使用扩展时间戳
+func TestLongRunningTimestamp(t *testing.T) {
+	at := assert.New(t)
+	const frames = 2000
+	start := uint32(0xffffff - 40*frames/2)
+
+	buf := bytes.NewBuffer(nil)
+	w := NewReadWriter(buf, 1024)
+	cs := ChunkStream{TypeID: 9, StreamID: 1, Length: 200}
+	for i := uint32(0); i < frames; i++ {
+		cs.Data = make([]byte, 200)
+		cs.Timestamp = start + i*40
+		at.Nil(cs.writeChunk(w, 128))
+	}
+	//接近32位的最大值
+	cs.Timestamp = 0xfffffff0
+	at.Nil(cs.writeChunk(w, 128))
+	at.Nil(w.Flush())
+
+	conn := &RtmpConn{
+		rw:                  NewReadWriter(buf, 1024),
+		remoteChunkSize:     128,
+		windowAckSize:       2500000,
+		remoteWindowAckSize: 2500000,
+		chunks:              make(map[uint32]*ChunkStream),
+	}
+	for i := uint32(0); i < frames; i++ {
+		msg, err := conn.Read()
+		at.Nil(err)
+		at.Equal(start+i*40, msg.Timestamp)
+		at.Equal(200, len(msg.Data))
+	}
+	msg, err := conn.Read()
+	at.Nil(err)
+	at.Equal(uint32(0xfffffff0), msg.Timestamp)
+}
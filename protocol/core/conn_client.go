@@ -41,6 +41,7 @@ type ConnClient struct {
 	query      string
 	curcmdName string
 	streamid   uint32
+	fourCcList []string //服务端回复的Enhanced RTMP编码列表
 	conn       *RtmpConn
 	encoder    *amf.Encoder
 	decoder    *amf.Decoder
@@ -124,6 +125,9 @@ func (cc *ConnClient) waitForResponse(commandName string) error {
 								bCode = true
 							}
 						}
+						if list, ok := objmap["fourCcList"].(amf.Array); ok {
+							cc.fourCcList = fourCcList(list)
+						}
 					}
 				}
 				if !bResult || !bTransID || !bCode {
@@ -282,6 +286,12 @@ func (cc *ConnClient) writeConnectMsg() error {
 	event["type"] = "nonprivate"
 	event["flashVer"] = "FMS.3.1"
 	event["tcUrl"] = cc.tcurl
+	//Enhanced RTMP，告诉服务端支持的FourCC编码
+	fourCcs := make(amf.Array, len(av.FourCCList))
+	for i, fourCC := range av.FourCCList {
+		fourCcs[i] = fourCC
+	}
+	event["fourCcList"] = fourCcs
 	cc.curcmdName = cmdConnect
 
 	cc.logger.Tracef("writeConnectMsg: connClient.transID=%d, event=%v", cc.transID, event)
@@ -305,7 +315,7 @@ func (cc *ConnClient) writeCreateStreamMsg() error {
 func (cc *ConnClient) writePublishMsg() error {
 	cc.transID++
 	cc.curcmdName = cmdPublish
-	if err := cc.writeMsg(cmdPublish, cc.transID, nil, cc.title, publishLive); err != nil {
+	if err := cc.writeMsg(cmdPublish, cc.transID, nil, cc.streamName(), publishLive); err != nil {
 		return err
 	}
 	return nil
@@ -317,12 +327,35 @@ func (cc *ConnClient) writePlayMsg() error {
 	cc.logger.Tracef("writePlayMsg: connClient.transID=%d, cmdPlay=%v, connClient.title=%v",
 		cc.transID, cmdPlay, cc.title)
 
-	if err := cc.writeMsg(cmdPlay, 0, nil, cc.title); err != nil {
+	if err := cc.writeMsg(cmdPlay, 0, nil, cc.streamName()); err != nil {
 		return err
 	}
 	return nil
 }
 
+//FourCcList 服务端支持的Enhanced RTMP编码，服务端不支持扩展头时为空
+func (cc *ConnClient) FourCcList() []string {
+	return cc.fourCcList
+}
+
+//Seek 播放录制文件时跳转到timestamp(毫秒)的位置
+func (cc *ConnClient) Seek(timestamp uint32) error {
+	return cc.writeMsg(cmdSeek, 0, nil, float64(timestamp))
+}
+
+//Pause 播放录制文件时暂停或者恢复播放，timestamp为当前播放的位置(毫秒)
+func (cc *ConnClient) Pause(pause bool, timestamp uint32) error {
+	return cc.writeMsg(cmdPause, 0, nil, pause, float64(timestamp))
+}
+
+//publish和play命令中的流名称，url中带有query时附加在名称之后，比如鉴权参数
+func (cc *ConnClient) streamName() string {
+	if cc.query != "" {
+		return cc.title + "?" + cc.query
+	}
+	return cc.title
+}
+
 func (cc *ConnClient) parseURL(url string) (local, remote string, err error) {
 	var parsedURL *neturl.URL
 	if parsedURL, err = neturl.Parse(url); err != nil {
@@ -434,6 +467,9 @@ func (cc *ConnClient) checkResponse(commandName string, values []interface{}) er
 				if code, ok := objmap["code"]; ok && code.(string) != connectSuccess {
 					return errFail
 				}
+				if list, ok := objmap["fourCcList"].(amf.Array); ok {
+					cc.fourCcList = fourCcList(list)
+				}
 			} else if commandName == cmdPublish {
 				if code, ok := objmap["code"]; ok && code.(string) != publishStart {
 					return errFail
@@ -5,8 +5,8 @@ import (
 	"io"
 	"testing"
 
-	"github.com/stretchr/testify/assert"
 	"github.com/fabo871218/srtmp/utils"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConnReadNormal(t *testing.T) {
@@ -27,10 +27,9 @@ func TestConnReadNormal(t *testing.T) {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		chunks:              make(map[uint32]ChunkStream),
+		chunks:              make(map[uint32]*ChunkStream),
 	}
-	var c ChunkStream
-	err := conn.Read(&c)
+	c, err := conn.Read()
 	at.Equal(err, nil)
 	at.Equal(int(c.CSID), 6)
 	at.Equal(int(c.Length), 307)
@@ -73,22 +72,21 @@ func TestConnCrossReading(t *testing.T) {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		chunks:              make(map[uint32]ChunkStream),
+		chunks:              make(map[uint32]*ChunkStream),
 	}
-	var c ChunkStream
 	//video 1
-	err := conn.Read(&c)
+	c, err := conn.Read()
 	at.Equal(err, nil)
 	at.Equal(int(c.TypeID), 9)
 	at.Equal(len(c.Data), 307)
 
 	//audio2
-	err = conn.Read(&c)
+	c, err = conn.Read()
 	at.Equal(err, nil)
 	at.Equal(int(c.TypeID), 8)
 	at.Equal(len(c.Data), 307)
 
-	err = conn.Read(&c)
+	c, err = conn.Read()
 	at.Equal(err, io.EOF)
 }
 
@@ -112,7 +110,7 @@ func TestSetChunksizeForWrite(t *testing.T) {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		chunks:              make(map[uint32]ChunkStream),
+		chunks:              make(map[uint32]*ChunkStream),
 	}
 
 	audio := ChunkStream{
@@ -164,23 +162,19 @@ func TestSetChunksize(t *testing.T) {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		chunks:              make(map[uint32]ChunkStream),
+		chunks:              make(map[uint32]*ChunkStream),
 	}
 
-	var c ChunkStream
-	err := conn.Read(&c)
+	c, err := conn.Read()
 	at.Equal(err, nil)
 	at.Equal(int(c.TypeID), 9)
 	at.Equal(int(c.CSID), 6)
 	at.Equal(int(c.StreamID), 1)
 	at.Equal(len(c.Data), 307)
 
-	//设置chunksize
+	//设置chunksize，控制消息在Read中处理，不会返回
 	chunkBuf := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x00, 0x96}
-	conn.rw = NewReadWriter(bytes.NewBuffer(chunkBuf), 1024)
-	err = conn.Read(&c)
-	at.Equal(err, nil)
 
 	data = data[:12]
 	data[7] = 0x8
@@ -192,12 +186,14 @@ func TestSetChunksize(t *testing.T) {
 	data = append(data, 0xc6)
 	data = append(data, data2...)
 
-	conn.rw = NewReadWriter(bytes.NewBuffer(data), 1024)
-	err = conn.Read(&c)
+	conn.rw = NewReadWriter(bytes.NewBuffer(append(chunkBuf, data...)), 1024)
+	c, err = conn.Read()
 	at.Equal(err, nil)
+	at.Equal(uint32(150), conn.remoteChunkSize)
+	at.Equal(int(c.TypeID), 8)
 	at.Equal(len(c.Data), 307)
 
-	err = conn.Read(&c)
+	c, err = conn.Read()
 	at.Equal(err, io.EOF)
 }
 
@@ -212,7 +208,7 @@ func TestConnWrite(t *testing.T) {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		chunks:              make(map[uint32]ChunkStream),
+		chunks:              make(map[uint32]*ChunkStream),
 	}
 
 	c1 := ChunkStream{
@@ -249,3 +245,205 @@ func TestConnWrite(t *testing.T) {
 	conn.Flush()
 	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0xa0, 0x0, 0x0, 0x4, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
 }
+
+func TestEncodeChunks(t *testing.T) {
+	for _, c := range []struct {
+		size      int
+		timestamp uint32
+	}{{3, 40}, {300, 40}, {128, 0x1000000}, {256, 0}} {
+		data := make([]byte, c.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		cs := ChunkStream{TypeID: 9, StreamID: 1, Timestamp: c.timestamp, Length: uint32(len(data)), Data: data}
+		wr := bytes.NewBuffer(nil)
+		rw := NewReadWriter(wr, 4096)
+		assert.Nil(t, cs.writeChunk(rw, 128))
+		rw.Flush()
+
+		encoded, err := cs.EncodeChunks(nil, 128)
+		assert.Nil(t, err)
+		assert.Equal(t, wr.Bytes(), encoded)
+		assert.True(t, len(encoded) <= cs.EncodedLen(128))
+
+		//编码好的数据可以被接收端正常解析
+		conn := &RtmpConn{
+			rw:                  NewReadWriter(bytes.NewBuffer(encoded), 4096),
+			remoteChunkSize:     128,
+			remoteWindowAckSize: 2500000,
+			chunks:              make(map[uint32]*ChunkStream),
+		}
+		msg, err := conn.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, c.timestamp, msg.Timestamp)
+		assert.Equal(t, data, msg.Data)
+	}
+}
+
+//discardConn 只用来测试写入，丢弃所有数据
+type discardConn struct{}
+
+func (discardConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+//benchmarkFanout 一个数据包发送给100个播放端
+func benchmarkFanout(b *testing.B, shared bool) {
+	const players = 100
+	conns := make([]*RtmpConn, players)
+	for i := range conns {
+		conns[i] = &RtmpConn{rw: NewReadWriter(discardConn{}, 4096), chunkSize: 4096}
+	}
+	data := make([]byte, 32*1024)
+	buf := make([]byte, 0, 64*1024)
+	b.SetBytes(int64(len(data) * players))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cs := ChunkStream{TypeID: 9, StreamID: 1, Timestamp: uint32(i), Length: uint32(len(data)), Data: data}
+		if shared {
+			encoded, _ := cs.EncodeChunks(buf[:0], 4096)
+			for _, conn := range conns {
+				conn.WriteChunks(encoded)
+				conn.Flush()
+			}
+			continue
+		}
+		for _, conn := range conns {
+			c := cs
+			conn.Write(&c)
+			conn.Flush()
+		}
+	}
+}
+
+func BenchmarkFanoutPerConn(b *testing.B) {
+	benchmarkFanout(b, false)
+}
+
+func BenchmarkFanoutShared(b *testing.B) {
+	benchmarkFanout(b, true)
+}
+
+func TestConnReadPooled(t *testing.T) {
+	var encoded []byte
+	for i, size := range []int{300, 5000} {
+		data := bytes.Repeat([]byte{byte(i + 1)}, size)
+		cs := ChunkStream{TypeID: 9, StreamID: 1, Timestamp: uint32(i * 40), Length: uint32(size), Data: data}
+		encoded, _ = cs.EncodeChunks(encoded, 128)
+	}
+	conn := &RtmpConn{
+		pool:                utils.NewPool(),
+		rw:                  NewReadWriter(bytes.NewBuffer(encoded), 4096),
+		remoteChunkSize:     128,
+		remoteWindowAckSize: 2500000,
+		chunks:              make(map[uint32]*ChunkStream),
+	}
+	first, err := conn.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 300), first.Data)
+	//取得内存之后Release不再归还，Data可以继续使用
+	data := first.Data
+	pool, buf := first.TakeBuffer()
+	assert.Equal(t, conn.pool, pool)
+	assert.NotNil(t, buf)
+	first.Release()
+
+	//message的header被重用
+	second, err := conn.Read()
+	assert.Nil(t, err)
+	assert.True(t, first == second)
+	assert.Equal(t, uint32(40), second.Timestamp)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 5000), second.Data)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 300), data)
+	second.Release()
+	assert.Nil(t, second.Data)
+	pool.Put(buf)
+}
+
+//loopReader 循环返回同一段数据
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func (r *loopReader) Write(p []byte) (int, error) { return len(p), nil }
+
+//benchmarkRead 读取1080p推流的message，6Mbps，30fps，2秒一个gop，
+//关键帧150KB，其他帧约23KB，aac音频128kbps，chunk size为4096
+func benchmarkRead(b *testing.B, pool *utils.Pool) {
+	var encoded []byte
+	var total int
+	for i := 0; i < 60; i++ {
+		size := 23 * 1024
+		if i == 0 {
+			size = 150 * 1024
+		}
+		video := ChunkStream{TypeID: 9, StreamID: 1, Timestamp: uint32(i * 33), Length: uint32(size), Data: make([]byte, size)}
+		encoded, _ = video.EncodeChunks(encoded, 4096)
+		audio := ChunkStream{TypeID: 8, StreamID: 1, Timestamp: uint32(i * 33), Length: 370, Data: make([]byte, 370)}
+		encoded, _ = audio.EncodeChunks(encoded, 4096)
+		total += size + 370
+	}
+	conn := &RtmpConn{
+		pool:                pool,
+		rw:                  NewReadWriter(&loopReader{data: encoded}, 4096),
+		chunkSize:           128,
+		remoteChunkSize:     4096,
+		remoteWindowAckSize: 2500000,
+		chunks:              make(map[uint32]*ChunkStream),
+	}
+	b.SetBytes(int64(total / 120))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := conn.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.Release()
+	}
+}
+
+//BenchmarkReadMessage 每个message重新分配内存
+func BenchmarkReadMessage(b *testing.B) {
+	benchmarkRead(b, nil)
+}
+
+//BenchmarkReadMessagePooled message内存从pool中分配，读取后归还
+func BenchmarkReadMessagePooled(b *testing.B) {
+	benchmarkRead(b, utils.NewPool())
+}
+
+//TestConnConcurrentWrite Read中回复ack的同时其他协程发送数据
+func TestConnConcurrentWrite(t *testing.T) {
+	msg := ChunkStream{CSID: 3, TypeID: 20, StreamID: 1, Length: 300, Data: make([]byte, 300)}
+	encoded, _ := msg.EncodeChunks(nil, 128)
+	conn := &RtmpConn{
+		rw:                  NewReadWriter(&loopReader{data: encoded}, 4096),
+		chunkSize:           128,
+		remoteChunkSize:     128,
+		remoteWindowAckSize: 1, //每读取一个message回复一次ack
+		chunks:              make(map[uint32]*ChunkStream),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c := ChunkStream{TypeID: 9, StreamID: 1, Length: 500, Data: make([]byte, 500)}
+			assert.Nil(t, conn.Write(&c))
+			assert.Nil(t, conn.Flush())
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		c, err := conn.Read()
+		assert.Nil(t, err)
+		c.Release()
+	}
+	<-done
+}
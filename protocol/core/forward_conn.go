@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/logger"
@@ -18,7 +21,8 @@ var (
 )
 
 var (
-	ErrReq = errors.New("req error")
+	ErrReq        = errors.New("req error")
+	ErrAuthFailed = errors.New("auth failed")
 )
 
 var (
@@ -30,20 +34,25 @@ var (
 	cmdFCUnpublish   = "FCUnpublish"
 	cmdDeleteStream  = "deleteStream"
 	cmdPlay          = "play"
+	cmdSeek          = "seek"
+	cmdPause         = "pause"
+	cmdReceiveAudio  = "receiveAudio"
+	cmdReceiveVideo  = "receiveVideo"
 )
 
 //ConnectInfo ...
 type ConnectInfo struct {
-	App            string `amf:"app" json:"app"`
-	Flashver       string `amf:"flashVer" json:"flashVer"`
-	SwfURL         string `amf:"swfUrl" json:"swfUrl"`
-	TcURL          string `amf:"tcUrl" json:"tcUrl"`
-	Fpad           bool   `amf:"fpad" json:"fpad"`
-	AudioCodecs    int    `amf:"audioCodecs" json:"audioCodecs"`
-	VideoCodecs    int    `amf:"videoCodecs" json:"videoCodecs"`
-	VideoFunction  int    `amf:"videoFunction" json:"videoFunction"`
-	PageURL        string `amf:"pageUrl" json:"pageUrl"`
-	ObjectEncoding int    `amf:"objectEncoding" json:"objectEncoding"`
+	App            string   `amf:"app" json:"app"`
+	Flashver       string   `amf:"flashVer" json:"flashVer"`
+	SwfURL         string   `amf:"swfUrl" json:"swfUrl"`
+	TcURL          string   `amf:"tcUrl" json:"tcUrl"`
+	Fpad           bool     `amf:"fpad" json:"fpad"`
+	AudioCodecs    int      `amf:"audioCodecs" json:"audioCodecs"`
+	VideoCodecs    int      `amf:"videoCodecs" json:"videoCodecs"`
+	VideoFunction  int      `amf:"videoFunction" json:"videoFunction"`
+	PageURL        string   `amf:"pageUrl" json:"pageUrl"`
+	ObjectEncoding int      `amf:"objectEncoding" json:"objectEncoding"`
+	FourCcList     []string `amf:"fourCcList" json:"fourCcList,omitempty"` //Enhanced RTMP支持的编码，为空表示不支持扩展头
 }
 
 //ConnectResp ...
@@ -62,8 +71,23 @@ type ConnectEvent struct {
 
 //PublishInfo ...
 type PublishInfo struct {
-	Name string
-	Type string
+	Name  string //流名称，不包含query
+	Query string //流名称中?之后的部分，比如鉴权参数
+	Type  string
+}
+
+//AuthFunc 在回复publish或play之前调用，返回错误时拒绝该请求
+type AuthFunc func(fc *ForwardConnect) error
+
+//RecordedFunc 在回复play之前调用，返回true表示播放的是录制文件
+type RecordedFunc func(fc *ForwardConnect) bool
+
+//PlayCommand 播放过程中客户端发送的控制命令
+type PlayCommand struct {
+	Name   string //seek、pause、receiveAudio或receiveVideo
+	Time   uint32 //seek和pause命令中的位置，单位毫秒
+	Pause  bool   //pause命令中，true表示暂停，false表示恢复
+	Enable bool   //receiveAudio和receiveVideo命令中，是否接收音频或视频
 }
 
 //ForwardConnect 与客户端对应的rtmp连接
@@ -78,6 +102,11 @@ type ForwardConnect struct {
 	decoder       *amf.Decoder
 	encoder       *amf.Encoder
 	bytesw        *bytes.Buffer
+	authFunc      AuthFunc
+	recordedFunc  RecordedFunc
+	isRecorded    bool
+	playCmd       *PlayCommand
+	writeMutex    sync.Mutex //播放录制文件时回复命令和发送数据在不同的协程，bytesw和encoder需要加锁
 	logger        logger.Logger
 }
 
@@ -94,6 +123,8 @@ func NewForwardConnect(conn *RtmpConn, log logger.Logger) *ForwardConnect {
 }
 
 func (fc *ForwardConnect) writeMsg(csid, streamID uint32, args ...interface{}) error {
+	fc.writeMutex.Lock()
+	defer fc.writeMutex.Unlock()
 	fc.bytesw.Reset()
 	for _, v := range args {
 		if _, err := fc.encoder.Encode(fc.bytesw, v, amf.AMF0); err != nil {
@@ -135,14 +166,48 @@ func (fc *ForwardConnect) connect(vs []interface{}) error {
 			if tcurl, ok := obimap["tcUrl"]; ok {
 				fc.ConnInfo.TcURL = tcurl.(string)
 			}
+			if swfURL, ok := obimap["swfUrl"].(string); ok {
+				fc.ConnInfo.SwfURL = swfURL
+			}
+			if pageURL, ok := obimap["pageUrl"].(string); ok {
+				fc.ConnInfo.PageURL = pageURL
+			}
 			if encoding, ok := obimap["objectEncoding"]; ok {
 				fc.ConnInfo.ObjectEncoding = int(encoding.(float64))
 			}
+			if list, ok := obimap["fourCcList"].(amf.Array); ok {
+				fc.ConnInfo.FourCcList = fourCcList(list)
+			}
 		}
 	}
 	return nil
 }
 
+//fourCcList 获取connect命令中的FourCC列表，"*"表示支持所有编码
+func fourCcList(list amf.Array) []string {
+	var ret []string
+	for _, v := range list {
+		if fourCC, ok := v.(string); ok {
+			ret = append(ret, fourCC)
+		}
+	}
+	return ret
+}
+
+//supportedFourCcList 返回list中本端也支持的编码
+func supportedFourCcList(list []string) amf.Array {
+	ret := amf.Array{}
+	for _, fourCC := range av.FourCCList {
+		for _, v := range list {
+			if v == fourCC || v == "*" {
+				ret = append(ret, fourCC)
+				break
+			}
+		}
+	}
+	return ret
+}
+
 func (fc *ForwardConnect) releaseStream(vs []interface{}) error {
 	return nil
 }
@@ -163,6 +228,10 @@ func (fc *ForwardConnect) connectResp(cur *ChunkStream) error {
 	resp := make(amf.Object)
 	resp["fmsVer"] = "FMS/3,0,1,123"
 	resp["capabilities"] = 31
+	if len(fc.ConnInfo.FourCcList) > 0 {
+		//回复双方都支持的编码
+		resp["fourCcList"] = supportedFourCcList(fc.ConnInfo.FourCcList)
+	}
 
 	event := make(amf.Object)
 	event["level"] = "status"
@@ -193,7 +262,12 @@ func (fc *ForwardConnect) publishOrPlay(vs []interface{}) error {
 		switch v.(type) {
 		case string:
 			if k == 2 {
-				fc.PublishInfo.Name = v.(string)
+				name := v.(string)
+				if pos := strings.Index(name, "?"); pos >= 0 {
+					fc.PublishInfo.Query = name[pos+1:]
+					name = name[:pos]
+				}
+				fc.PublishInfo.Name = name
 			} else if k == 3 {
 				fc.PublishInfo.Type = v.(string)
 			}
@@ -215,9 +289,39 @@ func (fc *ForwardConnect) publishResp(cur *ChunkStream) error {
 	return fc.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event)
 }
 
+//鉴权失败时的回复，publish回复NetStream.Publish.BadName，play回复NetConnection.Connect.Rejected
+func (fc *ForwardConnect) rejectResp(cur *ChunkStream, reason error) error {
+	event := make(amf.Object)
+	event["level"] = "error"
+	if fc.isPublisher {
+		event["code"] = "NetStream.Publish.BadName"
+	} else {
+		event["code"] = "NetConnection.Connect.Rejected"
+	}
+	event["description"] = reason.Error()
+	return fc.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event)
+}
+
+//鉴权，失败时回复客户端并返回错误
+func (fc *ForwardConnect) authenticate(cur *ChunkStream) error {
+	if fc.authFunc == nil {
+		return nil
+	}
+	err := fc.authFunc(fc)
+	if err == nil {
+		return nil
+	}
+	if e := fc.rejectResp(cur, err); e != nil {
+		fc.logger.Debugf("reject response failed, %v", e)
+	}
+	return fmt.Errorf("%w, %v", ErrAuthFailed, err)
+}
+
 func (fc *ForwardConnect) playResp(cur *ChunkStream) error {
-	fc.conn.SetRecorded()
 	fc.conn.SetBegin()
+	if fc.isRecorded {
+		fc.conn.SetRecorded()
+	}
 
 	event := make(amf.Object)
 	event["level"] = "status"
@@ -241,15 +345,39 @@ func (fc *ForwardConnect) playResp(cur *ChunkStream) error {
 		return err
 	}
 
-	event["level"] = "status"
-	event["code"] = "NetStream.Play.PublishNotify"
-	event["description"] = "Started playing notify."
-	if err := fc.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event); err != nil {
-		return err
+	//录制文件没有发布者，不发送PublishNotify
+	if !fc.isRecorded {
+		event["level"] = "status"
+		event["code"] = "NetStream.Play.PublishNotify"
+		event["description"] = "Started playing notify."
+		if err := fc.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event); err != nil {
+			return err
+		}
 	}
 	return fc.conn.Flush()
 }
 
+//解析播放控制命令，vs为命令名称之后的参数：transaction id，null，命令参数
+func (fc *ForwardConnect) playCommand(name string, vs []interface{}) *PlayCommand {
+	cmd := &PlayCommand{Name: name}
+	var args []interface{}
+	if len(vs) > 2 {
+		args = vs[2:]
+	}
+	for _, v := range args {
+		switch v := v.(type) {
+		case float64:
+			if v > 0 {
+				cmd.Time = uint32(v)
+			}
+		case bool:
+			cmd.Pause = v
+			cmd.Enable = v
+		}
+	}
+	return cmd
+}
+
 func (fc *ForwardConnect) handleCmdMsg(c *ChunkStream) error {
 	amfType := amf.AMF0
 	if c.TypeID == 17 {
@@ -260,6 +388,9 @@ func (fc *ForwardConnect) handleCmdMsg(c *ChunkStream) error {
 	if err != nil && err != io.EOF {
 		return err
 	}
+	if len(vs) == 0 {
+		return nil
+	}
 	// glog.Infof("rtmp req: %#v", vs)
 	switch vs[0].(type) {
 	case string:
@@ -301,6 +432,8 @@ func (fc *ForwardConnect) handleCmdMsg(c *ChunkStream) error {
 			fc.fcPublish(vs)
 		case cmdReleaseStream:
 			fc.releaseStream(vs)
+		case cmdSeek, cmdPause, cmdReceiveAudio, cmdReceiveVideo:
+			fc.playCmd = fc.playCommand(vs[0].(string), vs[1:])
 		case cmdFCUnpublish:
 		case cmdDeleteStream:
 		default:
@@ -353,19 +486,28 @@ func (fc *ForwardConnect) SetUpPlayOrPublish() error {
 				if err = fc.publishOrPlay(vs[1:]); err != nil {
 					return fmt.Errorf("handle publish command failed, %v", err)
 				}
+				fc.isPublisher = true
+				if err = fc.authenticate(chunk); err != nil {
+					return err
+				}
 				if err = fc.publishResp(chunk); err != nil {
 					return fmt.Errorf("publish response failed, %v", err)
 				}
-				fc.isPublisher = true
 				return nil
 			case cmdPlay:
 				if err = fc.publishOrPlay(vs[1:]); err != nil {
 					return fmt.Errorf("handle play command failed, %v", err)
 				}
+				fc.isPublisher = false
+				if err = fc.authenticate(chunk); err != nil {
+					return err
+				}
+				if fc.recordedFunc != nil {
+					fc.isRecorded = fc.recordedFunc(fc)
+				}
 				if err = fc.playResp(chunk); err != nil {
 					return fmt.Errorf("play response failed, %v", err)
 				}
-				fc.isPublisher = false
 				return nil
 			case cmdFcpublish:
 				fc.fcPublish(vs)
@@ -400,6 +542,122 @@ func (fc *ForwardConnect) ReadMsg() error {
 	return nil
 }
 
+//SetAuthFunc 设置鉴权函数，需要在SetUpPlayOrPublish之前调用
+func (fc *ForwardConnect) SetAuthFunc(f AuthFunc) {
+	fc.authFunc = f
+}
+
+//SetRecordedFunc 设置判断播放的是否是录制文件的函数，需要在SetUpPlayOrPublish之前调用
+func (fc *ForwardConnect) SetRecordedFunc(f RecordedFunc) {
+	fc.recordedFunc = f
+}
+
+//IsRecorded 播放的是否是录制文件
+func (fc *ForwardConnect) IsRecorded() bool {
+	return fc.isRecorded
+}
+
+//StreamID 返回createStream时分配的流id
+func (fc *ForwardConnect) StreamID() uint32 {
+	return uint32(fc.streamID)
+}
+
+//ReadPlayCommand 读取播放过程中客户端发送的seek、pause、receiveAudio和receiveVideo命令，
+//其他消息会被忽略
+func (fc *ForwardConnect) ReadPlayCommand() (PlayCommand, error) {
+	for {
+		c, err := fc.conn.Read()
+		if err != nil {
+			return PlayCommand{}, err
+		}
+		if c.TypeID != 20 && c.TypeID != 17 {
+			continue
+		}
+		fc.playCmd = nil
+		if err := fc.handleCmdMsg(c); err != nil {
+			return PlayCommand{}, err
+		}
+		if fc.playCmd != nil {
+			return *fc.playCmd, nil
+		}
+	}
+}
+
+//发送onStatus消息
+func (fc *ForwardConnect) sendStatus(level, code, description string) error {
+	event := make(amf.Object)
+	event["level"] = level
+	event["code"] = code
+	event["description"] = description
+	return fc.writeMsg(5, uint32(fc.streamID), "onStatus", 0, nil, event)
+}
+
+//SendSeekNotify 回复seek成功，timestamp为实际跳转到的位置，之后的数据从该位置开始
+func (fc *ForwardConnect) SendSeekNotify(timestamp uint32) error {
+	fc.conn.SetEOF()
+	if err := fc.sendStatus("status", "NetStream.Seek.Notify",
+		fmt.Sprintf("Seeking %d.", timestamp)); err != nil {
+		return err
+	}
+	fc.conn.SetBegin()
+	return fc.sendStatus("status", "NetStream.Play.Start", "Started playing stream.")
+}
+
+//SendSeekFailed 回复seek失败
+func (fc *ForwardConnect) SendSeekFailed(reason error) error {
+	return fc.sendStatus("error", "NetStream.Seek.Failed", reason.Error())
+}
+
+//SendPauseNotify 回复pause命令，pause为false时表示恢复播放
+func (fc *ForwardConnect) SendPauseNotify(pause bool) error {
+	if pause {
+		fc.conn.SetEOF()
+		return fc.sendStatus("status", "NetStream.Pause.Notify", "Paused stream.")
+	}
+	fc.conn.SetBegin()
+	return fc.sendStatus("status", "NetStream.Unpause.Notify", "Unpaused stream.")
+}
+
+//SendPlayComplete 通知客户端录制文件已经播放完成，发送Stream EOF、onPlayStatus
+//NetStream.Play.Complete和NetStream.Play.Stop，连接不会关闭，客户端仍然可以seek
+func (fc *ForwardConnect) SendPlayComplete() error {
+	fc.conn.SetEOF()
+
+	if err := fc.writePlayComplete(); err != nil {
+		return err
+	}
+	return fc.sendStatus("status", "NetStream.Play.Stop", "Stopped playing stream.")
+}
+
+//发送onPlayStatus NetStream.Play.Complete
+func (fc *ForwardConnect) writePlayComplete() error {
+	fc.writeMutex.Lock()
+	defer fc.writeMutex.Unlock()
+	fc.bytesw.Reset()
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = "NetStream.Play.Complete"
+	for _, v := range []interface{}{"onPlayStatus", event} {
+		if _, err := fc.encoder.Encode(fc.bytesw, v, amf.AMF0); err != nil {
+			return err
+		}
+	}
+	msg := fc.bytesw.Bytes()
+	c := ChunkStream{
+		CSID:     5,
+		TypeID:   av.TAG_SCRIPTDATAAMF0,
+		StreamID: uint32(fc.streamID),
+		Length:   uint32(len(msg)),
+		Data:     msg,
+	}
+	return fc.conn.Write(&c)
+}
+
+//RemoteAddr 返回客户端地址
+func (fc *ForwardConnect) RemoteAddr() string {
+	return fc.conn.RemoteAddr().String()
+}
+
 //IsPublisher ...
 func (fc *ForwardConnect) IsPublisher() bool {
 	return fc.isPublisher
@@ -418,6 +676,16 @@ func (fc *ForwardConnect) Write(c ChunkStream) error {
 	return fc.conn.Write(&c)
 }
 
+//ChunkSize 返回发送数据使用的chunk size
+func (fc *ForwardConnect) ChunkSize() uint32 {
+	return fc.conn.ChunkSize()
+}
+
+//WriteChunks 写入按ChunkSize编码好的chunk，数据可以被多个连接共享，不会被修改
+func (fc *ForwardConnect) WriteChunks(b []byte) error {
+	return fc.conn.WriteChunks(b)
+}
+
 //Flush ...
 func (fc *ForwardConnect) Flush() error {
 	return fc.conn.Flush()
@@ -436,6 +704,20 @@ func (fc *ForwardConnect) GetStreamInfo() (app string, name string, url string)
 	return
 }
 
+//SendUnpublish 通知播放端流已经停止发布，发送Stream EOF和NetStream.Play.UnpublishNotify
+func (fc *ForwardConnect) SendUnpublish() error {
+	//对端可能已经不再读取，设置超时避免阻塞
+	fc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer fc.conn.SetWriteDeadline(time.Time{})
+
+	fc.conn.SetEOF()
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = "NetStream.Play.UnpublishNotify"
+	event["description"] = "Stream is unpublished."
+	return fc.writeMsg(5, uint32(fc.streamID), "onStatus", 0, nil, event)
+}
+
 //Close ...
 func (fc *ForwardConnect) Close() {
 	fc.conn.Close()
@@ -3,6 +3,7 @@ package core
 import (
 	"encoding/binary"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/fabo871218/srtmp/utils"
@@ -30,8 +31,13 @@ type RtmpConn struct {
 	rw                  *ReadWriter
 	pool                *utils.Pool
 	chunks              map[uint32]*ChunkStream
+	msg                 ChunkStream //Read返回的message，每次Read重用
+	writeMutex          sync.Mutex  //Read中回复的ack可能和其他协程的发送并发，写入rw时加锁
 }
 
+//messagePool 所有连接共享的message内存池
+var messagePool = utils.NewPool()
+
 //NewRtmpConn ...
 func NewRtmpConn(c net.Conn, bufferSize int) *RtmpConn {
 	return &RtmpConn{
@@ -40,12 +46,14 @@ func NewRtmpConn(c net.Conn, bufferSize int) *RtmpConn {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		pool:                utils.NewPool(),
+		pool:                messagePool,
 		rw:                  NewReadWriter(c, bufferSize),
 		chunks:              make(map[uint32]*ChunkStream),
 	}
 }
 
+//Read 读取一个完整的message，协议控制消息在内部处理，不会返回。返回的ChunkStream每次Read都会重用，
+//需要保存时拷贝一份；Data使用pool内存，不再使用时调用Release归还，不调用时由gc回收
 func (rtmpConn *RtmpConn) Read() (c *ChunkStream, err error) {
 	var rb byte
 	for {
@@ -74,6 +82,7 @@ func (rtmpConn *RtmpConn) Read() (c *ChunkStream, err error) {
 		if !ok { //如果没找到，就创建一个新的chunkstream
 			cs = &ChunkStream{
 				CSID: csid,
+				pool: rtmpConn.pool,
 			}
 			rtmpConn.chunks[csid] = cs
 		}
@@ -83,7 +92,9 @@ func (rtmpConn *RtmpConn) Read() (c *ChunkStream, err error) {
 		}
 		//判断当前chunk是否读取完成
 		if cs.isComplete() {
-			c = &ChunkStream{
+			//内存的所有权交给返回的message，chunk stream的下一个message重新分配
+			c = &rtmpConn.msg
+			*c = ChunkStream{
 				Format:    cs.Format,
 				CSID:      cs.CSID,
 				Timestamp: cs.Timestamp,
@@ -91,26 +102,49 @@ func (rtmpConn *RtmpConn) Read() (c *ChunkStream, err error) {
 				TypeID:    cs.TypeID,
 				StreamID:  cs.StreamID,
 				Data:      cs.Data[0:cs.Length],
+				buf:       cs.buf,
+				pool:      cs.pool,
 			}
+			cs.buf = nil
 			//如果是控制消息，就直接处理掉，不反回到外层
-			isHandled := rtmpConn.handleControlMsg(cs)
-			rtmpConn.ack(cs.Length)
+			isHandled := rtmpConn.handleControlMsg(c)
+			rtmpConn.ack(c.Length)
 			if !isHandled {
 				return
 			}
+			c.Release()
 		}
 	}
 }
 
 func (rtmpConn *RtmpConn) Write(c *ChunkStream) error {
+	rtmpConn.writeMutex.Lock()
+	defer rtmpConn.writeMutex.Unlock()
 	if c.TypeID == idSetChunkSize {
 		rtmpConn.chunkSize = binary.BigEndian.Uint32(c.Data)
 	}
 	return c.writeChunk(rtmpConn.rw, int(rtmpConn.chunkSize))
 }
 
+//ChunkSize 返回发送数据使用的chunk size
+func (rtmpConn *RtmpConn) ChunkSize() uint32 {
+	rtmpConn.writeMutex.Lock()
+	defer rtmpConn.writeMutex.Unlock()
+	return rtmpConn.chunkSize
+}
+
+//WriteChunks 写入ChunkStream.EncodeChunks编码好的数据，chunk size需要和ChunkSize相同
+func (rtmpConn *RtmpConn) WriteChunks(b []byte) error {
+	rtmpConn.writeMutex.Lock()
+	defer rtmpConn.writeMutex.Unlock()
+	_, err := rtmpConn.rw.Write(b)
+	return err
+}
+
 //Flush ...
 func (rtmpConn *RtmpConn) Flush() error {
+	rtmpConn.writeMutex.Lock()
+	defer rtmpConn.writeMutex.Unlock()
 	return rtmpConn.rw.Flush()
 }
 
@@ -181,7 +215,7 @@ func (rtmpConn *RtmpConn) ack(size uint32) {
 	}
 	if rtmpConn.ackReceived >= rtmpConn.remoteWindowAckSize {
 		cs := rtmpConn.NewAck(rtmpConn.ackReceived)
-		cs.writeChunk(rtmpConn.rw, int(rtmpConn.chunkSize))
+		rtmpConn.Write(&cs)
 		rtmpConn.ackReceived = 0
 	}
 }
@@ -210,10 +244,10 @@ const (
 )
 
 /*
-   +------------------------------+-------------------------
-   |     Event Type ( 2- bytes )  | Event Data
-   +------------------------------+-------------------------
-   Pay load for the ‘User Control Message’.
++------------------------------+-------------------------
+|     Event Type ( 2- bytes )  | Event Data
++------------------------------+-------------------------
+Pay load for the ‘User Control Message’.
 */
 func (rtmpConn *RtmpConn) userControlMsg(eventType, buflen uint32) ChunkStream {
 	var ret ChunkStream
@@ -240,6 +274,15 @@ func (rtmpConn *RtmpConn) SetBegin() {
 	rtmpConn.Write(&ret)
 }
 
+//SetEOF 通知客户端流已经结束
+func (rtmpConn *RtmpConn) SetEOF() {
+	ret := rtmpConn.userControlMsg(streamEOF, 4)
+	for i := 0; i < 4; i++ {
+		ret.Data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
+	}
+	rtmpConn.Write(&ret)
+}
+
 //SetRecorded ...
 func (rtmpConn *RtmpConn) SetRecorded() {
 	ret := rtmpConn.userControlMsg(streamIsRecorded, 4)
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"time"
+)
+
+//StreamEventType 流事件类型
+type StreamEventType string
+
+const (
+	EventStreamCreate StreamEventType = "on_stream_create" //创建流
+	EventStreamClose  StreamEventType = "on_stream_close"  //流释放
+	EventPublish      StreamEventType = "on_publish"       //开始推流
+	EventUnpublish    StreamEventType = "on_unpublish"     //推流结束
+	EventPlay         StreamEventType = "on_play"          //开始播放
+	EventStop         StreamEventType = "on_stop"          //播放结束
+	EventPlayerLag    StreamEventType = "on_player_lag"    //播放端发送跟不上，开始落后
+)
+
+//StreamEvent 流生命周期事件
+type StreamEvent struct {
+	Type       StreamEventType `json:"type"`
+	Info       StreamInfo      `json:"info"`
+	RemoteAddr string          `json:"remote_addr"` //推流端或播放端地址，内部的写对象为空
+	Reason     string          `json:"reason"`      //结束原因或者落后的情况，只有结束类事件和EventPlayerLag有效
+	Time       time.Time       `json:"time"`
+}
+
+//StreamObserver 流事件的观察者，回调在流的处理协程中同步执行，实现时不能阻塞
+type StreamObserver interface {
+	OnStreamEvent(event StreamEvent)
+}
+
+//StreamObserverFunc 函数形式的StreamObserver
+type StreamObserverFunc func(event StreamEvent)
+
+//OnStreamEvent 实现StreamObserver
+func (f StreamObserverFunc) OnStreamEvent(event StreamEvent) {
+	f(event)
+}
+
+//读写对象实现该接口时，事件中会带上对端地址
+type remoteAddrer interface {
+	RemoteAddr() string
+}
+
+func remoteAddrOf(v interface{}) string {
+	if r, ok := v.(remoteAddrer); ok {
+		return r.RemoteAddr()
+	}
+	return ""
+}
@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+)
+
+//queuedPacket 发送队列中的数据包，chunks为rtmp播放端共享的chunk编码，可以为nil
+type queuedPacket struct {
+	*av.Packet
+	chunks *sharedChunks
+}
+
+//retain 进入队列时增加数据包和共享chunk的引用
+func (p queuedPacket) retain() {
+	p.Packet.Retain()
+	p.chunks.retain()
+}
+
+//release 发送或者丢弃之后释放引用
+func (p queuedPacket) release() {
+	p.chunks.release()
+	p.Packet.Release()
+}
+
+//packetQueue 播放端的发送队列，流循环写入，发送协程读取，
+//队列满时由写对象决定丢弃哪些数据包
+type packetQueue struct {
+	mutex  sync.Mutex
+	pkts   []queuedPacket
+	size   int
+	notify chan struct{}
+	closed bool
+}
+
+func newPacketQueue(size int) *packetQueue {
+	return &packetQueue{
+		pkts:   make([]queuedPacket, 0, size),
+		size:   size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+//push 写入数据包，force为true时不检查队列长度，队列满或者已经关闭时返回false
+func (q *packetQueue) push(p queuedPacket, force bool) bool {
+	q.mutex.Lock()
+	if q.closed || (!force && len(q.pkts) >= q.size) {
+		q.mutex.Unlock()
+		return false
+	}
+	q.pkts = append(q.pkts, p)
+	q.mutex.Unlock()
+	q.wakeup()
+	return true
+}
+
+//pop 读取数据包，队列为空时阻塞，关闭后先返回剩余的数据包，再返回false
+func (q *packetQueue) pop() (queuedPacket, bool) {
+	for {
+		q.mutex.Lock()
+		if len(q.pkts) > 0 {
+			p := q.pkts[0]
+			q.pkts[0] = queuedPacket{}
+			q.pkts = q.pkts[1:]
+			q.mutex.Unlock()
+			return p, true
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+		if closed {
+			return queuedPacket{}, false
+		}
+		<-q.notify
+	}
+}
+
+//drop 丢弃队列中满足条件的数据包，返回丢弃的数据包
+func (q *packetQueue) drop(match func(*av.Packet) bool) []queuedPacket {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var dropped []queuedPacket
+	pkts := q.pkts[:0]
+	for _, p := range q.pkts {
+		if match(p.Packet) {
+			dropped = append(dropped, p)
+		} else {
+			pkts = append(pkts, p)
+		}
+	}
+	for i := len(pkts); i < len(q.pkts); i++ {
+		q.pkts[i] = queuedPacket{}
+	}
+	q.pkts = pkts
+	return dropped
+}
+
+//backlog 返回队列中数据包的个数，以及最早的音视频数据包落后last的时长(毫秒)
+func (q *packetQueue) backlog(last uint32) (n int, lag uint32) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, p := range q.pkts {
+		if p.PacketType != av.PacketTypeMetadata {
+			if diff := int32(last - p.TimeStamp); diff > 0 {
+				lag = uint32(diff)
+			}
+			break
+		}
+	}
+	return len(q.pkts), lag
+}
+
+func (q *packetQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.wakeup()
+}
+
+func (q *packetQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+//gopQueue 带丢弃策略的发送队列，队列满时按SlowConsumerPolicy丢弃数据，丢弃视频之后等待下一个关键帧，
+//push只在流循环中调用
+type gopQueue struct {
+	*packetQueue
+	policy       SlowConsumerPolicy
+	keyframeNeed bool
+	droppedVideo uint64
+	droppedAudio uint64
+}
+
+func newGopQueue(size int, policy SlowConsumerPolicy) *gopQueue {
+	return &gopQueue{
+		packetQueue:  newPacketQueue(size),
+		policy:       policy,
+		keyframeNeed: true,
+	}
+}
+
+//push 写入数据包，调用者已经增加了p的引用，p被丢弃时释放；有数据包被丢弃时返回true
+func (q *gopQueue) push(p queuedPacket) bool {
+	before := q.dropped()
+	//metadata和sequence header不能丢弃，FrameType为关键帧的sequence header也不代表可以开始发送视频
+	if p.IsHeader() {
+		if !q.packetQueue.push(p, true) {
+			p.release()
+		}
+		return false
+	}
+	if p.PacketType == av.PacketTypeVideo {
+		if q.keyframeNeed {
+			if p.VHeader.FrameType != av.FRAME_KEY {
+				q.discard(p)
+				return true
+			}
+			q.keyframeNeed = false
+		}
+	}
+
+	if !q.packetQueue.push(p, false) {
+		q.relieve(p)
+	}
+	return q.dropped() != before
+}
+
+//relieve 队列满时按策略腾出空间，写入p或者丢弃p
+func (q *gopQueue) relieve(p queuedPacket) {
+	if q.policy.Strategy == DropNonReference {
+		if flv.IsDisposable(p.Packet) {
+			q.discard(p)
+			return
+		}
+		if dropped := q.drop(flv.IsDisposable); len(dropped) > 0 {
+			q.discard(dropped...)
+			if q.packetQueue.push(p, false) {
+				return
+			}
+		}
+	}
+
+	//丢弃队列中的视频，等待下一个关键帧，p是关键帧时从p开始新的gop
+	dropped := q.drop(func(v *av.Packet) bool {
+		return v.PacketType == av.PacketTypeVideo && !v.IsHeader()
+	})
+	q.discard(dropped...)
+	if p.PacketType == av.PacketTypeVideo {
+		q.keyframeNeed = p.VHeader.FrameType != av.FRAME_KEY
+		if q.keyframeNeed {
+			q.discard(p)
+			return
+		}
+	} else if len(dropped) > 0 {
+		q.keyframeNeed = true
+	}
+	if q.packetQueue.push(p, false) {
+		return
+	}
+
+	//队列中只有音频，丢弃最早的一帧
+	first := true
+	q.discard(q.drop(func(a *av.Packet) bool {
+		if first && !a.IsHeader() {
+			first = false
+			return true
+		}
+		return false
+	})...)
+	if !q.packetQueue.push(p, false) {
+		q.discard(p)
+	}
+}
+
+//discard 统计丢弃的数据包，并释放数据包和共享的chunk
+func (q *gopQueue) discard(pkts ...queuedPacket) {
+	for _, p := range pkts {
+		if p.PacketType == av.PacketTypeVideo {
+			atomic.AddUint64(&q.droppedVideo, 1)
+		} else {
+			atomic.AddUint64(&q.droppedAudio, 1)
+		}
+		p.release()
+	}
+}
+
+//dropped 返回丢弃的数据包总数
+func (q *gopQueue) dropped() uint64 {
+	return atomic.LoadUint64(&q.droppedVideo) + atomic.LoadUint64(&q.droppedAudio)
+}
+
+//clear 关闭队列并释放队列中剩余的数据包，不计入丢弃统计
+func (q *gopQueue) clear() {
+	q.close()
+	for _, p := range q.drop(func(*av.Packet) bool { return true }) {
+		p.release()
+	}
+}
@@ -3,86 +3,95 @@ package protocol
 import (
 	"bytes"
 	"fmt"
-	"io"
+	"sync"
 
+	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/logger"
 	"github.com/fabo871218/srtmp/protocol/amf"
 	"github.com/fabo871218/srtmp/protocol/core"
 )
 
-var (
-	STOP_CTRL = "RTMPRELAY_STOP"
-)
-
+//RtmpRelay 从PlayUrl拉流，并推送到PublishUrl
 type RtmpRelay struct {
 	PlayUrl              string
 	PublishUrl           string
+	mutex                sync.Mutex
 	cs_chan              chan *core.ChunkStream
-	sndctrl_chan         chan string
+	stopChan             chan struct{}
 	connectPlayClient    *core.ConnClient
 	connectPublishClient *core.ConnClient
 	startflag            bool
 	logger               logger.Logger
 }
 
-func NewRtmpRelay(playurl *string, publishurl *string) *RtmpRelay {
+//NewRtmpRelay 创建一个rtmp转推对象
+func NewRtmpRelay(playurl *string, publishurl *string, log logger.Logger) *RtmpRelay {
 	return &RtmpRelay{
 		PlayUrl:              *playurl,
 		PublishUrl:           *publishurl,
 		cs_chan:              make(chan *core.ChunkStream, 500),
-		sndctrl_chan:         make(chan string),
 		connectPlayClient:    nil,
 		connectPublishClient: nil,
 		startflag:            false,
+		logger:               log,
 	}
 }
 
-func (self *RtmpRelay) rcvPlayChunkStream() {
-	fmt.Printf("rcvPlayRtmpMediaPacket connectClient.Read...\n")
+func (self *RtmpRelay) rcvPlayChunkStream(stopChan chan struct{}) {
+	defer self.Stop()
 	for {
-		if self.startflag == false {
-			self.connectPlayClient.Close()
-			fmt.Printf("rcvPlayChunkStream close: playurl=%s, publishurl=%s\n", self.PlayUrl, self.PublishUrl)
-			break
-		}
 		rc, err := self.connectPlayClient.Read()
-
-		if err != nil && err == io.EOF {
-			break
+		if err != nil {
+			self.logger.Infof("Rtmp relay read from %s stopped, %v", self.PlayUrl, err)
+			return
 		}
-		//glog.Infof("connectPlayClient.Read return rc.TypeID=%v length=%d, err=%v", rc.TypeID, len(rc.Data), err)
+
 		switch rc.TypeID {
-		case 20, 17:
+		case 20, 17: //amf0和amf3命令消息
 			r := bytes.NewReader(rc.Data)
 			vs, err := self.connectPlayClient.DecodeBatch(r, amf.AMF0)
-
-			fmt.Printf("rcvPlayRtmpMediaPacket: vs=%v, err=%v\n", vs, err)
-		case 18:
-			fmt.Printf("rcvPlayRtmpMediaPacket: metadata....\n")
-		case 8, 9:
-			self.cs_chan <- rc
+			self.logger.Debugf("Rtmp relay receive command, vs=%v err=%v", vs, err)
+		case av.TAG_SCRIPTDATAAMF0, av.TAG_AUDIO, av.TAG_VIDEO:
+			//Read返回的ChunkStream会被下一次Read重用，拷贝一份
+			c := *rc
+			select {
+			case self.cs_chan <- &c:
+			case <-stopChan:
+				c.Release()
+				return
+			}
+			continue
 		}
+		rc.Release()
 	}
 }
 
-func (self *RtmpRelay) sendPublishChunkStream() {
+func (self *RtmpRelay) sendPublishChunkStream(stopChan chan struct{}) {
+	defer self.Stop()
 	for {
 		select {
 		case rc := <-self.cs_chan:
-			//glog.Infof("sendPublishChunkStream: rc.TypeID=%v length=%d", rc.TypeID, len(rc.Data))
-			self.connectPublishClient.Write(rc)
-		case ctrlcmd := <-self.sndctrl_chan:
-			if ctrlcmd == STOP_CTRL {
-				self.connectPublishClient.Close()
-				fmt.Printf("sendPublishChunkStream close: playurl=%s, publishurl=%s\n", self.PlayUrl, self.PublishUrl)
-				break
+			rc.StreamID = self.connectPublishClient.GetStreamID()
+			err := self.connectPublishClient.Write(rc)
+			rc.Release()
+			if err != nil {
+				self.logger.Infof("Rtmp relay write to %s stopped, %v", self.PublishUrl, err)
+				return
+			}
+			if err := self.connectPublishClient.Flush(); err != nil {
+				self.logger.Infof("Rtmp relay flush to %s stopped, %v", self.PublishUrl, err)
+				return
 			}
+		case <-stopChan:
+			return
 		}
 	}
 }
 
-//Start ...
+//Start 连接拉流和推流地址，并开始转推
 func (self *RtmpRelay) Start() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	if self.startflag {
 		return fmt.Errorf("The rtmprelay already started, playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl)
 	}
@@ -91,34 +100,41 @@ func (self *RtmpRelay) Start() error {
 	self.connectPublishClient = core.NewConnClient(self.logger)
 
 	self.logger.Debugf("Play server addr:%s starting....", self.PlayUrl)
-	err := self.connectPlayClient.Start(self.PlayUrl, "play")
-	if err != nil {
-		fmt.Printf("connectPlayClient.Start url=%v error\n", self.PlayUrl)
-		return err
+	if err := self.connectPlayClient.Start(self.PlayUrl, av.PLAY); err != nil {
+		return fmt.Errorf("connectPlayClient.Start failed, url:%s %v", self.PlayUrl, err)
 	}
 
-	fmt.Printf("publish server addr:%v starting....\n", self.PublishUrl)
-	err = self.connectPublishClient.Start(self.PublishUrl, "publish")
-	if err != nil {
-		fmt.Printf("connectPublishClient.Start url=%v error\n", self.PublishUrl)
+	self.logger.Debugf("Publish server addr:%s starting....", self.PublishUrl)
+	if err := self.connectPublishClient.Start(self.PublishUrl, av.PUBLISH); err != nil {
 		self.connectPlayClient.Close()
-		return err
+		return fmt.Errorf("connectPublishClient.Start failed, url:%s %v", self.PublishUrl, err)
 	}
 
 	self.startflag = true
-	go self.rcvPlayChunkStream()
-	go self.sendPublishChunkStream()
-
+	self.stopChan = make(chan struct{})
+	go self.rcvPlayChunkStream(self.stopChan)
+	go self.sendPublishChunkStream(self.stopChan)
 	return nil
 }
 
+//Stop 停止转推，可以多次调用
 func (self *RtmpRelay) Stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	if !self.startflag {
-		fmt.Printf("The rtmprelay already stoped, playurl=%s, publishurl=%s\n", self.PlayUrl, self.PublishUrl)
 		return
 	}
 
 	self.startflag = false
-	self.sndctrl_chan <- STOP_CTRL
+	close(self.stopChan)
+	self.connectPlayClient.Close()
+	self.connectPublishClient.Close()
+	self.logger.Infof("Rtmp relay stopped, playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl)
+}
 
+//IsStart 是否正在转推
+func (self *RtmpRelay) IsStart() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.startflag
 }
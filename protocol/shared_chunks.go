@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/protocol/core"
+)
+
+//chunkBufPool 编码chunk使用的内存，引用计数为0时放回
+var chunkBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+//encodedChunks 按一种chunk size和时间戳编码好的chunk
+type encodedChunks struct {
+	chunkSize uint32
+	timestamp uint32
+	buf       *[]byte
+}
+
+//sharedChunks 一个数据包编码后的chunk，被所有rtmp播放端共享，相同chunk size和时间戳的
+//播放端写入同一份数据，不需要各自编码。流循环持有一个引用，进入每个播放端的发送队列时加一，
+//发送或者丢弃后减一，引用计数为0时把内存放回chunkBufPool
+type sharedChunks struct {
+	refs    int32
+	pkt     *av.Packet
+	mutex   sync.Mutex
+	encoded []encodedChunks
+}
+
+func newSharedChunks(pkt *av.Packet) *sharedChunks {
+	return &sharedChunks{
+		refs: 1,
+		pkt:  pkt,
+	}
+}
+
+func (c *sharedChunks) retain() {
+	if c != nil {
+		atomic.AddInt32(&c.refs, 1)
+	}
+}
+
+func (c *sharedChunks) release() {
+	if c == nil || atomic.AddInt32(&c.refs, -1) != 0 {
+		return
+	}
+	for _, e := range c.encoded {
+		*e.buf = (*e.buf)[:0]
+		chunkBufPool.Put(e.buf)
+	}
+	c.encoded = nil
+}
+
+//chunks 返回按chunkSize和timestamp编码的chunk，第一次请求时编码，
+//返回的数据在release之前有效，不能修改
+func (c *sharedChunks) chunks(chunkSize, timestamp uint32) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, e := range c.encoded {
+		if e.chunkSize == chunkSize && e.timestamp == timestamp {
+			return *e.buf, nil
+		}
+	}
+
+	cs := core.ChunkStream{
+		Data:      c.pkt.Data,
+		Length:    uint32(len(c.pkt.Data)),
+		StreamID:  c.pkt.StreamID,
+		Timestamp: timestamp,
+		TypeID:    packetTypeID(c.pkt),
+	}
+	buf := chunkBufPool.Get().(*[]byte)
+	if n := cs.EncodedLen(int(chunkSize)); cap(*buf) < n {
+		*buf = make([]byte, 0, n)
+	}
+	b, err := cs.EncodeChunks((*buf)[:0], int(chunkSize))
+	if err != nil {
+		chunkBufPool.Put(buf)
+		return nil, err
+	}
+	*buf = b
+	c.encoded = append(c.encoded, encodedChunks{chunkSize: chunkSize, timestamp: timestamp, buf: buf})
+	return b, nil
+}
+
+//packetTypeID 返回数据包对应的rtmp消息类型
+func packetTypeID(p *av.Packet) uint32 {
+	switch p.PacketType {
+	case av.PacketTypeAudio:
+		return av.TAG_AUDIO
+	case av.PacketTypeMetadata:
+		return av.TAG_SCRIPTDATAAMF0
+	}
+	return av.TAG_VIDEO
+}
@@ -13,23 +13,33 @@ import (
 
 // StreamInfo ...
 type StreamInfo struct {
-	App  string
-	Name string
-	URL  string
+	App  string `json:"app"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
 }
 
 //RtmpStream rtmp流类型
 type RtmpStream struct {
 	streamID   string
 	isStart    bool
+	mutex      sync.RWMutex //保护reader和writers，流循环之外的读取需要加锁
 	cache      *cache.Cache
+	join       cache.JoinStrategy //播放端加入的方式
 	reader     ReadCloser
 	writers    []WriteCloser
+	joining    map[WriteCloser]struct{} //等待下一个关键帧的写对象，只在流循环中访问
 	streamInfo StreamInfo
+	attached   bool //是否已经添加了WriterFactory创建的写对象
+	//读对象被主动关闭的原因
+	readerReason string
+	tsStats      *TimestampStats //发布端时间戳的修正次数，替换发布端后继续累加
 
 	pktChan       chan *av.Packet
 	writerChan    chan WriteCloser
 	readerChan    chan ReadCloser
+	closeChan     chan struct{}
+	closeOnce     sync.Once
+	doneChan      chan struct{}
 	streamHandler *StreamHandler
 	logger        logger.Logger
 }
@@ -47,22 +57,28 @@ func (p *PackWriterCloser) NewWriter() (WriteCloser, error) {
 
 //NewStream 创建新的rtmp流
 func NewStream(streamInfo StreamInfo, handler *StreamHandler, log logger.Logger) *RtmpStream {
+	policy := handler.cachePolicy(streamInfo.App)
 	return &RtmpStream{
 		streamID:      utils.NewId(),
 		streamInfo:    streamInfo,
-		cache:         cache.NewCache(),
+		cache:         cache.NewCache(policy),
+		join:          policy.Join,
+		tsStats:       &TimestampStats{},
 		streamHandler: handler,
 		writers:       make([]WriteCloser, 0),
-		writerChan:    make(chan WriteCloser, 1),
-		readerChan:    make(chan ReadCloser, 1),
+		joining:       make(map[WriteCloser]struct{}),
+		writerChan:    make(chan WriteCloser),
+		readerChan:    make(chan ReadCloser),
 		pktChan:       make(chan *av.Packet, 16),
+		closeChan:     make(chan struct{}),
+		doneChan:      make(chan struct{}),
 		logger:        log,
 	}
 }
 
 //ID 获取rtmp流id
 func (s *RtmpStream) ID() string {
-	if s.reader != nil {
+	if s.GetReader() != nil {
 		return s.streamID
 	}
 	return ""
@@ -70,74 +86,224 @@ func (s *RtmpStream) ID() string {
 
 //GetReader 获取rtmp流读对象
 func (s *RtmpStream) GetReader() ReadCloser {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.reader
 }
 
+//GetWriters 获取rtmp流当前所有写对象的拷贝
+func (s *RtmpStream) GetWriters() []WriteCloser {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	writers := make([]WriteCloser, 0, len(s.writers))
+	for _, w := range s.writers {
+		if w != nil {
+			writers = append(writers, w)
+		}
+	}
+	return writers
+}
+
+//StreamInfo 获取rtmp流信息
+func (s *RtmpStream) StreamInfo() StreamInfo {
+	return s.streamInfo
+}
+
+//TimestampStats 返回发布端时间戳的修正次数
+func (s *RtmpStream) TimestampStats() TimestampStats {
+	return s.tsStats.load()
+}
+
 //AddReader 为rtmp流对象添加一个读对象
 func (s *RtmpStream) AddReader(r ReadCloser) error {
+	s.streamHandler.notify(EventPublish, s.streamInfo, remoteAddrOf(r), "")
 	go func() {
-		s.readerChan <- r
+		select {
+		case s.readerChan <- r:
+		case <-s.doneChan:
+			r.Close()
+			s.streamHandler.notify(EventUnpublish, s.streamInfo, remoteAddrOf(r), "stream closed")
+		}
 	}()
 	return nil
 }
 
 //AddWriter 为rtmp流对象添加一个写对象
 func (s *RtmpStream) AddWriter(w WriteCloser) error {
+	s.streamHandler.notify(EventPlay, s.streamInfo, remoteAddrOf(w), "")
 	go func() {
-		s.writerChan <- w
+		select {
+		case s.writerChan <- w:
+		case <-s.doneChan:
+			s.stopWriter(w, "stream closed")
+		}
 	}()
 	return nil
 }
 
-//开始读取流数据
-func (s *RtmpStream) startRead(wg *sync.WaitGroup) {
+//关闭写对象，并通知观察者
+func (s *RtmpStream) stopWriter(w WriteCloser, reason string) {
+	w.Close()
+	s.streamHandler.notify(EventStop, s.streamInfo, remoteAddrOf(w), reason)
+}
+
+//关闭读对象，reason会在读取协程退出时通知给观察者
+func (s *RtmpStream) closeReader(reason string) {
+	s.mutex.Lock()
+	s.readerReason = reason
+	s.mutex.Unlock()
+	s.reader.Close()
+}
+
+//Close 关闭rtmp流，流循环会关闭读对象和所有写对象后退出，可以多次调用
+func (s *RtmpStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+}
+
+//Done 返回一个channel，流循环退出并释放所有资源后会被关闭
+func (s *RtmpStream) Done() <-chan struct{} {
+	return s.doneChan
+}
+
+//开始读取流数据，stop关闭后不再等待流循环取走数据包
+func (s *RtmpStream) startRead(reader ReadCloser, stop <-chan struct{}, wg *sync.WaitGroup) {
 	s.logger.Infof("Start to read data, id:%s", s.streamID)
-	wg.Add(1)
 	defer wg.Done()
+	transformers := s.streamHandler.newTransformers(s.streamInfo)
+	sanitizer := newTimestampSanitizer(s.tsStats)
 	for {
 		pkt := &av.Packet{}
-		if err := s.reader.Read(pkt); err != nil {
+		if err := reader.Read(pkt); err != nil {
 			s.logger.Errorf("Read pkt failed, %s", err.Error())
+			s.mutex.Lock()
+			reason := s.readerReason
+			s.readerReason = ""
+			s.mutex.Unlock()
+			if reason == "" {
+				reason = err.Error()
+			}
+			s.streamHandler.notify(EventUnpublish, s.streamInfo, remoteAddrOf(reader), reason)
 			return
 		}
-		//先缓存数据包
-		s.cache.Write(pkt)
-		select {
-		case s.pktChan <- pkt:
-		default:
+		if len(transformers) > 0 {
+			//Transformer可能保存或者修改数据，不再归还pool
+			pkt.Detach()
+		}
+		pkts, err := transform(transformers, pkt)
+		if err != nil {
+			s.logger.Errorf("Transform pkt failed, %s", err.Error())
+		}
+		for _, p := range pkts {
+			//修正时间戳后再缓存和转发，所有写对象收到的时间戳都是单调递增的
+			sanitizer.sanitize(p)
+			//先缓存数据包，读取的引用交给流循环
+			s.cache.Write(p)
+			s.sendPacket(p, stop)
 		}
 	}
 }
 
+//sendPacket 把数据包交给流循环，pktChan满时丢弃普通的音视频帧，metadata和sequence header
+//等待流循环取走，直到stop关闭
+func (s *RtmpStream) sendPacket(p *av.Packet, stop <-chan struct{}) {
+	select {
+	case s.pktChan <- p:
+		return
+	default:
+	}
+	if !p.IsHeader() {
+		p.Release()
+		return
+	}
+	select {
+	case s.pktChan <- p:
+	case <-stop:
+		p.Release()
+	}
+}
+
+//transform 数据包依次经过每个Transformer，前一个的输出作为后一个的输入
+func transform(transformers []av.Transformer, pkt *av.Packet) ([]*av.Packet, error) {
+	pkts := []*av.Packet{pkt}
+	for _, t := range transformers {
+		out := make([]*av.Packet, 0, len(pkts))
+		for _, p := range pkts {
+			ret, err := t.Transform(p)
+			out = append(out, ret...)
+			if err != nil {
+				return out, err
+			}
+		}
+		pkts = out
+	}
+	return pkts, nil
+}
+
 //转发流数据
 func (s *RtmpStream) streamLoop() {
 	s.logger.Infof("Start stream loop, %s", s.streamID)
 	checkTicker := time.NewTicker(time.Second * 30)
+	var wg sync.WaitGroup
+	var stopRead chan struct{} //关闭后读取协程不再阻塞在发送sequence header上
+	exitReason := "stream closed"
 	defer func() {
 		streamKey := fmt.Sprintf("%s_%s", s.streamInfo.App, s.streamInfo.Name)
-		s.streamHandler.remove(streamKey)
-		s.close()
+		s.streamHandler.remove(streamKey, s)
+		s.close(exitReason)
+		if stopRead != nil {
+			close(stopRead)
+		}
+		wg.Wait()
 		checkTicker.Stop()
+		close(s.doneChan)
 		s.logger.Infof("Rtmp stream[%s] exit.", s.streamID)
+		s.streamHandler.notify(EventStreamClose, s.streamInfo, "", exitReason)
 	}()
 
-	var wg sync.WaitGroup
 	lastWriteRemove := time.Now()
 	for {
 		select {
 		case pkt := <-s.pktChan:
 			{
 				bRemove := false
+				//音视频数据只编码一次chunk，所有rtmp播放端共享
+				var chunks *sharedChunks
+				if pkt.PacketType != av.PacketTypeMetadata {
+					chunks = newSharedChunks(pkt)
+				}
+				//有不释放数据包的写对象时，内存不再归还pool
+				for _, w := range s.writers {
+					if _, ok := w.(av.PacketRetainer); !ok {
+						pkt.Detach()
+						break
+					}
+				}
 				for i, w := range s.writers {
-					if err := w.Write(pkt); err != nil {
+					if s.waitKeyframe(w, pkt) {
+						continue
+					}
+					var err error
+					if sw, ok := w.(sharedWriter); ok {
+						err = sw.writeShared(pkt, chunks)
+					} else {
+						err = w.Write(pkt)
+					}
+					if err != nil {
 						s.logger.Infof("Write packet failed, %s close writer.", err.Error())
-						w.Close() //todo 是否要传递参数
+						s.stopWriter(w, err.Error())
+						delete(s.joining, w)
 						s.writers[i] = nil
 						bRemove = true
 					}
 				}
 
+				chunks.release()
+				pkt.Release()
+
 				if bRemove {
+					s.mutex.Lock()
 					for i := 0; i < len(s.writers); {
 						if s.writers[i] == nil {
 							s.writers = append(s.writers[:i], s.writers[i+1:]...)
@@ -145,36 +311,43 @@ func (s *RtmpStream) streamLoop() {
 							i++
 						}
 					}
+					s.mutex.Unlock()
 					lastWriteRemove = time.Now()
 				}
 			}
 		case w := <-s.writerChan: // 接收到play消息
 			{
-				//TODO 这个方法不是很好，先这样，后续再优化
-				sw, ok := w.(*StreamWriter)
-				if ok == false {
-					s.logger.Errorf("can not cast writerclose to streamwriter")
-					w.Close()
-					return
+				//没有发送队列的写对象在单独的协程中写入，Write阻塞时不影响其他写对象
+				if _, ok := w.(queueSizer); !ok {
+					w = newAsyncWriter(w, maxQueueNum, s.logger)
 				}
-				if err := s.cache.Send(sw.packetQueue); err != nil {
+				limit := w.(queueSizer).QueueSize()
+				wait, err := s.cache.Send(w, s.join, limit)
+				if err != nil {
 					s.logger.Errorf("Send cache failed, %s", err.Error())
-					w.Close()
-					return
+					s.stopWriter(w, err.Error())
+					break
 				}
+				if wait {
+					s.joining[w] = struct{}{}
+				}
+				s.mutex.Lock()
 				s.writers = append(s.writers, w)
+				s.mutex.Unlock()
 			}
 		case r := <-s.readerChan: // 接收到push消息
 			{
 				if s.reader != nil {
-					s.reader.Close()
+					s.closeReader("replaced by new publisher")
+					close(stopRead)
 					wg.Wait() //等待读取数据协程结束
 
 					//清除pktChan中的
 				CleanLoop:
 					for {
 						select {
-						case <-s.pktChan:
+						case pkt := <-s.pktChan:
+							pkt.Release()
 						default:
 							break CleanLoop
 						}
@@ -184,9 +357,16 @@ func (s *RtmpStream) streamLoop() {
 						w.CalcBaseTimestamp()
 					}
 				}
+				s.mutex.Lock()
 				s.reader = r
-				go s.startRead(&wg)
+				s.mutex.Unlock()
+				wg.Add(1)
+				stopRead = make(chan struct{})
+				go s.startRead(r, stopRead, &wg)
 			}
+		case <-s.closeChan:
+			s.logger.Infof("Rtmp stream[%s] closed.", s.streamID)
+			return
 		case <-checkTicker.C:
 			{
 				//检查是否有writer，没有则释放
@@ -198,6 +378,7 @@ func (s *RtmpStream) streamLoop() {
 				//检查是否有reader
 				if s.reader == nil || !s.reader.Alive() {
 					s.logger.Debugf("Stream reader is nil(%v) or not alive, exit", s.reader == nil)
+					exitReason = "publisher timeout"
 					return
 				}
 
@@ -205,8 +386,11 @@ func (s *RtmpStream) streamLoop() {
 				for i := 0; i < len(s.writers); {
 					w := s.writers[i]
 					if !w.Alive() {
+						delete(s.joining, w)
+						s.mutex.Lock()
 						s.writers = append(s.writers[:i], s.writers[i+1:]...)
-						w.Close() //todo 是否要传递关闭原因
+						s.mutex.Unlock()
+						s.stopWriter(w, "player timeout")
 						lastWriteRemove = time.Now()
 					} else {
 						i++
@@ -217,9 +401,22 @@ func (s *RtmpStream) streamLoop() {
 	}
 }
 
-func (s *RtmpStream) close() {
+//waitKeyframe 写对象加入时没有发送缓存的gop，收到视频关键帧之前丢弃音视频数据，
+//音频和关键帧对齐，metadata和sequence header不丢弃
+func (s *RtmpStream) waitKeyframe(w WriteCloser, pkt *av.Packet) bool {
+	if _, ok := s.joining[w]; !ok || pkt.IsHeader() {
+		return false
+	}
+	if pkt.PacketType == av.PacketTypeVideo && pkt.VHeader.FrameType == av.FRAME_KEY {
+		delete(s.joining, w)
+		return false
+	}
+	return true
+}
+
+func (s *RtmpStream) close(reason string) {
 	if s.reader != nil {
-		s.reader.Close()
+		s.closeReader(reason)
 		s.logger.Infof("[%s] publish closed.", s.streamID)
 	}
 
@@ -229,15 +426,16 @@ CloseLoop:
 	for {
 		select {
 		case w := <-s.writerChan:
-			w.Close()
+			s.stopWriter(w, reason)
 		case r := <-s.readerChan:
 			r.Close()
+			s.streamHandler.notify(EventUnpublish, s.streamInfo, remoteAddrOf(r), reason)
 		default:
 			break CloseLoop
 		}
 	}
 
 	for _, writer := range s.writers {
-		writer.Close()
+		s.stopWriter(writer, reason)
 	}
 }
@@ -1,18 +1,43 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/fabo871218/srtmp/av"
 	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol/cache"
 	"github.com/fabo871218/srtmp/protocol/core"
 )
 
+//WriterFactory 在流开始发布时，为该流创建额外的写对象，比如hls输出
+type WriterFactory interface {
+	NewWriter(info StreamInfo) (WriteCloser, error)
+}
+
+//TransformerFactory 在发布端开始推流时，为该流创建数据包的处理阶段，比如音频转码，
+//不需要处理该流时返回nil
+type TransformerFactory interface {
+	NewTransformer(info StreamInfo) (av.Transformer, error)
+}
+
 //StreamHandler 管理RtmpStream，每个RtmpStream代表一路流
 type StreamHandler struct {
-	mutex   sync.Mutex
-	logger  logger.Logger
-	streams map[string]*RtmpStream
+	mutex        sync.Mutex
+	logger       logger.Logger
+	streams      map[string]*RtmpStream
+	factories    []WriterFactory
+	transformers []TransformerFactory
+	observers    []StreamObserver
+	auth         Authenticator
+	vod          VODResolver
+	vods         map[*VODPlayer]struct{}
+	slowPolicy   SlowConsumerPolicy
+	//gop缓存策略，key为app，""为默认策略，创建流时已经持有mutex，单独加锁
+	policyMutex   sync.Mutex
+	cachePolicies map[string]cache.Policy
 }
 
 //NewStreamHandler 创建一个管理RtmpStream的Handler
@@ -20,6 +45,9 @@ func NewStreamHandler(log logger.Logger) *StreamHandler {
 	handler := &StreamHandler{
 		logger:  log,
 		streams: make(map[string]*RtmpStream),
+		vods:    make(map[*VODPlayer]struct{}),
+
+		cachePolicies: make(map[string]cache.Policy),
 	}
 	return handler
 }
@@ -28,28 +56,38 @@ func NewStreamHandler(log logger.Logger) *StreamHandler {
 //bool indicate weathe the stream is new, true-new false-not
 func (h *StreamHandler) getOrCreate(streamInfo StreamInfo) *RtmpStream {
 	h.mutex.Lock()
-	defer h.mutex.Unlock()
 	streamKey := fmt.Sprintf("%s_%s", streamInfo.App, streamInfo.Name)
 	if stream, ok := h.streams[streamKey]; ok {
+		h.mutex.Unlock()
 		return stream
 	}
 
 	stream := NewStream(streamInfo, h, h.logger)
 	h.streams[streamKey] = stream
-	go stream.streamLoop()
+	h.mutex.Unlock()
+
 	h.logger.Infof("Create new stream, id:%s app:%s name:%s", stream.streamID,
 		streamInfo.App, streamInfo.Name)
+	h.notify(EventStreamCreate, streamInfo, "", "")
+	go stream.streamLoop()
 	return stream
 }
 
-func (h *StreamHandler) remove(key string) {
+func (h *StreamHandler) remove(key string, stream *RtmpStream) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	if _, ok := h.streams[key]; ok {
+	if v, ok := h.streams[key]; ok && v == stream {
 		delete(h.streams, key)
 	}
 }
 
+//GetStream 根据app和name获取流，不存在时返回nil
+func (h *StreamHandler) GetStream(app, name string) *RtmpStream {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.streams[fmt.Sprintf("%s_%s", app, name)]
+}
+
 //GetStreams 获取所有的流
 func (h *StreamHandler) GetStreams() []*RtmpStream {
 	streams := make([]*RtmpStream, 0)
@@ -61,6 +99,247 @@ func (h *StreamHandler) GetStreams() []*RtmpStream {
 	return streams
 }
 
+func (h *StreamHandler) getVODPlayers() []*VODPlayer {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	players := make([]*VODPlayer, 0, len(h.vods))
+	for p := range h.vods {
+		players = append(players, p)
+	}
+	return players
+}
+
+//Close 关闭所有的流和点播，不等待流释放完成
+func (h *StreamHandler) Close() {
+	for _, stream := range h.GetStreams() {
+		stream.Close()
+	}
+	for _, player := range h.getVODPlayers() {
+		player.Close()
+	}
+}
+
+//Shutdown 关闭所有的流和点播，并等待释放完成，ctx结束时返回ctx.Err()
+func (h *StreamHandler) Shutdown(ctx context.Context) error {
+	streams := h.GetStreams()
+	players := h.getVODPlayers()
+	for _, stream := range streams {
+		stream.Close()
+	}
+	for _, player := range players {
+		player.Close()
+	}
+	for _, stream := range streams {
+		select {
+		case <-stream.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, player := range players {
+		select {
+		case <-player.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+//AddObserver 添加一个流事件的观察者
+func (h *StreamHandler) AddObserver(o StreamObserver) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.observers = append(h.observers, o)
+}
+
+func (h *StreamHandler) notify(typ StreamEventType, info StreamInfo, remoteAddr, reason string) {
+	h.mutex.Lock()
+	observers := h.observers
+	h.mutex.Unlock()
+	notifyObservers(observers, typ, info, remoteAddr, reason)
+}
+
+func notifyObservers(observers []StreamObserver, typ StreamEventType, info StreamInfo, remoteAddr, reason string) {
+	if len(observers) == 0 {
+		return
+	}
+	event := StreamEvent{
+		Type:       typ,
+		Info:       info,
+		RemoteAddr: remoteAddr,
+		Reason:     reason,
+		Time:       time.Now(),
+	}
+	for _, o := range observers {
+		o.OnStreamEvent(event)
+	}
+}
+
+//SetAuthenticator 设置推流和拉流的鉴权，为nil时不鉴权
+func (h *StreamHandler) SetAuthenticator(auth Authenticator) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.auth = auth
+}
+
+//Authenticate 对连接进行鉴权，可以作为core.ForwardConnect的AuthFunc
+func (h *StreamHandler) Authenticate(conn *core.ForwardConnect) error {
+	return h.AuthenticateInfo(NewAuthInfo(conn))
+}
+
+//AuthenticateInfo 使用设置的Authenticator鉴权，http-flv等不是rtmp连接的播放端使用
+func (h *StreamHandler) AuthenticateInfo(info AuthInfo) error {
+	h.mutex.Lock()
+	auth := h.auth
+	h.mutex.Unlock()
+	if auth == nil {
+		return nil
+	}
+	return auth.Authenticate(info)
+}
+
+//SetCachePolicy 设置app的gop缓存策略，app为空时作为没有单独设置的app的默认策略，
+//只对之后创建的流生效
+func (h *StreamHandler) SetCachePolicy(app string, policy cache.Policy) {
+	h.policyMutex.Lock()
+	defer h.policyMutex.Unlock()
+	h.cachePolicies[app] = policy
+}
+
+//返回app的gop缓存策略，没有设置时使用cache.DefaultPolicy
+func (h *StreamHandler) cachePolicy(app string) cache.Policy {
+	h.policyMutex.Lock()
+	defer h.policyMutex.Unlock()
+	if policy, ok := h.cachePolicies[app]; ok {
+		return policy
+	}
+	if policy, ok := h.cachePolicies[""]; ok {
+		return policy
+	}
+	return cache.DefaultPolicy
+}
+
+//SetSlowConsumerPolicy 设置rtmp播放端发送跟不上时的处理方式，只对之后加入的播放端生效
+func (h *StreamHandler) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.slowPolicy = policy
+}
+
+//SetVODResolver 设置点播文件的查找方式，为nil时不支持点播
+func (h *StreamHandler) SetVODResolver(r VODResolver) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.vod = r
+}
+
+//查找播放请求对应的录制文件，同名的直播流正在发布时优先播放直播
+func (h *StreamHandler) resolveVOD(info StreamInfo) string {
+	h.mutex.Lock()
+	vod := h.vod
+	stream := h.streams[fmt.Sprintf("%s_%s", info.App, info.Name)]
+	h.mutex.Unlock()
+	if vod == nil || (stream != nil && stream.GetReader() != nil) {
+		return ""
+	}
+	return vod.Resolve(info)
+}
+
+//IsRecorded 播放请求是否对应录制文件，可以作为core.ForwardConnect的RecordedFunc
+func (h *StreamHandler) IsRecorded(conn *core.ForwardConnect) bool {
+	app, name, url := conn.GetStreamInfo()
+	return h.resolveVOD(StreamInfo{App: app, Name: name, URL: url}) != ""
+}
+
+//开始点播，点播不创建RtmpStream，每个连接单独读取文件
+func (h *StreamHandler) handleVOD(conn *core.ForwardConnect, info StreamInfo) error {
+	path := h.resolveVOD(info)
+	if path == "" {
+		return fmt.Errorf("record file of %s/%s not found", info.App, info.Name)
+	}
+	player, err := NewVODPlayer(conn, info, path, h.logger)
+	if err != nil {
+		return fmt.Errorf("NewVODPlayer failed, %v", err)
+	}
+	h.mutex.Lock()
+	h.vods[player] = struct{}{}
+	h.mutex.Unlock()
+
+	h.logger.Infof("Start vod, app:%s name:%s file:%s remote:%s", info.App, info.Name, path,
+		player.RemoteAddr())
+	h.notify(EventPlay, info, player.RemoteAddr(), "")
+	go func() {
+		reason := "player closed"
+		if err := player.Play(); err != nil {
+			reason = err.Error()
+		}
+		h.mutex.Lock()
+		delete(h.vods, player)
+		h.mutex.Unlock()
+		h.logger.Infof("Stop vod, app:%s name:%s remote:%s, %s", info.App, info.Name,
+			player.RemoteAddr(), reason)
+		h.notify(EventStop, info, player.RemoteAddr(), reason)
+	}()
+	return nil
+}
+
+//AddWriterFactory 添加一个WriterFactory，之后发布的流都会通过它创建写对象
+func (h *StreamHandler) AddWriterFactory(f WriterFactory) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.factories = append(h.factories, f)
+}
+
+//为流添加WriterFactory创建的写对象，每个流只添加一次
+func (h *StreamHandler) attachWriters(stream *RtmpStream) {
+	h.mutex.Lock()
+	if stream.attached {
+		h.mutex.Unlock()
+		return
+	}
+	stream.attached = true
+	factories := h.factories
+	h.mutex.Unlock()
+
+	for _, f := range factories {
+		w, err := f.NewWriter(stream.streamInfo)
+		if err != nil {
+			h.logger.Errorf("Create writer failed, app:%s name:%s %v", stream.streamInfo.App,
+				stream.streamInfo.Name, err)
+			continue
+		}
+		stream.AddWriter(w)
+	}
+}
+
+//AddTransformerFactory 添加一个TransformerFactory，多个Transformer按添加的顺序串联
+func (h *StreamHandler) AddTransformerFactory(f TransformerFactory) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.transformers = append(h.transformers, f)
+}
+
+//为发布端创建Transformer，每个发布端单独创建，重新推流时状态不会延续
+func (h *StreamHandler) newTransformers(info StreamInfo) []av.Transformer {
+	h.mutex.Lock()
+	factories := h.transformers
+	h.mutex.Unlock()
+
+	transformers := make([]av.Transformer, 0, len(factories))
+	for _, f := range factories {
+		t, err := f.NewTransformer(info)
+		if err != nil {
+			h.logger.Errorf("Create transformer failed, app:%s name:%s %v", info.App, info.Name, err)
+			continue
+		}
+		if t != nil {
+			transformers = append(transformers, t)
+		}
+	}
+	return transformers
+}
+
 // HandleConnect ...
 func (h *StreamHandler) HandleConnect(conn *core.ForwardConnect) error {
 	app, name, url := conn.GetStreamInfo()
@@ -70,14 +349,25 @@ func (h *StreamHandler) HandleConnect(conn *core.ForwardConnect) error {
 		URL:  url,
 	}
 
+	if !conn.IsPublisher() && conn.IsRecorded() {
+		return h.handleVOD(conn, streamInfo)
+	}
+
 	stream := h.getOrCreate(streamInfo)
 	if conn.IsPublisher() {
 		reader := NewStreamReader(conn, stream.ID(), h.logger)
 		if err := stream.AddReader(reader); err != nil {
 			return fmt.Errorf("Add stream reader failed, %v", err)
 		}
+		h.attachWriters(stream)
 	} else {
-		writer := NewStreamWriter(conn, stream.ID(), h.logger)
+		h.mutex.Lock()
+		policy := h.slowPolicy
+		h.mutex.Unlock()
+		writer := NewStreamWriter(conn, stream.ID(), policy, h.logger)
+		writer.OnLag(func(reason string) {
+			h.notify(EventPlayerLag, streamInfo, writer.RemoteAddr(), reason)
+		})
 		if err := stream.AddWriter(writer); err != nil {
 			return fmt.Errorf("Add stream writer failed, %v", err)
 		}
@@ -3,6 +3,8 @@ package protocol
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fabo871218/srtmp/av"
@@ -14,6 +16,7 @@ import (
 const (
 	maxQueueNum         = 1024
 	saveStaticsInterval = 5000
+	defaultLagThreshold = 3 * time.Second
 )
 
 // ReadCloser ...
@@ -31,6 +34,16 @@ type WriteCloser interface {
 	Write(*av.Packet) error
 }
 
+//queueSizer 写对象发送队列的长度，播放端加入时发送的缓存不超过队列长度，避免被丢弃
+type queueSizer interface {
+	QueueSize() int
+}
+
+//sharedWriter rtmp写对象实现该接口，发送时使用流循环共享的chunk编码
+type sharedWriter interface {
+	writeShared(p *av.Packet, chunks *sharedChunks) error
+}
+
 //StaticsBW todo comment
 type StaticsBW struct {
 	StreamID               uint32
@@ -45,28 +58,88 @@ type StaticsBW struct {
 	LastTimestamp int64
 }
 
+//Add 累加收发的字节数，每隔saveStaticsInterval毫秒更新一次速率，调用者负责加锁
+func (bw *StaticsBW) Add(streamid uint32, length uint64, isVideoFlag bool) {
+	nowInMS := int64(time.Now().UnixNano() / 1e6)
+	bw.StreamID = streamid
+	if isVideoFlag {
+		bw.VideoDatainBytes = bw.VideoDatainBytes + length
+	} else {
+		bw.AudioDatainBytes = bw.AudioDatainBytes + length
+	}
+
+	if bw.LastTimestamp == 0 {
+		bw.LastTimestamp = nowInMS
+	} else if (nowInMS - bw.LastTimestamp) >= saveStaticsInterval {
+		diffTimestamp := (nowInMS - bw.LastTimestamp) / 1000
+
+		bw.VideoSpeedInBytesperMS = (bw.VideoDatainBytes - bw.LastVideoDatainBytes) * 8 / uint64(diffTimestamp) / 1000
+		bw.AudioSpeedInBytesperMS = (bw.AudioDatainBytes - bw.LastAudioDatainBytes) * 8 / uint64(diffTimestamp) / 1000
+
+		bw.LastVideoDatainBytes = bw.VideoDatainBytes
+		bw.LastAudioDatainBytes = bw.AudioDatainBytes
+		bw.LastTimestamp = nowInMS
+	}
+}
+
+//BWStatics 发布端和播放端实现该接口时，统计接口会列出它的带宽信息
+type BWStatics interface {
+	URL() string
+	RemoteAddr() string
+	Statics() StaticsBW
+}
+
+//SlowConsumerStrategy 播放端发送队列满时丢弃数据的方式，音频和sequence header优先保留
+type SlowConsumerStrategy int
+
+const (
+	DropNonReference SlowConsumerStrategy = iota //先丢弃不被参考的视频帧，仍然不够时丢弃到下一个gop
+	DropToNextGop                                //丢弃队列中的视频，等待下一个关键帧
+)
+
+//SlowConsumerPolicy 播放端发送跟不上时的处理方式，发送队列中最早的数据包落后最新的数据包
+//超过LagThreshold时认为播放端落后，通知EventPlayerLag
+type SlowConsumerPolicy struct {
+	Strategy        SlowConsumerStrategy
+	LagThreshold    time.Duration //0表示使用默认值3秒
+	DisconnectAfter time.Duration //持续落后超过该时长时断开播放端，0表示不断开
+}
+
+//WriterQueueStats 播放端发送队列的状态
+type WriterQueueStats struct {
+	Depth        int    `json:"depth"`         //队列中的数据包个数
+	Lag          uint32 `json:"lag"`           //队列中最早的数据包落后的时长(毫秒)
+	DroppedVideo uint64 `json:"dropped_video"` //丢弃的视频帧个数
+	DroppedAudio uint64 `json:"dropped_audio"` //丢弃的音频帧个数
+	Lagging      uint64 `json:"lagging"`       //落后的次数
+}
+
 //StreamWriter 是代表rtmp连接的写入对象
 type StreamWriter struct {
 	av.RWBaser
-	streamID     string
-	closed       bool
-	keyframeNeed bool
-	conn         *core.ForwardConnect
-	packetQueue  chan *av.Packet
-	WriteBWInfo  StaticsBW
-	logger       logger.Logger
+	streamID    string
+	closed      int32 //在发送协程和流循环中访问，使用原子操作
+	closeOnce   sync.Once
+	conn        *core.ForwardConnect
+	queue       *gopQueue
+	onLag       func(reason string)
+	lastTs      uint32    //最后写入的音视频时间戳
+	lagSince    time.Time //开始落后的时间，没有落后时为零值
+	lagging     uint64
+	bwLock      sync.Mutex //WriteBWInfo在发送协程中更新，在http协程中读取
+	WriteBWInfo StaticsBW
+	logger      logger.Logger
 }
 
 //NewStreamWriter 创建一个新的写入对象
-func NewStreamWriter(conn *core.ForwardConnect, streamID string, log logger.Logger) *StreamWriter {
+func NewStreamWriter(conn *core.ForwardConnect, streamID string, policy SlowConsumerPolicy, log logger.Logger) *StreamWriter {
 	writer := &StreamWriter{
-		streamID:     streamID,
-		conn:         conn,
-		RWBaser:      av.NewRWBaser(time.Second * 10),
-		packetQueue:  make(chan *av.Packet, maxQueueNum),
-		WriteBWInfo:  StaticsBW{0, 0, 0, 0, 0, 0, 0, 0},
-		logger:       log,
-		keyframeNeed: true,
+		streamID:    streamID,
+		conn:        conn,
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		queue:       newGopQueue(maxQueueNum, policy),
+		WriteBWInfo: StaticsBW{0, 0, 0, 0, 0, 0, 0, 0},
+		logger:      log,
 	}
 
 	//todo 这个是否有必要先检查一下读写情况
@@ -76,136 +149,173 @@ func NewStreamWriter(conn *core.ForwardConnect, streamID string, log logger.Logg
 		if err != nil {
 			writer.logger.Errorf("SendPacket failed, %s", err.Error())
 		}
+		writer.conn.Close()
 	}()
 	return writer
 }
 
+//OnLag 设置播放端开始落后时的回调，在写入数据的协程中调用，需要在添加到流之前设置
+func (sw *StreamWriter) OnLag(f func(reason string)) {
+	sw.onLag = f
+}
+
 //SaveStatics 保存统计信息
 func (sw *StreamWriter) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
-	nowInMS := int64(time.Now().UnixNano() / 1e6)
-	sw.WriteBWInfo.StreamID = streamid
-	if isVideoFlag {
-		sw.WriteBWInfo.VideoDatainBytes = sw.WriteBWInfo.VideoDatainBytes + length
-	} else {
-		sw.WriteBWInfo.AudioDatainBytes = sw.WriteBWInfo.AudioDatainBytes + length
-	}
-
-	if sw.WriteBWInfo.LastTimestamp == 0 {
-		sw.WriteBWInfo.LastTimestamp = nowInMS
-	} else if (nowInMS - sw.WriteBWInfo.LastTimestamp) >= saveStaticsInterval {
-		diffTimestamp := (nowInMS - sw.WriteBWInfo.LastTimestamp) / 1000
-
-		sw.WriteBWInfo.VideoSpeedInBytesperMS = (sw.WriteBWInfo.VideoDatainBytes - sw.WriteBWInfo.LastVideoDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-		sw.WriteBWInfo.AudioSpeedInBytesperMS = (sw.WriteBWInfo.AudioDatainBytes - sw.WriteBWInfo.LastAudioDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-
-		sw.WriteBWInfo.LastVideoDatainBytes = sw.WriteBWInfo.VideoDatainBytes
-		sw.WriteBWInfo.LastAudioDatainBytes = sw.WriteBWInfo.AudioDatainBytes
-		sw.WriteBWInfo.LastTimestamp = nowInMS
-	}
+	sw.bwLock.Lock()
+	defer sw.bwLock.Unlock()
+	sw.WriteBWInfo.Add(streamid, length, isVideoFlag)
 }
 
 //Check 连接状态检测
 func (sw *StreamWriter) Check() {
 	for {
-		_, err := sw.conn.Read()
+		cs, err := sw.conn.Read()
 		if err != nil {
 			sw.Close()
 			return
 		}
+		cs.Release()
 	}
 }
 
-//Write ...
-func (sw *StreamWriter) Write(p *av.Packet) (err error) {
-	if sw.closed {
+//Write 写入数据包，队列满时按SlowConsumerPolicy丢弃数据，持续落后超过DisconnectAfter时返回错误
+func (sw *StreamWriter) Write(p *av.Packet) error {
+	return sw.writeShared(p, nil)
+}
+
+//writeShared 和Write相同，chunks为流循环创建的共享chunk编码，进入发送队列时增加数据包和chunk的引用，
+//发送或者丢弃之后释放
+func (sw *StreamWriter) writeShared(p *av.Packet, chunks *sharedChunks) (err error) {
+	if atomic.LoadInt32(&sw.closed) != 0 {
 		err = errors.New("PeerWriter closed")
 		return
 	}
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("Panic %v", e)
-		}
-	}()
 
-	if p.PacketType == av.PacketTypeVideo {
-		if sw.keyframeNeed {
-			if p.VHeader.FrameType != av.FRAME_KEY {
-				sw.logger.Warn("Key frame need.")
-				return
-			}
-			sw.keyframeNeed = false
-		}
+	if p.PacketType != av.PacketTypeMetadata {
+		atomic.StoreUint32(&sw.lastTs, p.TimeStamp)
+	}
+	if err = sw.checkLag(); err != nil {
+		return
 	}
 
-	select {
-	case sw.packetQueue <- p:
-	default:
-		if p.PacketType == av.PacketTypeVideo && p.VHeader.FrameType == av.FRAME_KEY {
-			sw.keyframeNeed = true
+	qp := queuedPacket{Packet: p, chunks: chunks}
+	qp.retain()
+	sw.queue.push(qp)
+	return
+}
+
+//checkLag 检查播放端是否落后，开始落后时通知一次，持续落后超过DisconnectAfter时返回错误
+func (sw *StreamWriter) checkLag() error {
+	n, lag := sw.queue.backlog(sw.lastTs)
+	threshold := sw.queue.policy.LagThreshold
+	if threshold <= 0 {
+		threshold = defaultLagThreshold
+	}
+	if time.Duration(lag)*time.Millisecond < threshold {
+		sw.lagSince = time.Time{}
+		return nil
+	}
+	if sw.lagSince.IsZero() {
+		sw.lagSince = time.Now()
+		atomic.AddUint64(&sw.lagging, 1)
+		reason := fmt.Sprintf("lag %dms, queue %d", lag, n)
+		sw.logger.Warnf("Player of stream %s falls behind, %s", sw.streamID, reason)
+		if sw.onLag != nil {
+			sw.onLag(reason)
 		}
-		sw.logger.Warn("packet droped...")
 	}
-	return
+	if sw.queue.policy.DisconnectAfter > 0 && time.Since(sw.lagSince) >= sw.queue.policy.DisconnectAfter {
+		return fmt.Errorf("player lagging for %v, lag %dms", sw.queue.policy.DisconnectAfter, lag)
+	}
+	return nil
+}
+
+//QueueStats 返回发送队列的状态
+func (sw *StreamWriter) QueueStats() WriterQueueStats {
+	n, lag := sw.queue.backlog(atomic.LoadUint32(&sw.lastTs))
+	return WriterQueueStats{
+		Depth:        n,
+		Lag:          lag,
+		DroppedVideo: atomic.LoadUint64(&sw.queue.droppedVideo),
+		DroppedAudio: atomic.LoadUint64(&sw.queue.droppedAudio),
+		Lagging:      atomic.LoadUint64(&sw.lagging),
+	}
+}
+
+//QueueSize 返回发送队列的长度
+func (sw *StreamWriter) QueueSize() int {
+	return sw.queue.size
 }
 
-//SendPacket todo comment
+//RetainsPackets 数据包在发送队列中时持有引用，发送或者丢弃之后释放
+func (sw *StreamWriter) RetainsPackets() {}
+
+//SendPacket 从队列中读取数据包发送，有共享的chunk编码时直接写入，不再重新编码
 func (sw *StreamWriter) SendPacket() error {
 	var cs core.ChunkStream
 	for {
-		p, ok := <-sw.packetQueue
-		if ok {
-			cs.Data = p.Data
-			cs.Length = uint32(len(p.Data))
-			cs.StreamID = p.StreamID
-			cs.Timestamp = p.TimeStamp
-			cs.Timestamp += sw.BaseTimeStamp()
-
-			isVideo := false
-			switch p.PacketType {
-			case av.PacketTypeVideo:
-				cs.TypeID = av.TAG_VIDEO
-				isVideo = true
-			case av.PacketTypeAudio:
-				cs.TypeID = av.TAG_AUDIO
-			case av.PacketTypeMetadata:
-				cs.TypeID = av.TAG_SCRIPTDATAAMF0
+		p, ok := sw.queue.pop()
+		if !ok {
+			//队列关闭，通知播放端流已经结束
+			if err := sw.conn.SendUnpublish(); err != nil {
+				sw.logger.Debugf("Send unpublish failed, %v", err)
 			}
-			sw.SaveStatics(p.StreamID, uint64(cs.Length), isVideo)
-			sw.SetPreTime()
-			sw.RecTimeStamp(cs.Timestamp, cs.TypeID)
-			err := sw.conn.Write(cs)
-			if err != nil {
-				sw.closed = true
-				return err
+			return errors.New("closed")
+		}
+
+		timestamp := p.TimeStamp + sw.BaseTimeStamp()
+		typeID := packetTypeID(p.Packet)
+		sw.SaveStatics(p.StreamID, uint64(len(p.Data)), typeID == av.TAG_VIDEO)
+		sw.SetPreTime()
+		sw.RecTimeStamp(timestamp, typeID)
+
+		var err error
+		if p.chunks != nil {
+			var b []byte
+			if b, err = p.chunks.chunks(sw.conn.ChunkSize(), timestamp); err == nil {
+				err = sw.conn.WriteChunks(b)
 			}
-			sw.conn.Flush()
 		} else {
-			return errors.New("closed")
+			cs.Data = p.Data
+			cs.Length = uint32(len(p.Data))
+			cs.StreamID = p.StreamID
+			cs.Timestamp = timestamp
+			cs.TypeID = typeID
+			err = sw.conn.Write(cs)
 		}
+		p.release()
+		if err != nil {
+			atomic.StoreInt32(&sw.closed, 1)
+			return err
+		}
+		sw.conn.Flush()
 	}
 }
 
-//StreamInfo todo comment
-// func (sw *StreamWriter) StreamInfo() (ret av.StreamInfo) {
-// 	ret.UID = sw.UID
-// 	_, _, URL := sw.conn.GetStreamInfo()
-// 	ret.URL = URL
-// 	_url, err := url.Parse(URL)
-// 	if err != nil {
-// 		fmt.Printf("Parse url failed, url:%s err:%v\n", URL, err)
-// 	}
-// 	ret.Key = strings.TrimLeft(_url.Path, "/")
-// 	ret.Inter = true
-// 	return
-// }
-
-//Close todo comment
+//URL 返回播放端请求的url
+func (sw *StreamWriter) URL() string {
+	_, _, url := sw.conn.GetStreamInfo()
+	return url
+}
+
+//RemoteAddr 返回播放端地址
+func (sw *StreamWriter) RemoteAddr() string {
+	return sw.conn.RemoteAddr()
+}
+
+//Statics 返回发送的带宽统计信息
+func (sw *StreamWriter) Statics() StaticsBW {
+	sw.bwLock.Lock()
+	defer sw.bwLock.Unlock()
+	return sw.WriteBWInfo
+}
+
+//Close 关闭写对象，发送协程会通知播放端流已经结束，然后关闭连接
 func (sw *StreamWriter) Close() {
-	if !sw.closed {
-		close(sw.packetQueue)
-	}
-	sw.closed = true
-	sw.conn.Close()
+	sw.closeOnce.Do(func() {
+		atomic.StoreInt32(&sw.closed, 1)
+		sw.queue.close()
+	})
 }
 
 //StreamReader todo comment
@@ -214,6 +324,7 @@ type StreamReader struct {
 	streamID   string
 	demuxer    *flv.Demuxer
 	conn       *core.ForwardConnect
+	bwLock     sync.Mutex //ReadBWInfo在读取协程中更新，在http协程中读取
 	ReadBWInfo StaticsBW
 	logger     logger.Logger
 }
@@ -232,28 +343,9 @@ func NewStreamReader(conn *core.ForwardConnect, streamID string, log logger.Logg
 
 //SaveStatics todo comment
 func (pr *StreamReader) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
-	nowInMS := int64(time.Now().UnixNano() / 1e6)
-
-	pr.ReadBWInfo.StreamID = streamid
-	if isVideoFlag {
-		pr.ReadBWInfo.VideoDatainBytes = pr.ReadBWInfo.VideoDatainBytes + length
-	} else {
-		pr.ReadBWInfo.AudioDatainBytes = pr.ReadBWInfo.AudioDatainBytes + length
-	}
-
-	if pr.ReadBWInfo.LastTimestamp == 0 {
-		pr.ReadBWInfo.LastTimestamp = nowInMS
-	} else if (nowInMS - pr.ReadBWInfo.LastTimestamp) >= saveStaticsInterval {
-		diffTimestamp := (nowInMS - pr.ReadBWInfo.LastTimestamp) / 1000
-
-		//glog.Infof("now=%d, last=%d, diff=%d", nowInMS, v.ReadBWInfo.LastTimestamp, diffTimestamp)
-		pr.ReadBWInfo.VideoSpeedInBytesperMS = (pr.ReadBWInfo.VideoDatainBytes - pr.ReadBWInfo.LastVideoDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-		pr.ReadBWInfo.AudioSpeedInBytesperMS = (pr.ReadBWInfo.AudioDatainBytes - pr.ReadBWInfo.LastAudioDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-
-		pr.ReadBWInfo.LastVideoDatainBytes = pr.ReadBWInfo.VideoDatainBytes
-		pr.ReadBWInfo.LastAudioDatainBytes = pr.ReadBWInfo.AudioDatainBytes
-		pr.ReadBWInfo.LastTimestamp = nowInMS
-	}
+	pr.bwLock.Lock()
+	defer pr.bwLock.Unlock()
+	pr.ReadBWInfo.Add(streamid, length, isVideoFlag)
 }
 
 func (pr *StreamReader) Read(p *av.Packet) (err error) {
@@ -276,6 +368,7 @@ func (pr *StreamReader) Read(p *av.Packet) (err error) {
 			cs.TypeID == av.TAG_SCRIPTDATAAMF3 {
 			break
 		}
+		cs.Release()
 	}
 
 	isVideo := false
@@ -291,24 +384,32 @@ func (pr *StreamReader) Read(p *av.Packet) (err error) {
 	p.StreamID = cs.StreamID
 	p.Data = cs.Data
 	p.TimeStamp = cs.Timestamp
+	//message的内存交给数据包，最后一个引用Release时归还
+	pool, buf := cs.TakeBuffer()
+	p.SetBuffer(pool, buf)
 
 	pr.SaveStatics(p.StreamID, uint64(len(p.Data)), isVideo)
 	pr.demuxer.DemuxH(p)
 	return err
 }
 
-//StreamInfo 返回信息
-// func (pr *StreamReader) StreamInfo() (ret av.StreamInfo) {
-// 	ret.UID = pr.UID
-// 	_, _, URL := pr.conn.GetStreamInfo()
-// 	ret.URL = URL
-// 	_url, err := url.Parse(URL)
-// 	if err != nil {
-// 		fmt.Printf("Parse url failed, url:%s err:%v\n", URL, err)
-// 	}
-// 	ret.Key = strings.TrimLeft(_url.Path, "/")
-// 	return
-// }
+//URL 返回发布端请求的url
+func (pr *StreamReader) URL() string {
+	_, _, url := pr.conn.GetStreamInfo()
+	return url
+}
+
+//RemoteAddr 返回发布端地址
+func (pr *StreamReader) RemoteAddr() string {
+	return pr.conn.RemoteAddr()
+}
+
+//Statics 返回接收的带宽统计信息
+func (pr *StreamReader) Statics() StaticsBW {
+	pr.bwLock.Lock()
+	defer pr.bwLock.Unlock()
+	return pr.ReadBWInfo
+}
 
 //Close 关闭读对象
 func (pr *StreamReader) Close() {
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestWriter 不启动发送协程，队列中的数据不会被取走
+func newTestWriter(size int, policy SlowConsumerPolicy) *StreamWriter {
+	return &StreamWriter{
+		queue:  newGopQueue(size, policy),
+		logger: logger.NewDefaultFactory().NewLogger(logger.LogLevelError),
+	}
+}
+
+func h264Packet(t *testing.T, ts uint32, frameType uint8, nalu byte) *av.Packet {
+	header := av.VideoPacketHeader{FrameType: frameType, CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_NALU}
+	data, err := flv.PackVideoData(&header, 0, []byte{0, 0, 0, 1, nalu, 0x9a, 0x02}, ts)
+	assert.NoError(t, err)
+	return &av.Packet{PacketType: av.PacketTypeVideo, TimeStamp: ts, VHeader: header, Data: data}
+}
+
+func queuedTimestamps(sw *StreamWriter) []uint32 {
+	ts := make([]uint32, 0, len(sw.queue.pkts))
+	for _, p := range sw.queue.pkts {
+		ts = append(ts, p.TimeStamp)
+	}
+	return ts
+}
+
+func TestStreamWriterDropNonReference(t *testing.T) {
+	sw := newTestWriter(4, SlowConsumerPolicy{Strategy: DropNonReference})
+	assert.Nil(t, sw.Write(h264Packet(t, 0, av.FRAME_KEY, 0x65)))
+	assert.Nil(t, sw.Write(h264Packet(t, 40, av.FRAME_INTER, 0x01)))
+	assert.Nil(t, sw.Write(h264Packet(t, 80, av.FRAME_INTER, 0x41)))
+	assert.Nil(t, sw.Write(audioPacket(90)))
+	//队列满时先丢弃不被参考的帧
+	assert.Nil(t, sw.Write(audioPacket(110)))
+	assert.Equal(t, []uint32{0, 80, 90, 110}, queuedTimestamps(sw))
+	//没有可以丢弃的帧时，丢弃到下一个gop，音频保留
+	assert.Nil(t, sw.Write(h264Packet(t, 120, av.FRAME_INTER, 0x41)))
+	assert.Equal(t, []uint32{90, 110}, queuedTimestamps(sw))
+	assert.Nil(t, sw.Write(h264Packet(t, 160, av.FRAME_INTER, 0x41)))
+	assert.Nil(t, sw.Write(audioPacket(130)))
+	assert.Nil(t, sw.Write(h264Packet(t, 200, av.FRAME_KEY, 0x65)))
+	assert.Equal(t, []uint32{90, 110, 130, 200}, queuedTimestamps(sw))
+
+	//sequence header不受队列长度限制
+	seq := h264Packet(t, 200, av.FRAME_KEY, 0x67)
+	seq.VHeader.AVCPacketType = av.AVC_SEQHDR
+	assert.Nil(t, sw.Write(seq))
+	assert.Equal(t, 5, len(sw.queue.pkts))
+
+	stats := sw.QueueStats()
+	assert.Equal(t, uint64(5), stats.DroppedVideo)
+	assert.Equal(t, uint64(0), stats.DroppedAudio)
+	assert.Equal(t, 5, stats.Depth)
+	assert.Equal(t, uint32(110), stats.Lag)
+}
+
+func TestStreamWriterDropAudio(t *testing.T) {
+	sw := newTestWriter(2, SlowConsumerPolicy{Strategy: DropToNextGop})
+	for i := uint32(0); i < 4; i++ {
+		assert.Nil(t, sw.Write(audioPacket(i*20)))
+	}
+	assert.Equal(t, []uint32{40, 60}, queuedTimestamps(sw))
+	assert.Equal(t, uint64(2), sw.QueueStats().DroppedAudio)
+}
+
+func TestStreamWriterLag(t *testing.T) {
+	var reasons []string
+	sw := newTestWriter(1024, SlowConsumerPolicy{LagThreshold: time.Second, DisconnectAfter: 50 * time.Millisecond})
+	sw.OnLag(func(reason string) {
+		reasons = append(reasons, reason)
+	})
+	for i := uint32(0); i <= 50; i++ {
+		assert.Nil(t, sw.Write(audioPacket(i*20)))
+	}
+	assert.Equal(t, []string{"lag 1000ms, queue 50"}, reasons)
+	assert.Nil(t, sw.Write(audioPacket(1020)))
+	assert.Equal(t, 1, len(reasons))
+	assert.Equal(t, uint64(1), sw.QueueStats().Lagging)
+
+	//持续落后超过DisconnectAfter时断开
+	time.Sleep(60 * time.Millisecond)
+	assert.NotNil(t, sw.Write(audioPacket(1040)))
+
+	//发送追上之后不再算落后
+	sw.queue.drop(func(p *av.Packet) bool { return p.TimeStamp < 1000 })
+	assert.Nil(t, sw.Write(audioPacket(1060)))
+	assert.Equal(t, uint32(60), sw.QueueStats().Lag)
+}
+
+func TestSharedChunks(t *testing.T) {
+	p := audioPacket(40)
+	p.Data = make([]byte, 300)
+	chunks := newSharedChunks(p)
+	b1, err := chunks.chunks(128, 40)
+	assert.Nil(t, err)
+	b2, _ := chunks.chunks(128, 40)
+	assert.Equal(t, &b1[0], &b2[0])
+	b3, _ := chunks.chunks(4096, 40)
+	assert.Equal(t, 12+300, len(b3))
+	assert.Equal(t, 12+300+2, len(b1))
+	_, _ = chunks.chunks(128, 1040)
+	assert.Equal(t, 3, len(chunks.encoded))
+
+	//进入发送队列时增加引用，丢弃时释放
+	sw := newTestWriter(1, SlowConsumerPolicy{Strategy: DropToNextGop})
+	assert.Nil(t, sw.writeShared(p, chunks))
+	assert.Equal(t, int32(2), chunks.refs)
+	assert.Nil(t, sw.writeShared(audioPacket(60), nil))
+	assert.Equal(t, int32(1), chunks.refs)
+	chunks.release()
+	assert.Equal(t, 0, len(chunks.encoded))
+}
+
+func TestStreamWriterClose(t *testing.T) {
+	sw := newTestWriter(1024, SlowConsumerPolicy{})
+	//流循环写入的同时在其他协程中关闭
+	done := make(chan struct{})
+	go func() {
+		sw.Close()
+		close(done)
+	}()
+	for i := uint32(0); i < 100; i++ {
+		sw.Write(audioPacket(i * 20))
+	}
+	<-done
+	assert.NotNil(t, sw.Write(audioPacket(2000)))
+}
+
+type countPool struct {
+	puts int
+}
+
+func (pool *countPool) Put(*[]byte) {
+	pool.puts++
+}
+
+func TestStreamWriterPacketBuffer(t *testing.T) {
+	pool := &countPool{}
+	p := audioPacket(40)
+	p.SetBuffer(pool, &p.Data)
+
+	//在发送队列中时持有引用，读取的引用释放后内存不归还
+	sw := newTestWriter(1, SlowConsumerPolicy{Strategy: DropToNextGop})
+	assert.Nil(t, sw.Write(p))
+	p.Release()
+	assert.Equal(t, 0, pool.puts)
+	//被丢弃后释放，内存归还
+	assert.Nil(t, sw.Write(audioPacket(60)))
+	assert.Equal(t, 1, pool.puts)
+}
+
+func BenchmarkSharedChunks(b *testing.B) {
+	p := videoPacket(0)
+	p.Data = make([]byte, 32*1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		chunks := newSharedChunks(p)
+		//100个播放端使用同一份编码
+		for j := 0; j < 100; j++ {
+			chunks.retain()
+			chunks.chunks(4096, uint32(i))
+			chunks.release()
+		}
+		chunks.release()
+	}
+}
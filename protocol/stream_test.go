@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+//chanReader 从channel中读取数据包，channel关闭后返回io.EOF
+type chanReader struct {
+	pkts chan *av.Packet
+}
+
+func (r *chanReader) Close()      {}
+func (r *chanReader) Alive() bool { return true }
+
+func (r *chanReader) Read(p *av.Packet) error {
+	pkt, ok := <-r.pkts
+	if !ok {
+		return io.EOF
+	}
+	*p = *pkt
+	return nil
+}
+
+func TestStreamKeepSeqHeader(t *testing.T) {
+	log := logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+	s := NewStream(StreamInfo{App: "live", Name: "test"}, NewStreamHandler(log), log)
+	reader := &chanReader{pkts: make(chan *av.Packet)}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.startRead(reader, stop, &wg)
+
+	audio := func(ts uint32) *av.Packet {
+		return &av.Packet{PacketType: av.PacketTypeAudio, TimeStamp: ts, Data: []byte{0x72, 0xd5},
+			AHeader: av.AudioPacketHeader{SoundFormat: av.SOUND_ALAW}}
+	}
+	seq := func(ts uint32) *av.Packet {
+		return &av.Packet{PacketType: av.PacketTypeVideo, TimeStamp: ts, Data: []byte{0x17, 0, 0, 0, 0, 1, 0x4d, 0, 0x1e},
+			VHeader: av.VideoPacketHeader{FrameType: av.FRAME_KEY, CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_SEQHDR}}
+	}
+
+	//流循环没有取走数据包，pktChan满了之后普通的帧被丢弃，sequence header等待
+	size := cap(s.pktChan)
+	for i := 0; i < size+4; i++ {
+		reader.pkts <- audio(uint32(i * 20))
+	}
+	reader.pkts <- seq(uint32((size + 4) * 20))
+	for i := 0; i < size; i++ {
+		p := <-s.pktChan
+		assert.Equal(t, uint32(av.PacketTypeAudio), p.PacketType)
+		assert.Equal(t, uint32(i*20), p.TimeStamp)
+	}
+	select {
+	case p := <-s.pktChan:
+		assert.True(t, p.IsHeader())
+	case <-time.After(time.Second):
+		t.Fatal("sequence header dropped")
+	}
+
+	//stop关闭后不再等待
+	for i := 0; i < size; i++ {
+		reader.pkts <- audio(uint32((size + 5 + i) * 20))
+	}
+	reader.pkts <- seq(uint32((2*size + 5) * 20))
+	close(stop)
+	close(reader.pkts)
+	wg.Wait()
+	assert.Equal(t, size, len(s.pktChan))
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"sync/atomic"
+
+	"github.com/fabo871218/srtmp/av"
+)
+
+const (
+	tsMaxJitter       = 500   //小于该值(毫秒)的回退认为是抖动，修正为和上一帧相同
+	tsMaxGap          = 10000 //相邻两帧间隔超过该值(毫秒)认为时间戳跳变
+	tsMaxDrift        = 2000  //音视频时间戳相差超过该值(毫秒)时，落后的一路向前对齐
+	tsDefaultDuration = 20    //还没有正常的帧间隔时，跳变后使用的帧间隔
+)
+
+//TimestampStats 时间戳修正的次数
+type TimestampStats struct {
+	Backward uint64 `json:"backward"` //时间戳大幅回退，重新对齐
+	Gap      uint64 `json:"gap"`      //时间戳大幅跳变，重新对齐
+	Jitter   uint64 `json:"jitter"`   //时间戳小幅回退，修正为单调递增
+	Drift    uint64 `json:"drift"`    //音视频时间戳相差过大，落后的一路向前对齐
+}
+
+//load 返回统计的快照，统计在读取协程中更新
+func (stats *TimestampStats) load() TimestampStats {
+	return TimestampStats{
+		Backward: atomic.LoadUint64(&stats.Backward),
+		Gap:      atomic.LoadUint64(&stats.Gap),
+		Jitter:   atomic.LoadUint64(&stats.Jitter),
+		Drift:    atomic.LoadUint64(&stats.Drift),
+	}
+}
+
+//trackTimestamp 一路音频或视频的时间戳状态，时间戳都展开成64位，避免32位回绕的影响
+type trackTimestamp struct {
+	started  bool
+	lastRaw  uint32 //上一帧的输入时间戳
+	lastIn   int64  //展开后的上一帧输入时间戳
+	lastOut  int64  //上一帧输出的时间戳
+	offset   int64  //输出时间戳 = 输入时间戳 + offset
+	duration int64  //最近一次正常的帧间隔
+}
+
+//timestampSanitizer 修正发布端的时间戳，保证每一路时间戳单调递增，
+//时间戳回退或者跳变时接着上一帧继续，音视频相差过大时对齐，
+//每个发布端创建一个，发布端替换后由写对象的BaseTimestamp保证递增
+type timestampSanitizer struct {
+	audio trackTimestamp
+	video trackTimestamp
+	stats *TimestampStats
+}
+
+func newTimestampSanitizer(stats *TimestampStats) *timestampSanitizer {
+	return &timestampSanitizer{
+		stats: stats,
+	}
+}
+
+//sanitize 修改p.TimeStamp，metadata不处理
+func (s *timestampSanitizer) sanitize(p *av.Packet) {
+	var track, other *trackTimestamp
+	var isSeqHeader bool
+	switch p.PacketType {
+	case av.PacketTypeVideo:
+		track, other = &s.video, &s.audio
+		isSeqHeader = p.VHeader.IsSeqHeader()
+	case av.PacketTypeAudio:
+		track, other = &s.audio, &s.video
+		isSeqHeader = p.AHeader.IsSeqHeader()
+	default:
+		return
+	}
+	//中途重发的sequence header时间戳经常为0，使用上一帧的时间戳
+	if isSeqHeader {
+		if track.started {
+			p.TimeStamp = uint32(track.lastOut)
+		}
+		return
+	}
+
+	var in int64
+	if !track.started {
+		in = int64(p.TimeStamp)
+		//使用另一路的修正量，之前的修正对两路同样有效
+		if other.started {
+			track.offset = other.offset
+		}
+		track.duration = tsDefaultDuration
+	} else {
+		delta := int64(int32(p.TimeStamp - track.lastRaw))
+		in = track.lastIn + delta
+		switch {
+		case delta < -tsMaxJitter || delta > tsMaxGap:
+			//编码器重启或者时间戳错乱，接着上一帧继续
+			if delta < 0 {
+				atomic.AddUint64(&s.stats.Backward, 1)
+			} else {
+				atomic.AddUint64(&s.stats.Gap, 1)
+			}
+			track.offset = track.lastOut + track.duration - in
+		case delta < 0:
+			atomic.AddUint64(&s.stats.Jitter, 1)
+		case delta > 0:
+			track.duration = delta
+		}
+	}
+	out := in + track.offset
+
+	//只把落后的一路向前对齐，保证时间戳不会回退，
+	//晚开始的一路(比如中途开启音频，时间戳从0开始)也会对齐到另一路
+	if other.started && out+tsMaxDrift < other.lastOut {
+		atomic.AddUint64(&s.stats.Drift, 1)
+		track.offset += other.lastOut - out
+		out = other.lastOut
+	}
+	if track.started && out < track.lastOut {
+		out = track.lastOut
+	}
+	if out < 0 {
+		out = 0
+	}
+
+	track.started = true
+	track.lastRaw = p.TimeStamp
+	track.lastIn = in
+	track.lastOut = out
+	p.TimeStamp = uint32(out)
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/stretchr/testify/assert"
+)
+
+func videoPacket(ts uint32) *av.Packet {
+	return &av.Packet{
+		PacketType: av.PacketTypeVideo,
+		TimeStamp:  ts,
+		VHeader:    av.VideoPacketHeader{CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_NALU},
+	}
+}
+
+func audioPacket(ts uint32) *av.Packet {
+	return &av.Packet{
+		PacketType: av.PacketTypeAudio,
+		TimeStamp:  ts,
+		AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_AAC, AACPacketType: av.AAC_RAW},
+	}
+}
+
+func sanitizeAll(s *timestampSanitizer, pkts ...*av.Packet) []uint32 {
+	out := make([]uint32, 0, len(pkts))
+	for _, p := range pkts {
+		s.sanitize(p)
+		out = append(out, p.TimeStamp)
+	}
+	return out
+}
+
+func TestTimestampSanitizerTrack(t *testing.T) {
+	var stats TimestampStats
+	s := newTimestampSanitizer(&stats)
+	//正常的时间戳不修改
+	assert.Equal(t, []uint32{1000, 1040, 1080}, sanitizeAll(s, videoPacket(1000), videoPacket(1040), videoPacket(1080)))
+	//小幅回退修正为和上一帧相同，之后恢复
+	assert.Equal(t, []uint32{1080, 1120}, sanitizeAll(s, videoPacket(1070), videoPacket(1120)))
+	//编码器重启，接着上一帧按最近的帧间隔继续
+	assert.Equal(t, []uint32{1170, 1210}, sanitizeAll(s, videoPacket(0), videoPacket(40)))
+	//大幅跳变
+	assert.Equal(t, []uint32{1250, 1290}, sanitizeAll(s, videoPacket(3600040), videoPacket(3600080)))
+	//中途重发的sequence header
+	seq := videoPacket(0)
+	seq.VHeader.FrameType = av.FRAME_KEY
+	seq.VHeader.AVCPacketType = av.AVC_SEQHDR
+	assert.Equal(t, []uint32{1290, 1330}, sanitizeAll(s, seq, videoPacket(3600120)))
+	assert.Equal(t, TimestampStats{Backward: 1, Gap: 1, Jitter: 1}, stats.load())
+
+	//32位回绕不算跳变
+	stats = TimestampStats{}
+	s = newTimestampSanitizer(&stats)
+	assert.Equal(t, []uint32{0xffffffd8, 0, 40}, sanitizeAll(s, videoPacket(0xffffffd8), videoPacket(0), videoPacket(40)))
+	assert.Equal(t, TimestampStats{}, stats.load())
+}
+
+func TestTimestampSanitizerDrift(t *testing.T) {
+	var stats TimestampStats
+	s := newTimestampSanitizer(&stats)
+	assert.Equal(t, []uint32{10000, 10000, 10040, 10023},
+		sanitizeAll(s, videoPacket(10000), audioPacket(10000), videoPacket(10040), audioPacket(10023)))
+
+	//音频时间戳重启，视频正常，音频接着上一帧继续
+	assert.Equal(t, []uint32{10080, 10046}, sanitizeAll(s, videoPacket(10080), audioPacket(5)))
+	assert.Equal(t, uint64(1), stats.load().Backward)
+
+	//音频落后超过2秒，向前对齐到视频
+	assert.Equal(t, []uint32{15000, 15000, 15040, 15023},
+		sanitizeAll(s, videoPacket(15000), audioPacket(28), videoPacket(15040), audioPacket(51)))
+	assert.Equal(t, uint64(1), stats.load().Drift)
+
+	//中途开始的音频，时间戳从0开始
+	s = newTimestampSanitizer(&stats)
+	assert.Equal(t, []uint32{60000, 60040, 60040, 60080, 60063},
+		sanitizeAll(s, videoPacket(60000), videoPacket(60040), audioPacket(0), videoPacket(60080), audioPacket(23)))
+	assert.Equal(t, uint64(2), stats.load().Drift)
+}
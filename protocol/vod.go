@@ -0,0 +1,339 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol/core"
+)
+
+//提前发送的数据时长，让播放端有一定的缓冲
+const vodBufferTime = time.Millisecond * 500
+
+//VODResolver 根据播放请求查找录制文件，返回空字符串表示不是点播
+type VODResolver interface {
+	Resolve(info StreamInfo) string
+}
+
+//VODResolverFunc 函数形式的VODResolver
+type VODResolverFunc func(info StreamInfo) string
+
+//Resolve 实现VODResolver
+func (f VODResolverFunc) Resolve(info StreamInfo) string {
+	return f(info)
+}
+
+//NewDirResolver 在dir目录下查找录制文件，播放rtmp://host/app/name时对应的文件为
+//dir/app/name，name没有.flv后缀时会自动加上
+func NewDirResolver(dir string) VODResolver {
+	return VODResolverFunc(func(info StreamInfo) string {
+		name := info.Name
+		if !strings.HasSuffix(name, ".flv") {
+			name += ".flv"
+		}
+		path := filepath.Join(dir, info.App, name)
+		//防止通过..访问dir之外的文件
+		if rel, err := filepath.Rel(dir, path); err != nil || strings.HasPrefix(rel, "..") {
+			return ""
+		}
+		if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+			return ""
+		}
+		return path
+	})
+}
+
+//VODPlayer 按照实时速度向播放端发送录制文件，支持seek、pause、receiveAudio和receiveVideo
+type VODPlayer struct {
+	conn      *core.ForwardConnect
+	info      StreamInfo
+	reader    *flv.FileReader
+	closeOnce sync.Once
+	closeChan chan struct{}
+	doneChan  chan struct{}
+	logger    logger.Logger
+
+	//以下字段只在Play中使用
+	metadata *av.Packet
+	videoSeq *av.Packet
+	audioSeq *av.Packet
+	pending  *av.Packet
+	started  bool
+	paused   bool
+	eof      bool
+	noAudio  bool
+	noVideo  bool
+	keyNeed  bool
+	baseTs   uint32    //baseTime时对应的文件时间戳
+	baseTime time.Time //开始按照实时速度发送的时间
+	lastTs   uint32
+}
+
+//NewVODPlayer 打开录制文件，创建一个点播对象
+func NewVODPlayer(conn *core.ForwardConnect, info StreamInfo, path string, log logger.Logger) (*VODPlayer, error) {
+	reader, err := flv.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &VODPlayer{
+		conn:      conn,
+		info:      info,
+		reader:    reader,
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+		logger:    log,
+	}, nil
+}
+
+//RemoteAddr 返回播放端地址
+func (p *VODPlayer) RemoteAddr() string {
+	return p.conn.RemoteAddr()
+}
+
+//Close 停止播放，可以多次调用
+func (p *VODPlayer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+		p.conn.Close()
+	})
+}
+
+//Done 返回一个channel，Play返回后会被关闭
+func (p *VODPlayer) Done() <-chan struct{} {
+	return p.doneChan
+}
+
+//Play 发送录制文件，直到连接断开或者调用Close，返回后连接和文件都已经关闭
+//文件播放完成后不会断开连接，播放端仍然可以seek
+func (p *VODPlayer) Play() error {
+	defer close(p.doneChan)
+	defer p.reader.Close()
+	defer p.Close()
+
+	cmdChan := make(chan core.PlayCommand)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			cmd, err := p.conn.ReadPlayCommand()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			select {
+			case cmdChan <- cmd:
+			case <-p.closeChan:
+				return
+			}
+		}
+	}()
+
+	p.baseTime = time.Now()
+	for {
+		var wait time.Duration = -1
+		if !p.paused && !p.eof {
+			if p.pending == nil {
+				if err := p.readPacket(); err != nil {
+					return err
+				}
+				continue
+			}
+			wait = p.waitTime(p.pending.TimeStamp)
+			if wait == 0 {
+				select {
+				case cmd := <-cmdChan:
+					if err := p.handleCommand(cmd); err != nil {
+						return err
+					}
+				case err := <-errChan:
+					return err
+				case <-p.closeChan:
+					return nil
+				default:
+					if err := p.sendPacket(p.pending); err != nil {
+						return err
+					}
+					p.pending = nil
+				}
+				continue
+			}
+		}
+
+		//暂停或者播放完成时只等待命令
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		var err error
+		select {
+		case cmd := <-cmdChan:
+			err = p.handleCommand(cmd)
+		case err = <-errChan:
+		case <-p.closeChan:
+			return nil
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//waitTime 返回距离发送时间戳为ts的数据包还需要等待的时间，已经到了发送时间时返回0，
+//seek之后交错的音频时间戳可能小于baseTs，需要按有符号数计算
+func (p *VODPlayer) waitTime(ts uint32) time.Duration {
+	offset := time.Duration(int64(ts)-int64(p.baseTs)) * time.Millisecond
+	wait := p.baseTime.Add(offset).Sub(time.Now()) - vodBufferTime
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+//读取下一个数据包，文件结束时通知播放端
+func (p *VODPlayer) readPacket() error {
+	pkt := &av.Packet{}
+	if err := p.reader.Read(pkt); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("read file failed, %v", err)
+		}
+		p.eof = true
+		p.logger.Infof("VOD %s/%s play complete, remote:%s", p.info.App, p.info.Name, p.RemoteAddr())
+		return p.conn.SendPlayComplete()
+	}
+
+	switch pkt.PacketType {
+	case av.PacketTypeMetadata:
+		p.metadata = pkt
+	case av.PacketTypeVideo:
+		if pkt.VHeader.IsSeqHeader() {
+			p.videoSeq = pkt
+		}
+	case av.PacketTypeAudio:
+		if pkt.AHeader.IsSeqHeader() {
+			p.audioSeq = pkt
+		}
+	}
+	if !p.started {
+		//第一个数据包的时间戳可能不是0
+		p.started = true
+		p.baseTs = pkt.TimeStamp
+	}
+	p.pending = pkt
+	return nil
+}
+
+func (p *VODPlayer) sendPacket(pkt *av.Packet) error {
+	isSeqHeader := pkt == p.videoSeq || pkt == p.audioSeq || pkt == p.metadata
+	switch pkt.PacketType {
+	case av.PacketTypeAudio:
+		if p.noAudio && !isSeqHeader {
+			return nil
+		}
+	case av.PacketTypeVideo:
+		if !isSeqHeader {
+			if p.noVideo {
+				return nil
+			}
+			if p.keyNeed {
+				if pkt.VHeader.FrameType != av.FRAME_KEY {
+					return nil
+				}
+				p.keyNeed = false
+			}
+		}
+	}
+
+	var typeID uint32
+	switch pkt.PacketType {
+	case av.PacketTypeVideo:
+		typeID = av.TAG_VIDEO
+	case av.PacketTypeAudio:
+		typeID = av.TAG_AUDIO
+	default:
+		typeID = av.TAG_SCRIPTDATAAMF0
+	}
+	cs := core.ChunkStream{
+		Data:      pkt.Data,
+		Length:    uint32(len(pkt.Data)),
+		StreamID:  p.conn.StreamID(),
+		Timestamp: pkt.TimeStamp,
+		TypeID:    typeID,
+	}
+	if err := p.conn.Write(cs); err != nil {
+		return fmt.Errorf("write packet failed, %v", err)
+	}
+	p.lastTs = pkt.TimeStamp
+	return p.conn.Flush()
+}
+
+//重新发送sequence header，时间戳使用timestamp
+func (p *VODPlayer) sendSeqHeaders(timestamp uint32) error {
+	for _, pkt := range []*av.Packet{p.metadata, p.videoSeq, p.audioSeq} {
+		if pkt == nil {
+			continue
+		}
+		seq := *pkt
+		seq.TimeStamp = timestamp
+		if err := p.sendPacket(&seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *VODPlayer) handleCommand(cmd core.PlayCommand) error {
+	p.logger.Debugf("VOD %s/%s receive command:%+v", p.info.App, p.info.Name, cmd)
+	switch cmd.Name {
+	case "seek":
+		ts, err := p.reader.Seek(cmd.Time)
+		if err != nil {
+			p.logger.Warnf("VOD %s/%s seek to %d failed, %v", p.info.App, p.info.Name, cmd.Time, err)
+			return p.conn.SendSeekFailed(err)
+		}
+		p.pending = nil
+		p.eof = false
+		p.baseTs = ts
+		p.baseTime = time.Now()
+		if err := p.conn.SendSeekNotify(ts); err != nil {
+			return err
+		}
+		return p.sendSeqHeaders(ts)
+	case "pause":
+		if cmd.Pause == p.paused {
+			return p.conn.SendPauseNotify(cmd.Pause)
+		}
+		p.paused = cmd.Pause
+		if !p.paused {
+			//从暂停的位置继续按照实时速度发送
+			p.baseTs = p.lastTs
+			if p.pending != nil {
+				p.baseTs = p.pending.TimeStamp
+			}
+			p.baseTime = time.Now()
+		}
+		return p.conn.SendPauseNotify(cmd.Pause)
+	case "receiveAudio":
+		p.noAudio = !cmd.Enable
+	case "receiveVideo":
+		if p.noVideo && cmd.Enable {
+			p.keyNeed = true
+		}
+		p.noVideo = !cmd.Enable
+	default:
+		p.logger.Warnf("VOD %s/%s unsupport command:%s", p.info.App, p.info.Name, cmd.Name)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package srtmp
+
+import (
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+)
+
+//recorderFactory 为每个发布的流创建flv录制对象
+type recorderFactory struct {
+	cfg    flv.RecorderConfig
+	logger logger.Logger
+}
+
+//NewWriter 实现protocol.WriterFactory
+func (f *recorderFactory) NewWriter(info protocol.StreamInfo) (protocol.WriteCloser, error) {
+	return flv.NewRecorder(f.cfg, info.App, info.Name, f.logger), nil
+}
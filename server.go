@@ -1,21 +1,31 @@
 package srtmp
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/fabo871218/srtmp/logger"
 	"github.com/fabo871218/srtmp/protocol"
 	"github.com/fabo871218/srtmp/protocol/core"
-	"registry.code.tuya-inc.top/TuyaBEMiddleWare/golib/golog"
 )
 
-//Server rtmpfuwu
+//ErrServerClosed Server调用Shutdown或者Close后，Serve和ServeTLS返回该错误
+var ErrServerClosed = errors.New("rtmp: Server closed")
+
+//Server rtmp服务
 type Server struct {
-	handler *protocol.StreamHandler
-	logger  logger.Logger
+	handler    *protocol.StreamHandler
+	logger     logger.Logger
+	mutex      sync.Mutex
+	inShutdown bool
+	listeners  map[net.Listener]struct{}
+	conns      map[*core.RtmpConn]struct{} //还未建立play或者publish的连接
+	wg         sync.WaitGroup
 }
 
 //NewRtmpServer 创建一个rtmp服务
@@ -26,23 +36,51 @@ func NewRtmpServer(h *protocol.StreamHandler, log logger.Logger) *Server {
 	}
 }
 
-//Serve 启动rtmp监听服务
-func (s *Server) Serve(listenAddr string) (err error) {
+//Serve 启动rtmp监听服务，Shutdown或Close之后返回ErrServerClosed
+func (s *Server) Serve(listenAddr string) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("net.Listen failed, %v", err)
+	}
+	s.logger.Infof("Start rtmp server, listen on:%s", listenAddr)
+	return s.serve(listener)
+}
+
+//ServeTLS 启动监听rtmp tls连接，Shutdown或Close之后返回ErrServerClosed
+func (s *Server) ServeTLS(listenAddr string, tlsCrt, tlsKey string) error {
+	cert, err := tls.LoadX509KeyPair(tlsCrt, tlsKey)
+	if err != nil {
+		return fmt.Errorf("tls.LoadX509KeyPair failed, %s", err.Error())
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	listener, err := tls.Listen("tcp", listenAddr, config)
+	if err != nil {
+		return fmt.Errorf("Listen rtmp tls failed, %s", err.Error())
+	}
+	s.logger.Infof("Start rtmps server, listen on:%s", listenAddr)
+	return s.serve(listener)
+}
+
+func (s *Server) serve(listener net.Listener) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			s.logger.Errorf("rtmp server panic:%v", r)
 		}
 	}()
-	var listener net.Listener
-	listener, err = net.Listen("tcp", listenAddr)
-	if err != nil {
-		err = fmt.Errorf("net.Listen failed, %v", err)
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
 	}
-	s.logger.Infof("Start rtmp server, listen on:%s", listenAddr)
+	defer s.trackListener(listener, false)
+
 	for {
 		var netconn net.Conn
 		netconn, err = listener.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				//如果时临时错误，sleep一段时间继续
 				s.logger.Warn("Accept failed, temporary error, try again...")
@@ -50,62 +88,107 @@ func (s *Server) Serve(listenAddr string) (err error) {
 				continue
 			}
 			s.logger.Errorf("Accept failed, err:%s", err.Error())
-			return
+			return fmt.Errorf("Accept failed, %s", err.Error())
 		}
 		rtmpConn := core.NewRtmpConn(netconn, 4*1024)
 		s.logger.Infof("New rtmp connect, remote:%s local:%s",
 			rtmpConn.RemoteAddr().String(), rtmpConn.LocalAddr().String())
+		if !s.trackConn(rtmpConn, true) {
+			rtmpConn.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
 		go s.handleConn(rtmpConn)
 	}
 }
 
-//ServeTLS 启动监听rtmp tls连接
-func (s *Server) ServeTLS(listenAddr string, tlsCrt, tlsKey string) error {
-	defer func() {
-		if r := recover(); r != nil {
-			s.logger.Errorf("rtmps server panic:%v", r)
-		}
+//Shutdown 停止接受新的连接，通知所有播放端流已经结束，关闭所有的流并等待处理协程退出，
+//ctx结束时返回ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListenersAndConns()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.handler.Shutdown(ctx)
+}
 
-	cert, err := tls.LoadX509KeyPair(tlsCrt, tlsKey)
-	if err != nil {
-		return fmt.Errorf("tls.LoadX509KeyPair failed, %s", err.Error())
+//Close 立即关闭所有的监听和流，不等待处理协程退出
+func (s *Server) Close() error {
+	s.closeListenersAndConns()
+	s.handler.Close()
+	return nil
+}
+
+func (s *Server) closeListenersAndConns() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inShutdown = true
+	for l := range s.listeners {
+		l.Close()
 	}
+	for c := range s.conns {
+		c.Close()
+	}
+}
 
-	var listener net.Listener
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
-	listener, err = tls.Listen("tcp", listenAddr, config)
-	if err != nil {
-		golog.Error("Listen rtsp tls failed.", golog.String("err", err.Error()))
-		return fmt.Errorf("Listen rtsp tls failed, %s", err.Error())
+func (s *Server) shuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inShutdown
+}
+
+//添加或者删除listener，服务已经关闭时返回false
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
 	}
+	return true
+}
 
-	s.logger.Infof("Start rtmps server, listen on:%s", listenAddr)
-	for {
-		var netconn net.Conn
-		netconn, err = listener.Accept()
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				//如果时临时错误，sleep一段时间继续
-				s.logger.Warn("Accept failed, temporary error, try again...")
-				time.Sleep(time.Millisecond * 100)
-				continue
-			}
-			return fmt.Errorf("Accept failed, %s", err.Error())
+//添加或者删除还未建立play或者publish的连接，服务已经关闭时返回false
+func (s *Server) trackConn(c *core.RtmpConn, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*core.RtmpConn]struct{})
+	}
+	if add {
+		if s.inShutdown {
+			return false
 		}
-		rtmpConn := core.NewRtmpConn(netconn, 4*1024)
-		s.logger.Infof("New rtmp connect, remote:%s local:%s",
-			rtmpConn.RemoteAddr().String(), rtmpConn.LocalAddr().String())
-		go s.handleConn(rtmpConn)
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
 	}
+	return true
 }
 
 func (s *Server) handleConn(rtmpConn *core.RtmpConn) {
 	var err error
 	defer func() {
+		s.trackConn(rtmpConn, false)
 		if err != nil {
 			rtmpConn.Close()
 		}
+		s.wg.Done()
 	}()
 
 	if err = rtmpConn.HandshakeServer(); err != nil {
@@ -114,10 +197,16 @@ func (s *Server) handleConn(rtmpConn *core.RtmpConn) {
 	}
 	//创建一个服务端连接
 	forwardConn := core.NewForwardConnect(rtmpConn, s.logger)
+	forwardConn.SetAuthFunc(s.handler.Authenticate)
+	forwardConn.SetRecordedFunc(s.handler.IsRecorded)
 	if err = forwardConn.SetUpPlayOrPublish(); err != nil {
 		s.logger.Errorf("SetUpPlayOrPublish failed, %s", err.Error())
 		return
 	}
+	if s.shuttingDown() {
+		err = ErrServerClosed
+		return
+	}
 	//根据appname判断流是否存在
 	//如果是publish，如果对应的流已经存在，则关闭，重新创建
 	//如果是play，如果对应的流不存在，返回错误
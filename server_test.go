@@ -0,0 +1,764 @@
+package srtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/httpopera"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/media/aac"
+	"github.com/fabo871218/srtmp/media/g711"
+	"github.com/fabo871218/srtmp/media/opus"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/fabo871218/srtmp/protocol/amf"
+	"github.com/fabo871218/srtmp/protocol/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestServeListenError(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	err := api.ServeRtmp("invalid-address")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrServerClosed, err)
+}
+
+func TestServerShutdown(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addr := freeAddr(t)
+	server := api.NewRtmpServer()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(addr)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/test"))
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeVideo,
+		Data:       []byte{0, 0, 0, 1, 0x65, 1, 2, 3},
+		VHeader:    av.VideoPacketHeader{CodecID: av.VIDEO_H264, AVCPacketType: av.AVC_NALU},
+	}))
+
+	//播放端记录收到的onStatus，连接断开时关闭codes
+	player := core.NewConnClient(api.logger)
+	assert.Nil(t, player.Start("rtmp://"+addr+"/live/test", av.PLAY))
+	defer player.Close()
+	codes := make(chan string, 16)
+	go func() {
+		defer close(codes)
+		for {
+			cs, err := player.Read()
+			if err != nil {
+				return
+			}
+			if cs.TypeID != 20 {
+				continue
+			}
+			vs, _ := player.DecodeBatch(bytes.NewReader(cs.Data), amf.AMF0)
+			for _, v := range vs {
+				if obj, ok := v.(amf.Object); ok && obj["code"] != nil {
+					codes <- obj["code"].(string)
+				}
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, len(api.handler.GetStreams()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+	assert.Equal(t, 0, len(api.handler.GetStreams()))
+
+	//停止发布的通知之后断开连接
+	var unpublished bool
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case code, ok := <-codes:
+			if !ok {
+				closed = true
+				break
+			}
+			if code == "NetStream.Play.UnpublishNotify" {
+				unpublished = true
+			}
+		case <-timeout:
+			t.Fatal("player not closed after shutdown")
+		}
+	}
+	assert.True(t, unpublished)
+
+	//关闭之后可以在同一个地址上重新启动
+	l, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	l.Close()
+}
+
+//TestLiveStatDuringPublish 推流和播放的同时读取带宽统计，需要用-race运行
+func TestAPIShutdownHTTPServices(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	serveErr := make(chan error, len(addrs))
+	go func() { serveErr <- api.ServeHLS(addrs[0]) }()
+	go func() { serveErr <- api.ServeHTTPFlv(addrs[1]) }()
+	go func() { serveErr <- api.ServeHTTPOpera(addrs[2], "127.0.0.1:1935") }()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, api.Shutdown(ctx))
+	for range addrs {
+		select {
+		case err := <-serveErr:
+			assert.Equal(t, http.ErrServerClosed, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("http service not closed after shutdown")
+		}
+	}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		assert.Nil(t, err)
+		l.Close()
+	}
+}
+
+func TestLiveStatDuringPublish(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addr, httpAddr := freeAddr(t), freeAddr(t)
+	go api.ServeRtmp(addr)
+	go api.ServeHTTPFlv(httpAddr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/stat"))
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/live/stat", func(*av.Packet) {}, nil))
+	//http-flv播放端也要列出
+	resp, err := http.Get("http://" + httpAddr + "/live/stat.flv")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	go io.Copy(ioutil.Discard, resp.Body)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			publisher.SendPacket(&av.Packet{
+				PacketType: av.PacketTypeAudio,
+				TimeStamp:  uint32(i * 20),
+				Data:       []byte{0xd5, 0x55, 0xd5, 0x55},
+				AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_ALAW, SoundType: av.SOUND_MONO},
+			})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	opera := httpopera.NewServer(api.handler, addr, api.logger)
+	var stat struct {
+		Publishers []struct {
+			AudioTotalBytes uint64 `json:"audio_total_bytes"`
+		} `json:"publishers"`
+		Players []struct {
+			RemoteAddr      string `json:"remote_addr"`
+			AudioTotalBytes uint64 `json:"audio_total_bytes"`
+		} `json:"players"`
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		rec := httptest.NewRecorder()
+		opera.GetLiveStatics(rec, httptest.NewRequest("GET", "/stat/livestat", nil))
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &stat))
+	}
+	time.Sleep(100 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	opera.GetLiveStatics(rec, httptest.NewRequest("GET", "/stat/livestat", nil))
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &stat))
+	assert.Equal(t, 1, len(stat.Publishers))
+	assert.Equal(t, 2, len(stat.Players))
+	assert.NotZero(t, stat.Publishers[0].AudioTotalBytes)
+	for _, p := range stat.Players {
+		assert.NotEqual(t, "", p.RemoteAddr)
+		assert.NotZero(t, p.AudioTotalBytes)
+	}
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	infos := make(chan protocol.AuthInfo, 4)
+	auth := protocol.AuthenticatorFunc(func(info protocol.AuthInfo) error {
+		infos <- info
+		if info.IsPublish && info.Query != "token=abc" {
+			return errors.New("invalid token")
+		}
+		if !info.IsPublish && info.Name == "private" {
+			return errors.New("play not allowed")
+		}
+		return nil
+	})
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithAuthenticator(auth))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.NotNil(t, publisher.OpenPublish("rtmp://"+addr+"/live/test?token=bad"))
+	info := <-infos
+	assert.True(t, info.IsPublish)
+	assert.Equal(t, "live", info.ConnInfo.App)
+	assert.Equal(t, "test", info.Name)
+	assert.Equal(t, "token=bad", info.Query)
+	assert.NotEqual(t, "", info.RemoteAddr)
+
+	publisher = api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/test?token=abc"))
+	<-infos
+	time.Sleep(100 * time.Millisecond)
+	assert.NotNil(t, api.handler.GetStream("live", "test"))
+
+	player := api.NewRtmpClient()
+	assert.NotNil(t, player.OpenPlay("rtmp://"+addr+"/live/private", func(*av.Packet) {}, nil))
+	info = <-infos
+	assert.False(t, info.IsPublish)
+	assert.Equal(t, "private", info.Name)
+}
+
+func TestHTTPFlvAuthenticator(t *testing.T) {
+	infos := make(chan protocol.AuthInfo, 4)
+	auth := protocol.AuthenticatorFunc(func(info protocol.AuthInfo) error {
+		if info.IsPublish {
+			return nil
+		}
+		infos <- info
+		if info.Query != "token=abc" {
+			return errors.New("invalid token")
+		}
+		return nil
+	})
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithAuthenticator(auth))
+	addr, httpAddr := freeAddr(t), freeAddr(t)
+	go api.ServeRtmp(addr)
+	go api.ServeHTTPFlv(httpAddr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/test"))
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://" + httpAddr + "/live/test.flv?token=bad")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	info := <-infos
+	assert.Equal(t, "live", info.ConnInfo.App)
+	assert.Equal(t, "test", info.Name)
+	assert.Equal(t, "token=bad", info.Query)
+	assert.NotEqual(t, "", info.RemoteAddr)
+
+	resp, err = http.Get("http://" + httpAddr + "/live/test.flv?token=abc")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	header := make([]byte, 3)
+	_, err = io.ReadFull(resp.Body, header)
+	assert.Nil(t, err)
+	assert.Equal(t, "FLV", string(header))
+	assert.Equal(t, "token=abc", (<-infos).Query)
+}
+
+func TestConnectFourCcList(t *testing.T) {
+	infos := make(chan protocol.AuthInfo, 1)
+	auth := protocol.AuthenticatorFunc(func(info protocol.AuthInfo) error {
+		infos <- info
+		return nil
+	})
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithAuthenticator(auth))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := core.NewConnClient(api.logger)
+	assert.Nil(t, conn.Start("rtmp://"+addr+"/live/test", av.PUBLISH))
+	defer conn.Close()
+	assert.Equal(t, av.FourCCList, conn.FourCcList())
+	info := <-infos
+	assert.Equal(t, av.FourCCList, info.ConnInfo.FourCcList)
+}
+
+func TestStreamObserver(t *testing.T) {
+	events := make(chan protocol.StreamEvent, 16)
+	observer := protocol.StreamObserverFunc(func(e protocol.StreamEvent) {
+		events <- e
+	})
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithStreamObserver(observer))
+	addr := freeAddr(t)
+	server := api.NewRtmpServer()
+	go server.Serve(addr)
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/test"))
+	e := <-events
+	assert.Equal(t, protocol.EventStreamCreate, e.Type)
+	assert.Equal(t, "live", e.Info.App)
+	assert.Equal(t, "test", e.Info.Name)
+	e = <-events
+	assert.Equal(t, protocol.EventPublish, e.Type)
+	assert.NotEqual(t, "", e.RemoteAddr)
+
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/live/test", func(*av.Packet) {}, nil))
+	e = <-events
+	assert.Equal(t, protocol.EventPlay, e.Type)
+	assert.NotEqual(t, "", e.RemoteAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+
+	got := make(map[protocol.StreamEventType]protocol.StreamEvent)
+	for len(got) < 3 {
+		select {
+		case e = <-events:
+			got[e.Type] = e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing events, got:%v", got)
+		}
+	}
+	assert.Equal(t, "stream closed", got[protocol.EventUnpublish].Reason)
+	assert.Equal(t, "stream closed", got[protocol.EventStop].Reason)
+	assert.Equal(t, "stream closed", got[protocol.EventStreamClose].Reason)
+}
+
+func TestHEVCRelay(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	vps := []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90,
+		0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	sps := []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93,
+		0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00, 0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98, 0x04}
+	pps := []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	idr := []byte{0x26, 0x01, 0xaf, 0x09}
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/hevc"))
+	var frame []byte
+	for _, nalu := range [][]byte{vps, sps, pps, idr} {
+		frame = append(append(frame, 0, 0, 0, 1), nalu...)
+	}
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeVideo,
+		Data:       frame,
+		VHeader:    av.VideoPacketHeader{CodecID: av.VIDEO_HEVC, AVCPacketType: av.AVC_NALU},
+	}))
+
+	//后加入的播放端先收到sequence header中的参数集
+	received := make(chan []byte, 16)
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/live/hevc", func(p *av.Packet) {
+		if p.PacketType == av.PacketTypeVideo && p.VHeader.CodecID == av.VIDEO_HEVC {
+			received <- append([]byte{}, p.Data...)
+		}
+	}, nil))
+	for _, expect := range [][]byte{vps, sps, pps} {
+		select {
+		case data := <-received:
+			assert.Equal(t, expect, data)
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait parameter sets timeout")
+		}
+	}
+}
+
+func TestVP9Relay(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	//profile 0，bt709，1280x720的关键帧
+	keyFrame := []byte{0x82, 0x49, 0x83, 0x42, 0x40, 0x4f, 0xf0, 0x2c, 0xf0}
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/vp9"))
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeVideo,
+		Data:       keyFrame,
+		VHeader:    av.VideoPacketHeader{CodecID: av.VIDEO_VP9},
+	}))
+
+	//后加入的播放端先收到vpcC，之后的帧整帧转发
+	received := make(chan *av.Packet, 16)
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/live/vp9", func(p *av.Packet) {
+		if p.PacketType == av.PacketTypeVideo {
+			pkt := *p
+			pkt.Data = append([]byte{}, p.Data...)
+			received <- &pkt
+		}
+	}, nil))
+	select {
+	case p := <-received:
+		assert.Equal(t, uint8(av.VIDEO_VP9), p.VHeader.CodecID)
+		assert.True(t, p.VHeader.IsSeqHeader())
+		assert.Equal(t, []byte{0x01, 0x00, 0x00, 0x00, 0x00, 31, 0x80, 0x01, 0x01, 0x01, 0x00, 0x00}, p.Data)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait vpcC timeout")
+	}
+
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeVideo,
+		Data:       keyFrame,
+		TimeStamp:  40,
+		VHeader:    av.VideoPacketHeader{CodecID: av.VIDEO_VP9},
+	}))
+	select {
+	case p := <-received:
+		assert.True(t, p.VHeader.IsExHeader)
+		assert.False(t, p.VHeader.IsSeqHeader())
+		assert.Equal(t, uint8(av.FRAME_KEY), p.VHeader.FrameType)
+		assert.Equal(t, keyFrame, p.Data)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait vp9 frame timeout")
+	}
+}
+
+func TestOpusRelay(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	//没有提供OpusHead时，按SoundType生成
+	frame := []byte{0xfc, 0xff, 0xfe}
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/opus"))
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeAudio,
+		Data:       frame,
+		AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_OPUS, SoundType: av.SOUND_MONO},
+	}))
+
+	received := make(chan *av.Packet, 16)
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/live/opus", func(p *av.Packet) {
+		if p.PacketType == av.PacketTypeAudio {
+			pkt := *p
+			pkt.Data = append([]byte{}, p.Data...)
+			received <- &pkt
+		}
+	}, nil))
+	select {
+	case p := <-received:
+		assert.Equal(t, uint8(av.SOUND_OPUS), p.AHeader.SoundFormat)
+		assert.True(t, p.AHeader.IsSeqHeader())
+		assert.Equal(t, opus.NewHead(1, opus.SampleRate, opus.DefaultPreSkip), p.Data)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait opus head timeout")
+	}
+
+	//第一帧被缓存，后加入的播放端也能收到
+	select {
+	case p := <-received:
+		assert.False(t, p.AHeader.IsSeqHeader())
+		assert.Equal(t, uint32(0), p.TimeStamp)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait cached opus frame timeout")
+	}
+
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeAudio,
+		Data:       frame,
+		TimeStamp:  20,
+		AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_OPUS},
+	}))
+	select {
+	case p := <-received:
+		assert.True(t, p.AHeader.IsExHeader)
+		assert.False(t, p.AHeader.IsSeqHeader())
+		assert.Equal(t, uint32(20), p.TimeStamp)
+		assert.Equal(t, frame, p.Data)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait opus frame timeout")
+	}
+}
+
+func TestG711Relay(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/live/g711"))
+	received := make(chan *av.Packet, 16)
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/live/g711", func(p *av.Packet) {
+		if p.PacketType == av.PacketTypeAudio {
+			pkt := *p
+			pkt.Data = append([]byte{}, p.Data...)
+			received <- &pkt
+		}
+	}, nil))
+	time.Sleep(100 * time.Millisecond)
+
+	//g711没有sequence header，直接转发
+	samples := []byte{0xd5, 0x55, 0xd5, 0x55}
+	assert.Nil(t, publisher.SendPacket(&av.Packet{
+		PacketType: av.PacketTypeAudio,
+		Data:       samples,
+		TimeStamp:  40,
+		AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_ALAW, SoundType: av.SOUND_MONO},
+	}))
+	select {
+	case p := <-received:
+		assert.Equal(t, uint8(av.SOUND_ALAW), p.AHeader.SoundFormat)
+		assert.Equal(t, uint8(av.SOUND_16BIT), p.AHeader.SoundSize)
+		assert.Equal(t, uint32(40), p.TimeStamp)
+		assert.Equal(t, samples, p.Data)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait g711 frame timeout")
+	}
+}
+
+func TestG711ToAACRelay(t *testing.T) {
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithG711ToAAC("transcode"))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := api.NewRtmpClient()
+	assert.Nil(t, publisher.OpenPublish("rtmp://"+addr+"/transcode/g711"))
+	received := make(chan *av.Packet, 16)
+	player := api.NewRtmpClient()
+	assert.Nil(t, player.OpenPlay("rtmp://"+addr+"/transcode/g711", func(p *av.Packet) {
+		if p.PacketType == av.PacketTypeAudio {
+			pkt := *p
+			pkt.Data = append([]byte{}, p.Data...)
+			received <- &pkt
+		}
+	}, nil))
+	time.Sleep(100 * time.Millisecond)
+
+	//每个包1024个采样，编码器有一帧的延迟，第二个包之后才有aac输出
+	samples := make([]byte, 1024)
+	for i := range samples {
+		samples[i] = g711.PCMToALaw(int16(4000 * math.Sin(2*math.Pi*500*float64(i)/8000)))
+	}
+	for ts := uint32(0); ts < 3*128; ts += 128 {
+		assert.Nil(t, publisher.SendPacket(&av.Packet{
+			PacketType: av.PacketTypeAudio,
+			Data:       samples,
+			TimeStamp:  ts,
+			AHeader:    av.AudioPacketHeader{SoundFormat: av.SOUND_ALAW, SoundType: av.SOUND_MONO},
+		}))
+	}
+	for i, ts := range []uint32{0, 0, 128} {
+		select {
+		case p := <-received:
+			assert.Equal(t, uint8(av.SOUND_AAC), p.AHeader.SoundFormat)
+			assert.Equal(t, ts, p.TimeStamp)
+			if i == 0 {
+				assert.Equal(t, uint8(av.AAC_SEQHDR), p.AHeader.AACPacketType)
+				assert.Equal(t, aac.SpecificConfig(2, 11, 1), p.Data)
+			} else {
+				assert.Equal(t, uint8(av.AAC_RAW), p.AHeader.AACPacketType)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait aac frame timeout")
+		}
+	}
+}
+
+//播放端收到的消息
+type vodMsg struct {
+	code string //onStatus或者onPlayStatus中的code
+	ts   uint32
+	key  bool
+	seq  bool
+}
+
+func TestVODPlayback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "vod"), 0755))
+	file, err := os.Create(filepath.Join(dir, "vod", "movie.flv"))
+	assert.Nil(t, err)
+	flv.WriteHeader(file)
+	flv.WriteTag(file, av.TAG_VIDEO, 0, []byte{0x17, av.AVC_SEQHDR, 0, 0, 0, 1, 0x4d, 0, 0x1e})
+	//3秒的视频，每秒一个关键帧
+	for ts := uint32(0); ts < 3000; ts += 100 {
+		frameType := byte(0x27)
+		if ts%1000 == 0 {
+			frameType = 0x17
+		}
+		flv.WriteTag(file, av.TAG_VIDEO, ts, []byte{frameType, av.AVC_NALU, 0, 0, 0, 0, 0, 0, 1, 0x41})
+	}
+	file.Close()
+
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithVOD(dir))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := core.NewConnClient(api.logger)
+	assert.Nil(t, conn.Start("rtmp://"+addr+"/vod/movie", av.PLAY))
+	defer conn.Close()
+	msgs, next := readVODMessages(t, conn)
+	isCode := func(code string) func(m vodMsg) bool {
+		return func(m vodMsg) bool { return m.code == code }
+	}
+
+	//录制文件不发送PublishNotify
+	assert.Equal(t, "NetStream.Play.Start", next(func(m vodMsg) bool { return m.code != "" }).code)
+	assert.Equal(t, "NetStream.Data.Start", next(func(m vodMsg) bool { return m.code != "" }).code)
+	assert.True(t, next(func(m vodMsg) bool { return m.code == "" }).seq)
+
+	//按照实时速度发送
+	start := time.Now()
+	m := next(func(m vodMsg) bool { return m.ts >= 1000 })
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.True(t, m.key)
+
+	//seek到之前最近的关键帧
+	assert.Nil(t, conn.Seek(2500))
+	next(isCode("NetStream.Seek.Notify"))
+	next(isCode("NetStream.Play.Start"))
+	assert.True(t, next(func(m vodMsg) bool { return m.code == "" }).seq)
+	m = next(func(m vodMsg) bool { return m.code == "" })
+	assert.Equal(t, uint32(2000), m.ts)
+	assert.True(t, m.key)
+
+	//暂停期间不发送数据
+	assert.Nil(t, conn.Pause(true, 2000))
+	next(isCode("NetStream.Pause.Notify"))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, len(msgs))
+	assert.Nil(t, conn.Pause(false, 2000))
+	assert.Equal(t, "NetStream.Unpause.Notify", next(func(m vodMsg) bool { return true }).code)
+
+	next(isCode("NetStream.Play.Complete"))
+	next(isCode("NetStream.Play.Stop"))
+}
+
+func TestVODSeekInterleavedAudio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "vod"), 0755))
+	file, err := os.Create(filepath.Join(dir, "vod", "movie.flv"))
+	assert.Nil(t, err)
+	flv.WriteHeader(file)
+	flv.WriteTag(file, av.TAG_VIDEO, 0, []byte{0x17, av.AVC_SEQHDR, 0, 0, 0, 1, 0x4d, 0, 0x1e})
+	//每个视频帧之后是时间戳比它小的音频帧，seek到关键帧之后先读到更早的音频
+	for ts := uint32(0); ts < 3000; ts += 100 {
+		frameType := byte(0x27)
+		if ts%1000 == 0 {
+			frameType = 0x17
+		}
+		flv.WriteTag(file, av.TAG_VIDEO, ts, []byte{frameType, av.AVC_NALU, 0, 0, 0, 0, 0, 0, 1, 0x41})
+		if ts > 0 {
+			flv.WriteTag(file, av.TAG_AUDIO, ts-10, []byte{0x72, 0xd5, 0xd5})
+		}
+	}
+	file.Close()
+
+	api := NewAPI(WithLogLevel(logger.LogLevelError), WithVOD(dir))
+	addr := freeAddr(t)
+	go api.ServeRtmp(addr)
+	defer api.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := core.NewConnClient(api.logger)
+	assert.Nil(t, conn.Start("rtmp://"+addr+"/vod/movie", av.PLAY))
+	defer conn.Close()
+	_, next := readVODMessages(t, conn)
+	next(func(m vodMsg) bool { return m.code == "NetStream.Play.Start" })
+
+	//seek之后继续按照实时速度发送，不会因为更早的音频时间戳停住
+	assert.Nil(t, conn.Seek(2000))
+	next(func(m vodMsg) bool { return m.code == "NetStream.Seek.Notify" })
+	assert.Equal(t, uint32(2000), next(func(m vodMsg) bool { return m.code == "" && !m.seq }).ts)
+	assert.Equal(t, uint32(2100), next(func(m vodMsg) bool { return m.code == "" && !m.seq }).ts)
+}
+
+//readVODMessages 在协程中读取播放端收到的消息，返回的next等待下一个满足cond的消息
+func readVODMessages(t *testing.T, conn *core.ConnClient) (chan vodMsg, func(cond func(m vodMsg) bool) vodMsg) {
+	msgs := make(chan vodMsg, 64)
+	go func() {
+		defer close(msgs)
+		for {
+			cs, err := conn.Read()
+			if err != nil {
+				return
+			}
+			switch cs.TypeID {
+			case av.TAG_VIDEO:
+				msgs <- vodMsg{ts: cs.Timestamp, key: cs.Data[0]>>4 == av.FRAME_KEY, seq: cs.Data[1] == av.AVC_SEQHDR}
+			case av.TAG_SCRIPTDATAAMF0, 20:
+				vs, _ := conn.DecodeBatch(bytes.NewReader(cs.Data), amf.AMF0)
+				for _, v := range vs {
+					if obj, ok := v.(amf.Object); ok && obj["code"] != nil {
+						msgs <- vodMsg{code: obj["code"].(string)}
+					}
+				}
+			}
+		}
+	}()
+	next := func(cond func(m vodMsg) bool) vodMsg {
+		for {
+			select {
+			case m, ok := <-msgs:
+				if !ok {
+					t.Fatal("connection closed")
+				}
+				if cond(m) {
+					return m
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("wait message timeout")
+			}
+		}
+	}
+	return msgs, next
+}
@@ -1,6 +1,12 @@
 package srtmp
 
-import "github.com/fabo871218/srtmp/logger"
+import (
+	"github.com/fabo871218/srtmp/container/flv"
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/fabo871218/srtmp/protocol/cache"
+	"github.com/fabo871218/srtmp/webhook"
+)
 
 //SettingFunc ...
 type SettingFunc func(*SettingEngine)
@@ -9,6 +15,14 @@ type SettingFunc func(*SettingEngine)
 type SettingEngine struct {
 	loggerFactory logger.LoggerFactory
 	logLevel      logger.LogLevel
+	authenticator protocol.Authenticator
+	observers     []protocol.StreamObserver
+	webhook       *webhook.Config
+	recorder      *flv.RecorderConfig
+	vodDir        string
+	g711ToAAC     []string
+	cachePolicies map[string]cache.Policy
+	slowPolicy    *protocol.SlowConsumerPolicy
 }
 
 //WithLoggerFactory 设置日志创建类
@@ -24,3 +38,67 @@ func WithLogLevel(v logger.LogLevel) SettingFunc {
 		setting.logLevel = v
 	}
 }
+
+//WithAuthenticator 设置推流和拉流的鉴权
+func WithAuthenticator(v protocol.Authenticator) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.authenticator = v
+	}
+}
+
+//WithStreamObserver 添加流事件的观察者，可以多次设置
+func WithStreamObserver(v protocol.StreamObserver) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.observers = append(setting.observers, v)
+	}
+}
+
+//WithWebhook 设置webhook，推流、播放以及结束时向配置的url发送POST请求，
+//on_publish和on_play返回非2xx时拒绝该请求
+func WithWebhook(v webhook.Config) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.webhook = &v
+	}
+}
+
+//WithRecorder 开启录制，发布的流会按照配置录制成flv文件
+func WithRecorder(v flv.RecorderConfig) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.recorder = &v
+	}
+}
+
+//WithVOD 开启点播，播放rtmp://host/app/name时，如果没有同名的直播流，会播放dir/app/name.flv
+func WithVOD(dir string) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.vodDir = dir
+	}
+}
+
+//WithG711ToAAC 指定的app发布的g711音频会被转码成aac，hls等不支持g711的播放端也可以播放，可以多次设置。
+//转码使用aac.Encoder，输出8kHz单声道、不超过32kbps的aac-lc，没有心理声学模型，
+//音质只适合语音，并且有一帧(1024个采样)的延迟，参考aac.Encoder的限制
+func WithG711ToAAC(apps ...string) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.g711ToAAC = append(setting.g711ToAAC, apps...)
+	}
+}
+
+//WithCachePolicy 设置app的gop缓存策略，app为空时作为所有app的默认策略，可以多次设置，
+//没有设置时缓存1个gop，后加入的播放端从缓存的关键帧开始播放，policy.Join可以选择从最新的关键帧开始或者等待下一个关键帧
+func WithCachePolicy(app string, policy cache.Policy) SettingFunc {
+	return func(setting *SettingEngine) {
+		if setting.cachePolicies == nil {
+			setting.cachePolicies = make(map[string]cache.Policy)
+		}
+		setting.cachePolicies[app] = policy
+	}
+}
+
+//WithSlowConsumerPolicy 设置rtmp播放端发送跟不上时的处理方式，默认先丢弃不被参考的视频帧，
+//不会断开播放端，播放端开始落后时通知protocol.EventPlayerLag
+func WithSlowConsumerPolicy(v protocol.SlowConsumerPolicy) SettingFunc {
+	return func(setting *SettingEngine) {
+		setting.slowPolicy = &v
+	}
+}
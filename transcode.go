@@ -0,0 +1,28 @@
+package srtmp
+
+import (
+	"github.com/fabo871218/srtmp/av"
+	"github.com/fabo871218/srtmp/media/transcode"
+	"github.com/fabo871218/srtmp/protocol"
+)
+
+//g711TranscoderFactory 为配置的app创建g711转aac的Transformer
+type g711TranscoderFactory struct {
+	apps map[string]struct{}
+}
+
+func newG711TranscoderFactory(apps []string) *g711TranscoderFactory {
+	f := &g711TranscoderFactory{apps: make(map[string]struct{}, len(apps))}
+	for _, app := range apps {
+		f.apps[app] = struct{}{}
+	}
+	return f
+}
+
+//NewTransformer 实现protocol.TransformerFactory，没有配置的app返回nil
+func (f *g711TranscoderFactory) NewTransformer(info protocol.StreamInfo) (av.Transformer, error) {
+	if _, ok := f.apps[info.App]; !ok {
+		return nil, nil
+	}
+	return transcode.NewG711ToAAC(), nil
+}
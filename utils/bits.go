@@ -0,0 +1,132 @@
+package utils
+
+import "errors"
+
+//ErrBitsOverflow 读取的位数超过了数据长度
+var ErrBitsOverflow = errors.New("bits overflow")
+
+//BitReader 按位读取数据，读越界后记录错误，之后的读取都返回0
+type BitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+//NewBitReader ...
+func NewBitReader(data []byte) *BitReader {
+	return &BitReader{data: data}
+}
+
+//ReadBits 读取n位，n最大为32
+func (br *BitReader) ReadBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if br.pos >= len(br.data)*8 {
+			br.err = ErrBitsOverflow
+			return 0
+		}
+		bit := (br.data[br.pos/8] >> uint(7-br.pos%8)) & 0x01
+		v = v<<1 | uint32(bit)
+		br.pos++
+	}
+	return v
+}
+
+//ReadFlag 读取1位，返回是否为1
+func (br *BitReader) ReadFlag() bool {
+	return br.ReadBits(1) == 1
+}
+
+//Skip 跳过n位
+func (br *BitReader) Skip(n int) {
+	br.pos += n
+	if br.pos > len(br.data)*8 {
+		br.err = ErrBitsOverflow
+	}
+}
+
+//ReadUE 读取指数哥伦布编码的无符号数
+func (br *BitReader) ReadUE() uint32 {
+	zeros := 0
+	for br.ReadBits(1) == 0 {
+		if br.err != nil || zeros >= 31 {
+			br.err = ErrBitsOverflow
+			return 0
+		}
+		zeros++
+	}
+	return (1<<uint(zeros) - 1) + br.ReadBits(zeros)
+}
+
+//ReadSE 读取指数哥伦布编码的有符号数
+func (br *BitReader) ReadSE() int32 {
+	v := br.ReadUE()
+	if v&0x01 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+//Pos 已经读取的位数
+func (br *BitReader) Pos() int {
+	return br.pos
+}
+
+//Err 读取过程中是否越界
+func (br *BitReader) Err() error {
+	return br.err
+}
+
+//BitWriter 按位写入数据，高位在前
+type BitWriter struct {
+	data []byte
+	pos  int
+}
+
+//NewBitWriter ...
+func NewBitWriter(capacity int) *BitWriter {
+	return &BitWriter{data: make([]byte, 0, capacity)}
+}
+
+//WriteBits 写入v的低n位，n最大为32
+func (bw *BitWriter) WriteBits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bw.pos%8 == 0 {
+			bw.data = append(bw.data, 0)
+		}
+		if (v>>uint(i))&0x01 == 1 {
+			bw.data[bw.pos/8] |= 1 << uint(7-bw.pos%8)
+		}
+		bw.pos++
+	}
+}
+
+//WriteFlag 写入1位
+func (bw *BitWriter) WriteFlag(b bool) {
+	if b {
+		bw.WriteBits(1, 1)
+	} else {
+		bw.WriteBits(0, 1)
+	}
+}
+
+//Pos 已经写入的位数
+func (bw *BitWriter) Pos() int {
+	return bw.pos
+}
+
+//WriteUE 写入指数哥伦布编码的无符号数
+func (bw *BitWriter) WriteUE(v uint32) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	bw.WriteBits(0, n)
+	bw.WriteBits(v, n+1)
+}
+
+//Bytes 返回写入的数据，最后一个字节不足8位时低位补0
+func (bw *BitWriter) Bytes() []byte {
+	return bw.data
+}
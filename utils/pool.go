@@ -1,24 +1,56 @@
 package utils
 
+import (
+	"sync"
+)
+
+const (
+	minPoolShift = 7  //最小的内存块128字节
+	maxPoolShift = 22 //最大的内存块4M，更大的直接分配，不放回
+)
+
+//Pool 按2的幂次分级的内存池，Get返回的内存用完后通过Put归还，
+//没有归还的内存由gc回收，归还之后不能再访问
 type Pool struct {
-	pos int
-	buf []byte
+	classes [maxPoolShift - minPoolShift + 1]sync.Pool
 }
 
-const maxpoolsize = 50 * 1024
+//NewPool ...
+func NewPool() *Pool {
+	return &Pool{}
+}
 
-func (pool *Pool) Get(size int) []byte {
-	if maxpoolsize-pool.pos < size {
-		pool.pos = 0
-		pool.buf = make([]byte, maxpoolsize)
+//poolClass 返回能容纳size的最小级别，超过最大的级别时返回-1
+func poolClass(size int) int {
+	for i := 0; i <= maxPoolShift-minPoolShift; i++ {
+		if size <= 1<<uint(i+minPoolShift) {
+			return i
+		}
 	}
-	b := pool.buf[pool.pos : pool.pos+size]
-	pool.pos += size
-	return b
+	return -1
 }
 
-func NewPool() *Pool {
-	return &Pool{
-		buf: make([]byte, maxpoolsize),
+//Get 返回长度为size的内存，内容是之前使用时留下的，需要调用者覆盖
+func (pool *Pool) Get(size int) *[]byte {
+	class := poolClass(size)
+	if class < 0 {
+		b := make([]byte, size)
+		return &b
+	}
+	if v := pool.classes[class].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<uint(class+minPoolShift))
+	return &b
+}
+
+//Put 归还Get返回的内存，不是Get分配的内存会被忽略
+func (pool *Pool) Put(b *[]byte) {
+	class := poolClass(cap(*b))
+	if class < 0 || cap(*b) != 1<<uint(class+minPoolShift) {
+		return
 	}
+	pool.classes[class].Put(b)
 }
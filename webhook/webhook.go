@@ -0,0 +1,284 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+)
+
+const (
+	defaultTimeout       = 3 * time.Second
+	defaultRetryInterval = 500 * time.Millisecond
+	maxQueueNum          = 256
+)
+
+//Config webhook配置，url为空时不发送对应的事件
+type Config struct {
+	OnPublish   string //推流时调用，返回非2xx时拒绝推流
+	OnUnpublish string //推流结束时调用
+	OnPlay      string //播放时调用，返回非2xx时拒绝播放
+	OnStop      string //播放结束时调用
+
+	Timeout       time.Duration //每次请求的超时时间，默认3秒
+	Retries       int           //失败后的重试次数，on_publish和on_play只在请求出错时重试，非2xx不重试
+	RetryInterval time.Duration //重试间隔，默认500毫秒
+}
+
+//Event 发送给webhook的json内容
+type Event struct {
+	Action     string `json:"action"`
+	App        string `json:"app"`
+	Name       string `json:"name"`
+	URL        string `json:"url,omitempty"`
+	TcURL      string `json:"tc_url,omitempty"`
+	PageURL    string `json:"page_url,omitempty"`
+	Query      string `json:"query,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Time       int64  `json:"time"`
+}
+
+type request struct {
+	url   string
+	event Event
+}
+
+type playerKey struct {
+	app, name, remoteAddr string
+}
+
+//Notifier 通过http POST发送流事件，实现了protocol.Authenticator和protocol.StreamObserver
+//on_publish和on_play在鉴权时同步发送，on_unpublish和on_stop在后台异步发送，
+//on_stop只发送给鉴权后加入流的播放端，hls、录制等内部写对象没有对端地址，不发送
+type Notifier struct {
+	cfg       Config
+	client    *http.Client
+	queue     chan request
+	mutex     sync.Mutex
+	players   map[playerKey]int //已经开始播放还没有结束的播放端
+	closeOnce sync.Once
+	stopChan  chan struct{}   //关闭时通知发送协程发送完队列中的事件后退出
+	doneChan  chan struct{}   //发送协程退出后关闭
+	ctx       context.Context //超过Shutdown的期限时取消，中断正在发送的请求
+	cancel    context.CancelFunc
+	logger    logger.Logger
+}
+
+//NewNotifier 创建一个webhook通知对象
+func NewNotifier(cfg Config, log logger.Logger) *Notifier {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan request, maxQueueNum),
+		players:  make(map[playerKey]int),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   log,
+	}
+	go n.sendLoop()
+	return n
+}
+
+//Authenticate 实现protocol.Authenticator，发送on_publish或on_play，返回非2xx或者请求失败时拒绝
+func (n *Notifier) Authenticate(info protocol.AuthInfo) error {
+	action, url := "on_play", n.cfg.OnPlay
+	if info.IsPublish {
+		action, url = "on_publish", n.cfg.OnPublish
+	}
+	if url == "" {
+		return nil
+	}
+
+	event := Event{
+		Action:     action,
+		App:        info.ConnInfo.App,
+		Name:       info.Name,
+		TcURL:      info.ConnInfo.TcURL,
+		PageURL:    info.ConnInfo.PageURL,
+		Query:      info.Query,
+		RemoteAddr: info.RemoteAddr,
+		Time:       time.Now().Unix(),
+	}
+	var err error
+	for i := 0; i <= n.cfg.Retries; i++ {
+		if i > 0 {
+			time.Sleep(n.cfg.RetryInterval)
+		}
+		var status int
+		if status, err = n.post(url, event); err != nil {
+			n.logger.Warnf("Webhook %s failed, url:%s %v", action, url, err)
+			continue
+		}
+		if status < 200 || status > 299 {
+			return fmt.Errorf("%s rejected by webhook, status:%d", action, status)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s webhook failed, %v", action, err)
+}
+
+//OnStreamEvent 实现protocol.StreamObserver，异步发送on_unpublish和on_stop
+func (n *Notifier) OnStreamEvent(e protocol.StreamEvent) {
+	var action, url string
+	switch e.Type {
+	case protocol.EventUnpublish:
+		action, url = "on_unpublish", n.cfg.OnUnpublish
+	case protocol.EventPlay:
+		n.trackPlayer(e, 1)
+		return
+	case protocol.EventStop:
+		if !n.trackPlayer(e, -1) {
+			return
+		}
+		action, url = "on_stop", n.cfg.OnStop
+	}
+	if url == "" {
+		return
+	}
+
+	req := request{
+		url: url,
+		event: Event{
+			Action:     action,
+			App:        e.Info.App,
+			Name:       e.Info.Name,
+			URL:        e.Info.URL,
+			RemoteAddr: e.RemoteAddr,
+			Reason:     e.Reason,
+			Time:       e.Time.Unix(),
+		},
+	}
+	select {
+	case <-n.stopChan:
+		n.logger.Warnf("Webhook notifier closed, %s dropped, %s/%s", action, e.Info.App, e.Info.Name)
+		return
+	default:
+	}
+	select {
+	case n.queue <- req:
+	default:
+		n.logger.Warnf("Webhook queue is full, %s dropped, %s/%s", action, e.Info.App, e.Info.Name)
+	}
+}
+
+//trackPlayer 记录开始播放的播放端，结束时返回是否开始过，没有对端地址的内部写对象不记录
+func (n *Notifier) trackPlayer(e protocol.StreamEvent, delta int) bool {
+	if e.RemoteAddr == "" {
+		return false
+	}
+	key := playerKey{app: e.Info.App, name: e.Info.Name, remoteAddr: e.RemoteAddr}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	count := n.players[key] + delta
+	if count < 0 {
+		return false
+	}
+	if count == 0 {
+		delete(n.players, key)
+	} else {
+		n.players[key] = count
+	}
+	return true
+}
+
+//Close 不再接收新的事件，等待队列中的事件发送完成(包括重试)后返回
+func (n *Notifier) Close() {
+	n.Shutdown(context.Background())
+}
+
+//Shutdown 不再接收新的事件，等待队列中的事件发送完成，超过ctx的期限时中断发送，
+//丢弃剩余的事件并返回ctx.Err()
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.closeOnce.Do(func() {
+		close(n.stopChan)
+	})
+	select {
+	case <-n.doneChan:
+		return nil
+	case <-ctx.Done():
+		n.cancel()
+		<-n.doneChan
+		return ctx.Err()
+	}
+}
+
+func (n *Notifier) sendLoop() {
+	defer close(n.doneChan)
+	defer n.cancel()
+	for {
+		select {
+		case req := <-n.queue:
+			n.send(req)
+		case <-n.stopChan:
+			for {
+				select {
+				case req := <-n.queue:
+					n.send(req)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//发送通知，出错或者返回非2xx时重试，Shutdown超时后放弃
+func (n *Notifier) send(req request) {
+	if n.ctx.Err() != nil {
+		return
+	}
+	for i := 0; i <= n.cfg.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(n.cfg.RetryInterval):
+			case <-n.ctx.Done():
+				return
+			}
+		}
+		status, err := n.post(req.url, req.event)
+		if err == nil && status >= 200 && status <= 299 {
+			return
+		}
+		n.logger.Warnf("Webhook %s failed, url:%s status:%d err:%v", req.event.Action, req.url, status, err)
+	}
+}
+
+func (n *Notifier) post(url string, event Event) (int, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("json.Marshal failed, %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req.WithContext(n.ctx))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
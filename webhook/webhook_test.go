@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabo871218/srtmp/logger"
+	"github.com/fabo871218/srtmp/protocol"
+	"github.com/fabo871218/srtmp/protocol/core"
+	"github.com/stretchr/testify/assert"
+)
+
+var testLogger = logger.NewDefaultFactory().NewLogger(logger.LogLevelError)
+
+func TestAuthenticate(t *testing.T) {
+	events := make(chan Event, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+		if e.Query != "token=abc" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	n := NewNotifier(Config{OnPublish: ts.URL}, testLogger)
+	defer n.Close()
+	info := protocol.AuthInfo{
+		ConnInfo:   core.ConnectInfo{App: "live", TcURL: "rtmp://127.0.0.1/live"},
+		Name:       "test",
+		Query:      "token=abc",
+		RemoteAddr: "127.0.0.1:5000",
+		IsPublish:  true,
+	}
+	assert.Nil(t, n.Authenticate(info))
+	e := <-events
+	assert.Equal(t, "on_publish", e.Action)
+	assert.Equal(t, "live", e.App)
+	assert.Equal(t, "test", e.Name)
+	assert.Equal(t, "rtmp://127.0.0.1/live", e.TcURL)
+	assert.Equal(t, "127.0.0.1:5000", e.RemoteAddr)
+
+	info.Query = "token=bad"
+	assert.NotNil(t, n.Authenticate(info))
+	<-events
+
+	//没有配置on_play时不鉴权
+	info.IsPublish = false
+	assert.Nil(t, n.Authenticate(info))
+	assert.Equal(t, 0, len(events))
+}
+
+func TestAuthenticateTimeout(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	n := NewNotifier(Config{
+		OnPlay:        ts.URL,
+		Timeout:       50 * time.Millisecond,
+		Retries:       1,
+		RetryInterval: 10 * time.Millisecond,
+	}, testLogger)
+	defer n.Close()
+	assert.NotNil(t, n.Authenticate(protocol.AuthInfo{Name: "test"}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+func TestNotifyRetry(t *testing.T) {
+	var count int32
+	events := make(chan Event, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer ts.Close()
+
+	n := NewNotifier(Config{
+		OnUnpublish:   ts.URL,
+		Retries:       2,
+		RetryInterval: 10 * time.Millisecond,
+	}, testLogger)
+	defer n.Close()
+
+	//没有配置on_stop，不发送
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventStop})
+	n.OnStreamEvent(protocol.StreamEvent{
+		Type:       protocol.EventUnpublish,
+		Info:       protocol.StreamInfo{App: "live", Name: "test"},
+		RemoteAddr: "127.0.0.1:5000",
+		Reason:     "EOF",
+		Time:       time.Now(),
+	})
+
+	select {
+	case e := <-events:
+		assert.Equal(t, "on_unpublish", e.Action)
+		assert.Equal(t, "live", e.App)
+		assert.Equal(t, "test", e.Name)
+		assert.Equal(t, "EOF", e.Reason)
+	case <-time.After(3 * time.Second):
+		t.Fatal("on_unpublish not received")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+func TestNotifyStop(t *testing.T) {
+	events := make(chan Event, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer ts.Close()
+
+	n := NewNotifier(Config{OnStop: ts.URL}, testLogger)
+	defer n.Close()
+	info := protocol.StreamInfo{App: "live", Name: "test"}
+	//内部写对象和没有开始播放的写对象不发送on_stop
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventPlay, Info: info})
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventStop, Info: info})
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventStop, Info: info, RemoteAddr: "127.0.0.1:5001"})
+
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventPlay, Info: info, RemoteAddr: "127.0.0.1:5000"})
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventStop, Info: info, RemoteAddr: "127.0.0.1:5000", Reason: "EOF"})
+	select {
+	case e := <-events:
+		assert.Equal(t, "on_stop", e.Action)
+		assert.Equal(t, "127.0.0.1:5000", e.RemoteAddr)
+		assert.Equal(t, "EOF", e.Reason)
+	case <-time.After(3 * time.Second):
+		t.Fatal("on_stop not received")
+	}
+	//同一个播放端只发送一次
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventStop, Info: info, RemoteAddr: "127.0.0.1:5000"})
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&count, 1)
+	}))
+	defer ts.Close()
+
+	n := NewNotifier(Config{OnUnpublish: ts.URL}, testLogger)
+	info := protocol.StreamInfo{App: "live", Name: "test"}
+	for i := 0; i < 3; i++ {
+		n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventUnpublish, Info: info})
+	}
+	//Close返回时队列中的事件都已经发送
+	n.Close()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	//关闭之后的事件不再发送
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventUnpublish, Info: info})
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	n := NewNotifier(Config{OnUnpublish: ts.URL, Timeout: time.Minute}, testLogger)
+	n.OnStreamEvent(protocol.StreamEvent{Type: protocol.EventUnpublish, Info: protocol.StreamInfo{App: "live", Name: "test"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, n.Shutdown(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+}